@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/raff/cashier/storage"
+)
+
+// An upload, a download and a delete are recorded in the audit log file and in the recent events
+func TestAuditLog(t *testing.T) {
+	cc := newTestCashier(t)
+
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.log")
+	audit, err := storage.OpenAuditLog(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+
+	cc.sdb, cc.audit = storage.Audit(cc.sdb, audit), audit
+
+	data := testData(40000)
+	if rec := uploadTest(t, cc, "f", data, nil); rec.Code != http.StatusCreated {
+		t.Fatalf("upload: %v %v", rec.Code, rec.Body)
+	}
+	if rec := serveTest(t, cc.getEntry, httptest.NewRequest(http.MethodGet, "/x/f", nil), "f"); rec.Code != http.StatusOK {
+		t.Fatalf("GET: %v %v", rec.Code, rec.Body)
+	}
+	if rec := serveTest(t, cc.deleteEntry, httptest.NewRequest(http.MethodDelete, "/x/f", nil), "f"); rec.Code/100 != 2 {
+		t.Fatalf("DELETE: %v %v", rec.Code, rec.Body)
+	}
+
+	expected := []storage.AuditEvent{
+		{Op: storage.AuditCreate, Key: "f", Bytes: int64(len(data))},
+		{Op: storage.AuditComplete, Key: "f", Bytes: int64(len(data))},
+		{Op: storage.AuditRead, Key: "f", Bytes: int64(len(data))},
+		{Op: storage.AuditDelete, Key: "f"},
+	}
+
+	check := func(what string, events []storage.AuditEvent) {
+		if len(events) != len(expected) {
+			t.Fatalf("%v: %+v, expected %v events", what, events, len(expected))
+		}
+
+		for i, event := range events {
+			if event.Time.IsZero() || event.Op != expected[i].Op || event.Key != expected[i].Key ||
+				event.Bytes != expected[i].Bytes || event.Error != "" {
+				t.Errorf("%v: event %v is %+v, expected %+v", what, i, event, expected[i])
+			}
+		}
+	}
+
+	check("recent", audit.Recent())
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var logged []storage.AuditEvent
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		var event storage.AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("audit line %q: %v", scanner.Text(), err)
+		}
+
+		logged = append(logged, event)
+	}
+
+	check("file", logged)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/labstack/echo"
+)
+
+// Limit the requests in flight from each remote IP
+type connLimiter struct {
+	max int
+
+	sync.Mutex
+	active map[string]int // IP -> requests in flight
+}
+
+func newConnLimiter(max int) *connLimiter {
+	return &connLimiter{max: max, active: map[string]int{}}
+}
+
+func (l *connLimiter) acquire(ip string) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.active[ip] >= l.max {
+		return false
+	}
+
+	l.active[ip]++
+	return true
+}
+
+func (l *connLimiter) release(ip string) {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.active[ip]--; l.active[ip] <= 0 {
+		delete(l.active, ip)
+	}
+}
+
+// Middleware rejecting requests with 429 while the client IP has max requests in flight
+func (l *connLimiter) Limit(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ip := c.RealIP()
+		if !l.acquire(ip) {
+			return respondError(c, http.StatusTooManyRequests, CodeTooManyConnections)
+		}
+
+		defer l.release(ip)
+		return next(c)
+	}
+}
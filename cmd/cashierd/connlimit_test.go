@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+func TestConnLimiter(t *testing.T) {
+	l := newConnLimiter(2)
+
+	release := make(chan struct{})
+	handler := l.Limit(func(c echo.Context) error {
+		if c.QueryParam("wait") != "" {
+			<-release
+		}
+		return c.NoContent(http.StatusOK)
+	})
+
+	request := func(ip, query string) int {
+		req := httptest.NewRequest(http.MethodGet, "/x/f?"+query, nil)
+		req.RemoteAddr = ip + ":1234"
+		return serveTest(t, handler, req, "f").Code
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if code := request("10.0.0.1", "wait=1"); code != http.StatusOK {
+				t.Errorf("slow request: %v", code)
+			}
+		}()
+	}
+
+	for i := 0; i < 100; i++ {
+		l.Lock()
+		n := l.active["10.0.0.1"]
+		l.Unlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if code := request("10.0.0.1", ""); code != http.StatusTooManyRequests {
+		t.Errorf("request over the limit: %v, expected 429", code)
+	}
+	if code := request("10.0.0.2", ""); code != http.StatusOK {
+		t.Errorf("request from another IP: %v", code)
+	}
+
+	close(release)
+	wg.Wait()
+
+	if code := request("10.0.0.1", ""); code != http.StatusOK {
+		t.Errorf("request after the others completed: %v", code)
+	}
+	if len(l.active) != 0 {
+		t.Errorf("requests still counted: %v", l.active)
+	}
+}
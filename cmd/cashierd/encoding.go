@@ -0,0 +1,90 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var errUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// Return true if the request body is compressed
+func encodedBody(req *http.Request) bool {
+	switch strings.ToLower(req.Header.Get("Content-Encoding")) {
+	case "", "identity":
+		return false
+	}
+
+	return true
+}
+
+// Return a reader for the request body, decompressing it according to Content-Encoding
+func decodeBody(req *http.Request) (io.Reader, error) {
+	switch strings.ToLower(req.Header.Get("Content-Encoding")) {
+	case "", "identity":
+		return req.Body, nil
+
+	case "gzip", "x-gzip":
+		return gzip.NewReader(req.Body)
+
+	case "deflate":
+		return zlib.NewReader(req.Body)
+	}
+
+	return nil, errUnsupportedEncoding
+}
+
+// Return true if the client accepts gzip responses (and didn't disable it with q=0)
+func acceptsGzip(req *http.Request) bool {
+	for _, enc := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(enc, ";")
+
+		switch strings.ToLower(strings.TrimSpace(parts[0])) {
+		case "gzip", "x-gzip", "*":
+			if len(parts) > 1 && strings.Replace(parts[1], " ", "", -1) == "q=0" {
+				return false
+			}
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// A temporary file, removed on Close
+type spoolFile struct {
+	*os.File
+}
+
+func (f spoolFile) Close() error {
+	f.File.Close()
+	return os.Remove(f.Name())
+}
+
+// Copy reader to a temporary file, to find out the length of the data.
+// Returns the file, positioned at the start, and the length.
+func spool(reader io.Reader) (io.ReadCloser, int64, error) {
+	f, err := ioutil.TempFile("", "cashier-upload-")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	sf := spoolFile{f}
+
+	n, err := io.Copy(f, reader)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		sf.Close()
+		return nil, 0, err
+	}
+
+	return sf, n, nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/raff/cashier/storage"
+)
+
+// Compressed uploads are stored, and served, decompressed
+func TestUploadEncoded(t *testing.T) {
+	cc := newTestCashier(t)
+	data := testData(100000)
+
+	for enc, newWriter := range map[string]func(io.Writer) io.WriteCloser{
+		"gzip":    func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+		"deflate": func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) },
+	} {
+		var body bytes.Buffer
+		w := newWriter(&body)
+		w.Write(data)
+		w.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/x/"+enc, &body)
+		req.Header.Set("Content-Encoding", enc)
+		if rec := serveTest(t, cc.createEntry, req, enc); rec.Code != http.StatusCreated {
+			t.Fatalf("%v upload: %v %v", enc, rec.Code, rec.Body)
+		}
+
+		if stat, _ := cc.sdb.Stat(enc); stat == nil || stat.Length != int64(len(data)) {
+			t.Errorf("%v upload: %+v", enc, stat)
+		}
+
+		rec := serveTest(t, cc.getEntry, httptest.NewRequest(http.MethodGet, "/x/"+enc, nil), enc)
+		if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), data) {
+			t.Errorf("%v download: %v, %v bytes", enc, rec.Code, rec.Body.Len())
+		}
+	}
+}
+
+// Clients accepting gzip get the stored <id>.gz variant, the others the identity file
+func TestGetGzipVariant(t *testing.T) {
+	cc := newTestCashier(t)
+	data := testData(100000)
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(data)
+	w.Close()
+
+	putTestFile(t, cc.sdb, "f", data)
+	putTestFile(t, cc.sdb, "f.gz", gz.Bytes())
+	putTestFile(t, cc.sdb, "plain", data)
+
+	get := func(id, accept, srange string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/x/"+id, nil)
+		if accept != "" {
+			req.Header.Set("Accept-Encoding", accept)
+		}
+		if srange != "" {
+			req.Header.Set("Range", srange)
+		}
+
+		return serveTest(t, cc.getEntry, req, id)
+	}
+
+	for _, tc := range []struct {
+		id, accept, srange string
+		gzip               bool
+	}{
+		{"f", "gzip, deflate", "", true},
+		{"f", "br;q=1.0, *", "", true},
+		{"f", "", "", false},
+		{"f", "gzip;q=0, deflate", "", false},
+		{"f", "gzip", "bytes=0-99", false}, // ranges are in the identity content
+		{"plain", "gzip", "", false},       // no variant
+	} {
+		rec := get(tc.id, tc.accept, tc.srange)
+		if rec.Code/100 != 2 {
+			t.Fatalf("%+v: %v %v", tc, rec.Code, rec.Body)
+		}
+		if vary := rec.Header().Get("Vary"); vary != "Accept-Encoding" {
+			t.Errorf("%+v: Vary %q", tc, vary)
+		}
+
+		expected := data
+		if tc.srange != "" {
+			expected = data[:100]
+		}
+		if tc.gzip {
+			expected = gz.Bytes()
+		}
+
+		if enc := rec.Header().Get("Content-Encoding"); (enc == "gzip") != tc.gzip {
+			t.Errorf("%+v: Content-Encoding %q", tc, enc)
+		}
+		if !bytes.Equal(rec.Body.Bytes(), expected) {
+			t.Errorf("%+v: %v bytes, content differs", tc, rec.Body.Len())
+		}
+	}
+
+	// the variant itself is served as stored
+	rec := get("f.gz", "gzip", "")
+	if rec.Header().Get("Content-Encoding") != "" || !bytes.Equal(rec.Body.Bytes(), gz.Bytes()) {
+		t.Errorf("GET f.gz: Content-Encoding %q, %v bytes", rec.Header().Get("Content-Encoding"), rec.Body.Len())
+	}
+}
+
+// Range requests from gzip-accepting clients are served from the identity content
+func TestGetRangeIdentity(t *testing.T) {
+	cc := newTestCashier(t)
+	data := testData(3*storage.BlockSize + 10)
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(data)
+	w.Close()
+
+	putTestFile(t, cc.sdb, "f", data)
+	putTestFile(t, cc.sdb, "f.gz", gz.Bytes())
+
+	for _, tc := range []struct {
+		method, srange string
+		start, end     int
+	}{
+		{http.MethodGet, "bytes=100-199", 100, 199},
+		{http.MethodGet, fmt.Sprintf("bytes=%v-", storage.BlockSize-10), storage.BlockSize - 10, len(data) - 1},
+		{http.MethodGet, "bytes=-50", len(data) - 50, len(data) - 1},
+		{http.MethodHead, "bytes=0-9", 0, 9},
+	} {
+		req := httptest.NewRequest(tc.method, "/x/f", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		req.Header.Set("Range", tc.srange)
+
+		rec := serveTest(t, cc.headEntry, req, "f")
+		if rec.Code != http.StatusPartialContent || rec.Header().Get("Content-Encoding") != "" {
+			t.Errorf("%v %v: %v, Content-Encoding %q", tc.method, tc.srange, rec.Code, rec.Header().Get("Content-Encoding"))
+		}
+		if crange := rec.Header().Get("Content-Range"); crange != fmt.Sprintf("bytes %v-%v/%v", tc.start, tc.end, len(data)) {
+			t.Errorf("%v %v: Content-Range %q", tc.method, tc.srange, crange)
+		}
+		if rec.Header().Get("Accept-Ranges") != "bytes" {
+			t.Errorf("%v %v: Accept-Ranges %q", tc.method, tc.srange, rec.Header().Get("Accept-Ranges"))
+		}
+		if tc.method == http.MethodGet && !bytes.Equal(rec.Body.Bytes(), data[tc.start:tc.end+1]) {
+			t.Errorf("%v %v: %v bytes, content differs", tc.method, tc.srange, rec.Body.Len())
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/x/f", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	rec := serveTest(t, cc.getEntry, req, "f")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Encoding") != "gzip" || !bytes.Equal(rec.Body.Bytes(), gz.Bytes()) {
+		t.Errorf("GET without range: %v, Content-Encoding %q", rec.Code, rec.Header().Get("Content-Encoding"))
+	}
+}
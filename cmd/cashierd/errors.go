@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo"
+)
+
+// Error codes, returned as {"error": {"code": code, "message": message}} (or as problem types, see ErrorFormatProblem)
+const (
+	CodeInternal            = "internal-error"       // 500: unexpected storage or request error (message has details)
+	CodeStorageUnavailable  = "storage-unavailable"  // 503: the storage is failing, retry later
+	CodeMaintenance         = "maintenance"          // 503: writes are suspended during maintenance, see Retry-After
+	CodeNotFound            = "not-found"            // 404: no file with this key
+	CodeIncomplete          = "incomplete"           // 403: the file is still being uploaded, see Range
+	CodeMissingBlock        = "missing-block"        // 502: a block of the file is missing from the storage
+	CodeImmutable           = "immutable"            // 403: the file can't be modified or deleted until it expires
+	CodeFileExists          = "file-exists"          // 409: a file with this key already exists, see Range and Retry-Until to resume
+	CodeFileComplete        = "complete"             // 409: the file is already complete
+	CodeStaleUpload         = "stale-upload"         // 410: the incomplete upload is too old to resume and was deleted
+	CodeFileDeleted         = "deleted"              // 410: the file was soft deleted, only its metadata is left
+	CodeUploadDeadline      = "upload-deadline"      // 408: the upload took too long, see Range to resume
+	CodeUploadIdle          = "upload-idle"          // 408: no upload data arrived for too long, see Range to resume
+	CodeMissingFile         = "missing-file"         // 400: no file in the request
+	CodeMissingFileName     = "missing-file-name"    // 400: a multipart file without a file name
+	CodeMissingFileLength   = "missing-file-length"  // 400: the file length is unknown
+	CodeMultipartExpected   = "multipart-expected"   // 400: the request is not a multipart form
+	CodeRangeExpected       = "range-expected"       // 400: resuming requires Content-Range, see Range
+	CodeInvalidRange        = "invalid-range"        // 400: Content-Range doesn't match the next write position, see Range
+	CodeTrimmed             = "trimmed"              // 416: the range starts before the first available byte, see Content-Range
+	CodeInvalidHash         = "invalid-hash"         // 400: X-File-Hash is not a hex string
+	CodeHashMismatch        = "hash-mismatch"        // 400: the uploaded data doesn't match X-File-Hash
+	CodeMetadataTooLarge    = "metadata-too-large"   // 413: the file metadata exceeds the storage limit
+	CodeQuotaExceeded       = "quota-exceeded"       // 507: the file doesn't fit in the namespace quota
+	CodeInsufficientSpace   = "insufficient-space"   // 507: the file doesn't fit in the storage free space
+	CodeInvalidListing      = "invalid-listing"      // 400: the index sort, order or limit is not valid
+	CodeUnsupportedEncoding = "unsupported-encoding" // 415: Content-Encoding is not gzip or deflate
+	CodeScrubDisabled       = "scrub-disabled"       // 404: the scrubber is not running
+	CodeNotCounter          = "not-counter"          // 409: the file is not a counter (8 bytes, complete)
+	CodeInvalidDelta        = "invalid-delta"        // 400: the counter delta is not an integer
+	CodeTooManyConnections  = "too-many-connections" // 429: too many requests in flight from the client IP
+	CodeSessionNotFound     = "session-not-found"    // 404: no upload session with this token (expired or committed)
+	CodeMissingID           = "missing-id"           // 400: no key to commit the upload session to
+	CodeInvalidVersion      = "invalid-version"      // 400: the version is not a positive integer
+	CodeHTTPError           = "http-error"           // any: other errors from routing and middleware (e.g. 405)
+)
+
+var errorMessages = map[string]string{
+	CodeInternal:            "internal error",
+	CodeStorageUnavailable:  "storage unavailable",
+	CodeMaintenance:         "writes suspended for maintenance",
+	CodeNotFound:            "file not found",
+	CodeIncomplete:          "file incomplete",
+	CodeMissingBlock:        "file data missing",
+	CodeImmutable:           "file is immutable",
+	CodeFileExists:          "file exists",
+	CodeFileComplete:        "file complete",
+	CodeStaleUpload:         "upload expired",
+	CodeFileDeleted:         "file deleted",
+	CodeUploadDeadline:      "upload deadline exceeded",
+	CodeUploadIdle:          "upload stalled",
+	CodeMissingFile:         "missing file",
+	CodeMissingFileName:     "missing file name",
+	CodeMissingFileLength:   "missing file length",
+	CodeMultipartExpected:   "multipart form expected",
+	CodeRangeExpected:       "Content-Range expected",
+	CodeInvalidRange:        "invalid range",
+	CodeTrimmed:             "range trimmed",
+	CodeInvalidHash:         "invalid hash",
+	CodeHashMismatch:        "hash mismatch",
+	CodeMetadataTooLarge:    "metadata too large",
+	CodeQuotaExceeded:       "quota exceeded",
+	CodeInsufficientSpace:   "insufficient storage space",
+	CodeInvalidListing:      "invalid sort, order or limit",
+	CodeUnsupportedEncoding: "unsupported content encoding",
+	CodeScrubDisabled:       "scrubber disabled",
+	CodeNotCounter:          "not a counter",
+	CodeInvalidDelta:        "invalid delta",
+	CodeTooManyConnections:  "too many connections",
+	CodeSessionNotFound:     "upload session not found",
+	CodeMissingID:           "missing file id",
+	CodeInvalidVersion:      "invalid version",
+	CodeHTTPError:           "http error",
+}
+
+// Error response formats
+const (
+	ErrorFormatJSON    = "json"    // {"error": {"code": code, "message": message}}
+	ErrorFormatProblem = "problem" // RFC 7807 application/problem+json, with type problemType + code
+)
+
+// Error response format (set with -error-format)
+var errorFormat = ErrorFormatJSON
+
+// Base of the problem type URIs
+const problemType = "urn:cashier:error:"
+
+// Return the error body for code, with an optional message (the default message for code if empty)
+// and additional info
+func errorBody(code, message string, info mmap) mmap {
+	if message == "" {
+		message = errorMessages[code]
+	}
+
+	e := mmap{"code": code, "message": message}
+	for k, v := range info {
+		e[k] = v
+	}
+
+	return mmap{"error": e}
+}
+
+// Return the RFC 7807 problem details for code, with an optional message (the detail)
+// and additional info (as extension members)
+func problemBody(c echo.Context, status int, code, message string, info mmap) mmap {
+	p := mmap{
+		"type":     problemType + code,
+		"title":    errorMessages[code],
+		"status":   status,
+		"instance": c.Request().URL.Path,
+		"code":     code,
+	}
+	if message != "" {
+		p["detail"] = message
+	}
+	for k, v := range info {
+		p[k] = v
+	}
+
+	return p
+}
+
+// Send an error response in the configured format
+func sendError(c echo.Context, status int, code, message string, info mmap) error {
+	if errorFormat != ErrorFormatProblem {
+		return c.JSON(status, errorBody(code, message, info))
+	}
+
+	body, err := json.Marshal(problemBody(c, status, code, message, info))
+	if err != nil {
+		return err
+	}
+
+	return c.Blob(status, "application/problem+json", body)
+}
+
+// Send an error response with the default message for code
+func respondError(c echo.Context, status int, code string) error {
+	return sendError(c, status, code, "", nil)
+}
+
+// Echo error handler, so that errors from routing and middleware have the same format
+func httpErrorHandler(err error, c echo.Context) {
+	status, code, message := http.StatusInternalServerError, CodeInternal, err.Error()
+
+	if he, ok := err.(*echo.HTTPError); ok {
+		status, code, message = he.Code, CodeHTTPError, fmt.Sprint(he.Message)
+		if status == http.StatusNotFound {
+			code = CodeNotFound
+		}
+	}
+
+	if c.Response().Committed {
+		return
+	}
+
+	if c.Request().Method == http.MethodHead {
+		err = c.NoContent(status)
+	} else {
+		err = sendError(c, status, code, message, nil)
+	}
+	if err != nil {
+		c.Logger().Error(err)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+// Each error path returns its documented status and code, with the code message
+func TestErrorCodes(t *testing.T) {
+	cc := newTestCashier(t)
+	putTestFile(t, cc.sdb, "complete", testData(100))
+	if err := cc.sdb.CreateFile("partial", "p", "", 100, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(method, path string, body io.Reader, headers ...string) *http.Request {
+		req := httptest.NewRequest(method, path, body)
+		for i := 0; i < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		return req
+	}
+
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	mw.WriteField("name", "value")
+	mw.Close()
+
+	for _, tc := range []struct {
+		name    string
+		handler echo.HandlerFunc
+		req     *http.Request
+		id      string
+		status  int
+		code    string
+	}{
+		{"get missing", cc.getEntry, request(http.MethodGet, "/x/missing", nil), "missing", http.StatusNotFound, CodeNotFound},
+		{"get incomplete", cc.getEntry, request(http.MethodGet, "/x/partial", nil), "partial", http.StatusForbidden, CodeIncomplete},
+		{"create existing", cc.createEntry, request(http.MethodPost, "/x/complete", strings.NewReader("x")), "complete", http.StatusConflict, CodeFileExists},
+		{"create invalid hash", cc.createEntry, request(http.MethodPost, "/x/new", strings.NewReader("x"), "X-File-Hash", "zz"), "new", http.StatusBadRequest, CodeInvalidHash},
+		{"create encoding", cc.createEntry, request(http.MethodPost, "/x/new", strings.NewReader("x"), "Content-Encoding", "br"), "new", http.StatusUnsupportedMediaType, CodeUnsupportedEncoding},
+		{"create no file", cc.createEntry, request(http.MethodPost, "/x/new", &form, "Content-Type", mw.FormDataContentType()), "new", http.StatusBadRequest, CodeMissingFile},
+		{"put complete", cc.updateEntry, request(http.MethodPut, "/x/complete", strings.NewReader("x"), "Content-Range", "bytes 0-0/1"), "complete", http.StatusConflict, CodeFileComplete},
+		{"put no range", cc.updateEntry, request(http.MethodPut, "/x/partial", strings.NewReader("x")), "partial", http.StatusBadRequest, CodeRangeExpected},
+		{"put wrong range", cc.updateEntry, request(http.MethodPut, "/x/partial", strings.NewReader("x"), "Content-Range", "bytes 10-10/100"), "partial", http.StatusBadRequest, CodeInvalidRange},
+		{"put no length", cc.updateEntry, request(http.MethodPut, "/x/new", strings.NewReader("x"), "Content-Range", "bytes 0-0/*"), "new", http.StatusBadRequest, CodeMissingFileLength},
+	} {
+		rec := serveTest(t, tc.handler, tc.req, tc.id)
+
+		var body struct {
+			Error struct {
+				Code    string
+				Message string
+			}
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Errorf("%v: %v %q", tc.name, err, rec.Body)
+			continue
+		}
+
+		if rec.Code != tc.status || body.Error.Code != tc.code || body.Error.Message != errorMessages[tc.code] {
+			t.Errorf("%v: %v %+v, expected %v %v", tc.name, rec.Code, body.Error, tc.status, tc.code)
+		}
+	}
+}
+
+// With -error-format problem errors are RFC 7807 problem details
+func TestProblemErrors(t *testing.T) {
+	cc := newTestCashier(t)
+	putTestFile(t, cc.sdb, "complete", testData(100))
+
+	errorFormat = ErrorFormatProblem
+	defer func() { errorFormat = ErrorFormatJSON }()
+
+	for _, tc := range []struct {
+		name    string
+		handler echo.HandlerFunc
+		req     *http.Request
+		id      string
+		status  int
+		code    string
+	}{
+		{"get missing", cc.getEntry, httptest.NewRequest(http.MethodGet, "/x/missing", nil), "missing", http.StatusNotFound, CodeNotFound},
+		{"create existing", cc.createEntry, httptest.NewRequest(http.MethodPost, "/x/complete", strings.NewReader("x")), "complete", http.StatusConflict, CodeFileExists},
+	} {
+		rec := serveTest(t, tc.handler, tc.req, tc.id)
+
+		if ctype := rec.Header().Get("Content-Type"); ctype != "application/problem+json" {
+			t.Errorf("%v: Content-Type %q", tc.name, ctype)
+		}
+
+		var problem map[string]interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &problem); err != nil {
+			t.Errorf("%v: %v %q", tc.name, err, rec.Body)
+			continue
+		}
+
+		if rec.Code != tc.status || problem["status"] != float64(tc.status) || problem["type"] != problemType+tc.code ||
+			problem["title"] != errorMessages[tc.code] || problem["instance"] != tc.req.URL.Path || problem["code"] != tc.code {
+			t.Errorf("%v: %v %v, expected %v %v", tc.name, rec.Code, problem, tc.status, tc.code)
+		}
+		if _, ok := problem["error"]; ok {
+			t.Errorf("%v: JSON error envelope in the problem: %v", tc.name, problem)
+		}
+	}
+}
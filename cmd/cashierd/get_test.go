@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/raff/cashier/storage"
+)
+
+// A trimmed file is served from Base, and ranges before Base are rejected
+func TestGetTrimmed(t *testing.T) {
+	cc := newTestCashier(t)
+
+	data := testData(3*storage.BlockSize + 100)
+	length := int64(len(data))
+	base := int64(storage.BlockSize)
+
+	putTestFile(t, cc.sdb, "f", data)
+	if err := cc.sdb.TrimFront("f", base); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := serveTest(t, cc.getEntry, httptest.NewRequest(http.MethodGet, "/x/f", nil), "f")
+	if rec.Code != http.StatusPartialContent {
+		t.Fatalf("GET: %v %v", rec.Code, rec.Body)
+	}
+	if cr := rec.Header().Get("Content-Range"); cr != fmt.Sprintf("bytes %v-%v/%v", base, length-1, length) {
+		t.Errorf("Content-Range: %v", cr)
+	}
+	if cl := rec.Header().Get("Content-Length"); cl != strconv.FormatInt(length-base, 10) {
+		t.Errorf("Content-Length: %v", cl)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), data[base:]) {
+		t.Errorf("GET: got %v bytes, expected %v", rec.Body.Len(), length-base)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/x/f", nil)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%v-%v", base+10, base+19))
+	rec = serveTest(t, cc.getEntry, req, "f")
+	if rec.Code != http.StatusPartialContent || !bytes.Equal(rec.Body.Bytes(), data[base+10:base+20]) {
+		t.Errorf("GET range after base: %v %q", rec.Code, rec.Body)
+	}
+
+	for _, r := range []string{"bytes=0-9", fmt.Sprintf("bytes=%v-%v", base-1, base+10), fmt.Sprintf("bytes=-%v", length), "bytes=2000000-,0-1"} {
+		req := httptest.NewRequest(http.MethodGet, "/x/f", nil)
+		req.Header.Set("Range", r)
+		rec := serveTest(t, cc.getEntry, req, "f")
+		if rec.Code != http.StatusRequestedRangeNotSatisfiable {
+			t.Errorf("GET %v: %v, expected 416", r, rec.Code)
+		}
+		if cr := rec.Header().Get("Content-Range"); cr != fmt.Sprintf("bytes */%v", length) {
+			t.Errorf("GET %v: Content-Range %v", r, cr)
+		}
+	}
+
+	rec = serveTest(t, cc.headEntry, httptest.NewRequest(http.MethodHead, "/x/f", nil), "f")
+	if rec.Code != http.StatusPartialContent || rec.Header().Get("Content-Length") != strconv.FormatInt(length-base, 10) {
+		t.Errorf("HEAD: %v %v", rec.Code, rec.Header())
+	}
+}
+
+func TestRangeStart(t *testing.T) {
+	for _, tc := range []struct {
+		srange string
+		start  int64
+	}{
+		{"bytes=10-20", 10},
+		{"bytes=10-", 10},
+		{"bytes=30-40, 5-6", 5},
+		{"bytes=-10", 90},
+		{"bytes=-200", 0},
+		{"items=0-1", 100},
+		{"bytes=x-1", 100},
+	} {
+		if start := rangeStart(tc.srange, 100); start != tc.start {
+			t.Errorf("rangeStart(%q): %v, expected %v", tc.srange, start, tc.start)
+		}
+	}
+}
+
+// Once the leading blocks of a file with a block TTL expire, the file is served from the first block left
+func TestGetBlockTTLExpired(t *testing.T) {
+	now := time.Now()
+	cc := newTestCashier(t, storage.WithClock(func() time.Time { return now }))
+
+	data := testData(3*storage.BlockSize + 100)
+	length, base := int64(len(data)), int64(storage.BlockSize)
+
+	hash, _, _ := storage.GetHash(bytes.NewReader(data))
+	if err := cc.sdb.CreateFile("f", "f", "", length, hash, storage.WithBlockTTL(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cc.sdb.WriteAt("f", 0, data[:base]); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(30 * time.Second)
+	if _, err := storage.WriteAll(cc.sdb, "f", base, data[base:]); err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(45 * time.Second) // the first block expired
+	rec := serveTest(t, cc.getEntry, httptest.NewRequest(http.MethodGet, "/x/f", nil), "f")
+	if rec.Code != http.StatusPartialContent || !bytes.Equal(rec.Body.Bytes(), data[base:]) {
+		t.Fatalf("GET: %v, %v bytes", rec.Code, rec.Body.Len())
+	}
+	if cr := rec.Header().Get("Content-Range"); cr != fmt.Sprintf("bytes %v-%v/%v", base, length-1, length) {
+		t.Errorf("Content-Range: %v", cr)
+	}
+
+	now = now.Add(time.Minute) // all the blocks expired
+	rec = serveTest(t, cc.getEntry, httptest.NewRequest(http.MethodGet, "/x/f", nil), "f")
+	if rec.Code != http.StatusRequestedRangeNotSatisfiable || !strings.Contains(rec.Body.String(), CodeTrimmed) {
+		t.Errorf("GET after expiry: %v %v", rec.Code, rec.Body)
+	}
+}
+
+func TestServerErrorTrimmed(t *testing.T) {
+	rec := serveTest(t, func(c echo.Context) error {
+		return serverError(c, storage.ErrTrimmed)
+	}, httptest.NewRequest(http.MethodGet, "/x/f", nil), "f")
+
+	if rec.Code != http.StatusRequestedRangeNotSatisfiable || !strings.Contains(rec.Body.String(), CodeTrimmed) {
+		t.Errorf("ErrTrimmed: %v %v", rec.Code, rec.Body)
+	}
+}
+
+func TestGetStrictTTL(t *testing.T) {
+	cc := newTestCashier(t)
+	putTestFile(t, cc.sdb, "f", testData(10))
+
+	cc.sdb = storage.StrictTTL(cc.sdb, storage.WithClock(func() time.Time { return time.Now().Add(2 * time.Hour) }))
+
+	rec := serveTest(t, cc.getEntry, httptest.NewRequest(http.MethodGet, "/x/f", nil), "f")
+	if rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), CodeNotFound) {
+		t.Errorf("GET expired file: %v %v", rec.Code, rec.Body)
+	}
+}
+
+// A store where a block of one file is missing
+type missingStore struct {
+	storage.StorageDB
+	key   string
+	block int64
+}
+
+func (s missingStore) ReadAt(key string, buf []byte, pos int64) (int64, error) {
+	if key == s.key && pos+int64(len(buf)) > s.block*storage.BlockSize {
+		return 0, storage.ErrMissingBlock{Block: s.block}
+	}
+
+	return s.StorageDB.ReadAt(key, buf, pos)
+}
+
+// A missing block found before sending the data is a 502, naming the block
+func TestGetMissingBlock(t *testing.T) {
+	cc := newTestCashier(t)
+	putTestFile(t, cc.sdb, "f", testData(3*storage.BlockSize))
+	cc.sdb = missingStore{cc.sdb, "f", 0}
+
+	rec := serveTest(t, cc.getEntry, httptest.NewRequest(http.MethodGet, "/x/f", nil), "f")
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("GET: %v, expected 502", rec.Code)
+	}
+
+	var body struct {
+		Error struct {
+			Code  string
+			Block int64
+		}
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("%v: %q", err, rec.Body)
+	}
+	if body.Error.Code != CodeMissingBlock || body.Error.Block != 0 {
+		t.Errorf("error %+v", body.Error)
+	}
+}
+
+// A ranged HEAD advertises range support as the ranged GET would
+func TestHeadRange(t *testing.T) {
+	cc := newTestCashier(t)
+	putTestFile(t, cc.sdb, "f", testData(1000))
+
+	for srange, cr := range map[string]string{"bytes=0-0": "bytes 0-0/1000", "bytes=500-": "bytes 500-999/1000"} {
+		req := httptest.NewRequest(http.MethodHead, "/x/f", nil)
+		req.Header.Set("Range", srange)
+
+		rec := serveTest(t, cc.headEntry, req, "f")
+		if rec.Code != http.StatusPartialContent || rec.Body.Len() != 0 {
+			t.Errorf("HEAD %v: %v, %v bytes", srange, rec.Code, rec.Body.Len())
+		}
+		if got := rec.Header().Get("Content-Range"); got != cr {
+			t.Errorf("HEAD %v: Content-Range %q, expected %q", srange, got, cr)
+		}
+		if rec.Header().Get("Accept-Ranges") != "bytes" {
+			t.Errorf("HEAD %v: Accept-Ranges %q", srange, rec.Header().Get("Accept-Ranges"))
+		}
+	}
+
+	rec := serveTest(t, cc.headEntry, httptest.NewRequest(http.MethodHead, "/x/f", nil), "f")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Length") != "1000" || rec.Header().Get("Accept-Ranges") != "bytes" {
+		t.Errorf("HEAD: %v %v", rec.Code, rec.Header())
+	}
+}
+
+// Files hashed with SHA-256 are served with Digest and X-SRI, other files without
+func TestGetDigest(t *testing.T) {
+	data := testData(3*storage.BlockSize + 10)
+	sum := sha256.Sum256(data)
+	digest := base64.StdEncoding.EncodeToString(sum[:])
+
+	for alg, expected := range map[string]string{storage.HashSHA256: digest, storage.HashCumulative: ""} {
+		cc := newTestCashier(t, storage.WithHash(alg))
+		cc.hashAlg = alg
+
+		if rec := uploadTest(t, cc, "f", data, nil); rec.Code != http.StatusCreated {
+			t.Fatalf("%v upload: %v %v", alg, rec.Code, rec.Body)
+		}
+
+		rec := serveTest(t, cc.getEntry, httptest.NewRequest(http.MethodGet, "/x/f", nil), "f")
+		if expected == "" {
+			if rec.Header().Get("Digest") != "" || rec.Header().Get("X-SRI") != "" {
+				t.Errorf("%v: Digest %q, X-SRI %q", alg, rec.Header().Get("Digest"), rec.Header().Get("X-SRI"))
+			}
+			continue
+		}
+
+		if d := rec.Header().Get("Digest"); d != "SHA-256="+expected {
+			t.Errorf("%v: Digest %q, expected %q", alg, d, expected)
+		}
+		if sri := rec.Header().Get("X-SRI"); sri != "sha256-"+expected {
+			t.Errorf("%v: X-SRI %q", alg, sri)
+		}
+	}
+}
+
+// A request for several ranges gets a multipart/byteranges response with each range of the file
+func TestGetMultiRange(t *testing.T) {
+	cc := newTestCashier(t)
+
+	data := testData(3*storage.BlockSize + 100)
+	putTestFile(t, cc.sdb, "f", data)
+
+	ranges := []struct{ start, end int }{
+		{0, 10},
+		{storage.BlockSize - 5, 2*storage.BlockSize + 5}, // across blocks
+		{100, 200}, // before the previous range
+		{len(data) - 50, len(data) - 1},
+	}
+
+	var spec []string
+	for _, r := range ranges {
+		spec = append(spec, fmt.Sprintf("%v-%v", r.start, r.end))
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/x/f", nil)
+	req.Header.Set("Range", "bytes="+strings.Join(spec, ","))
+
+	rec := serveTest(t, cc.getEntry, req, "f")
+	if rec.Code != http.StatusPartialContent {
+		t.Fatalf("GET: %v %v", rec.Code, rec.Body)
+	}
+
+	mtype, params, err := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+	if err != nil || mtype != "multipart/byteranges" {
+		t.Fatalf("Content-Type %q %v", rec.Header().Get("Content-Type"), err)
+	}
+
+	mr := multipart.NewReader(rec.Body, params["boundary"])
+	for i, r := range ranges {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("part %v: %v", i, err)
+		}
+
+		if crange := part.Header.Get("Content-Range"); crange != fmt.Sprintf("bytes %v-%v/%v", r.start, r.end, len(data)) {
+			t.Errorf("part %v: Content-Range %v", i, crange)
+		}
+
+		got, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatalf("part %v: %v", i, err)
+		}
+		if !bytes.Equal(got, data[r.start:r.end+1]) {
+			t.Errorf("part %v: %v bytes differ from the file range %v-%v", i, len(got), r.start, r.end)
+		}
+	}
+
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Errorf("after the last range: %v", err)
+	}
+}
+
+// Downloads of missing files get the configured redirect or page, or the JSON error by default
+func TestGetNotFound(t *testing.T) {
+	cc := newTestCashier(t)
+
+	get := func() *httptest.ResponseRecorder {
+		return serveTest(t, cc.getEntry, httptest.NewRequest(http.MethodGet, "/x/missing", nil), "missing")
+	}
+
+	if rec := get(); rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), CodeNotFound) {
+		t.Errorf("default: %v %v", rec.Code, rec.Body)
+	}
+
+	cc.notFoundPage, cc.notFoundType = []byte("<h1>This link expired</h1>"), "text/html; charset=utf-8"
+	rec := get()
+	if rec.Code != http.StatusNotFound || rec.Body.String() != string(cc.notFoundPage) || rec.Header().Get("Content-Type") != cc.notFoundType {
+		t.Errorf("page: %v %q %v", rec.Code, rec.Header().Get("Content-Type"), rec.Body)
+	}
+
+	cc.notFoundRedirect = "https://example.com/expired"
+	if rec := get(); rec.Code != http.StatusFound || rec.Header().Get("Location") != cc.notFoundRedirect {
+		t.Errorf("redirect: %v, Location %q", rec.Code, rec.Header().Get("Location"))
+	}
+
+	// only missing files are redirected
+	putTestFile(t, cc.sdb, "f", testData(10))
+	if rec := serveTest(t, cc.getEntry, httptest.NewRequest(http.MethodGet, "/x/f", nil), "f"); rec.Code != http.StatusOK {
+		t.Errorf("existing file: %v", rec.Code)
+	}
+}
+
+// After DELETE ?soft=1 downloads get 410, while the metadata is still returned
+func TestGetSoftDeleted(t *testing.T) {
+	cc := newTestCashier(t)
+	putTestFile(t, cc.sdb, "f", testData(100))
+
+	if rec := serveTest(t, cc.deleteEntry, httptest.NewRequest(http.MethodDelete, "/x/f?soft=1", nil), "f"); rec.Code/100 != 2 {
+		t.Fatalf("soft delete: %v %v", rec.Code, rec.Body)
+	}
+
+	rec := serveTest(t, cc.getEntry, httptest.NewRequest(http.MethodGet, "/x/f", nil), "f")
+	if rec.Code != http.StatusGone || !strings.Contains(rec.Body.String(), CodeFileDeleted) {
+		t.Errorf("GET soft deleted: %v %v", rec.Code, rec.Body)
+	}
+
+	var info storage.FileInfo
+	rec = serveTest(t, cc.getMetadata, httptest.NewRequest(http.MethodGet, "/x/f/meta", nil), "f")
+	if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil || rec.Code != http.StatusOK || !info.Deleted() || info.Length != 100 {
+		t.Errorf("metadata of soft deleted: %v %v", rec.Code, rec.Body)
+	}
+
+	if rec := serveTest(t, cc.deleteEntry, httptest.NewRequest(http.MethodDelete, "/x/missing?soft=1", nil), "missing"); rec.Code != http.StatusNotFound {
+		t.Errorf("soft delete missing: %v", rec.Code)
+	}
+}
+
+// A store counting the Stat calls
+type statCounter struct {
+	storage.StorageDB
+	stats int
+}
+
+func (s *statCounter) Stat(key string) (*storage.FileInfo, error) {
+	s.stats++
+	return s.StorageDB.Stat(key)
+}
+
+// HEAD ?exists=1 checks only that the file exists, ?exists=complete that it's also complete
+func TestHeadExists(t *testing.T) {
+	cc := newTestCashier(t)
+	putTestFile(t, cc.sdb, "complete", testData(100))
+	if err := cc.sdb.CreateFile("partial", "partial", "", 100, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	sdb := &statCounter{StorageDB: cc.sdb}
+	cc.sdb = sdb
+
+	for _, tc := range []struct {
+		id, exists string
+		status     int
+	}{
+		{"complete", "1", http.StatusOK},
+		{"partial", "1", http.StatusOK},
+		{"missing", "1", http.StatusNotFound},
+		{"complete", "complete", http.StatusOK},
+		{"partial", "complete", http.StatusForbidden},
+		{"missing", "complete", http.StatusNotFound},
+	} {
+		sdb.stats = 0
+
+		rec := serveTest(t, cc.headEntry, httptest.NewRequest(http.MethodHead, "/x/"+tc.id+"?exists="+tc.exists, nil), tc.id)
+		if rec.Code != tc.status {
+			t.Errorf("HEAD %v ?exists=%v: %v, expected %v", tc.id, tc.exists, rec.Code, tc.status)
+		}
+		if tc.exists == "1" && sdb.stats != 0 {
+			t.Errorf("HEAD %v ?exists=1: %v Stat calls", tc.id, sdb.stats)
+		}
+	}
+}
+
+// A store counting the ReadAt calls
+type readCounter struct {
+	storage.StorageDB
+	reads int
+}
+
+func (s *readCounter) ReadAt(key string, buf []byte, pos int64) (int64, error) {
+	s.reads++
+	return s.StorageDB.ReadAt(key, buf, pos)
+}
+
+// Downloads stream the file with a single reader rather than a ReadAt per buffer
+func TestGetStreamed(t *testing.T) {
+	cc := newTestCashier(t)
+
+	data := testData(20*storage.BlockSize + 10)
+	putTestFile(t, cc.sdb, "f", data)
+
+	sdb := &readCounter{StorageDB: cc.sdb}
+	cc.sdb = sdb
+
+	rec := serveTest(t, cc.getEntry, httptest.NewRequest(http.MethodGet, "/x/f", nil), "f")
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), data) {
+		t.Fatalf("GET: %v, %v bytes", rec.Code, rec.Body.Len())
+	}
+	if sdb.reads > 1 { // the check that the data is there
+		t.Errorf("%v ReadAt calls for a full download", sdb.reads)
+	}
+}
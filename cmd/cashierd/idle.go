@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+type connKey struct{}
+
+// Add the client connection to the request context (for http.Server.ConnContext)
+func withConn(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, conn)
+}
+
+// A request body that fails with a timeout if no data arrives for the idle timeout,
+// by extending the read deadline of the client connection before each read
+type idleBody struct {
+	io.ReadCloser
+
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (b *idleBody) Read(p []byte) (int, error) {
+	b.conn.SetReadDeadline(time.Now().Add(b.timeout))
+	return b.ReadCloser.Read(p)
+}
+
+// Apply the idle timeout to the upload body, if enabled
+func (cc *Cashier) limitIdle(c echo.Context) {
+	conn, ok := c.Request().Context().Value(connKey{}).(net.Conn)
+	if cc.idleTimeout <= 0 || !ok {
+		return
+	}
+
+	c.Request().Body = &idleBody{ReadCloser: c.Request().Body, conn: conn, timeout: cc.idleTimeout}
+}
+
+// Return the error code if err is an upload timeout, or ""
+func timeoutCode(err error) string {
+	if err == context.DeadlineExceeded {
+		return CodeUploadDeadline
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return CodeUploadIdle
+	}
+
+	return ""
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/raff/cashier/storage"
+)
+
+// An upload that stalls for longer than the idle timeout fails with 408, and can be resumed
+func TestUploadIdleTimeout(t *testing.T) {
+	cc := newTestCashier(t)
+	cc.idleTimeout = 100 * time.Millisecond
+
+	e := echo.New()
+	e.HTTPErrorHandler = httpErrorHandler
+	e.POST("/x/:id", cc.createEntry)
+
+	server := httptest.NewUnstartedServer(e)
+	server.Config.ConnContext = withConn
+	server.Start()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	data := testData(3 * storage.BlockSize)
+
+	// send one block, then stall
+	fmt.Fprintf(conn, "POST /x/f HTTP/1.1\r\nHost: cashier\r\nContent-Length: %v\r\n\r\n", len(data))
+	conn.Write(data[:storage.BlockSize])
+
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(5 * time.Second))
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if elapsed := time.Since(start); elapsed < cc.idleTimeout {
+		t.Errorf("response after %v, before the idle timeout", elapsed)
+	}
+	if resp.StatusCode != http.StatusRequestTimeout {
+		t.Fatalf("stalled upload: %v, expected 408", resp.StatusCode)
+	}
+
+	expected := fmt.Sprintf("bytes=%v-%v/%v", storage.BlockSize, len(data)-1, len(data))
+	if srange := resp.Header.Get("Range"); srange != expected {
+		t.Errorf("Range %q, expected %q", srange, expected)
+	}
+
+	// the rest of the file can be uploaded
+	rec := serveTest(t, cc.updateEntry, putRequest("f", data[storage.BlockSize:],
+		fmt.Sprintf("bytes %v-%v/%v", storage.BlockSize, len(data)-1, len(data))), "f")
+	if rec.Code/100 != 2 || !strings.Contains(rec.Body.String(), "hash") {
+		t.Fatalf("resume: %v %v", rec.Code, rec.Body)
+	}
+	if got := readTestFile(t, cc.sdb, "f"); !bytes.Equal(got, data) {
+		t.Errorf("resumed file differs")
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo"
+	"github.com/raff/cashier/storage"
+)
+
+var indexTemplate = template.Must(template.New("index").Funcs(template.FuncMap{
+	"pathEscape": url.PathEscape,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><title>Index of {{.Prefix}}</title></head>
+<body>
+<h1>Index of {{.Prefix}}</h1>
+<table>
+<tr><th>Name</th><th>Size</th><th>Modified</th></tr>
+{{range .Files}}<tr><td><a href="/x/{{pathEscape .Key}}">{{.Key}}</a></td><td>{{.Length}}</td><td>{{.Created.Format "2006-01-02 15:04:05"}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// List the complete files with a key starting with prefix, as an HTML page
+// (or JSON, if requested via Accept).
+// The prefix may contain URL-encoded slashes (i.e. /x/proj%2Fimg%2F/) or plain ones (/x/proj/img/).
+// ?sort=name|created|size and ?order=asc|desc select the order (default: storage order),
+// ?limit=n returns only the first n files.
+func (cc *Cashier) getIndex(c echo.Context) error {
+	prefix := c.Param("prefix")
+
+	var opts []storage.ListOption
+
+	order := c.QueryParam("order")
+	if order != "" && order != "asc" && order != "desc" {
+		return respondError(c, http.StatusBadRequest, CodeInvalidListing)
+	}
+
+	if by := c.QueryParam("sort"); by != "" {
+		if !storage.ValidSort(by) {
+			return respondError(c, http.StatusBadRequest, CodeInvalidListing)
+		}
+
+		opts = append(opts, storage.WithSort(by, order == "desc"))
+	}
+
+	limit := 0
+	if l := c.QueryParam("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			return respondError(c, http.StatusBadRequest, CodeInvalidListing)
+		}
+	}
+
+	files, err := cc.sdb.ListFiles(prefix, opts...)
+	if err != nil {
+		return serverError(c, err)
+	}
+
+	complete := make([]*storage.FileInfo, 0, len(files))
+	for _, f := range files {
+		if limit > 0 && len(complete) == limit {
+			break
+		}
+		if f.Next == storage.FileComplete {
+			complete = append(complete, f)
+		}
+	}
+
+	if strings.Contains(c.Request().Header.Get("Accept"), "application/json") {
+		return c.JSON(http.StatusOK, complete)
+	}
+
+	c.Response().Header().Set("Content-Type", "text/html; charset=utf-8")
+	c.Response().WriteHeader(http.StatusOK)
+	return indexTemplate.Execute(c.Response(), mmap{"Prefix": prefix, "Files": complete})
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/raff/cashier/storage"
+)
+
+func TestGetIndex(t *testing.T) {
+	cc := newTestCashier(t)
+	for _, key := range []string{"proj/img/a.png", "proj/img/b.png", "proj/doc.txt", "other"} {
+		putTestFile(t, cc.sdb, key, testData(10))
+	}
+	if err := cc.sdb.CreateFile("proj/img/partial", "p", "", 10, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := serveParamTest(t, cc.getIndex, httptest.NewRequest(http.MethodGet, "/x/proj%2Fimg%2F/", nil), "prefix", "proj/img/")
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("index: %v %v", rec.Code, rec.Header())
+	}
+	for _, link := range []string{`href="/x/proj%2Fimg%2Fa.png"`, `href="/x/proj%2Fimg%2Fb.png"`} {
+		if !strings.Contains(rec.Body.String(), link) {
+			t.Errorf("index without %v: %v", link, rec.Body)
+		}
+	}
+	if body := rec.Body.String(); strings.Contains(body, "doc.txt") || strings.Contains(body, "partial") {
+		t.Errorf("index with other files: %v", body)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/x/proj%2F/?sort=name&order=desc", nil)
+	req.Header.Set("Accept", "application/json")
+	rec = serveParamTest(t, cc.getIndex, req, "prefix", "proj/")
+
+	var files []*storage.FileInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &files); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("JSON index: %v %v %q", rec.Code, err, rec.Body)
+	}
+
+	var keys []string
+	for _, f := range files {
+		keys = append(keys, f.Key)
+	}
+	if strings.Join(keys, " ") != "proj/img/b.png proj/img/a.png proj/doc.txt" {
+		t.Errorf("JSON index: %v", keys)
+	}
+}
+
+// Index paths with plain or escaped slashes, and the links in the index, route to their handlers
+func TestIndexRoutes(t *testing.T) {
+	cc := newTestCashier(t)
+	data := testData(10)
+	for _, key := range []string{"proj/img/a.png", "proj/doc.txt"} {
+		putTestFile(t, cc.sdb, key, data)
+	}
+
+	e := echo.New()
+	e.HTTPErrorHandler = httpErrorHandler
+	e.Pre(escapeIndexPath)
+	e.Use(unescapeParams)
+	addDownloadRoutes(e, cc)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	var link string
+	for _, path := range []string{"/x/proj/img/", "/x/proj%2Fimg%2F/"} {
+		rec := get(path)
+		body := rec.Body.String()
+		if rec.Code != http.StatusOK || !strings.Contains(body, "proj/img/a.png") || strings.Contains(body, "doc.txt") {
+			t.Fatalf("index %v: %v %v", path, rec.Code, body)
+		}
+
+		link = body[strings.Index(body, `href="`)+len(`href="`):]
+		link = link[:strings.Index(link, `"`)]
+	}
+
+	if rec := get(link); rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), data) {
+		t.Errorf("link %v: %v %v", link, rec.Code, rec.Body)
+	}
+	if rec := get(link + "/meta"); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"Key":"proj/img/a.png"`) {
+		t.Errorf("metadata of %v: %v %v", link, rec.Code, rec.Body)
+	}
+}
+
+// The index lists the newest uploads first with sort=created&order=desc, up to limit
+func TestGetIndexNewest(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	cc := newTestCashier(t, storage.WithClock(func() time.Time { return now }))
+
+	for i, key := range []string{"b", "d", "a", "c"} {
+		putTestFile(t, cc.sdb, key, testData(10*(4-i)))
+		now = now.Add(time.Second)
+	}
+
+	listing := func(query string) (int, []string) {
+		req := httptest.NewRequest(http.MethodGet, "/x//?"+query, nil)
+		req.Header.Set("Accept", "application/json")
+		rec := serveParamTest(t, cc.getIndex, req, "prefix", "")
+		if rec.Code != http.StatusOK {
+			return rec.Code, nil
+		}
+
+		var files []*storage.FileInfo
+		if err := json.Unmarshal(rec.Body.Bytes(), &files); err != nil {
+			t.Fatalf("%v: %v %q", query, err, rec.Body)
+		}
+
+		var keys []string
+		for _, f := range files {
+			keys = append(keys, f.Key)
+		}
+		return rec.Code, keys
+	}
+
+	for _, test := range []struct {
+		query    string
+		code     int
+		expected string
+	}{
+		{"sort=created&order=desc", http.StatusOK, "c a d b"},
+		{"sort=created", http.StatusOK, "b d a c"},
+		{"sort=created&order=desc&limit=2", http.StatusOK, "c a"},
+		{"sort=size&order=asc", http.StatusOK, "c a d b"},
+		{"sort=name&order=desc", http.StatusOK, "d c b a"},
+		{"sort=date", http.StatusBadRequest, ""},
+		{"sort=size&order=up", http.StatusBadRequest, ""},
+		{"limit=0", http.StatusBadRequest, ""},
+	} {
+		code, keys := listing(test.query)
+		if code != test.code || strings.Join(keys, " ") != test.expected {
+			t.Errorf("%v: %v %v, expected %v %v", test.query, code, keys, test.code, test.expected)
+		}
+	}
+}
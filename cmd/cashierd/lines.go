@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo"
+	"github.com/raff/cashier/storage"
+)
+
+const (
+	defaultLines = 100
+	maxLines     = 10000
+)
+
+// Return up to max lines (default 100) of file id, starting at byte offset from,
+// and the offset of the next line, to continue reading (lines are never split between calls)
+func (cc *Cashier) getLines(c echo.Context) error {
+	id := c.Param("id")
+
+	var from int64
+	if f := c.QueryParam("from"); f != "" {
+		var err error
+		if from, err = strconv.ParseInt(f, 10, 64); err != nil || from < 0 {
+			return respondError(c, http.StatusBadRequest, CodeInvalidRange)
+		}
+	}
+
+	max := defaultLines
+	if m := c.QueryParam("max"); m != "" {
+		var err error
+		if max, err = strconv.Atoi(m); err != nil || max <= 0 {
+			return respondError(c, http.StatusBadRequest, CodeInvalidRange)
+		}
+		if max > maxLines {
+			max = maxLines
+		}
+	}
+
+	info, err := cc.sdb.Stat(id)
+	if err == storage.ErrNotFound {
+		return respondError(c, http.StatusNotFound, CodeNotFound)
+	}
+	if err != nil {
+		return serverError(c, err)
+	}
+	if info.Next != storage.FileComplete {
+		return respondError(c, http.StatusForbidden, CodeIncomplete)
+	}
+	if from < info.Base {
+		from = info.Base
+	}
+	if from > info.Length {
+		return respondError(c, http.StatusBadRequest, CodeInvalidRange)
+	}
+
+	content := &ReadSeeker{sdb: cc.sdb, key: id, pos: from, base: info.Base, length: info.Length}
+	defer content.Close()
+
+	reader := bufio.NewReader(content)
+	lines := make([]string, 0, max)
+	next := from
+
+	for len(lines) < max && next < info.Length {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return serverError(c, err)
+		}
+
+		next += int64(len(line))
+		lines = append(lines, strings.TrimRight(line, "\r\n"))
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	return c.JSON(http.StatusOK, mmap{"lines": lines, "next": next, "eof": next >= info.Length})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Lines are read in batches, continuing from the returned offset
+func TestGetLines(t *testing.T) {
+	cc := newTestCashier(t)
+
+	content := "first\r\nsecond\n\n" + strings.Repeat("x", 20000) + "\nlast"
+	putTestFile(t, cc.sdb, "log", []byte(content))
+
+	type batch struct {
+		Lines []string
+		Next  int64
+		EOF   bool
+	}
+
+	get := func(query string) (int, batch) {
+		var b batch
+		rec := serveTest(t, cc.getLines, httptest.NewRequest(http.MethodGet, "/x/log/lines?"+query, nil), "log")
+		json.Unmarshal(rec.Body.Bytes(), &b)
+		return rec.Code, b
+	}
+
+	code, b := get("max=2")
+	if code != http.StatusOK || strings.Join(b.Lines, "|") != "first|second" || b.Next != 14 || b.EOF {
+		t.Fatalf("first batch: %v %+v", code, b)
+	}
+
+	code, b = get("max=10&from=14")
+	if code != http.StatusOK || len(b.Lines) != 3 || b.Lines[0] != "" || len(b.Lines[1]) != 20000 || b.Lines[2] != "last" {
+		t.Fatalf("second batch: %v %v lines", code, len(b.Lines))
+	}
+	if b.Next != int64(len(content)) || !b.EOF {
+		t.Errorf("second batch: next %v, eof %v", b.Next, b.EOF)
+	}
+
+	for _, query := range []string{"from=-1", "from=x", "max=0", "from=100000"} {
+		if code, _ := get(query); code != http.StatusBadRequest {
+			t.Errorf("%v: %v, expected 400", query, code)
+		}
+	}
+}
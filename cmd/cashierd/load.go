@@ -0,0 +1,82 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo"
+	"github.com/raff/cashier/storage"
+)
+
+// Uploads and downloads in flight, for the autoscaling signal
+var (
+	inFlightUploads   = expvar.NewInt("inflight_uploads")
+	inFlightDownloads = expvar.NewInt("inflight_downloads")
+)
+
+// Return a middleware counting the requests in flight of a route in n
+func countIn(n *expvar.Int) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			n.Add(1)
+			defer n.Add(-1)
+
+			return next(c)
+		}
+	}
+}
+
+// Return the current load: uploads and downloads in flight and, if the max concurrency is configured,
+// the saturation (in flight / max). The response is 503 while the storage breaker is open, so that
+// an autoscaler doesn't scale on a failing instance.
+// With ?format=prometheus (or Accept: text/plain) the values are Prometheus gauges.
+func (cc *Cashier) getLoad(c echo.Context) error {
+	uploads, downloads := inFlightUploads.Value(), inFlightDownloads.Value()
+
+	healthy := true
+	if cc.breaker != nil {
+		state, _ := cc.breaker.State()
+		healthy = state != storage.BreakerOpen
+	}
+
+	status := http.StatusOK
+	if !healthy {
+		status = http.StatusServiceUnavailable
+	}
+
+	saturation := -1.0 // unknown
+	if cc.maxConcurrent > 0 {
+		saturation = float64(uploads+downloads) / float64(cc.maxConcurrent)
+	}
+
+	if c.QueryParam("format") == "prometheus" || strings.HasPrefix(c.Request().Header.Get("Accept"), "text/plain") {
+		var b strings.Builder
+
+		gauge := func(name string, value interface{}) {
+			fmt.Fprintf(&b, "# TYPE cashier_%v gauge\ncashier_%v %v\n", name, name, value)
+		}
+
+		gauge("inflight_uploads", uploads)
+		gauge("inflight_downloads", downloads)
+		if saturation >= 0 {
+			gauge("saturation", saturation)
+		}
+		if healthy {
+			gauge("healthy", 1)
+		} else {
+			gauge("healthy", 0)
+		}
+
+		return c.String(status, b.String())
+	}
+
+	load := mmap{"uploads": uploads, "downloads": downloads, "healthy": healthy}
+	if saturation >= 0 {
+		load["max"] = cc.maxConcurrent
+		load["saturation"] = saturation
+	}
+
+	return c.JSON(status, load)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/raff/cashier/storage"
+)
+
+// A store whose Stat always fails
+type downStore struct {
+	storage.StorageDB
+}
+
+func (s downStore) Stat(key string) (*storage.FileInfo, error) {
+	return nil, errors.New("down")
+}
+
+// The load reports the requests in flight through countIn, and the saturation
+func TestGetLoad(t *testing.T) {
+	cc := newTestCashier(t)
+	cc.maxConcurrent = 4
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	wait := func(c echo.Context) error {
+		started <- struct{}{}
+		<-release
+		return c.NoContent(http.StatusOK)
+	}
+
+	var wg sync.WaitGroup
+	for _, n := range []*expvar.Int{inFlightUploads, inFlightUploads, inFlightDownloads} {
+		handler := countIn(n)(wait)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serveTest(t, handler, httptest.NewRequest(http.MethodGet, "/x/f", nil), "f")
+		}()
+		<-started
+	}
+
+	var load struct {
+		Uploads, Downloads, Max int
+		Saturation              float64
+		Healthy                 bool
+	}
+
+	rec := serveTest(t, cc.getLoad, httptest.NewRequest(http.MethodGet, "/metrics/load", nil), "")
+	if err := json.Unmarshal(rec.Body.Bytes(), &load); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("load: %v %v", rec.Code, rec.Body)
+	}
+	if load.Uploads != 2 || load.Downloads != 1 || load.Max != 4 || load.Saturation != 0.75 || !load.Healthy {
+		t.Errorf("load %+v, expected 2 uploads, 1 download, saturation 0.75", load)
+	}
+
+	rec = serveTest(t, cc.getLoad, httptest.NewRequest(http.MethodGet, "/metrics/load?format=prometheus", nil), "")
+	for _, gauge := range []string{"cashier_inflight_uploads 2\n", "cashier_inflight_downloads 1\n", "cashier_saturation 0.75\n", "cashier_healthy 1\n"} {
+		if !strings.Contains(rec.Body.String(), gauge) {
+			t.Errorf("prometheus load %q, expected %q", rec.Body, gauge)
+		}
+	}
+
+	close(release)
+	wg.Wait()
+
+	if rec = serveTest(t, cc.getLoad, httptest.NewRequest(http.MethodGet, "/metrics/load", nil), ""); !strings.Contains(rec.Body.String(), `"uploads":0`) {
+		t.Errorf("load after the requests completed: %v", rec.Body)
+	}
+
+	// an instance with an open storage breaker is reported as unhealthy
+	cc.breaker = storage.NewCircuitBreaker(downStore{cc.sdb}, 1, time.Hour)
+	cc.breaker.Stat("f")
+
+	rec = serveTest(t, cc.getLoad, httptest.NewRequest(http.MethodGet, "/metrics/load", nil), "")
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), `"healthy":false`) {
+		t.Errorf("load with the breaker open: %v %v", rec.Code, rec.Body)
+	}
+}
@@ -1,16 +1,26 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
 	"errors"
+	"expvar"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/labstack/echo"
@@ -19,11 +29,51 @@ import (
 )
 
 type Cashier struct {
-	sdb storage.StorageDB
+	sdb      storage.StorageDB
+	scrubber *Scrubber
+	readonly bool
+
+	defaultType string // Content-Type for uploads without a type
+	backend     string // storage backend type
+	hashAlg     string // hash algorithm for new files
+	pipelined   bool   // read the upload body while writing the previous block
+
+	maxUploadAge   time.Duration // max time since the last write to resume an upload
+	uploadDeadline time.Duration // max duration of an upload request
+	idleTimeout    time.Duration // max time without upload data
+	reserveTTL     time.Duration // time to start the upload of a reserved file
+	sessionTTL     time.Duration // time an upload session is kept without writes, until committed
+	blockSize      int64         // block size of new files
+	sliding        *slidingTTL   // refresh the TTL of downloaded files (nil to disable)
+	ttlRules       ttlRules      // TTL by content type
+	maxVersions    int           // previous versions kept when a file is overwritten (0 to disable)
+
+	receiptKey []byte // key to sign upload receipts (nil to disable)
+
+	audit *storage.AuditLog // audit log (nil to disable)
+
+	breaker       *storage.CircuitBreaker // storage breaker (nil if disabled)
+	maxConcurrent int                     // uploads and downloads in flight the server is sized for (0 if unknown)
+
+	notFoundRedirect string // URL to redirect downloads of missing files to
+	notFoundPage     []byte // body for downloads of missing files (nil for the JSON error)
+	notFoundType     string // Content-Type of notFoundPage
 }
 
 type mmap = map[string]interface{}
 
+var inFlight = expvar.NewInt("inflight")
+
+// Middleware counting the requests in flight
+func countRequests(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		inFlight.Add(1)
+		defer inFlight.Add(-1)
+
+		return next(c)
+	}
+}
+
 func statusMessage(code, subcode interface{}, info mmap) mmap {
 	message := mmap{"code": code, "subcode": subcode}
 
@@ -34,6 +84,274 @@ func statusMessage(code, subcode interface{}, info mmap) mmap {
 	return message
 }
 
+// Return an error response for a storage (or request) error.
+// Unexpected errors are reported as CodeInternal, with the error message.
+func serverError(c echo.Context, err error) error {
+	if err == storage.ErrUnavailable {
+		return respondError(c, http.StatusServiceUnavailable, CodeStorageUnavailable)
+	}
+	if err == storage.ErrInvalidHash {
+		return respondError(c, http.StatusBadRequest, CodeHashMismatch)
+	}
+	if err == storage.ErrImmutable {
+		return respondError(c, http.StatusForbidden, CodeImmutable)
+	}
+	if err == storage.ErrDeleted {
+		return respondError(c, http.StatusGone, CodeFileDeleted)
+	}
+	if err == storage.ErrQuotaExceeded {
+		return respondError(c, http.StatusInsufficientStorage, CodeQuotaExceeded)
+	}
+	if err == storage.ErrNoSpace {
+		return respondError(c, http.StatusInsufficientStorage, CodeInsufficientSpace)
+	}
+	if err == storage.ErrTrimmed {
+		return respondError(c, http.StatusRequestedRangeNotSatisfiable, CodeTrimmed)
+	}
+
+	return sendError(c, http.StatusInternalServerError, CodeInternal, err.Error(), nil)
+}
+
+// Return ctype or, if empty, the content type for the extension of filename or the default content type
+func (cc *Cashier) contentType(ctype, filename string) string {
+	if ctype != "" {
+		return ctype
+	}
+	if ctype = mime.TypeByExtension(filepath.Ext(filename)); ctype != "" {
+		return ctype
+	}
+
+	return cc.defaultType
+}
+
+// Return the length of a multipart file part, or -1 if unknown
+func partLength(p *multipart.Part) int64 {
+	size := int64(-1)
+
+	if p.Header.Get("Content-Length") != "" {
+		fmt.Sscanf(p.Header.Get("Content-Length"), "%d", &size)
+	}
+
+	return size
+}
+
+// Return the file name from the Content-Disposition header, or def if missing
+func fileName(h http.Header, def string) string {
+	if cdisp := h.Get("Content-Disposition"); cdisp != "" {
+		_, params, _ := mime.ParseMediaType(cdisp)
+		if fname, ok := params["filename"]; ok {
+			return fname
+		}
+	}
+
+	return def
+}
+
+// Return the expected file hash from the X-File-Hash header (hex encoded, optionally with an "alg:" prefix), if present.
+// The storage hashes each block as it writes it, and verifies the hash when the file is complete.
+func fileHash(h http.Header) ([]byte, error) {
+	return storage.ParseHash(h.Get("X-File-Hash"))
+}
+
+// Return the context for an upload, limited by the upload deadline
+func (cc *Cashier) uploadContext(c echo.Context) (context.Context, context.CancelFunc) {
+	if cc.uploadDeadline > 0 {
+		return context.WithTimeout(c.Request().Context(), cc.uploadDeadline)
+	}
+
+	return context.WithCancel(c.Request().Context())
+}
+
+// Return 408 for an upload that didn't complete before the deadline or stalled (code),
+// with the range to resume from
+func (cc *Cashier) uploadTimeout(c echo.Context, id, code string) error {
+	if info, err := cc.sdb.Stat(id); err == nil && info.Next != storage.FileComplete {
+		c.Response().Header().Set("Range", nextRange(info))
+	}
+
+	return respondError(c, http.StatusRequestTimeout, code)
+}
+
+// Return the options for a new file from the request (or part) headers and content type
+func (cc *Cashier) fileOptions(h http.Header, ctype string) []storage.FileOption {
+	var opts []storage.FileOption
+
+	if immutable, _ := strconv.ParseBool(h.Get("X-Immutable")); immutable {
+		opts = append(opts, storage.WithImmutable())
+	}
+	if ttl, ok := cc.ttlRules.match(ctype); ok {
+		opts = append(opts, storage.WithTTL(ttl))
+	}
+	if ttl, err := time.ParseDuration(h.Get("X-Block-TTL")); err == nil && ttl > 0 {
+		opts = append(opts, storage.WithBlockTTL(ttl))
+	}
+	if ranged(h) {
+		opts = append(opts, storage.WithRanges())
+	}
+
+	return opts
+}
+
+// Return true if the new file can be written in any order (X-Ranges), with a PUT for each range
+func ranged(h http.Header) bool {
+	ranges, _ := strconv.ParseBool(h.Get("X-Ranges"))
+	return ranges
+}
+
+// Return the Range to resume the upload of an incomplete file from: the next gap
+// (up to the first range written past it, for a file written in any order)
+func nextRange(info *storage.FileInfo) string {
+	end := info.Length
+	if len(info.Ranges) > 0 {
+		end = info.Ranges[0].Start
+	}
+
+	return fmt.Sprintf("bytes=%v-%v/%v", info.Next, end-1, info.Length)
+}
+
+// Return true if the range start-stop can be written to the file: at the next write position or,
+// for a file written in any order, at any block boundary past it that wasn't written yet
+func writableRange(info *storage.FileInfo, start, stop int64) bool {
+	if start != info.Next && (!info.Ranged || start < info.Next || start%info.BlockSize != 0) {
+		return false
+	}
+
+	for _, r := range info.Ranges {
+		if start < r.End && r.Start <= stop {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Return the block size of the files created by the server
+func (cc *Cashier) fileBlockSize() int64 {
+	if cc.blockSize == 0 {
+		return storage.BlockSize
+	}
+
+	return cc.blockSize
+}
+
+// Read data from reader and write it to file id, starting at pos, a block (of blockSize bytes) at a time,
+// until ctx is done. Returns the number of bytes read and the next write position.
+func (cc *Cashier) writeFrom(ctx context.Context, id string, reader io.Reader, pos, blockSize int64) (int64, int64, error) {
+	if pos == storage.FileComplete { // empty file, complete on creation
+		return 0, pos, nil
+	}
+	if cc.pipelined {
+		return cc.writeFromPipelined(ctx, id, reader, pos, blockSize)
+	}
+
+	var buf = make([]byte, blockSize)
+	var nread int64
+
+	for pos != storage.FileComplete {
+		if err := ctx.Err(); err != nil {
+			log.Printf("upload %v: %v", id, err)
+			return nread, pos, err
+		}
+
+		n, err := io.ReadAtLeast(reader, buf, len(buf))
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF { // ErrUnexpectedEOF is a short last block
+			log.Printf("upload %v: error reading - %v", id, err)
+			return nread, pos, err
+		}
+
+		log.Printf("upload %v: read %v", id, n)
+
+		npos, werr := cc.sdb.WriteAt(id, pos, buf[:n])
+		if werr != nil {
+			log.Printf("upload %v: error writing - %v", id, werr)
+			return nread, pos, werr
+		}
+
+		log.Printf("upload %v: wrote %v, next %v", id, n, npos)
+		nread += int64(n)
+		pos = npos
+
+		if err == io.ErrUnexpectedEOF {
+			break
+		}
+	}
+
+	return nread, pos, nil
+}
+
+// Return the write position for a new file of the specified size
+// (empty files are complete as soon as they are created)
+func startPos(size int64) int64 {
+	if size == 0 {
+		return storage.FileComplete
+	}
+
+	return 0
+}
+
+// Return the success message for an upload,
+// including the computed hash if the file is now complete
+func (cc *Cashier) uploadMessage(id, subcode string, pos int64) mmap {
+	if pos != storage.FileComplete {
+		return statusMessage("success", subcode, nil)
+	}
+
+	info, err := cc.sdb.Stat(id)
+	if err != nil {
+		log.Printf("upload %v: %v", id, err.Error())
+		return statusMessage("success", subcode, nil)
+	}
+
+	alg := info.HashAlg
+	if alg == "" {
+		alg = storage.HashCumulative
+	}
+
+	message := mmap{"hash": info.Hash, "algorithm": alg, "length": info.Length}
+	if cc.receiptKey != nil {
+		for k, v := range cc.signedReceipt(info) {
+			message[k] = v
+		}
+	}
+
+	return statusMessage("success", subcode, message)
+}
+
+// Return the time until the incomplete file can be resumed
+func (cc *Cashier) resumeDeadline(info *storage.FileInfo) time.Time {
+	deadline := info.ExpiresAt
+	if cc.maxUploadAge > 0 {
+		if stale := info.Created.Add(cc.maxUploadAge); deadline.IsZero() || stale.Before(deadline) {
+			deadline = stale
+		}
+	}
+
+	return deadline
+}
+
+// Return the error response for an upload to an existing file,
+// with the range to resume and the resume deadline if the file is incomplete
+func (cc *Cashier) fileExists(c echo.Context, id string, info *storage.FileInfo) error {
+	log.Printf("upload %v: exists", id)
+
+	if info == nil || info.Next == storage.FileComplete {
+		return respondError(c, http.StatusConflict, CodeFileExists)
+	}
+
+	c.Response().Header().Set("Range", nextRange(info))
+
+	resume := mmap{"resume-offset": info.Next}
+	if deadline := cc.resumeDeadline(info); !deadline.IsZero() {
+		c.Response().Header().Set("Retry-Until", deadline.UTC().Format(http.TimeFormat))
+		resume["resume-deadline"] = deadline.UTC()
+	}
+
+	return sendError(c, http.StatusConflict, CodeFileExists, "", resume)
+}
+
 func (cc *Cashier) createEntry(c echo.Context) error {
 	id := c.Param("id")
 
@@ -47,34 +365,75 @@ func (cc *Cashier) createEntry(c echo.Context) error {
 		fmt.Sscanf(c.Request().Header.Get("X-File-Length"), "%d", &size)
 	}
 
+	hash, err := fileHash(c.Request().Header)
+	if err != nil {
+		return respondError(c, http.StatusBadRequest, CodeInvalidHash)
+	}
+
+	// the key written: an overwrite is written to a temporary key, and replaces id once complete
+	key := id
+
+	// Reject duplicates before reading the body: with "Expect: 100-continue"
+	// the server only asks the client for the body once the handler reads it
+	if info, err := cc.sdb.Stat(id); err == nil {
+		overwrite, _ := strconv.ParseBool(c.Request().Header.Get("X-Overwrite"))
+		if !overwrite || info.Next != storage.FileComplete {
+			return cc.fileExists(c, id, info)
+		}
+
+		// with X-Overwrite, a complete file is replaced unless X-File-Hash matches its hash
+		if stored, _ := storage.ParseHash(info.Hash); len(hash) > 0 && bytes.Equal(hash, stored) && !info.Deleted() {
+			log.Printf("upload %v: unchanged", id)
+			return c.JSON(http.StatusOK, cc.uploadMessage(id, "unchanged", storage.FileComplete))
+		}
+
+		key = sessionPrefix + newSessionToken()
+		log.Printf("upload %v: overwrite as %v", id, key)
+	}
+
+	cc.limitIdle(c)
+
 	mp, err := c.Request().MultipartReader()
 	if err == http.ErrNotMultipart {
 		err = nil
 
-		fname := id
-		cdisp := c.Request().Header.Get("Content-Disposition")
-		if cdisp != "" {
-			_, params, _ := mime.ParseMediaType(cdisp)
-			if _, ok := params["filename"]; ok {
-				fname = params["filename"]
+		fname := fileName(c.Request().Header, id)
+
+		// not a form, we just read the (decompressed) body
+		reader, err = decodeBody(c.Request())
+		if err != nil {
+			return respondError(c, http.StatusUnsupportedMediaType, CodeUnsupportedEncoding)
+		}
+
+		if size < 0 && encodedBody(c.Request()) {
+			// the decompressed length is not known until the body is read
+			spooled, n, err := spool(reader)
+			if err != nil {
+				log.Printf("upload %v: %v", id, err.Error())
+				return serverError(c, err)
 			}
+
+			defer spooled.Close()
+			reader, size = spooled, n
 		}
 
 		if size < 0 {
 			size = c.Request().ContentLength
 		}
 
-		// not a form, we just read the body
-		err = cc.sdb.CreateFile(id, fname, c.Request().Header.Get("Content-Type"), size, nil)
-		reader = c.Request().Body
+		ctype := cc.contentType(c.Request().Header.Get("Content-Type"), fname)
+		err = cc.sdb.CreateFile(key, fname, ctype, size, hash, cc.fileOptions(c.Request().Header, ctype)...)
 	} else if err == nil {
 		fname := id
 		ftype := ""
 
 		for {
 			p, err := mp.NextPart()
+			if err == io.EOF {
+				break
+			}
 			if err != nil {
-				return c.JSON(http.StatusInternalServerError, statusMessage("error", err.Error(), nil))
+				return serverError(c, err)
 			}
 
 			if p.FormName() == "file" { // file to upload
@@ -85,8 +444,13 @@ func (cc *Cashier) createEntry(c echo.Context) error {
 				reader = p
 				ftype = p.Header.Get("Content-Type")
 
-				if p.Header.Get("Content-Length") != "" {
-					fmt.Sscanf(p.Header.Get("Content-File-Length"), "%d", &size)
+				if l := partLength(p); l >= 0 {
+					size = l
+				}
+				if p.Header.Get("X-File-Hash") != "" {
+					if hash, err = fileHash(http.Header(p.Header)); err != nil {
+						return respondError(c, http.StatusBadRequest, CodeInvalidHash)
+					}
 				}
 
 				// this seems to casue the server to read the full request
@@ -97,201 +461,646 @@ func (cc *Cashier) createEntry(c echo.Context) error {
 		}
 
 		if reader == nil {
-			return c.JSON(http.StatusBadRequest, statusMessage("missing", "missing-file", nil))
+			return respondError(c, http.StatusBadRequest, CodeMissingFile)
 		}
 		if size < 0 {
-			return c.JSON(http.StatusBadRequest, statusMessage("missing", "missing-file-length", nil))
+			return respondError(c, http.StatusBadRequest, CodeMissingFileLength)
 		}
 
-		err = cc.sdb.CreateFile(id, fname, ftype, size, nil)
+		ctype := cc.contentType(ftype, fname)
+		err = cc.sdb.CreateFile(key, fname, ctype, size, hash, cc.fileOptions(c.Request().Header, ctype)...)
 	} else {
 		log.Printf("upload %v: cannot get form data - %v", id, err)
 	}
 
+	if err == storage.ErrInfoTooBig {
+		log.Printf("upload %v: metadata too large", id)
+		return respondError(c, http.StatusRequestEntityTooLarge, CodeMetadataTooLarge)
+	}
 	if err == storage.ErrExists {
-		log.Printf("upload %v: exists", id)
-
 		info, _ := cc.sdb.Stat(id)
-		if info != nil && info.Next != storage.FileComplete {
-			c.Response().Header().Set("Range",
-				fmt.Sprintf("bytes=%v-%v/%v", info.Next, info.Length-1, info.Length))
-		}
-		return c.JSON(http.StatusConflict, statusMessage("conflict", "file-exists", nil))
+		return cc.fileExists(c, id, info)
 	}
 	if err != nil {
 		log.Printf("upload %v: %v", id, err.Error())
-		return c.JSON(http.StatusInternalServerError, statusMessage("error", err.Error(), nil))
+		return serverError(c, err)
 	}
 
-	log.Printf("upload %v: created", id)
+	log.Printf("upload %v: created", key)
 
-	var buf = make([]byte, storage.BlockSize)
-	var pos int64
-	var nread int64
+	ctx, cancel := cc.uploadContext(c)
+	defer cancel()
 
-	for pos != storage.FileComplete {
-		var n int
+	nread, pos, err := cc.writeFrom(ctx, key, reader, startPos(size), cc.fileBlockSize())
+	if nread != size {
+		log.Printf("upload %v: expected %v read %v writepos %v", key, size, nread, pos)
+	}
+	if key != id {
+		if err == nil && pos != storage.FileComplete {
+			err = io.ErrUnexpectedEOF // an overwrite can't be resumed
+		}
+		if err == nil {
+			err = cc.replaceFile(key, id)
+		}
+		if err != nil {
+			cc.sdb.DeleteFile(key) // the previous version is kept
+		}
+	}
+	if code := timeoutCode(err); code != "" {
+		return cc.uploadTimeout(c, id, code)
+	}
+	if err != nil {
+		log.Printf("upload %v: %v", key, err.Error())
+		return serverError(c, err)
+	}
+
+	return c.JSON(http.StatusCreated, cc.uploadMessage(id, "created", pos))
+}
 
-		n, err = io.ReadAtLeast(reader, buf, storage.BlockSize)
+// Replace the file id with the complete file key, keeping the previous content as a version if enabled.
+// When overwrites of id complete concurrently, the last one to be renamed wins.
+func (cc *Cashier) replaceFile(key, id string) error {
+	for {
+		var err error
+		if cc.maxVersions > 0 {
+			err = storage.KeepVersion(cc.sdb, id, cc.maxVersions)
+		} else {
+			err = cc.sdb.DeleteFile(id)
+		}
+		if err != nil && err != storage.ErrNotFound {
+			return err
+		}
+		if err := cc.sdb.Rename(key, id); err != storage.ErrExists {
+			return err
+		}
+	}
+}
+
+// Upload multiple files in a multipart form.
+// Each "file" part is stored using its file name as key.
+func (cc *Cashier) createEntries(c echo.Context) error {
+	cc.limitIdle(c)
+
+	mp, err := c.Request().MultipartReader()
+	if err == http.ErrNotMultipart {
+		return respondError(c, http.StatusBadRequest, CodeMultipartExpected)
+	}
+	if err != nil {
+		return serverError(c, err)
+	}
+
+	ctx, cancel := cc.uploadContext(c)
+	defer cancel()
+
+	var results []mmap
+	failed := 0
+
+	failure := func(id string, status int, code, message string) {
+		failed++
+
+		result := errorBody(code, message, nil)
+		result["id"] = id
+		result["status"] = status
+		results = append(results, result)
+	}
+
+	for {
+		p, err := mp.NextPart()
 		if err == io.EOF {
-			if n == 0 {
-				break
-			}
-		} else if err != nil {
-			log.Printf("upload %v: error reading - %v", id, err)
 			break
 		}
+		if err != nil {
+			return serverError(c, err)
+		}
 
-		log.Printf("upload %v: read %v", id, n)
+		if p.FormName() != "file" {
+			continue
+		}
+
+		id := p.FileName()
+		size := partLength(p)
+
+		if id == "" {
+			failure(id, http.StatusBadRequest, CodeMissingFileName, "")
+			continue
+		}
+		if size < 0 {
+			failure(id, http.StatusBadRequest, CodeMissingFileLength, "")
+			continue
+		}
+
+		hash, err := fileHash(http.Header(p.Header))
+		if err != nil {
+			failure(id, http.StatusBadRequest, CodeInvalidHash, "")
+			continue
+		}
+
+		if ctx.Err() != nil {
+			failure(id, http.StatusRequestTimeout, CodeUploadDeadline, "")
+			continue
+		}
+
+		log.Println("create", id)
+
+		ctype := cc.contentType(p.Header.Get("Content-Type"), id)
+		err = cc.sdb.CreateFile(id, id, ctype, size, hash, cc.fileOptions(http.Header(p.Header), ctype)...)
+		if err == storage.ErrInfoTooBig {
+			log.Printf("upload %v: metadata too large", id)
+			failure(id, http.StatusRequestEntityTooLarge, CodeMetadataTooLarge, "")
+			continue
+		}
+		if err == storage.ErrExists {
+			log.Printf("upload %v: exists", id)
+			failure(id, http.StatusConflict, CodeFileExists, "")
+			continue
+		}
+		if err == storage.ErrQuotaExceeded {
+			log.Printf("upload %v: quota exceeded", id)
+			failure(id, http.StatusInsufficientStorage, CodeQuotaExceeded, "")
+			continue
+		}
+		if err == storage.ErrNoSpace {
+			log.Printf("upload %v: not enough free space", id)
+			failure(id, http.StatusInsufficientStorage, CodeInsufficientSpace, "")
+			continue
+		}
+		if err != nil {
+			log.Printf("upload %v: %v", id, err.Error())
+			failure(id, http.StatusInternalServerError, CodeInternal, err.Error())
+			continue
+		}
+
+		nread, pos, err := cc.writeFrom(ctx, id, p, startPos(size), cc.fileBlockSize())
+		if nread != size {
+			log.Printf("upload %v: expected %v read %v writepos %v", id, size, nread, pos)
+		}
+		if code := timeoutCode(err); code != "" {
+			failure(id, http.StatusRequestTimeout, code, "")
+			continue
+		}
+		if err == storage.ErrInvalidHash {
+			log.Printf("upload %v: hash mismatch", id)
+			failure(id, http.StatusBadRequest, CodeHashMismatch, "")
+			continue
+		}
+		if err != nil {
+			log.Printf("upload %v: %v", id, err.Error())
+			failure(id, http.StatusInternalServerError, CodeInternal, err.Error())
+			continue
+		}
+
+		results = append(results, statusMessage("success", "created", mmap{"id": id, "status": http.StatusCreated}))
+	}
+
+	if len(results) == 0 {
+		return respondError(c, http.StatusBadRequest, CodeMissingFile)
+	}
+	if failed > 0 {
+		return c.JSON(http.StatusMultiStatus, results)
+	}
+
+	return c.JSON(http.StatusCreated, results)
+}
+
+var (
+	errInvalidRange  = errors.New("invalid range")
+	errMissingLength = errors.New("missing file length")
+	errInvalidHash   = errors.New("invalid hash")
+)
+
+// Parse Content-Range "bytes start-stop/length", where length can be "*" (unknown mid-stream):
+// then the file length flength is returned
+func parseContentRange(srange string, flength int64) (start, stop, length int64, err error) {
+	if strings.HasSuffix(srange, "/*") {
+		_, err = fmt.Sscanf(srange, "bytes %d-%d/*", &start, &stop)
+		return start, stop, flength, err
+	}
+
+	_, err = fmt.Sscanf(srange, "bytes %d-%d/%d", &start, &stop, &length)
+	return
+}
+
+// Return the first byte requested by Range "bytes=start-stop,...", for a file of the given length
+// (length if the header can't be parsed: http.ServeContent rejects it)
+func rangeStart(srange string, length int64) int64 {
+	if !strings.HasPrefix(srange, "bytes=") {
+		return length
+	}
+
+	first := length
+	for _, r := range strings.Split(srange[len("bytes="):], ",") {
+		var start int64
+		r = strings.TrimSpace(r)
+
+		if strings.HasPrefix(r, "-") { // suffix range: the last n bytes
+			n, err := strconv.ParseInt(r[1:], 10, 64)
+			if err != nil {
+				return length
+			}
+			if start = length - n; start < 0 {
+				start = 0
+			}
+		} else if i := strings.Index(r, "-"); i < 0 {
+			return length
+		} else if n, err := strconv.ParseInt(r[:i], 10, 64); err != nil || n < 0 {
+			return length
+		} else {
+			start = n
+		}
+
+		if start < first {
+			first = start
+		}
+	}
+
+	return first
+}
+
+// Create file id for a PUT to a missing file, with the length from Content-Range
+// ("bytes 0-N/L" or "bytes */L"), X-File-Length or Content-Length (if not compressed).
+// With "bytes 0-N/*" the length must be in X-File-Length.
+// A file written in any order (X-Ranges) can be created by a range at any position.
+// If the file was created concurrently, return it so that the upload can resume.
+func (cc *Cashier) createFromRange(c echo.Context, id string) (*storage.FileInfo, error) {
+	req := c.Request()
+	length := req.ContentLength
+
+	if req.Header.Get("X-File-Length") != "" {
+		fmt.Sscanf(req.Header.Get("X-File-Length"), "%d", &length)
+	} else if encodedBody(req) {
+		length = -1
+	}
+
+	if srange := req.Header.Get("Content-Range"); srange != "" {
+		if _, err := fmt.Sscanf(srange, "bytes */%d", &length); err != nil {
+			flength := int64(-1) // the body is not the whole file
+			if req.Header.Get("X-File-Length") != "" {
+				flength = length
+			}
+
+			var start int64
+			if start, _, length, err = parseContentRange(srange, flength); err != nil {
+				return nil, errInvalidRange
+			}
+			if start != 0 && !ranged(req.Header) {
+				return nil, storage.ErrNotFound
+			}
+		}
+	}
+	if length < 0 {
+		return nil, errMissingLength
+	}
+
+	hash, err := fileHash(req.Header)
+	if err != nil {
+		return nil, errInvalidHash
+	}
+
+	fname := fileName(req.Header, id)
+	ctype := cc.contentType(req.Header.Get("Content-Type"), fname)
+	err = cc.sdb.CreateFile(id, fname, ctype, length, hash, cc.fileOptions(req.Header, ctype)...)
+	if err != nil && err != storage.ErrExists {
+		return nil, err
+	}
+
+	log.Printf("upload %v: created", id)
+	return cc.sdb.Stat(id)
+}
+
+// Resume the upload of file id, or create it if missing (upsert)
+func (cc *Cashier) updateEntry(c echo.Context) error {
+	return cc.resumeUpload(c, c.Param("id"), true)
+}
+
+// Write the request body to file id at the position in Content-Range,
+// creating the file if missing and upsert is set
+func (cc *Cashier) resumeUpload(c echo.Context, id string, upsert bool) error {
+	srange := c.Request().Header.Get("Content-Range")
+	created := false
+
+	info, err := cc.sdb.Stat(id)
+	if err == storage.ErrNotFound && upsert {
+		info, err = cc.createFromRange(c, id)
+		created = err == nil && (info.Next == 0 || info.Length == 0)
+	}
+	switch err {
+	case nil:
+	case storage.ErrNotFound:
+		return respondError(c, http.StatusNotFound, CodeNotFound)
+	case errInvalidRange:
+		return respondError(c, http.StatusBadRequest, CodeInvalidRange)
+	case errMissingLength:
+		return respondError(c, http.StatusBadRequest, CodeMissingFileLength)
+	case errInvalidHash:
+		return respondError(c, http.StatusBadRequest, CodeInvalidHash)
+	case storage.ErrInfoTooBig:
+		return respondError(c, http.StatusRequestEntityTooLarge, CodeMetadataTooLarge)
+	default:
+		return serverError(c, err)
+	}
+	if info.Next == storage.FileComplete {
+		if created { // empty file
+			return c.JSON(http.StatusCreated, cc.uploadMessage(id, "created", storage.FileComplete))
+		}
+		return respondError(c, http.StatusConflict, CodeFileComplete)
+	}
+	if cc.maxUploadAge > 0 && time.Since(info.Created) > cc.maxUploadAge {
+		log.Printf("upload %v: stale, last write %v", id, info.Created)
+		if err := cc.sdb.DeleteFile(id); err != nil {
+			log.Printf("upload %v: %v", id, err.Error())
+		}
+		return respondError(c, http.StatusGone, CodeStaleUpload)
+	}
+
+	if created {
+		if strings.HasPrefix(srange, "bytes */") && c.Request().ContentLength == 0 {
+			return c.JSON(http.StatusCreated, cc.uploadMessage(id, "created", 0))
+		}
+		if srange == "" || strings.HasPrefix(srange, "bytes */") { // the body is the whole file
+			srange = fmt.Sprintf("bytes 0-%v/%v", info.Length-1, info.Length)
+		}
+	} else if info.Reserved && srange == "" { // claim a reservation with the whole file
+		srange = fmt.Sprintf("bytes 0-%v/%v", info.Length-1, info.Length)
+	}
+
+	if srange == "" {
+		c.Response().Header().Set("Range", nextRange(info))
+		return respondError(c, http.StatusBadRequest, CodeRangeExpected)
+	}
+
+	start, stop, length, err := parseContentRange(srange, info.Length)
+	if err != nil {
+		c.Response().Header().Set("Range", nextRange(info))
+		return respondError(c, http.StatusBadRequest, CodeInvalidRange)
+	}
+	if length != info.Length || !writableRange(info, start, stop) {
+		log.Printf("upload %v: range %v-%v/%v next %v/%v",
+			id, start, stop, length, info.Next, info.Length)
+		c.Response().Header().Set("Range", nextRange(info))
+		return respondError(c, http.StatusBadRequest, CodeInvalidRange)
+	}
+	if stop < length-1 && (stop-start+1)%info.BlockSize != 0 {
+		log.Printf("upload %v: range %v-%v/%v next %v/%v",
+			id, start, stop, length, info.Next, info.Length)
+		c.Response().Header().Set("Range", nextRange(info))
+		return respondError(c, http.StatusBadRequest, CodeInvalidRange)
+	}
+
+	log.Printf("upload %v: resume from %v", id, start)
+
+	cc.limitIdle(c)
+
+	reader, err := decodeBody(c.Request())
+	if err != nil {
+		return respondError(c, http.StatusUnsupportedMediaType, CodeUnsupportedEncoding)
+	}
+
+	size := stop - start + 1
+
+	ctx, cancel := cc.uploadContext(c)
+	defer cancel()
+
+	nread, pos, err := cc.writeFrom(ctx, id, reader, start, info.BlockSize)
+	if nread != size {
+		log.Printf("upload %v: expected %v read %v writepos %v", id, size, nread, pos)
+	}
+	if code := timeoutCode(err); code != "" {
+		return cc.uploadTimeout(c, id, code)
+	}
+	if err != nil {
+		log.Printf("upload %v: %v", id, err.Error())
+		return serverError(c, err)
+	}
+
+	subcode := "updated"
+	if created {
+		subcode = "created"
+	}
+	if info.Ranged && pos != storage.FileComplete {
+		return c.JSON(http.StatusCreated, cc.rangesMessage(id, subcode))
+	}
+
+	return c.JSON(http.StatusCreated, cc.uploadMessage(id, subcode, pos))
+}
+
+// Return the success message for a range written to a file written in any order,
+// with the ranges written so far ("start-stop", as in Content-Range) and the next gap (resume-offset)
+func (cc *Cashier) rangesMessage(id, subcode string) mmap {
+	info, err := cc.sdb.Stat(id)
+	if err != nil {
+		log.Printf("upload %v: %v", id, err.Error())
+		return statusMessage("success", subcode, nil)
+	}
+
+	ranges := []string{}
+	for _, r := range info.Written() {
+		ranges = append(ranges, fmt.Sprintf("%v-%v", r.Start, r.End-1))
+	}
+
+	return statusMessage("success", subcode, mmap{"ranges": ranges, "resume-offset": info.Next})
+}
+
+// Delete file id. With ?soft=1 only the blocks are deleted: the metadata is kept
+// until it expires, and downloads return 410
+func (cc *Cashier) deleteEntry(c echo.Context) error {
+	id := c.Param("id")
 
-		npos, err := cc.sdb.WriteAt(id, pos, buf[:n])
-		if err != nil {
-			log.Printf("upload %v: error writing - %v", id, err)
-			break
+	if c.QueryParam("soft") == "1" {
+		if err := cc.sdb.SoftDelete(id); err != nil {
+			if err == storage.ErrNotFound {
+				return respondError(c, http.StatusNotFound, CodeNotFound)
+			}
+			return serverError(c, err)
 		}
 
-		log.Printf("upload %v: wrote %v, next %v", id, n, npos)
-		nread += int64(n)
-		pos = npos
-	}
-	if nread != size {
-		log.Printf("upload %v: expected %v read %v writepos %v", id, size, nread, pos)
+		return c.JSON(http.StatusCreated, statusMessage("success", "soft-deleted", nil))
 	}
-	if err != nil {
-		log.Printf("upload %v: %v", id, err.Error())
-		return c.JSON(http.StatusInternalServerError, statusMessage("error", err.Error(), nil))
+
+	if err := cc.sdb.DeleteFile(id); err != nil {
+		return serverError(c, err)
 	}
 
-	return c.JSON(http.StatusCreated, statusMessage("success", "created", nil))
+	return c.JSON(http.StatusCreated, statusMessage("success", "deleted", nil))
 }
 
-func (cc *Cashier) updateEntry(c echo.Context) error {
+// Reserve file id for an upload (with X-File-Length and the same headers as the upload):
+// the placeholder expires after the reservation TTL, unless the upload starts before with a PUT
+func (cc *Cashier) reserveEntry(c echo.Context) error {
 	id := c.Param("id")
+	req := c.Request()
 
-	info, err := cc.sdb.Stat(id)
-	if err == storage.ErrNotFound {
-		return c.JSON(http.StatusNotFound, statusMessage("missing", "not-found", nil))
+	length := int64(-1)
+	if req.Header.Get("X-File-Length") != "" {
+		fmt.Sscanf(req.Header.Get("X-File-Length"), "%d", &length)
 	}
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, statusMessage("error", err.Error(), nil))
+	if length < 0 {
+		return respondError(c, http.StatusBadRequest, CodeMissingFileLength)
 	}
-	if info.Next == storage.FileComplete {
-		return c.JSON(http.StatusConflict, statusMessage("conflict", "complete", nil))
+
+	hash, err := fileHash(req.Header)
+	if err != nil {
+		return respondError(c, http.StatusBadRequest, CodeInvalidHash)
 	}
 
-	srange := c.Request().Header.Get("Content-Range")
-	if srange == "" {
-		c.Response().Header().Set("Range",
-			fmt.Sprintf("bytes=%v-%v/%v", info.Next, info.Length-1, info.Length))
-		return c.JSON(http.StatusBadRequest, statusMessage("missing", "range-expected", nil))
+	fname := fileName(req.Header, id)
+	ctype := cc.contentType(req.Header.Get("Content-Type"), fname)
+	opts := cc.fileOptions(req.Header, ctype)
+	if length > 0 { // empty files are complete on creation
+		opts = append(opts, storage.WithReservation(cc.reserveTTL))
 	}
 
-	var start, stop, length int64
-	if _, err := fmt.Sscanf(srange, "bytes %d-%d/%d", &start, &stop, &length); err != nil {
-		c.Response().Header().Set("Range",
-			fmt.Sprintf("bytes=%v-%v/%v", info.Next, info.Length-1, info.Length))
-		return c.JSON(http.StatusBadRequest, statusMessage("invalid", "invalid-range", nil))
+	err = cc.sdb.CreateFile(id, fname, ctype, length, hash, opts...)
+	if err == storage.ErrExists {
+		info, _ := cc.sdb.Stat(id)
+		return cc.fileExists(c, id, info)
 	}
-	if start != info.Next || length != info.Length {
-		log.Printf("upload %v: range %v-%v/%v next %v/%v",
-			id, start, stop, length, info.Next, info.Length)
-		c.Response().Header().Set("Range",
-			fmt.Sprintf("bytes=%v-%v/%v", info.Next, info.Length-1, info.Length))
-		return c.JSON(http.StatusBadRequest, statusMessage("invalid", "invalid-range", nil))
+	if err == storage.ErrInfoTooBig {
+		return respondError(c, http.StatusRequestEntityTooLarge, CodeMetadataTooLarge)
 	}
-	if stop < length-1 && (stop-start+1)%storage.BlockSize != 0 {
-		log.Printf("upload %v: range %v-%v/%v next %v/%v",
-			id, start, stop, length, info.Next, info.Length)
-		c.Response().Header().Set("Range",
-			fmt.Sprintf("bytes=%v-%v/%v", info.Next, info.Length-1, info.Length))
-		return c.JSON(http.StatusBadRequest, statusMessage("invalid", "invalid-range", nil))
+	if err != nil {
+		log.Printf("upload %v: %v", id, err.Error())
+		return serverError(c, err)
 	}
 
-	log.Printf("upload %v: resume from %v", id, start)
-
-	reader := c.Request().Body
-	size := c.Request().ContentLength
-
-	buf := make([]byte, storage.BlockSize)
-	pos := int64(0)
-	nread := int64(0)
-
-	for pos = start; pos != storage.FileComplete; {
-		var n int
-
-		n, err = io.ReadAtLeast(reader, buf, storage.BlockSize)
-		if err == io.EOF {
-			if n == 0 {
-				break
-			}
-		} else if err != nil {
-			log.Printf("upload %v: error reading %v", id, err)
-			break
-		}
+	log.Printf("upload %v: reserved", id)
+	return c.JSON(http.StatusCreated, statusMessage("success", "reserved",
+		mmap{"reserved-until": time.Now().Add(cc.reserveTTL).UTC()}))
+}
 
-		log.Printf("upload %v: read %v", id, n)
+// Add delta (default 1) to the counter file id, creating it if missing
+func (cc *Cashier) incrEntry(c echo.Context) error {
+	id := c.Param("id")
 
-		npos, err := cc.sdb.WriteAt(id, pos, buf[:n])
-		if err != nil {
-			log.Printf("upload %v: error writing %v", id, err)
-			break
+	delta := int64(1)
+	if d := c.QueryParam("delta"); d != "" {
+		var err error
+		if delta, err = strconv.ParseInt(d, 10, 64); err != nil {
+			return respondError(c, http.StatusBadRequest, CodeInvalidDelta)
 		}
-
-		log.Printf("upload %v: wrote %v, next %v", id, n, npos)
-		nread += int64(n)
-		pos = npos
 	}
-	if nread != size {
-		log.Printf("upload %v: expected %v read %v writepos %v", id, size, nread, pos)
+
+	value, err := cc.sdb.IncrFile(id, delta)
+	if err == storage.ErrInvalidSize {
+		return respondError(c, http.StatusConflict, CodeNotCounter)
 	}
 	if err != nil {
-		log.Printf("upload %v: %v", id, err.Error())
-		return c.JSON(http.StatusInternalServerError, statusMessage("error", err.Error(), nil))
+		return serverError(c, err)
 	}
 
-	return c.JSON(http.StatusCreated, statusMessage("success", "updated", nil))
+	return c.JSON(http.StatusOK, statusMessage("success", "incremented", mmap{"value": value}))
 }
 
-func (cc *Cashier) deleteEntry(c echo.Context) error {
+// List the previous versions of the file id, oldest first
+func (cc *Cashier) getVersions(c echo.Context) error {
 	id := c.Param("id")
-	if err := cc.sdb.DeleteFile(id); err != nil {
-		return c.JSON(http.StatusInternalServerError, statusMessage("error", err.Error(), nil))
+
+	versions, err := storage.ListVersions(cc.sdb, id)
+	if err != nil {
+		return serverError(c, err)
+	}
+	if len(versions) == 0 {
+		if _, err := cc.sdb.Stat(id); err == storage.ErrNotFound {
+			return respondError(c, http.StatusNotFound, CodeNotFound)
+		}
 	}
 
-	return c.JSON(http.StatusCreated, statusMessage("success", "deleted", nil))
+	return c.JSON(http.StatusOK, versions)
 }
 
 func (cc *Cashier) getMetadata(c echo.Context) error {
 	id := c.Param("id")
 	info, err := cc.sdb.Stat(id)
 	if err == storage.ErrNotFound {
-		return c.JSON(http.StatusNotFound, statusMessage("missing", "not-found", nil))
+		return respondError(c, http.StatusNotFound, CodeNotFound)
 	}
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, statusMessage("error", err.Error(), nil))
+		return serverError(c, err)
 	}
 
 	return c.JSON(http.StatusOK, info)
 }
 
+// An io.ReadSeeker for a stored file, for http.ServeContent.
+// For multi-range requests ServeContent seeks to the start of each range
+// and reads the range length, so reads must not go past the end of the file.
+// Reads from the first available byte (base) go through a sequential reader of the file,
+// that is kept open while the reads follow each other; other reads use ReadAt.
 type ReadSeeker struct {
 	sdb    storage.StorageDB
 	key    string
 	pos    int64
+	base   int64
 	length int64
+
+	stream    io.ReadCloser
+	streamPos int64
+}
+
+// Return the sequential reader if it is at the current position, opening it at base
+func (rs *ReadSeeker) reader() io.Reader {
+	if rs.stream != nil && rs.streamPos != rs.pos {
+		rs.stream.Close()
+		rs.stream = nil
+	}
+
+	if rs.stream == nil && rs.pos == rs.base {
+		r, stat, err := rs.sdb.OpenReader(rs.key)
+		if err != nil {
+			return nil // ReadAt returns the error
+		}
+		if stat.Base != rs.base { // trimmed since
+			r.Close()
+			return nil
+		}
+
+		rs.stream, rs.streamPos = r, rs.base
+	}
+
+	return rs.stream
 }
 
 func (rs *ReadSeeker) Read(p []byte) (int, error) {
-	n, err := rs.sdb.ReadAt(rs.key, p, rs.pos)
+	if rs.pos >= rs.length {
+		return 0, io.EOF
+	}
+	if rest := rs.length - rs.pos; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+
+	var n int64
+	var err error
+
+	if stream := rs.reader(); stream != nil {
+		var nn int
+		nn, err = stream.Read(p)
+		n = int64(nn)
+		rs.streamPos += n
+	} else {
+		n, err = rs.sdb.ReadAt(rs.key, p, rs.pos)
+	}
+
 	rs.pos += n
 
-	if err != nil {
+	if merr, ok := err.(storage.ErrMissingBlock); ok {
+		log.Println("Read", rs.key, rs.pos, "missing block", merr.Block)
+	} else if err != nil && err != io.EOF {
 		log.Println("Read", rs.key, rs.pos, err)
 	}
 
 	return int(n), err
 }
 
+// Close the sequential reader, if open
+func (rs *ReadSeeker) Close() error {
+	if rs.stream == nil {
+		return nil
+	}
+
+	err := rs.stream.Close()
+	rs.stream = nil
+	return err
+}
+
 var errWhence = errors.New("Seek: invalid whence")
 var errOffset = errors.New("Seek: invalid offset")
 
@@ -319,72 +1128,572 @@ func (rs *ReadSeeker) Seek(offset int64, whence int) (int64, error) {
 	return offset, nil
 }
 
+// Digest names for the file hash algorithms that hash the whole content:
+// the RFC 3230 Digest algorithm, and the Subresource Integrity prefix.
+// The cumulative and merkle hashes combine the hashes of each write or block,
+// so they don't match a digest computed by clients and are not listed.
+var digestAlgorithms = map[string]struct{ digest, sri string }{
+	storage.HashSHA256: {"SHA-256", "sha256"},
+}
+
+// Set the Digest and X-SRI headers for a complete file, if the hash algorithm is a content digest
+func setDigest(h http.Header, info *storage.FileInfo) {
+	alg, ok := digestAlgorithms[info.HashAlg]
+	if !ok || info.Hash == "" || info.Base > 0 {
+		return
+	}
+
+	hash, err := storage.ParseHash(info.Hash)
+	if err != nil {
+		return
+	}
+
+	value := base64.StdEncoding.EncodeToString(hash)
+	h.Set("Digest", alg.digest+"="+value)
+	if alg.sri != "" {
+		h.Set("X-SRI", alg.sri+"-"+value)
+	}
+}
+
+// Respond to a download of a missing file (never uploaded, deleted or expired: backends don't keep
+// expired files around to tell them apart) with the configured redirect or page, or the JSON error
+func (cc *Cashier) notFound(c echo.Context) error {
+	if cc.notFoundRedirect != "" {
+		return c.Redirect(http.StatusFound, cc.notFoundRedirect)
+	}
+	if cc.notFoundPage != nil {
+		return c.Blob(http.StatusNotFound, cc.notFoundType, cc.notFoundPage)
+	}
+
+	return respondError(c, http.StatusNotFound, CodeNotFound)
+}
+
+// Download the file id, or its previous version ?version=n
 func (cc *Cashier) getEntry(c echo.Context) error {
 	id := c.Param("id")
+	if v := c.QueryParam("version"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return respondError(c, http.StatusBadRequest, CodeInvalidVersion)
+		}
+
+		id = storage.VersionKey(id, n)
+	}
+
 	info, err := cc.sdb.Stat(id)
 	if err == storage.ErrNotFound {
-		return c.JSON(http.StatusNotFound, statusMessage("missing", "not-found", nil))
+		return cc.notFound(c)
 	}
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, statusMessage("error", err.Error(), nil))
+		return serverError(c, err)
+	}
+	if info.Deleted() {
+		return respondError(c, http.StatusGone, CodeFileDeleted)
 	}
 
 	if info.ContentType != "" {
 		c.Response().Header().Set("Content-Type", info.ContentType)
 	}
 	if info.Next != storage.FileComplete {
-		c.Response().Header().Set("Range",
-			fmt.Sprintf("bytes=%v-%v/%v", info.Next, info.Length-1, info.Length))
-		return c.JSON(http.StatusForbidden, statusMessage("not-ready", "incomplete", nil))
+		c.Response().Header().Set("Range", nextRange(info))
+		return respondError(c, http.StatusForbidden, CodeIncomplete)
+	}
+
+	// Serve the precompressed variant <id>.gz, if stored, to clients accepting gzip.
+	// Ranges are always served from the identity file, so that the offsets are in the original content.
+	name := info.Name
+	if !strings.HasSuffix(id, ".gz") {
+		c.Response().Header().Add("Vary", "Accept-Encoding")
+
+		if acceptsGzip(c.Request()) && c.Request().Header.Get("Range") == "" {
+			if gz, err := cc.sdb.Stat(id + ".gz"); err == nil && gz.Next == storage.FileComplete && !gz.Deleted() {
+				c.Response().Header().Set("Content-Encoding", "gzip")
+				id, info = id+".gz", gz
+			}
+		}
 	}
 	if info.Hash != "" {
 		c.Response().Header().Set("ETag", fmt.Sprintf("%q", info.Hash))
 	}
+	setDigest(c.Response().Header(), info)
+
+	// A trimmed file starts at Base: it's served as a partial response from Base,
+	// and ranges starting before Base can't be satisfied (nor any, once all blocks expired)
+	if info.Base > 0 {
+		if srange := c.Request().Header.Get("Range"); srange == "" && info.Base < info.Length {
+			c.Request().Header.Set("Range", fmt.Sprintf("bytes=%v-", info.Base))
+		} else if srange == "" || rangeStart(srange, info.Length) < info.Base {
+			c.Response().Header().Set("Content-Range", fmt.Sprintf("bytes */%v", info.Length))
+			return respondError(c, http.StatusRequestedRangeNotSatisfiable, CodeTrimmed)
+		}
+	}
+
+	if c.Request().Method != http.MethodHead && info.Length > info.Base {
+		// check that the data is there before sending any response
+		if _, err := cc.sdb.ReadAt(id, make([]byte, 1), info.Base); err != nil {
+			if merr, ok := err.(storage.ErrMissingBlock); ok {
+				log.Printf("download %v: missing block %v", id, merr.Block)
+				return sendError(c, http.StatusBadGateway, CodeMissingBlock, "", mmap{"block": merr.Block})
+			}
+			if err == storage.ErrTrimmed { // more blocks expired since Stat
+				c.Response().Header().Set("Content-Range", fmt.Sprintf("bytes */%v", info.Length))
+			}
+
+			return serverError(c, err)
+		}
+	}
+
+	if cc.sliding != nil && c.Request().Method == http.MethodGet {
+		cc.sliding.touch(cc.sdb, id)
+	}
+
+	if cc.audit != nil && c.Request().Method != http.MethodHead {
+		cc.audit.Record(storage.AuditEvent{Time: time.Now(), Op: storage.AuditRead, Key: id, Bytes: info.Length - info.Base})
+	}
+
+	content := &ReadSeeker{sdb: cc.sdb, key: id, pos: 0, base: info.Base, length: info.Length}
+	defer content.Close()
+
+	// The hash of a complete download can be sent as a trailer (the hash doesn't cover trimmed files or ranges)
+	if c.Request().Method == http.MethodGet && wantTrailer(c.Request()) && info.Base == 0 && c.Request().Header.Get("Range") == "" {
+		c.Response().Header().Set("Trailer", "X-Content-Hash")
+
+		hr := &hashingReader{ReadSeeker: content, hash: storage.NewFileHasher(info.HashAlg, info.BlockSize), alg: info.HashAlg}
+		http.ServeContent(trailerWriter{c.Response()}, c.Request(), name, info.Created, hr)
+
+		if hr.Complete(info.Length) {
+			c.Response().Header().Set("X-Content-Hash", hr.Sum())
+		}
+		return nil
+	}
 
-	http.ServeContent(c.Response(), c.Request(), info.Name, info.Created, &ReadSeeker{sdb: cc.sdb, key: id, pos: 0, length: info.Length})
+	// ServeContent also answers a HEAD with Range with 206 and Content-Range,
+	// that download managers use to probe for range support
+	http.ServeContent(c.Response(), c.Request(), name, info.Created, content)
 	return nil
 }
 
+// HEAD with ?exists=1 only checks that the file exists, complete or not, without reading its metadata;
+// with ?exists=complete it also checks that the file is complete (403 if not).
+// Otherwise HEAD returns the same headers as GET.
+func (cc *Cashier) headEntry(c echo.Context) error {
+	id := c.Param("id")
+
+	switch c.QueryParam("exists") {
+	case "":
+		return cc.getEntry(c)
+
+	case "complete":
+		info, err := cc.sdb.Stat(id)
+		if err == storage.ErrNotFound {
+			return respondError(c, http.StatusNotFound, CodeNotFound)
+		}
+		if err != nil {
+			return serverError(c, err)
+		}
+		if info.Deleted() {
+			return respondError(c, http.StatusGone, CodeFileDeleted)
+		}
+		if info.Next != storage.FileComplete {
+			return respondError(c, http.StatusForbidden, CodeIncomplete)
+		}
+
+	default:
+		exists, err := cc.sdb.Exists(id)
+		if err != nil {
+			return serverError(c, err)
+		}
+		if !exists {
+			return respondError(c, http.StatusNotFound, CodeNotFound)
+		}
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+func (cc *Cashier) getPhysical(c echo.Context) error {
+	id := c.Param("id")
+	info, err := cc.sdb.StatPhysical(id)
+	if err == storage.ErrNotFound {
+		return respondError(c, http.StatusNotFound, CodeNotFound)
+	}
+	if err != nil {
+		return serverError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, info)
+}
+
+func (cc *Cashier) getDebugInfo(c echo.Context) error {
+	id := c.Param("id")
+	info, err := cc.sdb.DebugInfo(id)
+	if err == storage.ErrNotFound {
+		return respondError(c, http.StatusNotFound, CodeNotFound)
+	}
+	if err != nil {
+		return serverError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, info)
+}
+
+func (cc *Cashier) getOptions(c echo.Context) error {
+	if cc.readonly {
+		c.Response().Header().Set("Allow", "GET, HEAD, OPTIONS")
+	} else {
+		c.Response().Header().Set("Allow", "GET, HEAD, POST, PUT, DELETE, OPTIONS")
+	}
+
+	c.Response().Header().Set("Accept-Ranges", "bytes")
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Add GET / responding rootResponse (unless empty), and GET /routes listing all routes if exposeRoutes
+func addServerRoutes(e *echo.Echo, rootResponse string, exposeRoutes bool) {
+	if rootResponse != "" {
+		e.GET("/", func(c echo.Context) error {
+			return c.String(http.StatusOK, rootResponse)
+		}).Name = "Ping"
+	}
+
+	if exposeRoutes {
+		e.GET("/routes", func(c echo.Context) error {
+			return c.JSON(http.StatusOK, e.Routes())
+		}).Name = "Routes"
+	}
+}
+
+// Add the routes to download files and list them.
+// Keys can contain slashes, escaped as %2F in the key parameter (see unescapeParams);
+// an index prefix can also use plain slashes (see escapeIndexPath).
+func addDownloadRoutes(e *echo.Echo, cc *Cashier) {
+	e.OPTIONS("/x/:id", cc.getOptions).Name = "Options"
+	e.GET("/x/:id", cc.getEntry, countIn(inFlightDownloads)).Name = "Get"
+	e.HEAD("/x/:id", cc.headEntry).Name = "Head"
+	e.GET("/x/:id/meta", cc.getMetadata).Name = "Get Metadata"
+	e.GET("/x/:id/versions", cc.getVersions).Name = "Get Versions"
+	e.GET("/x/:id/lines", cc.getLines).Name = "Get Lines"
+	if cc.receiptKey != nil {
+		e.GET("/x/:id/receipt", cc.getReceipt).Name = "Get Receipt"
+	}
+	e.GET("/x/:prefix/", cc.getIndex).Name = "Get Index"
+}
+
+// Pre-routing middleware escaping the slashes of an index prefix (i.e. /x/proj/img/ as /x/proj%2Fimg/),
+// so that it routes to /x/:prefix/. A catch-all /x/* route would do, but echo's router
+// panics on some paths (i.e. /x/a/m) when it's mixed with the /x/:id/... routes.
+func escapeIndexPath(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		u := c.Request().URL
+		if prefix := strings.TrimPrefix(u.Path, "/x/"); prefix != u.Path && strings.HasSuffix(prefix, "/") && strings.Count(prefix, "/") > 1 {
+			u.RawPath = "/x/" + url.PathEscape(strings.TrimSuffix(prefix, "/")) + "/"
+		}
+
+		return next(c)
+	}
+}
+
+// Middleware unescaping the route parameters: echo routes on the escaped path if it has escapes
+// that matter (i.e. %2F in a key), and then the parameters are escaped too
+func unescapeParams(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if c.Request().URL.RawPath != "" {
+			values := c.ParamValues()
+			for i, v := range values {
+				if u, err := url.PathUnescape(v); err == nil {
+					values[i] = u
+				}
+			}
+
+			c.SetParamValues(values...)
+		}
+
+		return next(c)
+	}
+}
+
 func main() {
-	path := flag.String("path", "storage.data", "path to data folder")
+	path := flag.String("path", "storage.data", "path to data folder (or badger:path, aws:bucket/prefix)")
 	ttl := flag.Duration("ttl", 10*time.Minute, "time to live")
+	ttlFromCreation := flag.Bool("ttl-from-creation", false, "files expire a TTL after creation, instead of after the last write")
 	debug := flag.Bool("debug", false, "debug logging")
-	//gc := flag.Bool("gc", false, "run value-log gc")
+	redactKeys := flag.String("redact-keys", "", "regular expression of sensitive text (e.g. keys with emails) to redact in the logs")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "time to wait for requests in flight on shutdown")
+	readonly := flag.Bool("readonly", false, "open storage read-only and disable uploads and deletes")
+	cors := flag.Bool("cors", false, "enable CORS")
+	admin := flag.Bool("admin", false, "enable admin endpoints")
+	exposeRoutes := flag.Bool("expose-routes", false, "enable GET /routes, listing all routes")
+	errFormat := flag.String("error-format", ErrorFormatJSON, "format of error responses: json or problem (RFC 7807 application/problem+json)")
+	rootResponse := flag.String("root-response", "OK", "response for GET / (empty for 404)")
+	notFoundRedirect := flag.String("notfound-redirect", "", "URL to redirect downloads of missing files to (e.g. an \"expired link\" page)")
+	notFoundPage := flag.String("notfound-page", "", "file to send as the body of 404 responses to downloads of missing files")
+	pipelined := flag.Bool("pipeline", false, "read ahead the upload body while writing to storage (uses more memory)")
+	hashAlg := flag.String("hash", storage.HashCumulative, "hash algorithm for new files (cumulative, merkle, sha256)")
+	minFreeSpace := flag.Int64("min-free-space", 0, "bytes to keep free on the data volume, rejecting uploads that don't fit with 507 (badger, 0 to disable)")
+	inlineSize := flag.Int64("inline-size", 0, "store files up to this size in the metadata record, instead of separate blocks (max the block size, 0 to disable)")
+	blockSize := flag.Int64("block-size", storage.BlockSize, "block size of new files (a power of two, 1K to 64M): uploads are written a block at a time")
+	maxWriteSize := flag.Int64("max-write-size", 0, "max bytes written to the storage in a single call (a multiple of the block size, 0 for no limit)")
+	maxInfoSize := flag.Int("max-metadata-size", 0, "max size of the file metadata record (0 for the backend limit)")
+	defaultType := flag.String("default-content-type", "application/octet-stream", "content type for uploads without a type")
+	strictTTL := flag.Bool("strict-ttl", false, "files past their expiration time are not found, even if still stored")
+	uploadDeadline := flag.Duration("upload-deadline", 0, "max duration of an upload request; the file can be resumed after (0 for no limit)")
+	idleTimeout := flag.Duration("idle-timeout", 0, "max time without upload data, failing the upload with 408; the file can be resumed after (0 for no limit)")
+	reserveTTL := flag.Duration("reserve-ttl", time.Minute, "time to start the upload of a file reserved with POST /x/:id/reserve")
+	sessionTTL := flag.Duration("session-ttl", time.Hour, "time an upload session (POST /uploads) is kept without writes, until committed")
+	maxVersions := flag.Int("max-versions", 0, "previous versions to keep when a file is overwritten (X-Overwrite), as <id>@<n> (0 to disable)")
+	slidingInterval := flag.Duration("sliding-ttl", 0, "refresh the TTL of files when downloaded, at most once per this interval for each file (0 to disable)")
+	maxUploadAge := flag.Duration("max-upload-age", 0, "max time since the last write to resume an incomplete upload (0 for no limit)")
+	readConsistency := flag.String("read-consistency", storage.ReadStrong, "consistency of metadata reads for downloads and listings: strong or eventual (aws)")
+	eventualStat := flag.Bool("eventual-stat", false, "use cheaper, eventually consistent metadata reads for lookups (aws)")
+	breakerFailures := flag.Int("breaker-failures", 0, "consecutive storage failures before failing fast (0 to disable)")
+	breakerCooldown := flag.Duration("breaker-cooldown", 10*time.Second, "time to fail fast before retrying the storage")
+	replica := flag.String("replica", "", "also write all changes to this storage (same format as -path)")
+	strictReplica := flag.Bool("strict-replica", false, "fail writes if the replica fails (default: log replica failures)")
+	fallback := flag.String("fallback", "", "read files missing from -path from this storage (e.g. cold storage)")
+	origin := flag.String("origin", "", "URL to import files missing from the storage from on first access, with {key} replaced by the file key")
+	negativeTTL := flag.Duration("negative-cache", 0, "how long to remember lookups of missing files (0 to disable)")
+	statTTL := flag.Duration("stat-cache", 0, "how long to cache the metadata of complete files; changes by other servers on the same backend show up after this (0 to disable)")
+	scrubInterval := flag.Duration("scrub-interval", 0, "interval between store scrubs (0 to disable)")
+	scrubRate := flag.Int("scrub-rate", 10, "max number of files verified per second while scrubbing")
+	scrubState := flag.String("scrub-state", "scrub.state", "file used to checkpoint scrub progress")
+	gcInterval := flag.Duration("gc-interval", 0, "interval between storage GC runs, rejecting writes while running (0 to disable)")
+	gcMinSize := flag.Int64("gc-min-size", 0, "skip GC runs while the storage data (badger value log) is smaller than this, in bytes (0 to always run)")
+	receiptKey := flag.String("receipt-key", "", "HMAC-SHA256 key to sign upload receipts (empty to disable receipts)")
+	maxConcurrent := flag.Int("max-concurrent", 0, "uploads and downloads in flight the server is sized for, to report the saturation in /metrics/load (0 to omit it)")
+	maxConnsPerIP := flag.Int("max-conns-per-ip", 0, "max requests in flight from a client IP, rejecting more with 429 (0 for no limit)")
+	auditLog := flag.String("audit-log", "", "file to append an audit trail of file operations to, as JSON lines")
+	retryAfter := flag.Duration("retry-after", 30*time.Second, "Retry-After for writes rejected during maintenance")
+
+	var rules ttlRules
+	flag.Var(&rules, "ttl-rule", "TTL for a content type, as type/subtype=duration (e.g. image/*=1h); can be repeated, first match wins")
+
+	quotas := quotaLimits{}
+	flag.Var(quotas, "quota", "max bytes for a namespace (the key prefix before the first /), as namespace=bytes; can be repeated")
+	defaultQuota := flag.Int64("default-quota", 0, "max bytes for namespaces without a -quota (0 for no limit)")
 
 	flag.Parse()
 
-	sdb, err := storage.OpenBadger(*path, false, *ttl)
+	switch *errFormat {
+	case ErrorFormatJSON, ErrorFormatProblem:
+		errorFormat = *errFormat
+	default:
+		log.Fatal("invalid -error-format: ", *errFormat)
+	}
+
+	var accessLog io.Writer = os.Stdout
+	if *redactKeys != "" {
+		re, err := regexp.Compile(*redactKeys)
+		if err != nil {
+			log.Fatal("invalid -redact-keys: ", err)
+		}
+
+		accessLog = newRedactWriter(re, os.Stdout)
+		log.SetOutput(newRedactWriter(re, os.Stderr))
+	}
+
+	sdb, err := storage.Open(*path, *readonly, *ttl,
+		storage.WithMaxInfoSize(*maxInfoSize),
+		storage.WithHash(*hashAlg),
+		storage.WithEventualStat(*eventualStat),
+		storage.WithReadConsistency(*readConsistency),
+		storage.WithTTLFromCreation(*ttlFromCreation),
+		storage.WithMinFreeSpace(*minFreeSpace),
+		storage.WithInlineSize(*inlineSize),
+		storage.WithMaxWriteSize(*maxWriteSize),
+		storage.WithBlockSize(*blockSize))
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	defer sdb.Close()
 
+	store := sdb // the backend, without decorators
+
+	if sizer, ok := store.(storage.Sizer); ok {
+		expvar.Publish("storage_size", expvar.Func(func() interface{} {
+			index, data := sizer.Size()
+			return mmap{"index": index, "data": data}
+		}))
+	}
+
+	if *replica != "" {
+		rdb, err := storage.Open(*replica, *readonly, *ttl,
+			storage.WithMaxInfoSize(*maxInfoSize),
+			storage.WithHash(*hashAlg),
+			storage.WithInlineSize(*inlineSize),
+			storage.WithMaxWriteSize(*maxWriteSize),
+			storage.WithBlockSize(*blockSize))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if *strictReplica {
+			sdb = storage.StrictMultiWriter(sdb, rdb)
+		} else {
+			sdb = storage.MultiWriter(sdb, rdb)
+		}
+
+		defer rdb.Close()
+	}
+
+	if *fallback != "" {
+		fdb, err := storage.Open(*fallback, true, *ttl,
+			storage.WithReadConsistency(*readConsistency))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		sdb = storage.FailoverReader(sdb, fdb)
+
+		defer fdb.Close()
+	}
+
+	if *origin != "" {
+		sdb = storage.WithOrigin(sdb, func(key string) string {
+			return strings.Replace(*origin, "{key}", key, -1)
+		})
+	}
+
+	var breaker *storage.CircuitBreaker
+	if *breakerFailures > 0 {
+		breaker = storage.NewCircuitBreaker(sdb, *breakerFailures, *breakerCooldown)
+		expvar.Publish("breaker", expvar.Func(func() interface{} {
+			state, trips := breaker.State()
+			return mmap{"state": state, "trips": trips}
+		}))
+
+		sdb = breaker
+	}
+
+	if *strictTTL {
+		sdb = storage.StrictTTL(sdb)
+	}
+
+	if len(quotas) > 0 || *defaultQuota > 0 {
+		sdb, err = storage.Quota(sdb, quotas, *defaultQuota)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *negativeTTL > 0 {
+		sdb = storage.NegativeCache(sdb, *negativeTTL)
+	}
+
+	if *statTTL > 0 {
+		sdb = storage.StatCache(sdb, *statTTL)
+	}
+
+	if *maxVersions > 0 {
+		sdb = storage.Versioned(sdb)
+	}
+
+	var audit *storage.AuditLog
+	if *auditLog != "" {
+		audit, err = storage.OpenAuditLog(*auditLog, 1000)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		defer audit.Close()
+		sdb = storage.Audit(sdb, audit)
+	}
+
 	// Echo instance
 	e := echo.New()
 	e.Debug = *debug
-	cashier := &Cashier{sdb: sdb}
+	e.HTTPErrorHandler = httpErrorHandler
+	e.Server.ConnContext = withConn // for the idle timeout
+	backend, _ := storage.ParseDSN(*path)
+	cashier := &Cashier{sdb: sdb, readonly: *readonly, defaultType: *defaultType,
+		backend: backend, hashAlg: *hashAlg, pipelined: *pipelined,
+		maxUploadAge: *maxUploadAge, uploadDeadline: *uploadDeadline, idleTimeout: *idleTimeout, reserveTTL: *reserveTTL, sessionTTL: *sessionTTL, blockSize: *blockSize, ttlRules: rules, maxVersions: *maxVersions, audit: audit,
+		breaker: breaker, maxConcurrent: *maxConcurrent}
+
+	if *slidingInterval > 0 {
+		cashier.sliding = newSlidingTTL(*slidingInterval)
+	}
+
+	if *receiptKey != "" {
+		cashier.receiptKey = []byte(*receiptKey)
+	}
+
+	cashier.notFoundRedirect = *notFoundRedirect
+	if *notFoundPage != "" {
+		cashier.notFoundPage, err = ioutil.ReadFile(*notFoundPage)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		cashier.notFoundType = mime.TypeByExtension(filepath.Ext(*notFoundPage))
+		if cashier.notFoundType == "" {
+			cashier.notFoundType = http.DetectContentType(cashier.notFoundPage)
+		}
+	}
+
+	maint := NewMaintenance(*retryAfter)
+	maint.HandleSignals()
+
+	if *scrubInterval > 0 {
+		cashier.scrubber = NewScrubber(sdb, *scrubState, *scrubRate)
+		go cashier.scrubber.Run(*scrubInterval, maint)
+	}
+
+	if *gcInterval > 0 {
+		go maint.RunGC(store, *gcInterval, *gcMinSize)
+	}
 
 	// Middleware
+	e.Pre(escapeIndexPath)
+	e.Use(unescapeParams)
 	e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
-		Format: "time=${time_rfc3339} method=${method}, uri=${uri}, status=${status} in:${bytes_in} out:${bytes_out} elapsed:${latency_human}\n"}))
+		Format: "time=${time_rfc3339} method=${method}, uri=${uri}, status=${status} in:${bytes_in} out:${bytes_out} elapsed:${latency_human}\n",
+		Output: accessLog}))
 	e.Use(middleware.Recover())
+	e.Use(countRequests)
+	if *maxConnsPerIP > 0 {
+		e.Use(newConnLimiter(*maxConnsPerIP).Limit)
+	}
+
+	if *cors {
+		e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
+			AllowOrigins:  []string{"*"},
+			AllowHeaders:  []string{"Content-Type", "Content-Range", "Content-Disposition", "X-File-Length", "X-File-Hash", "X-Immutable", "X-Overwrite", "X-Ranges"},
+			ExposeHeaders: []string{"Range", "ETag", "Accept-Ranges", "Content-Range", "Retry-Until", "Digest", "X-SRI", "X-Content-Hash", "Location"},
+		}))
+	}
 
 	// Routes
-	e.GET("/", func(c echo.Context) error {
-		return c.String(http.StatusOK, "OK")
-	}).Name = "Ping"
+	addServerRoutes(e, *rootResponse, *exposeRoutes)
+
+	e.GET("/metrics", echo.WrapHandler(expvar.Handler())).Name = "Metrics"
+	e.GET("/metrics/load", cashier.getLoad).Name = "Load"
+	e.GET("/version", cashier.getVersion).Name = "Version"
+
+	if *admin {
+		e.GET("/admin/scrub", cashier.getScrub).Name = "Scrub Status"
+		e.GET("/x/:id/physical", cashier.getPhysical).Name = "Get Physical Info"
+		e.GET("/admin/x/:id/debug", cashier.getDebugInfo).Name = "Get Debug Info"
+		if audit != nil {
+			e.GET("/admin/audit", func(c echo.Context) error {
+				return c.JSON(http.StatusOK, audit.Recent())
+			}).Name = "Audit"
+		}
+	}
 
-	e.GET("/routes", func(c echo.Context) error {
-		return c.JSON(http.StatusOK, e.Routes())
-	}).Name = "Routes"
+	if !*readonly {
+		e.POST("/x", cashier.createEntries, maint.RejectWrites, countIn(inFlightUploads)).Name = "Create Multiple"
+		e.POST("/x/:id", cashier.createEntry, maint.RejectWrites, countIn(inFlightUploads)).Name = "Create"
+		e.PUT("/x/:id", cashier.updateEntry, maint.RejectWrites, countIn(inFlightUploads)).Name = "Update"
+		e.DELETE("/x/:id", cashier.deleteEntry, maint.RejectWrites).Name = "Delete"
+		e.POST("/x/:id/incr", cashier.incrEntry, maint.RejectWrites).Name = "Increment"
+		e.POST("/x/:id/reserve", cashier.reserveEntry, maint.RejectWrites).Name = "Reserve"
+		e.POST("/uploads", cashier.createSession, maint.RejectWrites).Name = "Create Session"
+		e.PATCH("/uploads/:session", cashier.updateSession, maint.RejectWrites, countIn(inFlightUploads)).Name = "Update Session"
+		e.POST("/uploads/:session/commit", cashier.commitSession, maint.RejectWrites).Name = "Commit Session"
+	}
 
-	e.POST("/x/:id", cashier.createEntry).Name = "Create"
-	e.PUT("/x/:id", cashier.updateEntry).Name = "Update"
-	e.DELETE("/x/:id", cashier.deleteEntry).Name = "Delete"
-	e.GET("/x/:id", cashier.getEntry).Name = "Get"
-	e.HEAD("/x/:id", cashier.getEntry).Name = "Head"
-	e.GET("/x/:id/meta", cashier.getMetadata).Name = "Get Metadata"
+	addDownloadRoutes(e, cashier)
 
 	go func() {
 		// Start server
@@ -393,15 +1702,17 @@ func main() {
 		}
 	}()
 
-	quit := make(chan os.Signal)
+	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt)
 
 	<-quit
-	log.Println("Shutting down...")
+	log.Println("Shutting down...", inFlight.Value(), "requests in flight")
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
 	defer cancel()
 	if err := e.Shutdown(ctx); err != nil {
-		e.Logger.Fatal(err)
+		log.Println("Shutdown:", err, "-", inFlight.Value(), "requests still in flight")
+	} else {
+		log.Println("Shutdown complete")
 	}
 }
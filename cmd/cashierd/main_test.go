@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/raff/cashier/storage"
+)
+
+// Return a Cashier on a new badger store, removed at the end of the test
+func newTestCashier(t *testing.T, opts ...storage.Option) *Cashier {
+	dir, err := ioutil.TempDir("", "cashierd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sdb, err := storage.OpenBadger(dir, false, time.Hour, opts...)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		sdb.Close()
+		os.RemoveAll(dir)
+	})
+
+	return &Cashier{sdb: sdb, defaultType: "application/octet-stream", backend: "badger",
+		hashAlg: storage.HashCumulative, blockSize: storage.BlockSize}
+}
+
+// Call handler for a request to path, with the route parameter id, and return the response
+func serveTest(t *testing.T, handler echo.HandlerFunc, req *http.Request, id string) *httptest.ResponseRecorder {
+	return serveParamTest(t, handler, req, "id", id)
+}
+
+// Call handler for a request to path, with the route parameter name set to value, and return the response
+func serveParamTest(t *testing.T, handler echo.HandlerFunc, req *http.Request, name, value string) *httptest.ResponseRecorder {
+	e := echo.New()
+	e.HTTPErrorHandler = httpErrorHandler
+
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames(name)
+	c.SetParamValues(value)
+
+	if err := handler(c); err != nil {
+		e.HTTPErrorHandler(err, c)
+	}
+
+	return rec
+}
+
+// Store a complete file with content data
+func putTestFile(t *testing.T, sdb storage.StorageDB, key string, data []byte) {
+	hash, _, err := storage.GetHash(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sdb.CreateFile(key, key, "application/octet-stream", int64(len(data)), hash); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.WriteAll(sdb, key, 0, data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Return size bytes of test data
+func testData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	return data
+}
+
+func TestOptions(t *testing.T) {
+	cc := newTestCashier(t)
+
+	for _, tc := range []struct {
+		readonly bool
+		allow    string
+	}{
+		{false, "GET, HEAD, POST, PUT, DELETE, OPTIONS"},
+		{true, "GET, HEAD, OPTIONS"},
+	} {
+		cc.readonly = tc.readonly
+
+		rec := serveTest(t, cc.getOptions, httptest.NewRequest(http.MethodOptions, "/x/f", nil), "f")
+		if rec.Code != http.StatusNoContent || rec.Header().Get("Allow") != tc.allow {
+			t.Errorf("readonly %v: %v, Allow %q", tc.readonly, rec.Code, rec.Header().Get("Allow"))
+		}
+		if rec.Header().Get("Accept-Ranges") != "bytes" {
+			t.Errorf("readonly %v: Accept-Ranges %q", tc.readonly, rec.Header().Get("Accept-Ranges"))
+		}
+	}
+}
+
+// Read the whole file key
+func readTestFile(t *testing.T, sdb storage.StorageDB, key string) []byte {
+	stat, err := sdb.Stat(key)
+	if err != nil {
+		t.Fatalf("%v: %v", key, err)
+	}
+	if stat.Next != storage.FileComplete {
+		t.Fatalf("%v: incomplete at %v", key, stat.Next)
+	}
+
+	buf := make([]byte, stat.Length)
+	if n, err := sdb.ReadAt(key, buf, 0); n != stat.Length {
+		t.Fatalf("%v: read %v: %v", key, n, err)
+	}
+
+	return buf
+}
+
+func TestServerRoutes(t *testing.T) {
+	for _, tc := range []struct {
+		root   string
+		routes bool
+	}{
+		{"OK", true},
+		{"", false},
+	} {
+		e := echo.New()
+		addServerRoutes(e, tc.root, tc.routes)
+
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/routes", nil))
+		if tc.routes && (rec.Code != http.StatusOK || !bytes.Contains(rec.Body.Bytes(), []byte(`"/routes"`))) {
+			t.Errorf("routes enabled: %v %v", rec.Code, rec.Body)
+		} else if !tc.routes && rec.Code != http.StatusNotFound {
+			t.Errorf("routes disabled: %v, expected 404", rec.Code)
+		}
+
+		rec = httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		if tc.root != "" && (rec.Code != http.StatusOK || rec.Body.String() != tc.root) {
+			t.Errorf("root %q: %v %q", tc.root, rec.Code, rec.Body)
+		} else if tc.root == "" && rec.Code != http.StatusNotFound {
+			t.Errorf("root disabled: %v, expected 404", rec.Code)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/raff/cashier/storage"
+)
+
+// Maintenance tracks background work (GC, compaction) that slows down writes.
+// While active, write requests are rejected with 503 and a Retry-After header.
+// Background work can be paused (SIGUSR1) and resumed (SIGUSR2).
+type Maintenance struct {
+	active     int32
+	paused     int32
+	retryAfter time.Duration
+}
+
+func NewMaintenance(retryAfter time.Duration) *Maintenance {
+	return &Maintenance{retryAfter: retryAfter}
+}
+
+func (m *Maintenance) Begin() {
+	atomic.StoreInt32(&m.active, 1)
+}
+
+func (m *Maintenance) End() {
+	atomic.StoreInt32(&m.active, 0)
+}
+
+func (m *Maintenance) Active() bool {
+	return atomic.LoadInt32(&m.active) != 0
+}
+
+// Pause background work: no new GC or scrub runs start, and a scrub in progress waits
+func (m *Maintenance) Pause() {
+	if atomic.SwapInt32(&m.paused, 1) == 0 {
+		log.Println("maintenance: paused")
+	}
+}
+
+// Resume background work
+func (m *Maintenance) Resume() {
+	if atomic.SwapInt32(&m.paused, 0) != 0 {
+		log.Println("maintenance: resumed")
+	}
+}
+
+func (m *Maintenance) Paused() bool {
+	return atomic.LoadInt32(&m.paused) != 0
+}
+
+// Pause background work on SIGUSR1 and resume it on SIGUSR2
+func (m *Maintenance) HandleSignals() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	go func() {
+		for s := range sig {
+			if s == syscall.SIGUSR1 {
+				m.Pause()
+			} else {
+				m.Resume()
+			}
+		}
+	}()
+}
+
+// Middleware rejecting requests while maintenance is active
+func (m *Maintenance) RejectWrites(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if m.Active() {
+			c.Response().Header().Set("Retry-After", fmt.Sprint(int(m.retryAfter.Seconds())))
+			return respondError(c, http.StatusServiceUnavailable, CodeMaintenance)
+		}
+
+		return next(c)
+	}
+}
+
+// Run the storage garbage collector every interval, in maintenance mode.
+// Backends with an expiration index remove expired files first.
+// Runs are skipped while paused, or while the storage data is smaller than minSize
+// (if the backend reports its size).
+func (m *Maintenance) RunGC(sdb storage.StorageDB, interval time.Duration, minSize int64) {
+	for {
+		time.Sleep(interval)
+
+		if m.Paused() {
+			log.Println("GC: paused, skipped")
+			continue
+		}
+
+		if !needsGC(sdb, minSize) {
+			continue
+		}
+
+		m.Begin()
+		start := time.Now()
+		if sw, ok := sdb.(storage.Sweeper); ok {
+			n, err := sw.SweepExpired(start)
+			if err != nil {
+				log.Println("GC: sweep:", err)
+			}
+			log.Println("GC: removed", n, "expired files")
+		}
+		if err := sdb.GC(); err != nil {
+			log.Println("GC:", err)
+		}
+		m.End()
+
+		log.Println("GC: completed in", time.Since(start))
+	}
+}
+
+// Return false if the backend reports a data size below minSize
+func needsGC(sdb storage.StorageDB, minSize int64) bool {
+	sizer, ok := sdb.(storage.Sizer)
+	if minSize <= 0 || !ok {
+		return true
+	}
+
+	_, data := sizer.Size()
+	return data >= minSize
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/raff/cashier/storage"
+)
+
+// During maintenance writes get a 503 with Retry-After, reads are served
+func TestMaintenanceRejectWrites(t *testing.T) {
+	cc := newTestCashier(t)
+	putTestFile(t, cc.sdb, "f", testData(100))
+
+	m := NewMaintenance(30 * time.Second)
+	create := m.RejectWrites(cc.createEntry)
+
+	m.Begin()
+
+	rec := serveTest(t, create, httptest.NewRequest(http.MethodPost, "/x/g", bytes.NewReader(testData(10))), "g")
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "30" {
+		t.Errorf("POST in maintenance: %v, Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	rec = serveTest(t, cc.getEntry, httptest.NewRequest(http.MethodGet, "/x/f", nil), "f")
+	if rec.Code != http.StatusOK || rec.Body.Len() != 100 {
+		t.Errorf("GET in maintenance: %v", rec.Code)
+	}
+
+	m.End()
+
+	rec = serveTest(t, create, httptest.NewRequest(http.MethodPost, "/x/g", bytes.NewReader(testData(10))), "g")
+	if rec.Code != http.StatusCreated {
+		t.Errorf("POST after maintenance: %v %v", rec.Code, rec.Body)
+	}
+}
+
+// A store counting the GC runs
+type gcCounter struct {
+	storage.StorageDB
+	runs int32
+}
+
+func (s *gcCounter) GC() error {
+	atomic.AddInt32(&s.runs, 1)
+	return nil
+}
+
+// GC runs are skipped while paused
+func TestMaintenancePause(t *testing.T) {
+	sdb := &gcCounter{}
+
+	m := NewMaintenance(time.Second)
+	m.Pause()
+	go m.RunGC(sdb, 10*time.Millisecond, 0)
+
+	time.Sleep(50 * time.Millisecond)
+	if runs := atomic.LoadInt32(&sdb.runs); runs != 0 {
+		t.Fatalf("%v GC runs while paused", runs)
+	}
+
+	m.Resume()
+	for i := 0; i < 100 && atomic.LoadInt32(&sdb.runs) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if atomic.LoadInt32(&sdb.runs) == 0 {
+		t.Errorf("no GC runs after resume")
+	}
+
+	m.Pause()
+	time.Sleep(20 * time.Millisecond) // let a run in progress complete
+	runs := atomic.LoadInt32(&sdb.runs)
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&sdb.runs); n != runs {
+		t.Errorf("%v GC runs after pausing again", n-runs)
+	}
+}
+
+// A store reporting its size, and counting the GC runs
+type sizedStore struct {
+	gcCounter
+	index, data int64
+}
+
+func (s *sizedStore) Size() (int64, int64) {
+	return s.index, atomic.LoadInt64(&s.data)
+}
+
+// With a size threshold GC only runs once the data grows past it
+func TestNeedsGC(t *testing.T) {
+	for _, tc := range []struct {
+		sdb     storage.StorageDB
+		minSize int64
+		gc      bool
+	}{
+		{&sizedStore{index: 1 << 30, data: 10 << 20}, 64 << 20, false}, // only the data size counts
+		{&sizedStore{data: 64 << 20}, 64 << 20, true},
+		{&sizedStore{data: 100 << 20}, 64 << 20, true},
+		{&sizedStore{}, 0, true},       // no threshold
+		{&gcCounter{}, 64 << 20, true}, // size not known
+	} {
+		if gc := needsGC(tc.sdb, tc.minSize); gc != tc.gc {
+			t.Errorf("needsGC(%+v, %v): %v, expected %v", tc.sdb, tc.minSize, gc, tc.gc)
+		}
+	}
+
+	sdb := &sizedStore{data: 10}
+	go NewMaintenance(time.Second).RunGC(sdb, 10*time.Millisecond, 100)
+
+	time.Sleep(50 * time.Millisecond)
+	if runs := atomic.LoadInt32(&sdb.runs); runs != 0 {
+		t.Fatalf("%v GC runs below the threshold", runs)
+	}
+
+	atomic.StoreInt64(&sdb.data, 200)
+	for i := 0; i < 100 && atomic.LoadInt32(&sdb.runs) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if atomic.LoadInt32(&sdb.runs) == 0 {
+		t.Errorf("no GC runs above the threshold")
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+
+	"github.com/raff/cashier/storage"
+)
+
+// Number of blocks read ahead by writeFromPipelined
+const pipelineDepth = 3
+
+// A block read from the upload body
+type chunk struct {
+	buf []byte
+	n   int
+	err error
+}
+
+// Same as writeFrom, but reads the next blocks while the previous one is being written,
+// so that a slow backend and a slow client don't add up.
+// Blocks are still written in order.
+func (cc *Cashier) writeFromPipelined(ctx context.Context, id string, reader io.Reader, pos, blockSize int64) (int64, int64, error) {
+	free := make(chan []byte, pipelineDepth)
+	for i := 0; i < pipelineDepth; i++ {
+		free <- make([]byte, blockSize)
+	}
+
+	chunks := make(chan chunk, pipelineDepth)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(chunks)
+
+		for {
+			var buf []byte
+
+			select {
+			case buf = <-free:
+			case <-done:
+				return
+			}
+
+			n, err := io.ReadAtLeast(reader, buf, len(buf))
+
+			select {
+			case chunks <- chunk{buf: buf, n: n, err: err}:
+			case <-done:
+				return
+			}
+
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	defer func() {
+		// stop the reader and wait for it, since it's not safe to read the body after the handler returns
+		close(done)
+		for range chunks {
+		}
+	}()
+
+	var nread int64
+
+	for ch := range chunks {
+		if err := ctx.Err(); err != nil {
+			log.Printf("upload %v: %v", id, err)
+			return nread, pos, err
+		}
+		if ch.err == io.EOF {
+			break
+		}
+		if ch.err != nil && ch.err != io.ErrUnexpectedEOF { // ErrUnexpectedEOF is a short last block
+			log.Printf("upload %v: error reading - %v", id, ch.err)
+			return nread, pos, ch.err
+		}
+
+		log.Printf("upload %v: read %v", id, ch.n)
+
+		npos, err := cc.sdb.WriteAt(id, pos, ch.buf[:ch.n])
+		if err != nil {
+			log.Printf("upload %v: error writing - %v", id, err)
+			return nread, pos, err
+		}
+
+		log.Printf("upload %v: wrote %v, next %v", id, ch.n, npos)
+		nread += int64(ch.n)
+		pos = npos
+
+		free <- ch.buf
+
+		if pos == storage.FileComplete || ch.err == io.ErrUnexpectedEOF {
+			break
+		}
+	}
+
+	return nread, pos, nil
+}
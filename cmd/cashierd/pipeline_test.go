@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/raff/cashier/storage"
+)
+
+// A reader counting the bytes read
+type countReader struct {
+	io.Reader
+	n int
+}
+
+func (r *countReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += n
+	return n, err
+}
+
+// An upload with the client hash reads the body once, to store and verify it
+func TestUploadSinglePass(t *testing.T) {
+	data := testData(5*storage.BlockSize + 10)
+	hash, _, _ := storage.GetHash(bytes.NewReader(data))
+	badHash, _, _ := storage.GetHash(bytes.NewReader(data[1:]))
+
+	for _, pipelined := range []bool{false, true} {
+		cc := newTestCashier(t)
+		cc.pipelined = pipelined
+
+		for key, h := range map[string][]byte{"good": hash, "bad": badHash} {
+			body := &countReader{Reader: bytes.NewReader(data)}
+			req := httptest.NewRequest(http.MethodPost, "/x/"+key, body)
+			req.Header.Set("X-File-Hash", hex.EncodeToString(h))
+			req.ContentLength = int64(len(data))
+
+			rec := serveTest(t, cc.createEntry, req, key)
+			if body.n != len(data) {
+				t.Errorf("pipelined %v, %v: read %v bytes, expected %v", pipelined, key, body.n, len(data))
+			}
+
+			switch key {
+			case "good":
+				if rec.Code != http.StatusCreated || !bytes.Equal(readTestFile(t, cc.sdb, key), data) {
+					t.Errorf("pipelined %v, %v: %v %v", pipelined, key, rec.Code, rec.Body)
+				}
+			case "bad":
+				if rec.Code != http.StatusBadRequest {
+					t.Errorf("pipelined %v, %v: %v %v, expected 400", pipelined, key, rec.Code, rec.Body)
+				}
+				if stat, err := cc.sdb.Stat(key); err == nil && stat.Next == storage.FileComplete {
+					t.Errorf("pipelined %v, %v: stored as complete", pipelined, key)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/raff/cashier/storage"
+)
+
+// Return a PUT request to /x/id with the body and the Content-Range (if not empty)
+func putRequest(id string, body []byte, srange string) *http.Request {
+	req := httptest.NewRequest(http.MethodPut, "/x/"+id, bytes.NewReader(body))
+	if srange != "" {
+		req.Header.Set("Content-Range", srange)
+	}
+
+	return req
+}
+
+// PUT creates a missing file, resumes an incomplete one, and conflicts with a complete one
+func TestPutUpsert(t *testing.T) {
+	cc := newTestCashier(t)
+
+	data := testData(2*storage.BlockSize + 10)
+	length := len(data)
+
+	// create with the whole body, from Content-Length
+	if rec := serveTest(t, cc.updateEntry, putRequest("whole", data, ""), "whole"); rec.Code != http.StatusCreated {
+		t.Fatalf("create: %v %v", rec.Code, rec.Body)
+	}
+	if !bytes.Equal(readTestFile(t, cc.sdb, "whole"), data) {
+		t.Errorf("created file content differs")
+	}
+
+	// create an empty file with the total length, then resume it
+	rec := serveTest(t, cc.updateEntry, putRequest("f", nil, fmt.Sprintf("bytes */%v", length)), "f")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create with */%v: %v %v", length, rec.Code, rec.Body)
+	}
+	if stat, _ := cc.sdb.Stat("f"); stat == nil || stat.Length != int64(length) || stat.Next != 0 {
+		t.Fatalf("created file: %+v", stat)
+	}
+
+	for _, r := range [][2]int{{0, storage.BlockSize}, {storage.BlockSize, length}} {
+		srange := fmt.Sprintf("bytes %v-%v/%v", r[0], r[1]-1, length)
+		if rec := serveTest(t, cc.updateEntry, putRequest("f", data[r[0]:r[1]], srange), "f"); rec.Code != http.StatusCreated {
+			t.Fatalf("resume %v: %v %v", srange, rec.Code, rec.Body)
+		}
+	}
+	if !bytes.Equal(readTestFile(t, cc.sdb, "f"), data) {
+		t.Errorf("resumed file content differs")
+	}
+
+	// a range not starting at 0 doesn't create the file
+	rec = serveTest(t, cc.updateEntry, putRequest("g", data[10:], fmt.Sprintf("bytes 10-%v/%v", length-1, length)), "g")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("create from 10: %v, expected 404", rec.Code)
+	}
+
+	// the file is complete
+	rec = serveTest(t, cc.updateEntry, putRequest("f", data, fmt.Sprintf("bytes 0-%v/%v", length-1, length)), "f")
+	if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), CodeFileComplete) {
+		t.Errorf("PUT complete file: %v %v, expected 409", rec.Code, rec.Body)
+	}
+}
+
+// Uploads can be resumed with an unknown total ("bytes start-stop/*"), checking only the start and block alignment
+func TestPutUnknownTotal(t *testing.T) {
+	cc := newTestCashier(t)
+
+	data := testData(3*storage.BlockSize + 10)
+	length := len(data)
+
+	put := func(start, end int, total string, headers ...string) *httptest.ResponseRecorder {
+		req := putRequest("f", data[start:end], fmt.Sprintf("bytes %v-%v/%v", start, end-1, total))
+		for i := 0; i < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+
+		return serveTest(t, cc.updateEntry, req, "f")
+	}
+
+	// without a file length a "/*" range can't create the file
+	if rec := put(0, storage.BlockSize, "*"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("create with /* and no length: %v %v", rec.Code, rec.Body)
+	}
+
+	if rec := put(0, storage.BlockSize, "*", "X-File-Length", fmt.Sprint(length)); rec.Code != http.StatusCreated {
+		t.Fatalf("create with /*: %v %v", rec.Code, rec.Body)
+	}
+	if stat, _ := cc.sdb.Stat("f"); stat == nil || stat.Length != int64(length) || stat.Next != int64(storage.BlockSize) {
+		t.Fatalf("created file: %+v", stat)
+	}
+
+	for _, tc := range []struct {
+		name       string
+		start, end int
+	}{
+		{"not at the next position", 2 * storage.BlockSize, 3 * storage.BlockSize},
+		{"not block aligned", storage.BlockSize, storage.BlockSize + 100},
+	} {
+		rec := put(tc.start, tc.end, "*")
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), CodeInvalidRange) {
+			t.Errorf("%v: %v %v", tc.name, rec.Code, rec.Body)
+		}
+		if srange := rec.Header().Get("Range"); srange != fmt.Sprintf("bytes=%v-%v/%v", storage.BlockSize, length-1, length) {
+			t.Errorf("%v: Range %q", tc.name, srange)
+		}
+	}
+
+	if rec := put(storage.BlockSize, 3*storage.BlockSize, "*"); rec.Code != http.StatusCreated {
+		t.Fatalf("resume with /*: %v %v", rec.Code, rec.Body)
+	}
+	if rec := put(3*storage.BlockSize, length, "*"); rec.Code != http.StatusCreated || !strings.Contains(rec.Body.String(), "hash") {
+		t.Fatalf("last chunk with /*: %v %v", rec.Code, rec.Body)
+	}
+	if !bytes.Equal(readTestFile(t, cc.sdb, "f"), data) {
+		t.Errorf("resumed file content differs")
+	}
+}
+
+// A file created with X-Ranges is written with a PUT for each range, in any order,
+// and completes when all the ranges are written
+func TestPutRanges(t *testing.T) {
+	cc := newTestCashier(t)
+
+	data := testData(4*storage.BlockSize + 10)
+	length := len(data)
+	half := 2 * storage.BlockSize
+	hash, _, _ := storage.GetHashAlg(bytes.NewReader(data), storage.HashMerkle)
+
+	put := func(start, end int) *httptest.ResponseRecorder {
+		req := putRequest("f", data[start:end], fmt.Sprintf("bytes %v-%v/%v", start, end-1, length))
+		req.Header.Set("X-Ranges", "1")
+		req.Header.Set("X-File-Hash", fmt.Sprintf("%x", hash))
+
+		return serveTest(t, cc.updateEntry, req, "f")
+	}
+
+	// the second half creates the file
+	rec := put(half, length)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("second half: %v %v", rec.Code, rec.Body)
+	}
+	if expected := fmt.Sprintf(`"ranges":["%v-%v"]`, half, length-1); !strings.Contains(rec.Body.String(), expected) || !strings.Contains(rec.Body.String(), `"resume-offset":0`) {
+		t.Errorf("second half: %v, expected %v", rec.Body, expected)
+	}
+
+	for _, tc := range []struct {
+		name       string
+		start, end int
+	}{
+		{"overlapping", half, half + storage.BlockSize},
+		{"not block aligned", 100, storage.BlockSize},
+	} {
+		rec := put(tc.start, tc.end)
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), CodeInvalidRange) {
+			t.Errorf("%v: %v %v", tc.name, rec.Code, rec.Body)
+		}
+		if srange := rec.Header().Get("Range"); srange != fmt.Sprintf("bytes=0-%v/%v", half-1, length) {
+			t.Errorf("%v: Range %q, expected the gap", tc.name, srange)
+		}
+	}
+
+	rec = put(storage.BlockSize, half)
+	if expected := fmt.Sprintf(`"ranges":["%v-%v"]`, storage.BlockSize, length-1); rec.Code != http.StatusCreated || !strings.Contains(rec.Body.String(), expected) {
+		t.Fatalf("second block: %v %v, expected %v", rec.Code, rec.Body, expected)
+	}
+
+	if rec := put(0, storage.BlockSize); rec.Code != http.StatusCreated || !strings.Contains(rec.Body.String(), fmt.Sprintf("%x", hash)) {
+		t.Fatalf("first block: %v %v", rec.Code, rec.Body)
+	}
+	if !bytes.Equal(readTestFile(t, cc.sdb, "f"), data) {
+		t.Errorf("file content differs")
+	}
+}
+
+// A reserved file is kept if the upload starts within the reservation TTL, and expires otherwise
+func TestReserve(t *testing.T) {
+	cc := newTestCashier(t)
+	cc.reserveTTL = time.Second
+
+	data := testData(2*storage.BlockSize + 10)
+
+	reserve := func(id string) {
+		req := httptest.NewRequest(http.MethodPost, "/x/"+id+"/reserve", nil)
+		req.Header.Set("X-File-Length", fmt.Sprint(len(data)))
+
+		if rec := serveTest(t, cc.reserveEntry, req, id); rec.Code != http.StatusCreated || !strings.Contains(rec.Body.String(), "reserved-until") {
+			t.Fatalf("reserve %v: %v %v", id, rec.Code, rec.Body)
+		}
+		if stat, _ := cc.sdb.Stat(id); stat == nil || !stat.Reserved || stat.Next != 0 || stat.Length != int64(len(data)) {
+			t.Fatalf("reserved %v: %+v", id, stat)
+		}
+	}
+
+	reserve("claimed")
+	reserve("abandoned")
+
+	if rec := serveTest(t, cc.updateEntry, putRequest("claimed", data, ""), "claimed"); rec.Code != http.StatusCreated {
+		t.Fatalf("claim: %v %v", rec.Code, rec.Body)
+	}
+	if stat, _ := cc.sdb.Stat("claimed"); stat == nil || stat.Reserved || time.Until(stat.ExpiresAt) < 30*time.Minute {
+		t.Fatalf("claimed file: %+v, expected the file TTL", stat)
+	}
+
+	time.Sleep(2100 * time.Millisecond) // badger expiration times are in seconds
+
+	if !bytes.Equal(readTestFile(t, cc.sdb, "claimed"), data) {
+		t.Errorf("claimed file content differs")
+	}
+	if _, err := cc.sdb.Stat("abandoned"); err != storage.ErrNotFound {
+		t.Errorf("abandoned reservation: %v, expected ErrNotFound", err)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Max bytes per namespace (the key prefix before the first "/").
+// Implements flag.Value, so that -quota can be repeated.
+type quotaLimits map[string]int64
+
+func (q quotaLimits) String() string {
+	var limits []string
+
+	for ns, limit := range q {
+		limits = append(limits, fmt.Sprintf("%v=%v", ns, limit))
+	}
+
+	return strings.Join(limits, ",")
+}
+
+// Add a limit in the form "namespace=bytes"
+func (q quotaLimits) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid quota %q, expected namespace=bytes", value)
+	}
+
+	limit, err := strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 64)
+	if err != nil || limit <= 0 {
+		return fmt.Errorf("invalid quota size %q", parts[1])
+	}
+
+	q[strings.TrimSpace(parts[0])] = limit
+	return nil
+}
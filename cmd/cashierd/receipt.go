@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/raff/cashier/storage"
+)
+
+// An upload receipt, signed with HMAC-SHA256 so that the uploader can later prove
+// what the server stored
+type Receipt struct {
+	ID          string    `json:"id"`
+	Length      int64     `json:"length"`
+	Hash        string    `json:"hash"`
+	Algorithm   string    `json:"algorithm"`
+	CompletedAt time.Time `json:"completed_at"`
+}
+
+// Return the receipt for a complete file
+func newReceipt(info *storage.FileInfo) *Receipt {
+	alg := info.HashAlg
+	if alg == "" {
+		alg = storage.HashCumulative
+	}
+
+	return &Receipt{ID: info.Key, Length: info.Length, Hash: info.Hash,
+		Algorithm: alg, CompletedAt: info.Created.UTC()}
+}
+
+// Return the hex encoded signature of the receipt JSON
+func (r *Receipt) Sign(key []byte) string {
+	data, _ := json.Marshal(r)
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Return true if signature is valid for the receipt
+func (r *Receipt) Verify(key []byte, signature string) bool {
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+
+	expected, _ := hex.DecodeString(r.Sign(key))
+	return hmac.Equal(sig, expected)
+}
+
+// Return the receipt and signature, as added to the response for a complete upload
+func (cc *Cashier) signedReceipt(info *storage.FileInfo) mmap {
+	r := newReceipt(info)
+	return mmap{"receipt": r, "signature": r.Sign(cc.receiptKey)}
+}
+
+func (cc *Cashier) getReceipt(c echo.Context) error {
+	id := c.Param("id")
+	info, err := cc.sdb.Stat(id)
+	if err == storage.ErrNotFound {
+		return respondError(c, http.StatusNotFound, CodeNotFound)
+	}
+	if err != nil {
+		return serverError(c, err)
+	}
+
+	if info.Next != storage.FileComplete {
+		return respondError(c, http.StatusForbidden, CodeIncomplete)
+	}
+
+	return c.JSON(http.StatusOK, cc.signedReceipt(info))
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// A signed receipt, as returned in responses
+type signedReceipt struct {
+	Receipt   *Receipt
+	Signature string
+}
+
+// The receipt of an upload, and the one from GET /x/:id/receipt, verify with the configured key only
+func TestReceipt(t *testing.T) {
+	cc := newTestCashier(t)
+	cc.receiptKey = []byte("secret")
+
+	rec := uploadTest(t, cc, "f", testData(1000), nil)
+
+	var upload signedReceipt
+	if err := json.Unmarshal(rec.Body.Bytes(), &upload); err != nil || upload.Receipt == nil {
+		t.Fatalf("upload: %v %v %q", rec.Code, err, rec.Body)
+	}
+
+	rec = serveTest(t, cc.getReceipt, httptest.NewRequest(http.MethodGet, "/x/f/receipt", nil), "f")
+
+	var get signedReceipt
+	if err := json.Unmarshal(rec.Body.Bytes(), &get); err != nil || get.Receipt == nil {
+		t.Fatalf("get receipt: %v %v %q", rec.Code, err, rec.Body)
+	}
+
+	stat, _ := cc.sdb.Stat("f")
+
+	for name, r := range map[string]signedReceipt{"upload": upload, "get": get} {
+		if r.Receipt.ID != "f" || r.Receipt.Length != 1000 || r.Receipt.Hash != stat.Hash {
+			t.Errorf("%v: receipt %+v", name, r.Receipt)
+		}
+		if !r.Receipt.Verify([]byte("secret"), r.Signature) {
+			t.Errorf("%v: signature doesn't verify", name)
+		}
+		if r.Receipt.Verify([]byte("wrong"), r.Signature) {
+			t.Errorf("%v: signature verifies with the wrong key", name)
+		}
+
+		r.Receipt.Length++
+		if r.Receipt.Verify([]byte("secret"), r.Signature) {
+			t.Errorf("%v: signature verifies a changed receipt", name)
+		}
+	}
+}
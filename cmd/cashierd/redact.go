@@ -0,0 +1,38 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"regexp"
+)
+
+// A log writer replacing the parts of each line matching a pattern (e.g. keys with user emails)
+// with their first 6 characters and a short hash, so that requests for the same key can still
+// be correlated
+type redactWriter struct {
+	re *regexp.Regexp
+	w  io.Writer
+}
+
+func newRedactWriter(re *regexp.Regexp, w io.Writer) io.Writer {
+	return &redactWriter{re: re, w: w}
+}
+
+// Return the redacted version of s
+func redact(s []byte) []byte {
+	sum := sha256.Sum256(s)
+	if len(s) > 6 {
+		s = s[:6]
+	}
+
+	return append(append(append([]byte{}, s...), '~'), hex.EncodeToString(sum[:4])...)
+}
+
+func (r *redactWriter) Write(p []byte) (int, error) {
+	if _, err := r.w.Write(r.re.ReplaceAllFunc(p, redact)); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo"
+	"github.com/labstack/echo/middleware"
+)
+
+// Keys matching -redact-keys are replaced in the access log and in the handlers' log lines
+func TestRedactKeys(t *testing.T) {
+	re := regexp.MustCompile(`[^/?\s]+@[^/?\s,]+`)
+	key := "alice@example.com"
+	redacted := string(redact([]byte(key)))
+
+	if !strings.HasPrefix(redacted, "alice@~") || len(redacted) != len("alice@~")+8 {
+		t.Fatalf("unexpected redacted key %q", redacted)
+	}
+	if other := string(redact([]byte("alice@example.org"))); other == redacted {
+		t.Errorf("different keys redacted to the same %q", other)
+	}
+
+	var accessLog bytes.Buffer
+
+	e := echo.New()
+	e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
+		Format: "method=${method}, uri=${uri}, status=${status}\n",
+		Output: newRedactWriter(re, &accessLog)}))
+	e.GET("/x/:id", func(c echo.Context) error {
+		return c.NoContent(http.StatusNotFound)
+	})
+
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/x/"+key+"?ttl=1h", nil))
+
+	line := accessLog.String()
+	if strings.Contains(line, key) || !strings.Contains(line, "uri=/x/"+redacted+"?ttl=1h,") {
+		t.Errorf("access log line %q, expected the key redacted as %q", line, redacted)
+	}
+
+	var handlerLog bytes.Buffer
+
+	logger := log.New(newRedactWriter(re, &handlerLog), "", 0)
+	logger.Printf("file %v not found", key)
+
+	if line := handlerLog.String(); line != "file "+redacted+" not found\n" {
+		t.Errorf("log line %q, expected the key redacted as %q", line, redacted)
+	}
+}
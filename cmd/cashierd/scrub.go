@@ -0,0 +1,153 @@
+package main
+
+import (
+	"expvar"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/raff/cashier/storage"
+)
+
+var scrubMetrics = expvar.NewMap("scrub")
+
+// The result of a scrub pass
+type ScrubResult struct {
+	Started   time.Time         `json:"started"`
+	Completed time.Time         `json:"completed,omitempty"`
+	Resumed   string            `json:"resumed,omitempty"` // key the pass resumed after
+	Files     int               `json:"files"`
+	Failed    map[string]string `json:"failed,omitempty"` // key -> error
+}
+
+// The scrubber periodically verifies the hash of all complete files
+type Scrubber struct {
+	sdb        storage.StorageDB
+	checkpoint string        // file storing the last verified key
+	delay      time.Duration // delay between files
+	maint      *Maintenance  // a pass in progress waits while paused
+
+	sync.Mutex
+	last    *ScrubResult
+	current *ScrubResult
+}
+
+func NewScrubber(sdb storage.StorageDB, checkpoint string, rate int) *Scrubber {
+	var delay time.Duration
+	if rate > 0 {
+		delay = time.Second / time.Duration(rate)
+	}
+
+	return &Scrubber{sdb: sdb, checkpoint: checkpoint, delay: delay}
+}
+
+// Run a scrub pass every interval, skipping passes while m is paused
+func (s *Scrubber) Run(interval time.Duration, m *Maintenance) {
+	s.maint = m
+
+	for {
+		if m.Paused() {
+			log.Println("scrub: paused, skipped")
+		} else {
+			s.Scrub()
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// Run one scrub pass, resuming from the last checkpoint if any
+func (s *Scrubber) Scrub() *ScrubResult {
+	result := &ScrubResult{Started: time.Now(), Failed: map[string]string{}}
+
+	s.Lock()
+	s.current = result
+	s.Unlock()
+
+	if s.checkpoint != "" {
+		if data, err := ioutil.ReadFile(s.checkpoint); err == nil {
+			result.Resumed = strings.TrimSpace(string(data))
+		}
+	}
+
+	files, err := s.sdb.ListFiles("")
+	if err != nil {
+		log.Println("scrub:", err)
+		scrubMetrics.Add("errors", 1)
+		return result
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].Key < files[j].Key })
+
+	for _, f := range files {
+		if f.Next != storage.FileComplete || f.Key <= result.Resumed {
+			continue
+		}
+
+		err := storage.Verify(s.sdb, f.Key)
+		if err == storage.ErrNotFound || err == storage.ErrTrimmed {
+			err = nil // deleted while scrubbing, or cannot be verified
+		}
+
+		s.Lock()
+		result.Files++
+		if err != nil {
+			result.Failed[f.Key] = err.Error()
+		}
+		s.Unlock()
+
+		scrubMetrics.Add("files", 1)
+
+		if err == storage.ErrInvalidHash {
+			log.Printf("scrub %v: hash mismatch", f.Key)
+			scrubMetrics.Add("mismatches", 1)
+		} else if err != nil {
+			log.Printf("scrub %v: %v", f.Key, err)
+			scrubMetrics.Add("errors", 1)
+		}
+
+		if s.checkpoint != "" {
+			if err := ioutil.WriteFile(s.checkpoint, []byte(f.Key), 0666); err != nil {
+				log.Println("scrub checkpoint:", err)
+			}
+		}
+
+		time.Sleep(s.delay)
+
+		for s.maint != nil && s.maint.Paused() {
+			time.Sleep(time.Second)
+		}
+	}
+
+	if s.checkpoint != "" {
+		os.Remove(s.checkpoint)
+	}
+
+	s.Lock()
+	result.Completed = time.Now()
+	s.last, s.current = result, nil
+	s.Unlock()
+
+	log.Printf("scrub: verified %v files, %v failed", result.Files, len(result.Failed))
+	scrubMetrics.Add("passes", 1)
+	return result
+}
+
+func (cc *Cashier) getScrub(c echo.Context) error {
+	if cc.scrubber == nil {
+		return respondError(c, http.StatusNotFound, CodeScrubDisabled)
+	}
+
+	s := cc.scrubber
+
+	s.Lock()
+	defer s.Unlock()
+
+	return c.JSON(http.StatusOK, mmap{"last": s.last, "current": s.current})
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/raff/cashier/storage"
+)
+
+// A store returning corrupted content for one file
+type corruptStore struct {
+	storage.StorageDB
+	key string
+}
+
+func (s corruptStore) ReadAt(key string, buf []byte, pos int64) (int64, error) {
+	n, err := s.StorageDB.ReadAt(key, buf, pos)
+	if key == s.key && n > 0 {
+		buf[0] ^= 0xff
+	}
+
+	return n, err
+}
+
+func TestScrubCorrupted(t *testing.T) {
+	cc := newTestCashier(t)
+	for _, key := range []string{"a", "b", "c"} {
+		putTestFile(t, cc.sdb, key, testData(3*storage.BlockSize+5))
+	}
+
+	result := NewScrubber(corruptStore{cc.sdb, "b"}, "", 0).Scrub()
+
+	if result.Files != 3 || len(result.Failed) != 1 {
+		t.Fatalf("verified %v files, failed %v", result.Files, result.Failed)
+	}
+	if msg := result.Failed["b"]; msg != storage.ErrInvalidHash.Error() {
+		t.Errorf("corrupted file: %q", msg)
+	}
+}
+
+// A pass resumes after the checkpoint, and removes it when complete
+func TestScrubResume(t *testing.T) {
+	cc := newTestCashier(t)
+	for _, key := range []string{"a", "b", "c"} {
+		putTestFile(t, cc.sdb, key, testData(100))
+	}
+
+	dir, err := ioutil.TempDir("", "scrub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	checkpoint := filepath.Join(dir, "scrub.state")
+	ioutil.WriteFile(checkpoint, []byte("a\n"), 0666)
+
+	result := NewScrubber(cc.sdb, checkpoint, 0).Scrub()
+	if result.Resumed != "a" || result.Files != 2 || len(result.Failed) != 0 {
+		t.Errorf("resumed after %q: verified %v files, failed %v", result.Resumed, result.Files, result.Failed)
+	}
+	if _, err := os.Stat(checkpoint); !os.IsNotExist(err) {
+		t.Errorf("checkpoint left: %v", err)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/raff/cashier/storage"
+)
+
+// Upload sessions are stored as files with this key prefix and the session token,
+// and renamed to the final key on commit
+const sessionPrefix = "_upload."
+
+// Return a new random session token
+func newSessionToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// Return the storage key for the session token, if the token is valid
+func sessionKey(token string) (string, bool) {
+	if b, err := hex.DecodeString(token); err != nil || len(b) != 16 {
+		return "", false
+	}
+
+	return sessionPrefix + token, true
+}
+
+// Start an upload session for a file that gets its key on commit,
+// with X-File-Length and the same headers as an upload. Returns the session token;
+// the session expires if not written for the session TTL.
+func (cc *Cashier) createSession(c echo.Context) error {
+	req := c.Request()
+
+	length := int64(-1)
+	if req.Header.Get("X-File-Length") != "" {
+		fmt.Sscanf(req.Header.Get("X-File-Length"), "%d", &length)
+	}
+	if length < 0 {
+		return respondError(c, http.StatusBadRequest, CodeMissingFileLength)
+	}
+
+	hash, err := fileHash(req.Header)
+	if err != nil {
+		return respondError(c, http.StatusBadRequest, CodeInvalidHash)
+	}
+
+	token := newSessionToken()
+	key := sessionPrefix + token
+
+	fname := fileName(req.Header, "")
+	ctype := cc.contentType(req.Header.Get("Content-Type"), fname)
+	opts := append(cc.fileOptions(req.Header, ctype), storage.WithTTL(cc.sessionTTL))
+
+	err = cc.sdb.CreateFile(key, fname, ctype, length, hash, opts...)
+	if err == storage.ErrInfoTooBig {
+		return respondError(c, http.StatusRequestEntityTooLarge, CodeMetadataTooLarge)
+	}
+	if err != nil {
+		log.Printf("upload %v: %v", key, err.Error())
+		return serverError(c, err)
+	}
+
+	log.Printf("upload %v: session created", key)
+
+	c.Response().Header().Set("Location", "/uploads/"+token)
+	return c.JSON(http.StatusCreated, statusMessage("success", "created",
+		mmap{"session": token, "expires": time.Now().Add(cc.sessionTTL).UTC()}))
+}
+
+// Write the request body to the session file at the position in Content-Range
+func (cc *Cashier) updateSession(c echo.Context) error {
+	key, ok := sessionKey(c.Param("session"))
+	if !ok {
+		return respondError(c, http.StatusNotFound, CodeNotFound)
+	}
+
+	return cc.resumeUpload(c, key, false)
+}
+
+// Move the complete session file to ?id=key, with the file options from the request headers
+func (cc *Cashier) commitSession(c echo.Context) error {
+	key, ok := sessionKey(c.Param("session"))
+	if !ok {
+		return respondError(c, http.StatusNotFound, CodeNotFound)
+	}
+
+	id := c.QueryParam("id")
+	if id == "" {
+		return respondError(c, http.StatusBadRequest, CodeMissingID)
+	}
+
+	info, err := cc.sdb.Stat(key)
+	if err == storage.ErrNotFound {
+		return respondError(c, http.StatusNotFound, CodeNotFound)
+	}
+	if err != nil {
+		return serverError(c, err)
+	}
+	if info.Next != storage.FileComplete {
+		c.Response().Header().Set("Range", nextRange(info))
+		return respondError(c, http.StatusForbidden, CodeIncomplete)
+	}
+
+	name := info.Name
+	if name == "" {
+		name = id
+	}
+
+	err = cc.copyFile(key, id, name, info, cc.fileOptions(c.Request().Header, info.ContentType))
+	if err == storage.ErrExists {
+		stat, _ := cc.sdb.Stat(id)
+		return cc.fileExists(c, id, stat)
+	}
+	if err == storage.ErrInfoTooBig {
+		return respondError(c, http.StatusRequestEntityTooLarge, CodeMetadataTooLarge)
+	}
+	if err != nil {
+		log.Printf("upload %v: commit %v: %v", id, key, err.Error())
+		return serverError(c, err)
+	}
+
+	if err := cc.sdb.DeleteFile(key); err != nil {
+		log.Printf("upload %v: %v", key, err.Error()) // the session expires anyway
+	}
+
+	log.Printf("upload %v: committed %v", id, key)
+	return c.JSON(http.StatusCreated, cc.uploadMessage(id, "committed", storage.FileComplete))
+}
+
+// Copy the complete file from to the new file to, with the specified name, the same content type and hash.
+// If the copy fails the new file is deleted.
+func (cc *Cashier) copyFile(from, to, name string, info *storage.FileInfo, opts []storage.FileOption) error {
+	hash, err := storage.ParseHash(info.Hash)
+	if err != nil {
+		return err
+	}
+
+	if err := cc.sdb.CreateFile(to, name, info.ContentType, info.Length, hash, opts...); err != nil {
+		return err
+	}
+
+	if err := copyData(cc.sdb, from, to, info.Length, cc.fileBlockSize()); err != nil {
+		cc.sdb.DeleteFile(to) // don't leave a partial file
+		return err
+	}
+
+	return nil
+}
+
+// Copy length bytes from file from to file to, written in multiples of blockSize
+func copyData(sdb storage.StorageDB, from, to string, length, blockSize int64) error {
+	if length == 0 { // empty files are complete on creation
+		return nil
+	}
+
+	reader, _, err := sdb.OpenReader(from)
+	if err != nil {
+		return err
+	}
+
+	defer reader.Close()
+
+	buf := make([]byte, 4*blockSize)
+
+	for pos := int64(0); pos != storage.FileComplete; {
+		n, err := io.ReadFull(reader, buf)
+		if err == io.ErrUnexpectedEOF { // short last block
+			err = nil
+		}
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF // the file was complete
+		}
+		if err == nil {
+			pos, err = storage.WriteAll(sdb, to, pos, buf[:n])
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/raff/cashier/storage"
+)
+
+// An upload session is created, written in two requests, resumed after a failed one, and committed to its key
+func TestUploadSession(t *testing.T) {
+	cc := newTestCashier(t)
+	cc.sessionTTL = time.Hour
+
+	data := testData(3*storage.BlockSize + 10)
+	length := len(data)
+
+	req := httptest.NewRequest(http.MethodPost, "/uploads", nil)
+	req.Header.Set("X-File-Length", fmt.Sprint(length))
+	req.Header.Set("Content-Type", "text/plain")
+
+	rec := serveTest(t, cc.createSession, req, "")
+
+	var created struct{ Session string }
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil || rec.Code != http.StatusCreated || created.Session == "" {
+		t.Fatalf("create session: %v %v", rec.Code, rec.Body)
+	}
+	if loc := rec.Header().Get("Location"); loc != "/uploads/"+created.Session {
+		t.Errorf("Location %q", loc)
+	}
+
+	token := created.Session
+	patch := func(start, end int) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPatch, "/uploads/"+token, bytes.NewReader(data[start:end]))
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %v-%v/%v", start, end-1, length))
+		return serveParamTest(t, cc.updateSession, req, "session", token)
+	}
+	commit := func(token, id string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/uploads/"+token+"/commit?id="+id, nil)
+		return serveParamTest(t, cc.commitSession, req, "session", token)
+	}
+
+	if rec := patch(0, storage.BlockSize); rec.Code != http.StatusCreated {
+		t.Fatalf("first part: %v %v", rec.Code, rec.Body)
+	}
+
+	// a retry of the first part fails with the range to resume from
+	rec = patch(0, storage.BlockSize)
+	if expected := fmt.Sprintf("bytes=%v-%v/%v", storage.BlockSize, length-1, length); rec.Code != http.StatusBadRequest || rec.Header().Get("Range") != expected {
+		t.Fatalf("retry: %v, Range %q, expected %q", rec.Code, rec.Header().Get("Range"), expected)
+	}
+
+	if rec := commit(token, "final"); rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), CodeIncomplete) {
+		t.Errorf("commit incomplete: %v %v", rec.Code, rec.Body)
+	}
+
+	if rec := patch(storage.BlockSize, length); rec.Code != http.StatusCreated {
+		t.Fatalf("resume: %v %v", rec.Code, rec.Body)
+	}
+
+	if rec := commit(token, "final"); rec.Code != http.StatusCreated || !strings.Contains(rec.Body.String(), "hash") {
+		t.Fatalf("commit: %v %v", rec.Code, rec.Body)
+	}
+
+	if !bytes.Equal(readTestFile(t, cc.sdb, "final"), data) {
+		t.Errorf("committed content differs")
+	}
+	if stat, _ := cc.sdb.Stat("final"); stat == nil || stat.ContentType != "text/plain" {
+		t.Errorf("committed file %+v", stat)
+	}
+	if _, err := cc.sdb.Stat(sessionPrefix + token); err != storage.ErrNotFound {
+		t.Errorf("session file after commit: %v", err)
+	}
+
+	if rec := commit(token, "other"); rec.Code != http.StatusNotFound {
+		t.Errorf("second commit: %v %v", rec.Code, rec.Body)
+	}
+	if rec := commit("not-a-token", "other"); rec.Code != http.StatusNotFound {
+		t.Errorf("invalid token: %v %v", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/raff/cashier/storage"
+)
+
+// Refresh the TTL of downloaded files (sliding expiration).
+// A refresh writes the file records again, so each file is refreshed at most once per interval.
+type slidingTTL struct {
+	interval time.Duration
+
+	mu      sync.Mutex
+	touched map[string]time.Time // key -> time of the last refresh
+}
+
+func newSlidingTTL(interval time.Duration) *slidingTTL {
+	return &slidingTTL{interval: interval, touched: map[string]time.Time{}}
+}
+
+// Return true if key should be refreshed now, dropping stale entries if the map grew
+func (s *slidingTTL) due(key string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if last, ok := s.touched[key]; ok && now.Sub(last) < s.interval {
+		return false
+	}
+
+	if len(s.touched) >= 1024 {
+		for k, last := range s.touched {
+			if now.Sub(last) >= s.interval {
+				delete(s.touched, k)
+			}
+		}
+	}
+
+	s.touched[key] = now
+	return true
+}
+
+// Refresh the TTL of key in the background, if not refreshed recently
+func (s *slidingTTL) touch(sdb storage.StorageDB, key string) {
+	if !s.due(key, time.Now()) {
+		return
+	}
+
+	go func() {
+		if err := sdb.Touch(key); err != nil && err != storage.ErrNotFound {
+			log.Printf("download %v: refresh TTL: %v", key, err)
+		}
+	}()
+}
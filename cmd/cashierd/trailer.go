@@ -0,0 +1,61 @@
+package main
+
+import (
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/raff/cashier/storage"
+)
+
+// Return true if the client asked for the X-Content-Hash trailer,
+// with "TE: trailers" or ?trailer=1
+func wantTrailer(req *http.Request) bool {
+	return strings.Contains(req.Header.Get("TE"), "trailers") || req.URL.Query().Get("trailer") == "1"
+}
+
+// A ReadSeeker hashing the content read since the last seek
+type hashingReader struct {
+	io.ReadSeeker
+
+	hash  hash.Hash
+	alg   string // file hash algorithm
+	start int64  // position of the last seek
+	n     int64  // bytes hashed
+}
+
+// Return true if the hash covers length bytes from the start
+func (r *hashingReader) Complete(length int64) bool {
+	return r.start == 0 && r.n == length
+}
+
+func (r *hashingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadSeeker.Read(p)
+	r.hash.Write(p[:n])
+	r.n += int64(n)
+	return n, err
+}
+
+// Restart the hash (ServeContent seeks back to the start after sniffing the content type)
+func (r *hashingReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.ReadSeeker.Seek(offset, whence)
+	r.hash.Reset()
+	r.start, r.n = pos, 0
+	return pos, err
+}
+
+// The hash of the content read, in the same format as the file hash
+func (r *hashingReader) Sum() string {
+	return storage.FormatHash(r.alg, r.hash.Sum(nil))
+}
+
+// A ResponseWriter dropping Content-Length, so that the response is chunked and can have trailers
+type trailerWriter struct {
+	http.ResponseWriter
+}
+
+func (w trailerWriter) WriteHeader(code int) {
+	w.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(code)
+}
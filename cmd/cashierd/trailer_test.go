@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo"
+	"github.com/raff/cashier/storage"
+)
+
+// Downloads with ?trailer=1 or "TE: trailers" end with the hash of the content in the X-Content-Hash trailer
+func TestGetHashTrailer(t *testing.T) {
+	for _, alg := range []string{storage.HashCumulative, storage.HashMerkle, storage.HashSHA256} {
+		cc := newTestCashier(t, storage.WithHash(alg))
+
+		data := testData(3*storage.BlockSize + 10)
+		if err := cc.sdb.CreateFile("f", "f", "", int64(len(data)), nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := storage.WriteAll(cc.sdb, "f", 0, data); err != nil {
+			t.Fatal(err)
+		}
+
+		stat, err := cc.sdb.Stat("f")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		e := echo.New()
+		e.GET("/x/:id", cc.getEntry)
+
+		server := httptest.NewServer(e)
+		defer server.Close()
+
+		get := func(query string, headers ...string) (*http.Response, []byte) {
+			req, _ := http.NewRequest(http.MethodGet, server.URL+"/x/f"+query, nil)
+			for i := 0; i < len(headers); i += 2 {
+				req.Header.Set(headers[i], headers[i+1])
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			body, err := ioutil.ReadAll(resp.Body) // the trailer is available after the body
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			return resp, body
+		}
+
+		for _, tc := range []struct {
+			query   string
+			headers []string
+		}{
+			{"?trailer=1", nil},
+			{"", []string{"TE", "trailers"}},
+		} {
+			resp, body := get(tc.query, tc.headers...)
+			if resp.StatusCode != http.StatusOK || !bytes.Equal(body, data) {
+				t.Fatalf("%v: GET %v %v: %v, %v bytes", alg, tc.query, tc.headers, resp.StatusCode, len(body))
+			}
+
+			trailer := resp.Trailer.Get("X-Content-Hash")
+			if trailer != stat.Hash || resp.Header.Get("ETag") != fmt.Sprintf("%q", trailer) {
+				t.Errorf("%v: GET %v %v: trailer %q, ETag %v, expected %v", alg, tc.query, tc.headers, trailer, resp.Header.Get("ETag"), stat.Hash)
+			}
+		}
+
+		if resp, _ := get(""); resp.Trailer.Get("X-Content-Hash") != "" || resp.ContentLength != int64(len(data)) {
+			t.Errorf("%v: GET without trailer: trailer %q, length %v", alg, resp.Trailer.Get("X-Content-Hash"), resp.ContentLength)
+		}
+		if resp, _ := get("?trailer=1", "Range", "bytes=0-9"); resp.Trailer.Get("X-Content-Hash") != "" {
+			t.Errorf("%v: range with trailer: %q", alg, resp.Trailer.Get("X-Content-Hash"))
+		}
+	}
+}
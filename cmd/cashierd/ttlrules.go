@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"path"
+	"strings"
+	"time"
+)
+
+// A content type pattern (e.g. "image/*") and the TTL for matching files
+type ttlRule struct {
+	pattern string
+	ttl     time.Duration
+}
+
+// TTL rules, evaluated in order (first match wins).
+// Implements flag.Value, so that -ttl-rule can be repeated.
+type ttlRules []ttlRule
+
+func (r *ttlRules) String() string {
+	var rules []string
+
+	for _, rule := range *r {
+		rules = append(rules, fmt.Sprintf("%v=%v", rule.pattern, rule.ttl))
+	}
+
+	return strings.Join(rules, ",")
+}
+
+// Add a rule in the form "pattern=duration"
+func (r *ttlRules) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid TTL rule %q, expected type/subtype=duration", value)
+	}
+
+	pattern := strings.TrimSpace(parts[0])
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid TTL rule pattern %q", pattern)
+	}
+
+	ttl, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return err
+	}
+	if ttl <= 0 {
+		return fmt.Errorf("invalid TTL rule duration %v", ttl)
+	}
+
+	*r = append(*r, ttlRule{pattern: pattern, ttl: ttl})
+	return nil
+}
+
+// Return the TTL of the first rule matching ctype
+func (r ttlRules) match(ctype string) (time.Duration, bool) {
+	if mtype, _, err := mime.ParseMediaType(ctype); err == nil {
+		ctype = mtype
+	}
+
+	for _, rule := range r {
+		if ok, _ := path.Match(rule.pattern, ctype); ok {
+			return rule.ttl, true
+		}
+	}
+
+	return 0, false
+}
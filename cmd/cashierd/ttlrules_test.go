@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestTTLRules(t *testing.T) {
+	cc := newTestCashier(t)
+	for _, rule := range []string{"image/png=2h", "image/*=1h", "video/*=168h"} {
+		if err := cc.ttlRules.Set(rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for ctype, ttl := range map[string]time.Duration{
+		"image/png":                 2 * time.Hour,
+		"image/jpeg":                time.Hour,
+		"video/mp4; codecs=avc1":    168 * time.Hour,
+		"application/octet-stream":  time.Hour, // the storage default
+		"text/plain; charset=utf-8": time.Hour,
+	} {
+		start := time.Now()
+		if rec := uploadTest(t, cc, "f", testData(10), map[string]string{"Content-Type": ctype}); rec.Code != http.StatusCreated {
+			t.Fatalf("%v: %v %v", ctype, rec.Code, rec.Body)
+		}
+
+		stat, err := cc.sdb.Stat("f")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := stat.ExpiresAt.Sub(start.Add(ttl)); d < -time.Second || d > 2*time.Second {
+			t.Errorf("%v: expires at %v, expected %v", ctype, stat.ExpiresAt, start.Add(ttl))
+		}
+
+		cc.sdb.DeleteFile("f")
+	}
+}
+
+func TestTTLRuleInvalid(t *testing.T) {
+	for _, rule := range []string{"image/*", "image/[=1h", "image/*=1x", "image/*=-1h"} {
+		var rules ttlRules
+		if err := rules.Set(rule); err == nil {
+			t.Errorf("%q: accepted", rule)
+		}
+	}
+}
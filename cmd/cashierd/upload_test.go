@@ -0,0 +1,595 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/raff/cashier/storage"
+)
+
+// A file part of a multipart upload
+type testPart struct {
+	name string
+	data []byte
+}
+
+// Return a multipart request to path with the file parts (with Content-Length, if length)
+func multipartRequest(t *testing.T, path string, parts []testPart, length bool) *http.Request {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	for _, p := range parts {
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename=%q`, p.name))
+		if length {
+			h.Set("Content-Length", fmt.Sprint(len(p.data)))
+		}
+
+		w, err := mw.CreatePart(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(p.data)
+	}
+	mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, path, &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+func TestCreateEntries(t *testing.T) {
+	cc := newTestCashier(t)
+
+	parts := []testPart{
+		{"a.txt", []byte("first file")},
+		{"b.bin", testData(40000)},
+		{"c", nil},
+	}
+
+	rec := serveTest(t, cc.createEntries, multipartRequest(t, "/x", parts, true), "")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST: %v %v", rec.Code, rec.Body)
+	}
+
+	var results []mmap
+	if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil || len(results) != len(parts) {
+		t.Fatalf("results: %v %v", rec.Body, err)
+	}
+
+	for _, p := range parts {
+		if got := readTestFile(t, cc.sdb, p.name); !bytes.Equal(got, p.data) {
+			t.Errorf("%v: content differs", p.name)
+		}
+	}
+
+	// files without a length fail, the others are stored
+	rec = serveTest(t, cc.createEntries, multipartRequest(t, "/x", []testPart{{"d", []byte("x")}}, false), "")
+	if rec.Code != http.StatusMultiStatus {
+		t.Errorf("POST without lengths: %v %v", rec.Code, rec.Body)
+	}
+	rec = serveTest(t, cc.createEntries, multipartRequest(t, "/x", parts[:1], true), "")
+	if rec.Code != http.StatusMultiStatus {
+		t.Errorf("POST existing file: %v %v", rec.Code, rec.Body)
+	}
+}
+
+// Upload data to id with the headers, and return the response
+func uploadTest(t *testing.T, cc *Cashier, id string, data []byte, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/x/"+id, bytes.NewReader(data))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	return serveTest(t, cc.createEntry, req, id)
+}
+
+func TestDefaultContentType(t *testing.T) {
+	cc := newTestCashier(t)
+	cc.defaultType = "application/x-cashier"
+
+	if rec := uploadTest(t, cc, "f", []byte("data"), nil); rec.Code != http.StatusCreated {
+		t.Fatalf("upload: %v %v", rec.Code, rec.Body)
+	}
+
+	if stat, _ := cc.sdb.Stat("f"); stat.ContentType != "application/x-cashier" {
+		t.Errorf("stored type %q", stat.ContentType)
+	}
+
+	rec := serveTest(t, cc.getEntry, httptest.NewRequest(http.MethodGet, "/x/f", nil), "f")
+	if ctype := rec.Header().Get("Content-Type"); ctype != "application/x-cashier" {
+		t.Errorf("served type %q", ctype)
+	}
+}
+
+func TestUploadMetadataTooLarge(t *testing.T) {
+	cc := newTestCashier(t, storage.WithMaxInfoSize(300))
+
+	rec := uploadTest(t, cc, "f", []byte("data"), map[string]string{"Content-Type": "text/x-" + strings.Repeat("a", 300)})
+	if rec.Code != http.StatusRequestEntityTooLarge || !strings.Contains(rec.Body.String(), CodeMetadataTooLarge) {
+		t.Errorf("upload: %v %v", rec.Code, rec.Body)
+	}
+	if _, err := cc.sdb.Stat("f"); err != storage.ErrNotFound {
+		t.Errorf("rejected file: %v", err)
+	}
+}
+
+// An upload cut in the middle (as by a shutdown) keeps the whole blocks received, and can be resumed
+func TestUploadInterrupted(t *testing.T) {
+	cc := newTestCashier(t)
+
+	data := testData(4*storage.BlockSize + 10)
+	length := len(data)
+	cut := 2*storage.BlockSize + 100
+
+	body := io.MultiReader(bytes.NewReader(data[:cut]), iotest.ErrReader(io.ErrUnexpectedEOF))
+	req := httptest.NewRequest(http.MethodPut, "/x/f", body)
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes 0-%v/%v", length-1, length))
+	if rec := serveTest(t, cc.updateEntry, req, "f"); rec.Code < 400 {
+		t.Errorf("interrupted upload: %v %v", rec.Code, rec.Body)
+	}
+
+	stat, err := cc.sdb.Stat("f")
+	if err != nil || stat.Next != 2*storage.BlockSize {
+		t.Fatalf("interrupted upload at %v: %v, expected %v", stat.Next, err, 2*storage.BlockSize)
+	}
+
+	req = httptest.NewRequest(http.MethodPut, "/x/f", bytes.NewReader(data[stat.Next:]))
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes %v-%v/%v", stat.Next, length-1, length))
+	if rec := serveTest(t, cc.updateEntry, req, "f"); rec.Code != http.StatusCreated {
+		t.Fatalf("resume: %v %v", rec.Code, rec.Body)
+	}
+
+	if !bytes.Equal(readTestFile(t, cc.sdb, "f"), data) {
+		t.Errorf("resumed file content differs")
+	}
+}
+
+// Resuming an upload whose last write is older than max-upload-age gets a 410, and the partial file is removed
+func TestResumeStale(t *testing.T) {
+	now := time.Now()
+	cc := newTestCashier(t, storage.WithClock(func() time.Time { return now }))
+	cc.maxUploadAge = time.Hour
+
+	data := testData(2*storage.BlockSize + 10)
+	for _, key := range []string{"fresh", "stale"} {
+		if key == "stale" {
+			now = time.Now().Add(-2 * time.Hour) // the last write was 2 hours ago
+		}
+
+		if err := cc.sdb.CreateFile(key, key, "", int64(len(data)), nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := storage.WriteAll(cc.sdb, key, 0, data[:storage.BlockSize]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now = time.Now()
+
+	for key, code := range map[string]int{"fresh": http.StatusCreated, "stale": http.StatusGone} {
+		req := httptest.NewRequest(http.MethodPut, "/x/"+key, bytes.NewReader(data[storage.BlockSize:]))
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %v-%v/%v", storage.BlockSize, len(data)-1, len(data)))
+
+		if rec := serveTest(t, cc.updateEntry, req, key); rec.Code != code {
+			t.Errorf("resume %v: %v %v, expected %v", key, rec.Code, rec.Body, code)
+		}
+	}
+
+	if _, err := cc.sdb.Stat("stale"); err != storage.ErrNotFound {
+		t.Errorf("stale upload: %v, expected ErrNotFound", err)
+	}
+}
+
+// A complete upload returns the computed hash, an incomplete one doesn't
+func TestUploadHash(t *testing.T) {
+	cc := newTestCashier(t)
+
+	data := testData(2*storage.BlockSize + 10)
+	rec := uploadTest(t, cc, "f", data, nil)
+
+	var body struct {
+		Code      string
+		Hash      string
+		Algorithm string
+		Length    int64
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || rec.Code != http.StatusCreated {
+		t.Fatalf("upload: %v %v %q", rec.Code, err, rec.Body)
+	}
+
+	stat, err := cc.sdb.Stat("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body.Code != "success" || body.Hash != stat.Hash || body.Algorithm != storage.HashCumulative || body.Length != stat.Length {
+		t.Errorf("response %+v, stat %+v", body, stat)
+	}
+
+	req := httptest.NewRequest(http.MethodPut, "/x/g", bytes.NewReader(data[:storage.BlockSize]))
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes 0-%v/%v", storage.BlockSize-1, len(data)))
+	rec = serveTest(t, cc.updateEntry, req, "g")
+	if rec.Code != http.StatusCreated || strings.Contains(rec.Body.String(), "hash") {
+		t.Errorf("partial upload: %v %v", rec.Code, rec.Body)
+	}
+}
+
+// A reader returning one block at a time, slowly
+type trickleReader struct {
+	data  []byte
+	delay time.Duration
+}
+
+func (r *trickleReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+
+	time.Sleep(r.delay)
+
+	if len(p) > storage.BlockSize {
+		p = p[:storage.BlockSize]
+	}
+
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// An upload past the deadline gets a 408 with the range to resume from
+func TestUploadDeadline(t *testing.T) {
+	cc := newTestCashier(t)
+	cc.uploadDeadline = 50 * time.Millisecond
+
+	data := testData(20 * storage.BlockSize)
+	req := httptest.NewRequest(http.MethodPut, "/x/f", &trickleReader{data: data, delay: 20 * time.Millisecond})
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes 0-%v/%v", len(data)-1, len(data)))
+
+	rec := serveTest(t, cc.updateEntry, req, "f")
+	if rec.Code != http.StatusRequestTimeout || !strings.Contains(rec.Body.String(), CodeUploadDeadline) {
+		t.Fatalf("slow upload: %v %v, expected 408", rec.Code, rec.Body)
+	}
+
+	stat, err := cc.sdb.Stat("f")
+	if err != nil || stat.Next <= 0 || stat.Next >= stat.Length || stat.Next%storage.BlockSize != 0 {
+		t.Fatalf("partial file: %+v %v", stat, err)
+	}
+	if r := rec.Header().Get("Range"); r != fmt.Sprintf("bytes=%v-%v/%v", stat.Next, len(data)-1, len(data)) {
+		t.Errorf("Range %q, next %v", r, stat.Next)
+	}
+}
+
+// An immutable complete file can't be overwritten or deleted
+func TestUploadImmutable(t *testing.T) {
+	cc := newTestCashier(t)
+
+	data := testData(100)
+	if rec := uploadTest(t, cc, "f", data, map[string]string{"X-Immutable": "true"}); rec.Code != http.StatusCreated {
+		t.Fatalf("upload: %v %v", rec.Code, rec.Body)
+	}
+
+	rec := uploadTest(t, cc, "f", testData(10), map[string]string{"X-Overwrite": "true"})
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), CodeImmutable) {
+		t.Errorf("overwrite: %v %v, expected 403", rec.Code, rec.Body)
+	}
+
+	rec = serveTest(t, cc.deleteEntry, httptest.NewRequest(http.MethodDelete, "/x/f", nil), "f")
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), CodeImmutable) {
+		t.Errorf("delete: %v %v, expected 403", rec.Code, rec.Body)
+	}
+
+	if !bytes.Equal(readTestFile(t, cc.sdb, "f"), data) {
+		t.Errorf("immutable file changed")
+	}
+}
+
+// Uploads past the namespace quota get a 507
+func TestUploadQuota(t *testing.T) {
+	cc := newTestCashier(t)
+
+	sdb, err := storage.Quota(cc.sdb, map[string]int64{"tenant": 1000}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.sdb = sdb
+
+	for _, tc := range []struct {
+		key  string
+		size int
+		code int
+	}{
+		{"tenant%2Fa", 600, http.StatusCreated},
+		{"tenant%2Fb", 400, http.StatusCreated},
+		{"tenant%2Fc", 1, http.StatusInsufficientStorage},
+	} {
+		rec := uploadTest(t, cc, tc.key, testData(tc.size), nil)
+		if rec.Code != tc.code {
+			t.Errorf("%v: %v %v, expected %v", tc.key, rec.Code, rec.Body, tc.code)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPut, "/x/tenant%2Fd", bytes.NewReader(testData(10)))
+	if rec := serveTest(t, cc.updateEntry, req, "tenant%2Fd"); rec.Code != http.StatusInsufficientStorage || !strings.Contains(rec.Body.String(), CodeQuotaExceeded) {
+		t.Errorf("PUT: %v %v, expected 507", rec.Code, rec.Body)
+	}
+}
+
+// Uploads rejected before reading the body don't consume it, so that with
+// "Expect: 100-continue" the client doesn't send it
+func TestUploadRejectedUnread(t *testing.T) {
+	cc := newTestCashier(t)
+	putTestFile(t, cc.sdb, "f", testData(100))
+
+	for _, tc := range []struct {
+		name    string
+		handler echo.HandlerFunc
+		method  string
+		headers map[string]string
+		code    int
+	}{
+		{"duplicate", cc.createEntry, http.MethodPost, nil, http.StatusConflict},
+		{"invalid hash", cc.createEntry, http.MethodPost, map[string]string{"X-File-Hash": "zz"}, http.StatusBadRequest},
+		{"complete", cc.updateEntry, http.MethodPut, map[string]string{"Content-Range": "bytes 0-99/100"}, http.StatusConflict},
+	} {
+		body := &countReader{Reader: bytes.NewReader(testData(100))}
+		req := httptest.NewRequest(tc.method, "/x/f", body)
+		req.Header.Set("Expect", "100-continue")
+		for k, v := range tc.headers {
+			req.Header.Set(k, v)
+		}
+
+		if rec := serveTest(t, tc.handler, req, "f"); rec.Code != tc.code || body.n != 0 {
+			t.Errorf("%v: %v, read %v bytes", tc.name, rec.Code, body.n)
+		}
+	}
+}
+
+// A 409 for an incomplete file has the offset to resume from, and the time until it can be resumed
+func TestUploadExistsResume(t *testing.T) {
+	cc := newTestCashier(t)
+
+	data := testData(3 * storage.BlockSize)
+	if err := cc.sdb.CreateFile("f", "f", "", int64(len(data)), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.WriteAll(cc.sdb, "f", 0, data[:storage.BlockSize]); err != nil {
+		t.Fatal(err)
+	}
+
+	stat, _ := cc.sdb.Stat("f")
+
+	for _, maxAge := range []time.Duration{0, time.Minute} {
+		cc.maxUploadAge = maxAge
+
+		deadline := stat.ExpiresAt.UTC()
+		if maxAge > 0 {
+			deadline = stat.Created.Add(maxAge).UTC()
+		}
+
+		rec := uploadTest(t, cc, "f", data, nil)
+
+		var body struct {
+			Error struct {
+				Code           string
+				ResumeOffset   int64     `json:"resume-offset"`
+				ResumeDeadline time.Time `json:"resume-deadline"`
+			}
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || rec.Code != http.StatusConflict {
+			t.Fatalf("max age %v: %v %v %q", maxAge, rec.Code, err, rec.Body)
+		}
+
+		if body.Error.Code != CodeFileExists || body.Error.ResumeOffset != storage.BlockSize || !body.Error.ResumeDeadline.Equal(deadline) {
+			t.Errorf("max age %v: %+v, expected deadline %v", maxAge, body.Error, deadline)
+		}
+		if ru := rec.Header().Get("Retry-Until"); ru != deadline.Format(http.TimeFormat) {
+			t.Errorf("max age %v: Retry-Until %q", maxAge, ru)
+		}
+		if r := rec.Header().Get("Range"); r != fmt.Sprintf("bytes=%v-%v/%v", storage.BlockSize, len(data)-1, len(data)) {
+			t.Errorf("max age %v: Range %q", maxAge, r)
+		}
+	}
+}
+
+// A store without space for new files
+type fullStore struct {
+	storage.StorageDB
+}
+
+func (fullStore) CreateFile(key, filename, ctype string, size int64, hash []byte, opts ...storage.FileOption) error {
+	return storage.ErrNoSpace
+}
+
+func TestUploadNoSpace(t *testing.T) {
+	cc := newTestCashier(t)
+	cc.sdb = fullStore{cc.sdb}
+
+	rec := uploadTest(t, cc, "f", testData(100), nil)
+	if rec.Code != http.StatusInsufficientStorage || !strings.Contains(rec.Body.String(), CodeInsufficientSpace) {
+		t.Errorf("upload: %v %v, expected 507", rec.Code, rec.Body)
+	}
+}
+
+// Without a Content-Type the type comes from the file name extension
+func TestContentTypeByExtension(t *testing.T) {
+	cc := newTestCashier(t)
+
+	// Go only knows .csv from the system mime.types
+	if err := mime.AddExtensionType(".csv", "text/csv"); err != nil {
+		t.Fatal(err)
+	}
+
+	csv := []byte("a,b\n1,2\n")
+
+	if rec := uploadTest(t, cc, "report.csv", csv, nil); rec.Code != http.StatusCreated {
+		t.Fatalf("upload: %v %v", rec.Code, rec.Body)
+	}
+	if rec := serveTest(t, cc.createEntries, multipartRequest(t, "/x", []testPart{{"data.csv", csv}}, true), ""); rec.Code != http.StatusCreated {
+		t.Fatalf("multipart upload: %v %v", rec.Code, rec.Body)
+	}
+	if rec := uploadTest(t, cc, "report.unknown", csv, nil); rec.Code != http.StatusCreated {
+		t.Fatalf("upload: %v %v", rec.Code, rec.Body)
+	}
+
+	for key, expected := range map[string]string{"report.csv": "text/csv", "data.csv": "text/csv", "report.unknown": cc.defaultType} {
+		stat, err := cc.sdb.Stat(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if mtype, _, _ := mime.ParseMediaType(stat.ContentType); mtype != expected {
+			t.Errorf("%v: stored type %q, expected %v", key, stat.ContentType, expected)
+		}
+	}
+
+	// an explicit Content-Type wins
+	if rec := uploadTest(t, cc, "other.csv", csv, map[string]string{"Content-Type": "text/plain"}); rec.Code != http.StatusCreated {
+		t.Fatalf("upload: %v %v", rec.Code, rec.Body)
+	}
+	if stat, _ := cc.sdb.Stat("other.csv"); stat.ContentType != "text/plain" {
+		t.Errorf("stored type %q, expected text/plain", stat.ContentType)
+	}
+}
+
+// Empty files, created with POST or PUT, are complete and can be downloaded right away
+func TestEmptyUpload(t *testing.T) {
+	cc := newTestCashier(t)
+
+	emptyMD5 := "d41d8cd98f00b204e9800998ecf8427e"
+
+	for _, rec := range []*httptest.ResponseRecorder{
+		uploadTest(t, cc, "post", nil, nil),
+		serveTest(t, cc.updateEntry, putRequest("put", nil, ""), "put"),
+	} {
+		var result mmap
+		json.Unmarshal(rec.Body.Bytes(), &result)
+		if rec.Code != http.StatusCreated || result["hash"] != emptyMD5 || result["length"] != 0.0 {
+			t.Fatalf("upload: %v %v", rec.Code, rec.Body)
+		}
+	}
+
+	for _, id := range []string{"post", "put"} {
+		rec := serveTest(t, cc.getEntry, httptest.NewRequest(http.MethodGet, "/x/"+id, nil), id)
+		if rec.Code != http.StatusOK || rec.Body.Len() != 0 {
+			t.Errorf("GET %v: %v, %v bytes", id, rec.Code, rec.Body.Len())
+		}
+		if etag := rec.Header().Get("ETag"); etag != `"`+emptyMD5+`"` {
+			t.Errorf("GET %v: ETag %v", id, etag)
+		}
+	}
+
+	// the file is complete, there is nothing to resume
+	if rec := serveTest(t, cc.updateEntry, putRequest("post", []byte("x"), "bytes 0-0/1"), "post"); rec.Code != http.StatusConflict {
+		t.Errorf("PUT to an empty file: %v %v", rec.Code, rec.Body)
+	}
+}
+
+// A store counting the WriteAt calls
+type writeCounter struct {
+	storage.StorageDB
+	writes int
+	fail   error // returned by WriteAt when set
+}
+
+func (s *writeCounter) WriteAt(key string, pos int64, data []byte) (int64, error) {
+	s.writes++
+	if s.fail != nil {
+		return 0, s.fail
+	}
+	return s.StorageDB.WriteAt(key, pos, data)
+}
+
+// With X-Overwrite a complete file is replaced, unless X-File-Hash matches its content
+func TestUploadOverwrite(t *testing.T) {
+	cc := newTestCashier(t)
+	sdb := &writeCounter{StorageDB: cc.sdb}
+	cc.sdb = sdb
+
+	data, changed := testData(40000), testData(40001)
+	putTestFile(t, cc.sdb, "f", data)
+
+	stat, _ := cc.sdb.Stat("f")
+
+	// same content: not rewritten
+	sdb.writes = 0
+	rec := uploadTest(t, cc, "f", data, map[string]string{"X-Overwrite": "1", "X-File-Hash": stat.Hash})
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "unchanged") {
+		t.Fatalf("same content: %v %v", rec.Code, rec.Body)
+	}
+	if sdb.writes != 0 {
+		t.Errorf("same content rewritten: %v writes", sdb.writes)
+	}
+
+	// without X-Overwrite the file is not replaced
+	if rec := uploadTest(t, cc, "f", changed, nil); rec.Code != http.StatusConflict {
+		t.Errorf("changed content without X-Overwrite: %v %v", rec.Code, rec.Body)
+	}
+
+	// a failed overwrite keeps the previous version, and no temporary file
+	hash, _, _ := storage.GetHash(bytes.NewReader(changed))
+	headers := map[string]string{"X-Overwrite": "1", "X-File-Hash": fmt.Sprintf("%x", hash)}
+
+	sdb.fail = storage.ErrUnavailable
+	if rec := uploadTest(t, cc, "f", changed, headers); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("failed overwrite: %v %v", rec.Code, rec.Body)
+	}
+	sdb.fail = nil
+
+	if !bytes.Equal(readTestFile(t, cc.sdb, "f"), data) {
+		t.Errorf("content changed by a failed overwrite")
+	}
+	if files, _ := cc.sdb.ListFiles(sessionPrefix); len(files) != 0 {
+		t.Errorf("temporary files left: %v", files)
+	}
+
+	// changed content: rewritten
+	sdb.writes = 0
+	if rec = uploadTest(t, cc, "f", changed, headers); rec.Code != http.StatusCreated {
+		t.Fatalf("changed content: %v %v", rec.Code, rec.Body)
+	}
+	if updated, _ := cc.sdb.Stat("f"); sdb.writes == 0 || updated.Length != int64(len(changed)) {
+		t.Errorf("changed content not rewritten: %v writes, %+v", sdb.writes, updated)
+	}
+	if !bytes.Equal(readTestFile(t, cc.sdb, "f"), changed) {
+		t.Errorf("content after overwrite differs")
+	}
+}
+
+// Concurrent overwrites each replace the file with a complete version
+func TestUploadOverwriteConcurrent(t *testing.T) {
+	cc := newTestCashier(t)
+	putTestFile(t, cc.sdb, "f", testData(100))
+
+	versions := [][]byte{testData(40000), testData(40001)}
+	codes := make([]int, len(versions))
+
+	var wg sync.WaitGroup
+	for i, data := range versions {
+		wg.Add(1)
+		go func(i int, data []byte) {
+			defer wg.Done()
+			codes[i] = uploadTest(t, cc, "f", data, map[string]string{"X-Overwrite": "1"}).Code
+		}(i, data)
+	}
+	wg.Wait()
+
+	if codes[0] != http.StatusCreated || codes[1] != http.StatusCreated {
+		t.Fatalf("overwrites: %v", codes)
+	}
+	if content := readTestFile(t, cc.sdb, "f"); !bytes.Equal(content, versions[0]) && !bytes.Equal(content, versions[1]) {
+		t.Errorf("content is not one of the versions (%v bytes)", len(content))
+	}
+}
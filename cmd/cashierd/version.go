@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/labstack/echo"
+)
+
+// Build information, set with:
+//
+//	go build -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=..."
+var (
+	version   string
+	commit    string
+	buildDate string
+)
+
+// Return the build information, using the module build info
+// for values not set at link time
+func buildInfo() (ver, rev, date string) {
+	ver, rev, date = version, commit, buildDate
+
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if ver == "" {
+			ver = bi.Main.Version
+		}
+
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && rev == "":
+				rev = s.Value
+			case s.Key == "vcs.time" && date == "":
+				date = s.Value
+			}
+		}
+	}
+
+	return
+}
+
+func (cc *Cashier) getVersion(c echo.Context) error {
+	ver, rev, date := buildInfo()
+
+	return c.JSON(http.StatusOK, mmap{
+		"version":   ver,
+		"commit":    rev,
+		"buildDate": date,
+		"go":        runtime.Version(),
+		"backend":   cc.backend,
+		"blockSize": cc.fileBlockSize(),
+		"hash":      cc.hashAlg,
+	})
+}
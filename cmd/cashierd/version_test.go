@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	"github.com/raff/cashier/storage"
+)
+
+func TestGetVersion(t *testing.T) {
+	cc := newTestCashier(t, storage.WithBlockSize(64*1024))
+	cc.blockSize = 64 * 1024
+
+	version = "v1.2.3"
+	defer func() { version = "" }()
+
+	rec := serveTest(t, cc.getVersion, httptest.NewRequest(http.MethodGet, "/version", nil), "")
+
+	var body struct {
+		Version   string
+		Go        string
+		Backend   string
+		BlockSize int64
+		Hash      string
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("version: %v %v %q", rec.Code, err, rec.Body)
+	}
+
+	if body.Version != "v1.2.3" || body.Go != runtime.Version() {
+		t.Errorf("build info: %+v", body)
+	}
+	if body.Backend != "badger" || body.BlockSize != 64*1024 || body.Hash != storage.HashCumulative {
+		t.Errorf("storage info: %+v", body)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/raff/cashier/storage"
+)
+
+// With versioning, an overwritten file is kept as a version that can be downloaded with ?version=n
+func TestOverwriteVersions(t *testing.T) {
+	cc := newTestCashier(t)
+	cc.sdb = storage.Versioned(cc.sdb)
+	cc.maxVersions = 1
+
+	contents := [][]byte{testData(40000), testData(40001), testData(40002)}
+	for i, data := range contents {
+		if rec := uploadTest(t, cc, "f", data, map[string]string{"X-Overwrite": "1"}); rec.Code != http.StatusCreated {
+			t.Fatalf("upload %v: %v %v", i, rec.Code, rec.Body)
+		}
+	}
+
+	rec := serveTest(t, cc.getVersions, httptest.NewRequest(http.MethodGet, "/x/f/versions", nil), "f")
+	var versions []storage.Version
+	if err := json.Unmarshal(rec.Body.Bytes(), &versions); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("versions: %v %v", rec.Code, rec.Body)
+	}
+	if len(versions) != 1 || versions[0].Version != 2 || versions[0].Length != int64(len(contents[1])) {
+		t.Fatalf("versions %+v, expected the second upload only", versions)
+	}
+
+	for _, test := range []struct {
+		query   string
+		code    int
+		content []byte
+	}{
+		{"", http.StatusOK, contents[2]},
+		{"?version=2", http.StatusOK, contents[1]},
+		{"?version=1", http.StatusNotFound, nil}, // pruned
+		{"?version=x", http.StatusBadRequest, nil},
+	} {
+		rec := serveTest(t, cc.getEntry, httptest.NewRequest(http.MethodGet, "/x/f"+test.query, nil), "f")
+		if rec.Code != test.code || (test.content != nil && !bytes.Equal(rec.Body.Bytes(), test.content)) {
+			t.Errorf("get %q: %v (%v bytes)", test.query, rec.Code, rec.Body.Len())
+		}
+	}
+
+	// deleting the file deletes its versions
+	if rec := serveTest(t, cc.deleteEntry, httptest.NewRequest(http.MethodDelete, "/x/f", nil), "f"); rec.Code != http.StatusCreated {
+		t.Fatalf("delete: %v %v", rec.Code, rec.Body)
+	}
+	if _, err := cc.sdb.Stat(storage.VersionKey("f", 2)); err != storage.ErrNotFound {
+		t.Errorf("version after delete: %v", err)
+	}
+	if rec := serveTest(t, cc.getVersions, httptest.NewRequest(http.MethodGet, "/x/f/versions", nil), "f"); rec.Code != http.StatusNotFound {
+		t.Errorf("versions after delete: %v %v", rec.Code, rec.Body)
+	}
+}
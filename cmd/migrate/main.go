@@ -0,0 +1,77 @@
+// Command migrate copies complete files between storage services (see storage.Migrate),
+// e.g. to move a cache from badger to AWS:
+//
+//	migrate -from badger:storage.data -to aws:bucket/prefix [keys...]
+//
+// Without keys, it copies all the complete files with the -prefix.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/raff/cashier/storage"
+)
+
+func main() {
+	from := flag.String("from", "", "source store (badger:path, aws:bucket/prefix)")
+	to := flag.String("to", "", "destination store (badger:path, aws:bucket/prefix)")
+	prefix := flag.String("prefix", "", "migrate the files with keys starting with prefix (without keys)")
+	ttl := flag.Duration("ttl", 10*time.Minute, "default time to live of the destination store")
+	blockSize := flag.Int64("block-size", storage.BlockSize, "block size of new files in the destination store (a power of two, 1K to 64M)")
+	concurrency := flag.Int("concurrency", 1, "number of files to copy in parallel")
+	dryRun := flag.Bool("dry-run", false, "list the files that would be migrated")
+	verbose := flag.Bool("verbose", false, "log each file")
+	flag.Parse()
+
+	if *from == "" || *to == "" {
+		fmt.Fprintln(os.Stderr, "usage: migrate -from store -to store [keys...]")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	src, err := storage.Open(*from, true, *ttl)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	keys := flag.Args()
+	if len(keys) == 0 {
+		if keys, err = storage.CompleteKeys(src, *prefix); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *dryRun {
+		for _, key := range keys {
+			fmt.Println("migrate", key)
+		}
+
+		src.Close()
+		return
+	}
+
+	dst, err := storage.Open(*to, false, *ttl, storage.WithBlockSize(*blockSize))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	failed := storage.MigrateAll(src, dst, keys, *concurrency, func(key string, err error) {
+		if err != nil {
+			log.Println(key, err)
+		} else if *verbose {
+			log.Println("migrated", key)
+		}
+	})
+
+	log.Println("done:", len(keys), "files,", failed, "failed")
+	dst.Close()
+	src.Close()
+
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -1,4 +1,3 @@
-// +build ignore
 package main
 
 import (
@@ -7,12 +6,245 @@ import (
 	"io"
 	"os"
 	"path/filepath"
-	//"strings"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/raff/cashier/storage"
 )
 
+var (
+	verbose bool
+	hashAlg string
+	printMu sync.Mutex
+)
+
+// thread-safe Println
+func logln(args ...interface{}) {
+	printMu.Lock()
+	fmt.Println(args...)
+	printMu.Unlock()
+}
+
+// Call fn for each key, running up to n concurrent workers.
+// Files are processed sequentially within a worker.
+// Returns the number of failed keys.
+func parallel(n int, keys []string, fn func(key string) error) int {
+	if n < 1 {
+		n = 1
+	}
+
+	var failed int32
+	var wg sync.WaitGroup
+
+	work := make(chan string)
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for key := range work {
+				if err := fn(key); err != nil {
+					logln(key, err)
+					atomic.AddInt32(&failed, 1)
+				}
+			}
+		}()
+	}
+
+	for _, key := range keys {
+		work <- key
+	}
+
+	close(work)
+	wg.Wait()
+
+	if len(keys) > 1 {
+		logln("done:", len(keys), "files,", failed, "failed")
+	}
+
+	return int(failed)
+}
+
+// Upload local file fpath as key, starting from position pos
+func putFile(sdb storage.StorageDB, key, fpath string, pos int64) error {
+	fname := filepath.Base(fpath)
+
+	f, err := os.Open(fpath)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	ctype := "application/octet-stream"
+	hash, sz, err := storage.GetHashAlg(f, hashAlg)
+	if err != nil {
+		return fmt.Errorf("calculating hash: %v", err)
+	}
+
+	if pos == 0 {
+		// if pos != 0, assume the file exists, but we didn't finish writing
+
+		if verbose {
+			logln("create file", fname, ctype, sz)
+		}
+
+		if err := sdb.CreateFile(key, fname, ctype, sz, hash); err != nil {
+			return err
+		}
+	}
+
+	var buf = make([]byte, 4*storage.BlockSize)
+
+	for pos != storage.FileComplete {
+		n, err := f.ReadAt(buf, pos)
+		if err == io.EOF {
+			if n != 0 {
+				err = nil
+			} else {
+				logln("unexpected EOF at", pos, "len", len(buf))
+				break
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		if verbose {
+			logln("write", key, sz, pos)
+		}
+
+		npos, err := sdb.WriteAt(key, pos, buf[:n])
+		if err != nil {
+			return err
+		}
+
+		pos = npos
+	}
+
+	return nil
+}
+
+// A byte range, from start to end (inclusive, -1 for the end of the file)
+type byteRange struct {
+	start, end int64
+}
+
+// Parse a range in the form "start-end" or "start-" (empty for the whole file)
+func parseRange(s string) (byteRange, error) {
+	r := byteRange{start: 0, end: -1}
+	if s == "" {
+		return r, nil
+	}
+
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return r, fmt.Errorf("invalid range %q, expected start-end", s)
+	}
+
+	var err error
+
+	if r.start, err = strconv.ParseInt(parts[0], 10, 64); err != nil || r.start < 0 {
+		return r, fmt.Errorf("invalid range start %q", parts[0])
+	}
+
+	if parts[1] != "" {
+		if r.end, err = strconv.ParseInt(parts[1], 10, 64); err != nil || r.end < r.start {
+			return r, fmt.Errorf("invalid range end %q", parts[1])
+		}
+	}
+
+	return r, nil
+}
+
+// Download the byte range r of key to writer
+func getFile(sdb storage.StorageDB, key string, writer io.Writer, r byteRange) error {
+	stat, err := sdb.Stat(key)
+	if err != nil {
+		return err
+	}
+
+	end := stat.Length
+	if r.end >= 0 {
+		end = r.end + 1
+	}
+	if r.start > 0 && r.start >= stat.Length || end > stat.Length {
+		return fmt.Errorf("range outside file length %v", stat.Length)
+	}
+
+	if r.start == 0 && r.end < 0 && stat.Base == 0 { // the whole file: read the blocks in sequence
+		if verbose {
+			logln("read", key, "sequential")
+		}
+
+		reader, _, err := sdb.OpenReader(key)
+		if err != nil {
+			return err
+		}
+
+		defer reader.Close()
+
+		_, err = io.Copy(writer, reader)
+		return err
+	}
+
+	var buf = make([]byte, 4*storage.BlockSize)
+	var pos = r.start
+
+	for pos < end {
+		if verbose {
+			logln("read", key, pos)
+		}
+
+		if rest := end - pos; rest < int64(len(buf)) {
+			buf = buf[:rest]
+		}
+
+		n, err := sdb.ReadAt(key, buf, pos)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if n == 0 {
+			return io.ErrUnexpectedEOF
+		}
+
+		if _, err = writer.Write(buf[:n]); err != nil {
+			return err
+		}
+
+		pos += n
+	}
+
+	return nil
+}
+
+// Download the byte range r of key to local file fpath (or the original file name, if fpath is empty)
+func getLocalFile(sdb storage.StorageDB, key, fpath string, r byteRange) error {
+	if fpath == "" {
+		stat, err := sdb.Stat(key)
+		if err != nil {
+			return err
+		}
+
+		fpath = stat.Name
+	}
+
+	f, err := os.OpenFile(fpath, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	logln("Get", fpath)
+	return getFile(sdb, key, f, r)
+}
+
 func main() {
 	path := flag.String("path", "storage.data", "path to data folder")
 	ttl := flag.Duration("ttl", 10*time.Minute, "time to live")
@@ -24,18 +256,22 @@ func main() {
 	cat := flag.Bool("cat", false, "download file to stdout")
 	del := flag.Bool("del", false, "delete file")
 	stat := flag.Bool("stat", false, "file info")
+	dedup := flag.Bool("dedup-report", false, "report the space deduplicating identical files would save")
 	ppos := flag.Int64("pos", 0, "file position")
+	prange := flag.String("range", "", "byte range to download, as start-end or start- (get, cat)")
 	aws := flag.Bool("aws", false, "store data in AWS")
-	verbose := flag.Bool("verbose", false, "log progress")
+	flag.BoolVar(&verbose, "verbose", false, "log progress")
+	flag.StringVar(&hashAlg, "hash", storage.HashCumulative, "hash algorithm for new files (cumulative, merkle, sha256)")
+	concurrency := flag.Int("concurrency", 1, "number of files to process in parallel (put, get)")
 	flag.Parse()
 
 	var sdb storage.StorageDB
 	var err error
 
 	if *aws {
-		sdb, err = storage.OpenAWS(*path, *ttl)
+		sdb, err = storage.OpenAWS(*path, *ttl, storage.WithHash(hashAlg))
 	} else {
-		sdb, err = storage.OpenBadger(*path, *rdonly, *ttl)
+		sdb, err = storage.OpenBadger(*path, *rdonly, *ttl, storage.WithHash(hashAlg))
 	}
 
 	if err != nil {
@@ -59,81 +295,44 @@ func main() {
 		}
 	}
 
-	if *put {
-		var key, fname, fpath string
-
-		switch flag.NArg() {
-		case 1:
-			fpath = flag.Arg(0)
-			fname = filepath.Base(fpath)
-			key = fname
-
-		case 2:
-			key = flag.Arg(0)
-			fpath = flag.Arg(1)
-			fname = filepath.Base(fpath)
-
-		default:
-			fmt.Println("usage: test -put [key] file")
-			return
-		}
-
-		f, err := os.Open(fpath)
+	if *dedup {
+		stats, err := storage.DedupReport(sdb)
 		if err != nil {
 			fmt.Println(err)
 			return
 		}
 
-		defer f.Close()
+		fmt.Printf("files: %v, duplicates: %v, total bytes: %v, unique bytes: %v, savings: %v bytes\n",
+			stats.Files, stats.Duplicates, stats.TotalBytes, stats.UniqueBytes, stats.TotalBytes-stats.UniqueBytes)
+	}
 
-		ctype := "application/octet-stream"
-		hash, sz, err := storage.GetHash(f)
-		if err != nil {
-			fmt.Println("calculating hash:", err)
+	if *put {
+		switch flag.NArg() {
+		case 0:
+			fmt.Println("usage: test -put [key] file | -put file file...")
 			return
-		}
-
-		if *ppos == 0 {
-			// if ppos != 0, assume the file exists, but we didn't finish writing
 
-			if *verbose {
-				fmt.Println("create file", fname, ctype, sz)
-			}
-
-			if err := sdb.CreateFile(key, fname, ctype, sz, hash); err != nil {
+		case 1:
+			fpath := flag.Arg(0)
+			if err := putFile(sdb, filepath.Base(fpath), fpath, *ppos); err != nil {
 				fmt.Println(err)
 				return
 			}
-		}
-
-		var buf = make([]byte, 4*storage.BlockSize)
 
-		for pos := *ppos; pos != storage.FileComplete; {
-			n, err := f.ReadAt(buf, pos)
-			if err == io.EOF {
-				if n != 0 {
-					err = nil
-				} else {
-					fmt.Println("unexpected EOF at", pos, "len", len(buf))
-					break
+		case 2:
+			if *concurrency <= 1 { // key file
+				if err := putFile(sdb, flag.Arg(0), flag.Arg(1), *ppos); err != nil {
+					fmt.Println(err)
+					return
 				}
+				break
 			}
-			if err != nil {
-				fmt.Println(err)
-				return
-			}
-
-			if *verbose {
-				fmt.Println("write", key, sz, pos)
-			}
-
-			npos, err := sdb.WriteAt(key, pos, buf[:n])
-			if err != nil {
-				fmt.Println(err)
-				return
-			}
+			fallthrough
 
-			pos = npos
+		default: // multiple files, the key is the file name
+			parallel(*concurrency, flag.Args(), func(fpath string) error {
+				return putFile(sdb, filepath.Base(fpath), fpath, 0)
+			})
 		}
 	}
 
@@ -142,68 +341,36 @@ func main() {
 			if *cat {
 				fmt.Println("usage: test -cat key")
 			} else {
-				fmt.Println("usage: test -get key [file]")
+				fmt.Println("usage: test -get key [file] | -get key key...")
 			}
 			return
 		}
 
-		key := flag.Arg(0)
-		var fpath string
-		var writer io.Writer
-
-		stat, err := sdb.Stat(key)
+		r, err := parseRange(*prange)
 		if err != nil {
 			fmt.Println(err)
 			return
 		}
 
-		if *get {
-			switch flag.NArg() {
-			case 1:
-				fpath = stat.Name
-
-			case 2:
-				fpath = flag.Arg(1)
-
-			default:
-				fmt.Println("usage: test -get key [file]")
-				return
-			}
-
-			f, err := os.OpenFile(fpath, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0666)
-			if err != nil {
+		if *cat {
+			if err := getFile(sdb, flag.Arg(0), os.Stdout, r); err != nil {
 				fmt.Println(err)
 				return
 			}
-
-			defer f.Close()
-			writer = f
-		} else {
-			writer = os.Stdout
-		}
-
-		fmt.Println("Get", fpath)
-
-		var buf = make([]byte, 4*storage.BlockSize)
-		var pos int64
-
-		for pos < stat.Length {
-			if *verbose {
-				fmt.Println("read", key, pos)
-			}
-
-			n, err := sdb.ReadAt(key, buf, pos)
-			if err != nil {
+		} else if flag.NArg() <= 2 && *concurrency <= 1 {
+			if err := getLocalFile(sdb, flag.Arg(0), flag.Arg(1), r); err != nil {
 				fmt.Println(err)
 				return
 			}
-
-			if _, err = writer.Write(buf[:n]); err != nil {
-				fmt.Println(err)
+		} else { // multiple keys, saved with the original file name
+			if *prange != "" {
+				fmt.Println("-range requires a single key")
 				return
 			}
 
-			pos += n
+			parallel(*concurrency, flag.Args(), func(key string) error {
+				return getLocalFile(sdb, key, "", r)
+			})
 		}
 	}
 
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/raff/cashier/storage"
+)
+
+// Every key is processed once by at most n workers, and the failed keys are counted
+func TestParallel(t *testing.T) {
+	var keys []string
+	for i := 0; i < 50; i++ {
+		keys = append(keys, fmt.Sprintf("f%02d", i))
+	}
+
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	done := map[string]int{}
+
+	failed := parallel(4, append(keys, "missing"), func(key string) error {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		done[key]++
+		mu.Unlock()
+
+		defer func() {
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}()
+
+		if key == "missing" {
+			return errors.New("not found")
+		}
+
+		return nil
+	})
+	if failed != 1 {
+		t.Errorf("%v failed, expected 1 (the missing key)", failed)
+	}
+	if maxRunning > 4 {
+		t.Errorf("%v workers running, expected at most 4", maxRunning)
+	}
+
+	for _, key := range keys {
+		if done[key] != 1 {
+			t.Errorf("%v processed %v times", key, done[key])
+		}
+	}
+}
+
+// Return a badger store with the file key containing data, removed at the end of the test
+func openTestStore(t *testing.T, key string, data []byte) storage.StorageDB {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sdb, err := storage.OpenBadger(dir, false, time.Hour)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		sdb.Close()
+		os.RemoveAll(dir)
+	})
+
+	hash, _, err := storage.GetHash(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sdb.CreateFile(key, key, "", int64(len(data)), hash); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.WriteAll(sdb, key, 0, data); err != nil {
+		t.Fatal(err)
+	}
+
+	return sdb
+}
+
+func TestGetFileRange(t *testing.T) {
+	data := make([]byte, 5*storage.BlockSize+10)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	sdb := openTestStore(t, "f", data)
+
+	for _, tc := range []struct {
+		srange     string
+		start, end int
+	}{
+		{"", 0, len(data)},
+		{"100-199", 100, 200},
+		{"16000-70000", 16000, 70001}, // across blocks
+		{"81900-", 81900, len(data)},
+	} {
+		r, err := parseRange(tc.srange)
+		if err != nil {
+			t.Fatalf("%q: %v", tc.srange, err)
+		}
+
+		var buf bytes.Buffer
+		if err := getFile(sdb, "f", &buf, r); err != nil || !bytes.Equal(buf.Bytes(), data[tc.start:tc.end]) {
+			t.Errorf("%q: %v bytes, %v", tc.srange, buf.Len(), err)
+		}
+	}
+
+	for _, srange := range []string{"100", "x-1", "10-5", "-10"} {
+		if _, err := parseRange(srange); err == nil {
+			t.Errorf("%q: accepted", srange)
+		}
+	}
+
+	for _, srange := range []string{"100-100000", "90000-"} {
+		r, _ := parseRange(srange)
+		if err := getFile(sdb, "f", ioutil.Discard, r); err == nil {
+			t.Errorf("%q: no error outside the file", srange)
+		}
+	}
+}
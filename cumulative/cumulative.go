@@ -1,5 +1,10 @@
 // Package cumulative provides an implementation of cumulative hash
-// (with the underlying hash been MD5)
+// (with the underlying hash been MD5).
+//
+// The input is split in chunks of ChunkSize bytes (the last one may be shorter)
+// and the hash is the byte-wise sum (modulo 256) of the MD5 digests of the chunks.
+// The result doesn't depend on how the input is split in Write calls: an input
+// up to ChunkSize bytes has the same hash as MD5, including the empty input.
 package cumulative
 
 import (
@@ -8,6 +13,9 @@ import (
 	"hash"
 )
 
+// The size of the hashed chunks (the default storage block size)
+const ChunkSize = 16 * 1024
+
 // New returns a new hash.Hash computing the cumulative hash of the input.
 // The Hash also implements encoding.BinaryMarshaler and encoding.BinaryUnmarshaler
 // to marshal and unmarshal the internal state of the hash.
@@ -16,11 +24,13 @@ func New() hash.Hash {
 }
 
 type digest struct {
-	current []byte
+	current []byte // sum of the complete chunks (nil if none)
+	buf     []byte // partial chunk
 }
 
 func (c *digest) Reset() {
 	c.current = nil
+	c.buf = nil
 }
 
 func (c *digest) Size() int {
@@ -31,34 +41,78 @@ func (c *digest) BlockSize() int {
 	return md5.BlockSize
 }
 
+// Add the MD5 of chunk to sum
+func add(sum, chunk []byte) []byte {
+	hash := md5.Sum(chunk)
+	if sum == nil {
+		return hash[:]
+	}
+
+	for i, h := range hash {
+		sum[i] += h
+	}
+	return sum
+}
+
 func (c *digest) Write(p []byte) (nn int, err error) {
 	nn = len(p)
-	hash := md5.Sum(p)
-	if c.current == nil {
-		c.current = hash[:]
-		return nn, nil
+
+	if len(c.buf) > 0 { // complete the partial chunk first
+		n := ChunkSize - len(c.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+
+		c.buf, p = append(c.buf, p[:n]...), p[n:]
+		if len(c.buf) < ChunkSize {
+			return nn, nil
+		}
+
+		c.current = add(c.current, c.buf)
+		c.buf = c.buf[:0]
 	}
 
-	for i, h := range hash {
-		c.current[i] += h
+	for len(p) >= ChunkSize {
+		c.current = add(c.current, p[:ChunkSize])
+		p = p[ChunkSize:]
 	}
+
+	c.buf = append(c.buf, p...)
 	return nn, nil
 }
 
 func (c *digest) Sum(in []byte) []byte {
-	// Make a copy of d so that caller can keep writing and summing.
+	if c.current == nil || len(c.buf) > 0 { // no input is the same as MD5
+		// Make a copy of current so that caller can keep writing and summing.
+		sum := add(append([]byte(nil), c.current...), c.buf)
+		return append(in, sum...)
+	}
+
 	return append(in, c.current...)
 }
 
+// The state is the sum of the complete chunks (zero if none) followed by the partial chunk,
+// so it's up to ChunkSize bytes longer than the sum when the input is written in smaller pieces
+// (e.g. by a storage with a smaller block size)
 func (d *digest) MarshalBinary() ([]byte, error) {
-	return d.current, nil
+	if len(d.buf) == 0 {
+		return append([]byte(nil), d.current...), nil
+	}
+
+	current := d.current
+	if current == nil {
+		current = make([]byte, md5.Size)
+	}
+
+	return append(append([]byte(nil), current...), d.buf...), nil
 }
 
 func (d *digest) UnmarshalBinary(b []byte) error {
-	if len(b) != d.Size() && len(b) == 0 {
+	if len(b) < d.Size() || len(b) > d.Size()+ChunkSize {
 		return errors.New("cumulative: invalid hash state size")
 	}
 
-	d.current = b
+	d.current = append([]byte(nil), b[:md5.Size]...)
+	d.buf = append([]byte(nil), b[md5.Size:]...)
 	return nil
 }
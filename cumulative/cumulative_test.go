@@ -0,0 +1,81 @@
+package cumulative
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding"
+	"testing"
+)
+
+func testInput(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i*13 + i/97)
+	}
+
+	return data
+}
+
+// Return the hash of data written in chunks of chunk bytes
+func sumChunks(data []byte, chunk int) []byte {
+	h := New()
+	for len(data) > chunk {
+		h.Write(data[:chunk])
+		data = data[chunk:]
+	}
+	h.Write(data)
+
+	return h.Sum(nil)
+}
+
+// The hash doesn't depend on how the input is split in Write calls
+func TestChunking(t *testing.T) {
+	for _, size := range []int{0, 1, 100, ChunkSize - 1, ChunkSize, 3*ChunkSize + 17} {
+		data := testInput(size)
+		expected := sumChunks(data, ChunkSize)
+
+		for _, chunk := range []int{1, 100, ChunkSize/2 + 3, ChunkSize, 2 * ChunkSize} {
+			if sum := sumChunks(data, chunk); !bytes.Equal(sum, expected) {
+				t.Errorf("size %v in chunks of %v: %x, expected %x", size, chunk, sum, expected)
+			}
+		}
+
+		if size <= ChunkSize {
+			if md := md5.Sum(data); !bytes.Equal(expected, md[:]) {
+				t.Errorf("size %v: %x, expected the MD5 %x", size, expected, md)
+			}
+		}
+	}
+}
+
+// The hash continues from a marshalled state, and the state doesn't change with later writes
+func TestState(t *testing.T) {
+	data := testInput(2*ChunkSize + 500)
+	expected := sumChunks(data, ChunkSize)
+
+	for _, split := range []int{100, ChunkSize, ChunkSize + 100, 2 * ChunkSize} {
+		h := New()
+		h.Write(data[:split])
+
+		state, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		saved := append([]byte(nil), state...)
+
+		h.Write(data[split:])
+		if !bytes.Equal(state, saved) {
+			t.Errorf("split %v: the state changed after Write", split)
+		}
+
+		r := New()
+		if err := r.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+			t.Fatal(err)
+		}
+		r.Write(data[split:])
+
+		if sum := r.Sum(nil); !bytes.Equal(sum, expected) {
+			t.Errorf("split %v: %x, expected %x", split, sum, expected)
+		}
+	}
+}
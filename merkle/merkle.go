@@ -0,0 +1,78 @@
+// Package merkle provides an implementation of a two-level hash tree:
+// each block written is hashed with MD5, and the final hash is the MD5
+// of the ordered list of block hashes.
+//
+// Blocks can be hashed in any order (see BlockHash.WriteBlock),
+// and the final hash only requires hashing the block hashes.
+package merkle
+
+import (
+	"crypto/md5"
+	"errors"
+	"hash"
+)
+
+// BlockHash is a hash.Hash that can also hash blocks out of order
+type BlockHash interface {
+	hash.Hash
+
+	// WriteBlock sets the hash of block n to the hash of p
+	WriteBlock(n int, p []byte)
+}
+
+// New returns a new BlockHash computing the merkle hash of the input.
+// Each call to Write hashes one block.
+// The Hash also implements encoding.BinaryMarshaler and encoding.BinaryUnmarshaler
+// to marshal and unmarshal the internal state of the hash (the list of block hashes).
+func New() BlockHash {
+	return new(digest)
+}
+
+type digest struct {
+	blocks []byte // concatenated block hashes
+}
+
+func (d *digest) Reset() {
+	d.blocks = nil
+}
+
+func (d *digest) Size() int {
+	return md5.Size
+}
+
+func (d *digest) BlockSize() int {
+	return md5.BlockSize
+}
+
+func (d *digest) Write(p []byte) (nn int, err error) {
+	hash := md5.Sum(p)
+	d.blocks = append(d.blocks, hash[:]...)
+	return len(p), nil
+}
+
+func (d *digest) WriteBlock(n int, p []byte) {
+	if end := (n + 1) * md5.Size; end > len(d.blocks) {
+		d.blocks = append(d.blocks, make([]byte, end-len(d.blocks))...)
+	}
+
+	hash := md5.Sum(p)
+	copy(d.blocks[n*md5.Size:], hash[:])
+}
+
+func (d *digest) Sum(in []byte) []byte {
+	hash := md5.Sum(d.blocks)
+	return append(in, hash[:]...)
+}
+
+func (d *digest) MarshalBinary() ([]byte, error) {
+	return append([]byte(nil), d.blocks...), nil
+}
+
+func (d *digest) UnmarshalBinary(b []byte) error {
+	if len(b)%md5.Size != 0 {
+		return errors.New("merkle: invalid hash state size")
+	}
+
+	d.blocks = append([]byte(nil), b...)
+	return nil
+}
@@ -0,0 +1,92 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding"
+	"testing"
+)
+
+func testBlocks() [][]byte {
+	var blocks [][]byte
+	for i := 0; i < 10; i++ {
+		blocks = append(blocks, bytes.Repeat([]byte{byte(i)}, 100+i))
+	}
+
+	return blocks
+}
+
+// The hash of blocks written in sequence is the MD5 of the ordered list of block MD5s
+func TestSequential(t *testing.T) {
+	blocks := testBlocks()
+
+	h := New()
+	var list []byte
+	for _, b := range blocks {
+		h.Write(b)
+
+		bh := md5.Sum(b)
+		list = append(list, bh[:]...)
+	}
+
+	if expected := md5.Sum(list); !bytes.Equal(h.Sum(nil), expected[:]) {
+		t.Fatalf("hash %x, expected %x", h.Sum(nil), expected)
+	}
+}
+
+// Blocks hashed out of order with WriteBlock give the hash of the sequential writes
+func TestWriteBlockOutOfOrder(t *testing.T) {
+	blocks := testBlocks()[:3]
+
+	sequential := New()
+	for _, b := range blocks {
+		sequential.Write(b)
+	}
+
+	h := New()
+	for _, n := range []int{2, 0, 1} {
+		h.WriteBlock(n, blocks[n])
+	}
+
+	if !bytes.Equal(h.Sum(nil), sequential.Sum(nil)) {
+		t.Fatalf("hash %x, expected %x", h.Sum(nil), sequential.Sum(nil))
+	}
+}
+
+// The state is the list of block hashes, and resumes the hash where it was
+func TestStateRoundTrip(t *testing.T) {
+	blocks := testBlocks()
+
+	full := New()
+	for _, b := range blocks {
+		full.Write(b)
+	}
+
+	h := New()
+	for i, b := range blocks {
+		h.Write(b)
+
+		state, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(state) != (i+1)*md5.Size {
+			t.Fatalf("state size %v after %v blocks", len(state), i+1)
+		}
+
+		h = New()
+		if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !bytes.Equal(h.Sum(nil), full.Sum(nil)) {
+		t.Fatalf("resumed hash %x, expected %x", h.Sum(nil), full.Sum(nil))
+	}
+}
+
+func TestInvalidState(t *testing.T) {
+	if err := New().(encoding.BinaryUnmarshaler).UnmarshalBinary(make([]byte, md5.Size+1)); err == nil {
+		t.Fatal("expected an error for a truncated state")
+	}
+}
@@ -0,0 +1,169 @@
+package storage
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	AuditCreate     = "create"
+	AuditWrite      = "write"    // failed writes only
+	AuditComplete   = "complete" // the last write of a file
+	AuditRead       = "read"
+	AuditDelete     = "delete"
+	AuditSoftDelete = "soft-delete"
+	AuditTrim       = "trim"
+	AuditIncr       = "incr"
+	AuditCopy       = "copy"   // the key is the new file
+	AuditRename     = "rename" // the key is the new file
+)
+
+// An operation on a file
+type AuditEvent struct {
+	Time  time.Time `json:"time"`
+	Op    string    `json:"op"`
+	Key   string    `json:"key"`
+	Bytes int64     `json:"bytes,omitempty"`
+	From  string    `json:"from,omitempty"`  // source of a copy or rename
+	Error string    `json:"error,omitempty"` // empty if the operation succeeded
+}
+
+// A destination for audit events
+type AuditSink interface {
+	Record(event AuditEvent)
+}
+
+// A storage service that records all changes to files in an audit sink.
+// Reads are not recorded here, since a download is made of many ReadAt calls.
+type audited struct {
+	StorageDB
+
+	sink AuditSink
+}
+
+// Return a storage service recording file changes to sink
+func Audit(sdb StorageDB, sink AuditSink) StorageDB {
+	return &audited{StorageDB: sdb, sink: sink}
+}
+
+func (a *audited) record(op, key string, bytes int64, err error) error {
+	event := AuditEvent{Time: time.Now(), Op: op, Key: key, Bytes: bytes}
+	if err != nil {
+		event.Error = err.Error()
+	}
+
+	a.sink.Record(event)
+	return err
+}
+
+func (a *audited) recordMove(op, src, dst string, err error) error {
+	event := AuditEvent{Time: time.Now(), Op: op, Key: dst, From: src}
+	if err != nil {
+		event.Error = err.Error()
+	}
+
+	a.sink.Record(event)
+	return err
+}
+
+func (a *audited) CreateFile(key, filename, ctype string, size int64, hash []byte, opts ...FileOption) error {
+	return a.record(AuditCreate, key, size, a.StorageDB.CreateFile(key, filename, ctype, size, hash, opts...))
+}
+
+func (a *audited) CreateFileWithTimes(key, filename, ctype string, size int64, hash []byte, created, expires time.Time, opts ...FileOption) error {
+	return a.record(AuditCreate, key, size, a.StorageDB.CreateFileWithTimes(key, filename, ctype, size, hash, created, expires, opts...))
+}
+
+func (a *audited) Copy(src, dst string) error {
+	return a.recordMove(AuditCopy, src, dst, a.StorageDB.Copy(src, dst))
+}
+
+func (a *audited) Rename(src, dst string) error {
+	return a.recordMove(AuditRename, src, dst, a.StorageDB.Rename(src, dst))
+}
+
+func (a *audited) DeleteFile(key string) error {
+	return a.record(AuditDelete, key, 0, a.StorageDB.DeleteFile(key))
+}
+
+func (a *audited) SoftDelete(key string) error {
+	return a.record(AuditSoftDelete, key, 0, a.StorageDB.SoftDelete(key))
+}
+
+func (a *audited) WriteAt(key string, pos int64, data []byte) (int64, error) {
+	npos, err := a.StorageDB.WriteAt(key, pos, data)
+	if err != nil {
+		a.record(AuditWrite, key, int64(len(data)), err)
+	} else if npos == FileComplete {
+		a.record(AuditComplete, key, pos+int64(len(data)), nil)
+	}
+
+	return npos, err
+}
+
+func (a *audited) TrimFront(key string, bytes int64) error {
+	return a.record(AuditTrim, key, bytes, a.StorageDB.TrimFront(key, bytes))
+}
+
+func (a *audited) IncrFile(key string, delta int64) (int64, error) {
+	value, err := a.StorageDB.IncrFile(key, delta)
+	return value, a.record(AuditIncr, key, delta, err)
+}
+
+// An audit sink appending events as JSON lines to a file, and keeping the most recent in memory
+type AuditLog struct {
+	mu     sync.Mutex
+	f      *os.File
+	enc    *json.Encoder
+	recent []AuditEvent // ring buffer
+	next   int
+	full   bool
+}
+
+// Open (or create) the audit log file, keeping the last n events in memory
+func OpenAuditLog(path string, n int) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if n < 1 {
+		n = 1
+	}
+
+	return &AuditLog{f: f, enc: json.NewEncoder(f), recent: make([]AuditEvent, n)}, nil
+}
+
+func (l *AuditLog) Record(event AuditEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.enc.Encode(event); err != nil {
+		log.Println("audit:", err)
+	}
+
+	l.recent[l.next] = event
+	l.next = (l.next + 1) % len(l.recent)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// Return the recent events, oldest first
+func (l *AuditLog) Recent() []AuditEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.full {
+		return append([]AuditEvent{}, l.recent[:l.next]...)
+	}
+
+	return append(append([]AuditEvent{}, l.recent[l.next:]...), l.recent[:l.next]...)
+}
+
+func (l *AuditLog) Close() error {
+	return l.f.Close()
+}
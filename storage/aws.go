@@ -1,6 +1,6 @@
 /*
 This package stores files in AWS S3 (and metadata in DynamoDB),
-allowing for incremental writes of multiple of BlockSize.
+allowing for incremental writes of multiple of the block size.
 For each file it stores a "metadata" record and a series of "block" records.
 Files and data expire after a predefined TTL.
 */
@@ -11,7 +11,9 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -27,15 +29,107 @@ import (
 // An instance of the Storage service based on AWS S3
 
 type awsStorage struct {
-	db     *dynamodb.Client
+	options
+
+	db     dynamoClient
 	store  *s3.Client
 	bucket string // bucket is also used as the table name in DynamoDB
 	prefix string
 	ttl    time.Duration
 }
 
+// The DynamoDB operations used by the store (a dynamoAPI, or a fake in tests)
+type dynamoClient interface {
+	GetItem(ctx context.Context, in *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error)
+	PutItem(ctx context.Context, in *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error)
+	UpdateItem(ctx context.Context, in *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error)
+	DeleteItem(ctx context.Context, in *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error)
+	Scan(ctx context.Context, in *dynamodb.ScanInput) (*dynamodb.ScanOutput, error)
+}
+
+// A dynamoClient sending the requests with the AWS client
+type dynamoAPI struct {
+	*dynamodb.Client
+}
+
+func (c dynamoAPI) GetItem(ctx context.Context, in *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	res, err := c.GetItemRequest(in).Send(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.GetItemOutput, nil
+}
+
+func (c dynamoAPI) PutItem(ctx context.Context, in *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	res, err := c.PutItemRequest(in).Send(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.PutItemOutput, nil
+}
+
+func (c dynamoAPI) UpdateItem(ctx context.Context, in *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	res, err := c.UpdateItemRequest(in).Send(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.UpdateItemOutput, nil
+}
+
+func (c dynamoAPI) DeleteItem(ctx context.Context, in *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	res, err := c.DeleteItemRequest(in).Send(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.DeleteItemOutput, nil
+}
+
+func (c dynamoAPI) Scan(ctx context.Context, in *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+	res, err := c.ScanRequest(in).Send(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.ScanOutput, nil
+}
+
+// Call page with the items of each page of the scan
+func scanPages(db dynamoClient, in *dynamodb.ScanInput, page func(items []map[string]dynamodb.AttributeValue) error) error {
+	for {
+		res, err := db.Scan(context.TODO(), in)
+		if err != nil {
+			return err
+		}
+		if err := page(res.Items); err != nil {
+			return err
+		}
+		if len(res.LastEvaluatedKey) == 0 {
+			return nil
+		}
+
+		next := *in
+		next.ExclusiveStartKey = res.LastEvaluatedKey
+		in = &next
+	}
+}
+
+// DynamoDB items are limited to 400KB, including attribute names and other attributes
+const maxDynamoValue = 400*1024 - 1024
+
 // Open data folder and return instance of storage service
-func OpenAWS(dataFolder string, ttl time.Duration) (*awsStorage, error) {
+func OpenAWS(dataFolder string, ttl time.Duration, opts ...Option) (*awsStorage, error) {
+	o := getOptions(opts)
+	if err := o.check(); err != nil {
+		return nil, err
+	}
+
+	if o.maxInfoSize <= 0 || o.maxInfoSize > maxDynamoValue {
+		o.maxInfoSize = maxDynamoValue
+	}
 
 	var prefix string
 	parts := strings.SplitN(dataFolder, "/", 2)
@@ -72,7 +166,55 @@ func OpenAWS(dataFolder string, ttl time.Duration) (*awsStorage, error) {
 		return nil, err // table does not exist ?
 	}
 
-	return &awsStorage{db: db, store: store, bucket: bucket, prefix: prefix, ttl: ttl}, nil
+	s := &awsStorage{options: o, db: dynamoAPI{db}, store: store, bucket: bucket, prefix: prefix, ttl: ttl}
+	if err := s.checkHash(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Record the default hash algorithm in a new store, or compare it with the recorded one.
+// The record has no TTL, so it doesn't expire.
+func (s *awsStorage) checkHash() error {
+	res, err := s.db.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		ConsistentRead: aws.Bool(true),
+		Key: map[string]dynamodb.AttributeValue{
+			"Id": {
+				S: aws.String(_HASH_KEY),
+			},
+		},
+		ProjectionExpression:     aws.String("#v"),
+		ExpressionAttributeNames: map[string]string{"#v": "Value"},
+		TableName:                aws.String(s.bucket),
+	})
+	if err != nil {
+		return err
+	}
+
+	if res.Item != nil {
+		s.checkStoreHash(aws.StringValue(res.Item["Value"].S))
+		return nil
+	}
+
+	_, err = s.db.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		Item: map[string]dynamodb.AttributeValue{
+			"Id": {
+				S: aws.String(_HASH_KEY),
+			},
+			"Value": {
+				S: aws.String(s.hashAlg()),
+			},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(Id)"),
+		TableName:           aws.String(s.bucket),
+	})
+
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return nil // recorded by another instance
+	}
+
+	return err
 }
 
 // Close storage service
@@ -87,23 +229,54 @@ func (s *awsStorage) GC() error {
 }
 
 func Nint(s *string) int64 {
-	n, _ := strconv.Atoi(*s)
-	return int64(n)
+	n, _ := strconv.ParseInt(*s, 10, 64)
+	return n
 }
 
 func intN(n int64) *string {
-	return aws.String(strconv.Itoa(int(n)))
+	return aws.String(strconv.FormatInt(n, 10))
+}
+
+// Return the expiration time for updated file records.
+// Files with preserved times keep their original expiration.
+func (s *awsStorage) expiration(fileInfo *info) time.Time {
+	if fileInfo.Preserve && !fileInfo.ExpiresAt.IsZero() {
+		return fileInfo.ExpiresAt
+	}
+	if fileInfo.Reserve > 0 {
+		return s.now().Add(fileInfo.Reserve)
+	}
+	if fileInfo.TTL > 0 {
+		return s.now().Add(fileInfo.TTL)
+	}
+
+	return s.now().Add(s.ttl)
 }
 
 func (s *awsStorage) upsertInfo(key string, value *info, create bool) error {
+	return s.putInfo(key, value, create, s.expiration(value))
+}
+
+// Write the file info, expiring at the specified time
+func (s *awsStorage) putInfo(key string, value *info, create bool, expires time.Time) error {
 	var cond *string
 
+	if create {
+		if err := value.completeEmpty(); err != nil {
+			return err
+		}
+	}
+
 	data, _ := value.MarshalString()
+	if err := s.checkInfoSize([]byte(data)); err != nil {
+		return err
+	}
+
 	if create {
 		cond = aws.String("attribute_not_exists(Id)")
 	}
 
-	_, err := s.db.PutItemRequest(&dynamodb.PutItemInput{
+	_, err := s.db.PutItem(context.TODO(), &dynamodb.PutItemInput{
 		Item: map[string]dynamodb.AttributeValue{
 			"Id": {
 				S: aws.String(infoKey(key)),
@@ -112,7 +285,7 @@ func (s *awsStorage) upsertInfo(key string, value *info, create bool) error {
 				S: aws.String(data),
 			},
 			"TTL": {
-				N: intN(time.Now().Add(s.ttl).Unix()),
+				N: intN(expires.Unix()),
 			},
 		},
 		ConditionExpression:         cond,
@@ -120,7 +293,7 @@ func (s *awsStorage) upsertInfo(key string, value *info, create bool) error {
 		ReturnItemCollectionMetrics: dynamodb.ReturnItemCollectionMetricsNone,
 		ReturnValues:                dynamodb.ReturnValueNone,
 		TableName:                   aws.String(s.bucket),
-	}).Send(context.TODO())
+	})
 
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
@@ -133,102 +306,140 @@ func (s *awsStorage) upsertInfo(key string, value *info, create bool) error {
 	return err
 }
 
-func (s *awsStorage) getInfo(key string) (*info, error) {
+// Read the file info. A consistent read costs twice as much,
+// but is required when the info is going to be updated.
+func (s *awsStorage) getInfo(key string, consistent bool) (*info, error) {
+	fileInfo, _, err := s.getInfoValue(key, consistent)
+	return fileInfo, err
+}
+
+// Read the file info, and the serialized info stored in the Value attribute
+func (s *awsStorage) getInfoValue(key string, consistent bool) (*info, string, error) {
 	key = infoKey(key)
 
-	res, err := s.db.GetItemRequest(&dynamodb.GetItemInput{
-		ConsistentRead: aws.Bool(true),
+	res, err := s.db.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		ConsistentRead: aws.Bool(consistent),
 		Key: map[string]dynamodb.AttributeValue{
 			"Id": {
 				S: aws.String(key),
 			},
 		},
-		ReturnConsumedCapacity: dynamodb.ReturnConsumedCapacityNone,
-		TableName:              aws.String(s.bucket),
-	}).Send(context.TODO())
+		// only the attributes of the file info (Value and TTL are reserved words)
+		ProjectionExpression:     aws.String("#v, #t, #c"),
+		ExpressionAttributeNames: map[string]string{"#v": "Value", "#t": "TTL", "#c": "Counter"},
+		ReturnConsumedCapacity:   dynamodb.ReturnConsumedCapacityNone,
+		TableName:                aws.String(s.bucket),
+	})
 
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	if res.Item == nil {
-		return nil, ErrNotFound
+		return nil, "", ErrNotFound
 	}
 
+	value := aws.StringValue(res.Item["Value"].S)
+
 	var fileInfo info
-	if err = (&fileInfo).UnmarshalString(aws.StringValue(res.Item["Value"].S)); err != nil {
+	if err = (&fileInfo).UnmarshalString(value); err != nil {
 		log.Println("Key:", key, "Item:", res)
-		return nil, err
+		return nil, "", err
 	}
 
 	fileInfo.ExpiresAt = time.Unix(Nint(res.Item["TTL"].N), 0)
-	return &fileInfo, nil
+	if fileInfo.Counter {
+		fileInfo.data = fileInfo.setCounter(Nint(res.Item["Counter"].N))
+	}
+
+	return &fileInfo, value, nil
 }
 
 // Create new file, by adding the file info
-func (s *awsStorage) CreateFile(key, filename, ctype string, size int64, hash []byte) error {
-	return s.upsertInfo(key,
-		&info{Name: filename, ContentType: ctype, Length: size, Hash: toHex(hash[:])}, true)
+func (s *awsStorage) CreateFile(key, filename, ctype string, size int64, hash []byte, opts ...FileOption) error {
+	fileInfo := newInfo(&info{Name: filename, ContentType: ctype, Length: size, Hash: toHex(hash[:]), HashAlg: s.hash,
+		BlockSize: s.blockSize, Inlined: s.inlined(size), Created: s.now()}, opts)
+
+	if s.ttlFromCreation {
+		fileInfo.ExpiresAt = s.expiration(fileInfo)
+		fileInfo.Preserve = true
+	}
+
+	return s.upsertInfo(key, fileInfo, true)
+}
+
+// Create new file, preserving the specified creation and expiration time
+func (s *awsStorage) CreateFileWithTimes(key, filename, ctype string, size int64, hash []byte, created, expires time.Time, opts ...FileOption) error {
+	if !expires.After(s.now()) {
+		return ErrExpired
+	}
+
+	return s.putInfo(key,
+		newInfo(&info{Name: filename, ContentType: ctype, Length: size, Hash: toHex(hash[:]), HashAlg: s.hash,
+			BlockSize: s.blockSize, Inlined: s.inlined(size), Created: created, Preserve: true, ExpiresAt: expires}, opts), true, expires)
 }
 
 // Delete file
 func (s *awsStorage) DeleteFile(key string) error {
 	ikey := infoKey(key)
 
-	_, err := s.db.DeleteItemRequest(&dynamodb.DeleteItemInput{
+	fileInfo, err := s.getInfo(key, true)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	if fileInfo != nil && fileInfo.locked(s.now()) {
+		return ErrImmutable
+	}
+
+	_, err = s.db.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
 		Key: map[string]dynamodb.AttributeValue{
 			"Id": {
-				S: aws.String(key),
+				S: aws.String(ikey),
 			},
 		},
 		ReturnConsumedCapacity:      dynamodb.ReturnConsumedCapacityNone,
 		ReturnItemCollectionMetrics: dynamodb.ReturnItemCollectionMetricsNone,
 		ReturnValues:                dynamodb.ReturnValueNone,
 		TableName:                   aws.String(s.bucket),
-	}).Send(context.TODO())
+	})
 	if err != nil {
 		return err
 	}
 
-	// here we should delete the S3 blocks
+	if fileInfo != nil && fileInfo.Inline != nil { // no S3 blocks
+		return nil
+	}
+
+	// delete the S3 blocks, including any left by an earlier failed delete
 	req := s.store.ListObjectsV2Request(&s3.ListObjectsV2Input{
-		Bucket:     aws.String(s.bucket),
-		Prefix:     aws.String(s.prefix),
-		StartAfter: aws.String(prefixKey(key)),
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.prefix + prefixKey(key)),
 	})
 
-	var dels s3.Delete
+	var objs []s3.ObjectIdentifier
 
 	p := s3.NewListObjectsV2Paginator(req)
 
 	for p.Next(context.TODO()) {
-		page := p.CurrentPage()
-
-		for _, obj := range page.Contents {
-			dels.Objects = append(dels.Objects, s3.ObjectIdentifier{Key: obj.Key})
+		for _, obj := range p.CurrentPage().Contents {
+			// skip the blocks of other files with this prefix (e.g. "key:1:0" for "key:1")
+			if _, ok := blockNumber(key, strings.TrimPrefix(aws.StringValue(obj.Key), s.prefix)); ok {
+				objs = append(objs, s3.ObjectIdentifier{Key: obj.Key})
+			}
 		}
 	}
 
 	if err := p.Err(); err != nil {
-		if len(dels.Objects) == 0 {
+		if len(objs) == 0 {
 			return err
 		}
 
 		log.Println(err)
 	}
 
-	if len(dels.Objects) == 0 {
-		return nil
-	}
-
-	_, err = s.store.DeleteObjectsRequest(&s3.DeleteObjectsInput{
-		Bucket: aws.String(s.bucket),
-		Delete: &dels,
-	}).Send(context.TODO())
-
 	// should check for list of Errors in DeleteObjectOutput
-	if err != nil {
-		log.Println("error deleting S3 %v: %v", ikey, err)
+	if err := s.deleteObjects(objs); err != nil {
+		log.Printf("error deleting S3 %v: %v", ikey, err)
 	}
 
 	return nil
@@ -240,29 +451,36 @@ func (s *awsStorage) WriteAt(key string, pos int64, data []byte) (int64, error)
 		return InvalidPos, ErrInvalidPos
 	}
 
-	nblocks, rest := len(data)/BlockSize, len(data)%BlockSize
-	startBlock, rr := int(pos/BlockSize), int(pos%BlockSize)
-	if rr != 0 {
-		log.Println(key, "pos", pos, "block", startBlock, "rest", rr)
-		return InvalidPos, ErrInvalidPos
-	}
-
 	retpos := InvalidPos
 
-	fileInfo, err := s.getInfo(key)
+	fileInfo, err := s.getInfo(key, true)
 	if err != nil {
 		return InvalidPos, err
 	}
 
+	blockSize := fileInfo.blockSize()
+	data = s.writeLimit(data, blockSize)
+
+	nblocks, rest := int64(len(data))/blockSize, int64(len(data))%blockSize
+	startBlock, rr := pos/blockSize, pos%blockSize
+	if rr != 0 {
+		log.Println(key, "pos", pos, "block", startBlock, "rest", rr)
+		return InvalidPos, ErrInvalidPos
+	}
+
 	//log.Println(fileInfo, "start", startBlock, "blocks", nblocks, "rest", rest, "pos", pos)
 
+	if fileInfo.DeletedAt > 0 {
+		return InvalidPos, ErrDeleted
+	}
+
 	if fileInfo.CurPos < 0 { // file complete
 		return InvalidPos, ErrExists
 	}
 
-	if pos != fileInfo.CurPos { // wrong start
-		log.Println(fileInfo.Name, "block", startBlock, "pos", pos, "cur", fileInfo.CurPos)
-		return InvalidPos, ErrInvalidPos
+	if err := fileInfo.checkWrite(pos, int64(len(data))); err != nil { // wrong start
+		log.Println(fileInfo.Name, "block", startBlock, "pos", pos, "cur", fileInfo.CurPos, "ranges", fileInfo.Ranges)
+		return InvalidPos, err
 	}
 
 	if pos+int64(len(data)) > fileInfo.Length { // out of boundary
@@ -270,7 +488,7 @@ func (s *awsStorage) WriteAt(key string, pos int64, data []byte) (int64, error)
 		return InvalidPos, ErrInvalidSize
 	}
 
-	fblocks := int(fileInfo.Length / BlockSize)
+	fblocks := fileInfo.Length / blockSize
 
 	if startBlock+nblocks < fblocks && rest != 0 {
 		log.Println(fileInfo.Name, "block", startBlock, "pos", pos, "n", nblocks, "file", fblocks, "rest", rest)
@@ -285,30 +503,44 @@ func (s *awsStorage) WriteAt(key string, pos int64, data []byte) (int64, error)
 	offs := int64(0)
 	ldata := len(data)
 
-	curHash := getHasher()
+	if fileInfo.Reserve > 0 { // the upload started: the file TTL applies from now
+		fileInfo.Reserve, fileInfo.Preserve = 0, false
+		if s.ttlFromCreation {
+			fileInfo.ExpiresAt = s.expiration(fileInfo)
+			fileInfo.Preserve = true
+		}
+	}
+
+	curHash := getHasher(fileInfo.HashAlg)
 	if err := unmarshalHash(curHash, fileInfo.CurHash); err != nil {
 		return InvalidPos, err
 	}
 
+	if fileInfo.Inlined || fileInfo.Inline != nil { // small file, stored in the metadata record
+		fileInfo.Inline = append(fileInfo.Inline, data...)
+		curHash.Write(data)
+		offs, ldata = int64(len(data)), 0
+	}
+
 	for ldata > 0 {
 		bkey := blockKey(key, block)
 		buf := data[offs:]
-		if len(buf) > BlockSize {
-			buf = buf[:BlockSize]
+		if int64(len(buf)) > blockSize {
+			buf = buf[:blockSize]
 		}
 
 		_, err := s.store.PutObjectRequest(&s3.PutObjectInput{
 			Body:    bytes.NewReader(buf),
 			Bucket:  aws.String(s.bucket),
 			Key:     aws.String(s.prefix + bkey),
-			Expires: aws.Time(time.Now().Add(s.ttl)),
+			Expires: aws.Time(s.expiration(fileInfo)),
 		}).Send(context.TODO())
 
 		if err != nil {
 			return InvalidPos, err
 		}
 
-		curHash.Write(buf)
+		hashBlock(curHash, block, buf)
 
 		block += 1
 		offs += int64(len(buf))
@@ -316,29 +548,35 @@ func (s *awsStorage) WriteAt(key string, pos int64, data []byte) (int64, error)
 	}
 
 	hh := curHash.Sum(nil)
-	if fileInfo.CurPos+offs == fileInfo.Length { // we are done
+	if fileInfo.addRange(pos, offs) == fileInfo.Length { // we are done
 		if fileInfo.Hash == "" {
 			fileInfo.Hash = toHex(hh)
 		} else if fileInfo.Hash != toHex(hh) {
 			// delete file ?
+			hashMismatch(key, fileInfo, toHex(hh))
 			return InvalidPos, ErrInvalidHash
 		}
 
 		retpos = FileComplete
 		fileInfo.CurPos = FileComplete
-		fileInfo.CurHash = ""
+		fileInfo.CurHash = completeHashState(fileInfo.HashAlg, curHash)
 	} else {
 		fileInfo.CurHash, err = marshalHash(curHash)
 		if err != nil {
 			return InvalidPos, err
 		}
 
-		fileInfo.CurPos += offs
-		retpos = fileInfo.CurPos
+		retpos = pos + offs
+	}
+
+	if !fileInfo.Preserve {
+		fileInfo.Created = s.now()
 	}
 
-	fileInfo.Created = time.Now()
-	return retpos, s.upsertInfo(key, fileInfo, false)
+	expires := s.expiration(fileInfo)
+	fileInfo.completeMigrated()
+
+	return retpos, s.putInfo(key, fileInfo, false, expires)
 }
 
 func (s *awsStorage) ReadAt(key string, buf []byte, pos int64) (int64, error) {
@@ -346,38 +584,63 @@ func (s *awsStorage) ReadAt(key string, buf []byte, pos int64) (int64, error) {
 		return 0, ErrInvalidPos
 	}
 
-	block, offs := pos/BlockSize, pos%BlockSize
 	nread := int64(0)
 
-	fileInfo, err := s.getInfo(key)
+	fileInfo, err := s.getInfo(key, s.strongReads())
 	if err != nil {
 		return 0, err
 	}
 
+	if fileInfo.DeletedAt > 0 {
+		return 0, ErrDeleted
+	}
+
+	if pos >= fileInfo.Length {
+		return 0, io.EOF
+	}
+
+	// a short read is at the end of the file, or of the data written so far
+	end, short := fileInfo.Length, io.EOF
 	if fileInfo.CurPos != FileComplete {
+		end, short = fileInfo.CurPos, ErrIncomplete
+	}
+
+	if pos >= end {
 		return 0, ErrIncomplete
 	}
 
-	if pos > fileInfo.Length {
-		return 0, ErrInvalidPos
+	if pos < fileInfo.Base {
+		return 0, ErrTrimmed
+	}
+
+	if data := fileInfo.content(); data != nil { // the content is in the metadata
+		n := int64(copy(buf, data[pos:]))
+		if n < int64(len(buf)) {
+			return n, short
+		}
+
+		return n, nil
 	}
 
-	lbuf := len(buf)
-	if int(fileInfo.Length-pos) < lbuf {
-		lbuf = int(fileInfo.Length - pos)
+	blockSize := fileInfo.blockSize()
+	block, offs := pos/blockSize, pos%blockSize
+
+	lbuf := int64(len(buf))
+	if rest := end - pos; rest < lbuf {
+		lbuf = rest
 	}
 
 	rrange := ""
+	readn := blockSize - offs // the first block may be partial
 	if offs > 0 {
 		rrange = fmt.Sprintf("bytes=%v-", offs)
-		if lbuf < int(BlockSize-offs) {
-			rrange += strconv.Itoa(int(offs) + lbuf - 1)
+		if lbuf < readn {
+			rrange += strconv.FormatInt(offs+lbuf-1, 10)
 		}
 	}
 
-	readn := BlockSize
-	for p := 0; lbuf > 0; block += 1 {
-		bkey := blockKey(key, int(block))
+	for p := int64(0); lbuf > 0; block += 1 {
+		bkey := blockKey(key, block)
 
 		res, err := s.store.GetObjectRequest(&s3.GetObjectInput{
 			Bucket: aws.String(s.bucket),
@@ -390,67 +653,528 @@ func (s *awsStorage) ReadAt(key string, buf []byte, pos int64) (int64, error) {
 		if err != nil {
 			if aerr, ok := err.(awserr.Error); ok {
 				if aerr.Code() == s3.ErrCodeNoSuchKey {
-					return 0, ErrNotFound
+					return 0, ErrMissingBlock{Block: block}
 				}
-
-				return 0, err
 			}
+
+			return 0, err
 		}
 
 		if readn > lbuf {
 			readn = lbuf
 		}
 
-		n, err := io.ReadAtLeast(res.Body, buf[p:], readn)
+		n, err := io.ReadAtLeast(res.Body, buf[p:p+readn], int(readn))
+		res.Body.Close()
+
 		if err != nil {
-			if err == io.EOF && n == lbuf {
-				err = nil
-			} else {
-				return 0, err // if we read something, should we return it ?
-			}
+			return 0, err // if we read something, should we return it ?
 		}
 
-		res.Body.Close()
-
 		nread += int64(n)
-		lbuf -= n
-		p += n
+		lbuf -= int64(n)
+		p += int64(n)
+		readn = blockSize
+	}
+
+	if nread < int64(len(buf)) {
+		return nread, short // like io.ReaderAt, a short read is at the end of the file
 	}
 
 	return nread, nil
 }
 
+// Return a sequential reader of the file, reading the metadata once and then the block objects in order
+func (s *awsStorage) OpenReader(key string) (io.ReadCloser, *FileInfo, error) {
+	fileInfo, err := s.getInfo(key, s.strongReads())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if fileInfo.DeletedAt > 0 {
+		return nil, nil, ErrDeleted
+	}
+
+	get := func(block int64) ([]byte, error) {
+		res, err := s.store.GetObjectRequest(&s3.GetObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(s.prefix + blockKey(key, block)),
+		}).Send(context.TODO())
+
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+				return nil, ErrMissingBlock{Block: block}
+			}
+
+			return nil, err
+		}
+
+		defer res.Body.Close()
+		return ioutil.ReadAll(res.Body)
+	}
+
+	return newBlockReader(fileInfo, get, nil), fileInfo.fileInfo(key, fileInfo.ExpiresAt), nil
+}
+
+// Atomically add delta to the counter file identified by key (a big-endian int64),
+// creating it if missing. Returns the new value.
+// The value is kept in a numeric attribute of the metadata item, updated with ADD.
+// As in badger, the file is checked first (only counters created by IncrFile are incremented here),
+// and the update only applies if the file didn't change since.
+func (s *awsStorage) IncrFile(key string, delta int64) (int64, error) {
+	for {
+		fileInfo, value, err := s.getInfoValue(key, true)
+		cond := "#v = :v"
+
+		switch {
+		case err == ErrNotFound:
+			fileInfo = &info{Name: key, HashAlg: s.hash, Created: s.now(), Counter: true}
+			fileInfo.setCounter(0)
+
+			value, _ = fileInfo.MarshalString()
+			cond = "attribute_not_exists(Id)"
+		case err != nil:
+			return 0, err
+		case fileInfo.DeletedAt > 0:
+			return 0, ErrDeleted
+		case fileInfo.CurPos != FileComplete || fileInfo.Length != counterSize || fileInfo.Base != 0:
+			return 0, ErrInvalidSize // not a counter
+		case fileInfo.locked(s.now()):
+			return 0, ErrImmutable
+		case !fileInfo.Counter:
+			return 0, ErrInvalidSize
+		}
+
+		res, err := s.db.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+			Key: map[string]dynamodb.AttributeValue{
+				"Id": {
+					S: aws.String(infoKey(key)),
+				},
+			},
+			UpdateExpression:    aws.String("ADD #c :d SET #v = if_not_exists(#v, :v), #t = :t"),
+			ConditionExpression: aws.String(cond),
+			ExpressionAttributeNames: map[string]string{
+				"#c": "Counter",
+				"#v": "Value",
+				"#t": "TTL",
+			},
+			ExpressionAttributeValues: map[string]dynamodb.AttributeValue{
+				":d": {N: intN(delta)},
+				":v": {S: aws.String(value)},
+				":t": {N: intN(s.expiration(fileInfo).Unix())},
+			},
+			ReturnValues: dynamodb.ReturnValueUpdatedNew,
+			TableName:    aws.String(s.bucket),
+		})
+
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); ok {
+				if aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+					continue // created or changed since read
+				}
+			}
+
+			return 0, err
+		}
+
+		return Nint(res.Attributes["Counter"].N), nil
+	}
+}
+
+// Remove the leading blocks of a file, up to offset bytes.
+// The offsets of the remaining data don't change.
+func (s *awsStorage) TrimFront(key string, bytes int64) error {
+	fileInfo, err := s.getInfo(key, true)
+	if err != nil {
+		return err
+	}
+
+	if fileInfo.DeletedAt > 0 {
+		return ErrDeleted
+	}
+	if fileInfo.locked(s.now()) {
+		return ErrImmutable
+	}
+
+	base := trimBase(fileInfo, bytes)
+	if base <= fileInfo.Base {
+		return nil
+	}
+
+	if err := s.deleteBlocks(key, fileInfo.Base/fileInfo.blockSize(), base/fileInfo.blockSize()); err != nil {
+		return err
+	}
+
+	fileInfo.Base = base
+	return s.upsertInfo(key, fileInfo, false)
+}
+
+// Delete the S3 objects of blocks from first to last (excluded)
+func (s *awsStorage) deleteBlocks(key string, first, last int64) error {
+	var objs []s3.ObjectIdentifier
+
+	for i := first; i < last; i++ {
+		objs = append(objs, s3.ObjectIdentifier{Key: aws.String(s.prefix + blockKey(key, i))})
+	}
+
+	return s.deleteObjects(objs)
+}
+
+// Delete the S3 objects, in batches of the max objects per DeleteObjects
+func (s *awsStorage) deleteObjects(objs []s3.ObjectIdentifier) error {
+	for len(objs) > 0 {
+		n := len(objs)
+		if n > 1000 {
+			n = 1000
+		}
+
+		_, err := s.store.DeleteObjectsRequest(&s3.DeleteObjectsInput{
+			Bucket: aws.String(s.bucket),
+			Delete: &s3.Delete{Objects: objs[:n]},
+		}).Send(context.TODO())
+		if err != nil {
+			return err
+		}
+
+		objs = objs[n:]
+	}
+
+	return nil
+}
+
+// Refresh the expiration of the file identified by key to a TTL from now (sliding expiration),
+// by the same rules as writes (see expiration). The TTL of the metadata item is updated, and the blocks are copied onto themselves
+// with the new Expires, restarting their age for the bucket lifecycle rules.
+func (s *awsStorage) Touch(key string) error {
+	fileInfo, err := s.getInfo(key, true)
+	if err != nil {
+		return err
+	}
+
+	expires := s.expiration(fileInfo)
+
+	_, err = s.db.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		Key: map[string]dynamodb.AttributeValue{
+			"Id": {
+				S: aws.String(infoKey(key)),
+			},
+		},
+		UpdateExpression:         aws.String("SET #t = :t"),
+		ConditionExpression:      aws.String("attribute_exists(Id)"),
+		ExpressionAttributeNames: map[string]string{"#t": "TTL"},
+		ExpressionAttributeValues: map[string]dynamodb.AttributeValue{
+			":t": {N: intN(expires.Unix())},
+		},
+		TableName: aws.String(s.bucket),
+	})
+
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			if aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+				return ErrNotFound // deleted since getInfo
+			}
+		}
+
+		return err
+	}
+
+	if fileInfo.BlockTTL > 0 || fileInfo.Counter || fileInfo.Preserve {
+		return nil
+	}
+
+	blocks := fileInfo.dataBlocks()
+
+	for i := fileInfo.Base / fileInfo.blockSize(); i < blocks; i++ {
+		if !fileInfo.hasBlock(i) { // not written yet (see WithRanges)
+			continue
+		}
+
+		bkey := s.prefix + blockKey(key, i)
+
+		_, err := s.store.CopyObjectRequest(&s3.CopyObjectInput{
+			Bucket:            aws.String(s.bucket),
+			Key:               aws.String(bkey),
+			CopySource:        aws.String(s.bucket + "/" + url.PathEscape(bkey)),
+			Expires:           aws.Time(expires),
+			MetadataDirective: s3.MetadataDirectiveReplace,
+		}).Send(context.TODO())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Copy the file src to the new file dst. The blocks are copied by S3 (CopyObject),
+// after the metadata of an empty incomplete file claims dst; the metadata of the copy
+// replaces it at the end. If the copy fails, dst is deleted.
+func (s *awsStorage) Copy(src, dst string) error {
+	return s.copyFile(src, dst, false)
+}
+
+// Move the file src to the new key dst: the file is copied as for Copy, keeping its info,
+// then src is deleted. A counter is moved by creating the new counter with its value.
+func (s *awsStorage) Rename(src, dst string) error {
+	return s.copyFile(src, dst, true)
+}
+
+func (s *awsStorage) copyFile(src, dst string, rename bool) error {
+	srcInfo, err := s.getInfo(src, true)
+	if err != nil {
+		return err
+	}
+	if srcInfo.DeletedAt > 0 {
+		return ErrDeleted
+	}
+
+	fileInfo := srcInfo
+
+	if rename {
+		if src == dst {
+			return ErrExists
+		}
+		if fileInfo.locked(s.now()) {
+			return ErrImmutable
+		}
+
+		if fileInfo.Counter { // the value is kept in its own attribute, see IncrFile
+			exists, err := s.Exists(dst)
+			if err != nil {
+				return err
+			}
+			if exists {
+				return ErrExists
+			}
+
+			if _, err := s.IncrFile(dst, fileInfo.counter()); err != nil {
+				return err
+			}
+
+			return s.DeleteFile(src)
+		}
+	} else {
+		fileInfo = srcInfo.copyInfo(s.now())
+		if s.ttlFromCreation {
+			fileInfo.ExpiresAt = s.expiration(fileInfo)
+			fileInfo.Preserve = true
+		}
+	}
+
+	if blocks := fileInfo.dataBlocks(); blocks == 0 { // the content (if any) is in the metadata
+		if err := s.upsertInfo(dst, fileInfo, true); err != nil {
+			return err
+		}
+	} else if err := s.copyBlocks(src, dst, fileInfo, blocks); err != nil {
+		return err
+	}
+
+	if rename {
+		return s.DeleteFile(src)
+	}
+
+	return nil
+}
+
+// Create dst with the S3 blocks of src, up to blocks, and the metadata in fileInfo
+func (s *awsStorage) copyBlocks(src, dst string, fileInfo *info, blocks int64) error {
+	claim := *fileInfo
+	claim.CurPos, claim.CurHash, claim.Base = 0, "", 0
+
+	if err := s.upsertInfo(dst, &claim, true); err != nil {
+		return err
+	}
+
+	expires := s.expiration(fileInfo)
+
+	for i := fileInfo.Base / fileInfo.blockSize(); i < blocks; i++ {
+		if !fileInfo.hasBlock(i) { // not written yet (see WithRanges)
+			continue
+		}
+
+		_, err := s.store.CopyObjectRequest(&s3.CopyObjectInput{
+			Bucket:            aws.String(s.bucket),
+			Key:               aws.String(s.prefix + blockKey(dst, i)),
+			CopySource:        aws.String(s.bucket + "/" + url.PathEscape(s.prefix+blockKey(src, i))),
+			Expires:           aws.Time(expires),
+			MetadataDirective: s3.MetadataDirectiveReplace,
+		}).Send(context.TODO())
+		if err == nil {
+			continue
+		}
+
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			err = ErrMissingBlock{Block: i}
+		}
+
+		s.DeleteFile(dst)
+		return err
+	}
+
+	if err := s.upsertInfo(dst, fileInfo, false); err != nil {
+		s.DeleteFile(dst)
+		return err
+	}
+
+	return nil
+}
+
+// Delete the blocks of a file, keeping the metadata (marked as deleted) until it expires
+func (s *awsStorage) SoftDelete(key string) error {
+	fileInfo, err := s.getInfo(key, true)
+	if err != nil {
+		return err
+	}
+
+	if fileInfo.DeletedAt > 0 {
+		return nil
+	}
+	if fileInfo.locked(s.now()) {
+		return ErrImmutable
+	}
+
+	if fileInfo.Inline == nil && !fileInfo.Counter {
+		if err := s.deleteBlocks(key, fileInfo.Base/fileInfo.blockSize(), fileInfo.dataBlocks()); err != nil {
+			return err
+		}
+	}
+
+	fileInfo.Inline = nil
+	fileInfo.DeletedAt = s.now().UnixNano()
+	return s.upsertInfo(key, fileInfo, false)
+}
+
 // Return file info
 func (s *awsStorage) Stat(key string) (*FileInfo, error) {
-	var stats *FileInfo
+	fileInfo, err := s.getInfo(key, s.strongReads() && !s.eventualStat)
+	if err != nil {
+		return nil, err
+	}
+
+	return fileInfo.fileInfo(key, fileInfo.ExpiresAt), nil
+}
+
+// Return true if the file exists (complete or not), fetching only the key of the metadata item
+func (s *awsStorage) Exists(key string) (bool, error) {
+	res, err := s.db.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		ConsistentRead: aws.Bool(s.strongReads() && !s.eventualStat),
+		Key: map[string]dynamodb.AttributeValue{
+			"Id": {
+				S: aws.String(infoKey(key)),
+			},
+		},
+		ProjectionExpression:   aws.String("Id"),
+		ReturnConsumedCapacity: dynamodb.ReturnConsumedCapacityNone,
+		TableName:              aws.String(s.bucket),
+	})
+
+	if err != nil {
+		return false, err
+	}
+
+	return res.Item != nil, nil
+}
+
+// Return the raw file metadata, for diagnostics
+func (s *awsStorage) DebugInfo(key string) (map[string]interface{}, error) {
+	fileInfo, err := s.getInfo(key, true)
+	if err != nil {
+		return nil, err
+	}
 
-	fileInfo, err := s.getInfo(key)
+	return fileInfo.debugInfo(key, fileInfo.ExpiresAt), nil
+}
+
+// Return storage details for the file
+func (s *awsStorage) StatPhysical(key string) (*PhysicalInfo, error) {
+	fileInfo, err := s.getInfo(key, true)
 	if err != nil {
 		return nil, err
 	}
 
-	stats = &FileInfo{
-		Name:        fileInfo.Name,
-		ContentType: fileInfo.ContentType,
-		Created:     fileInfo.Created,
-		Hash:        fileInfo.Hash,
-		Length:      fileInfo.Length,
-		Next:        fileInfo.CurPos,
-		ExpiresAt:   fileInfo.ExpiresAt,
+	data, _ := fileInfo.MarshalString()
+
+	stats := &PhysicalInfo{
+		Key:       key,
+		Medium:    "dynamodb+s3",
+		InfoBytes: int64(len(data)),
+		CurPos:    fileInfo.CurPos,
+		CurHash:   fileInfo.CurHash,
 	}
 
-	return stats, nil
+	req := s.store.ListObjectsV2Request(&s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.prefix + prefixKey(key)),
+	})
+
+	p := s3.NewListObjectsV2Paginator(req)
+
+	for p.Next(context.TODO()) {
+		for _, obj := range p.CurrentPage().Contents {
+			if _, ok := blockNumber(key, strings.TrimPrefix(aws.StringValue(obj.Key), s.prefix)); ok {
+				stats.Blocks++
+				stats.Bytes += aws.Int64Value(obj.Size)
+			}
+		}
+	}
+
+	return stats, p.Err()
 }
 
-// Scan database, for debugging purposes
-func (s *awsStorage) Scan(start string) error {
-	dbReq := s.db.ScanRequest(&dynamodb.ScanInput{
-		TableName: aws.String(s.bucket),
-		Select:    dynamodb.SelectAllAttributes,
+// Return file info for all files with a key starting with prefix
+func (s *awsStorage) ListFiles(prefix string, opts ...ListOption) ([]*FileInfo, error) {
+	var files []*FileInfo
+
+	err := scanPages(s.db, &dynamodb.ScanInput{
+		TableName:        aws.String(s.bucket),
+		ConsistentRead:   aws.Bool(s.strongReads()),
+		FilterExpression: aws.String("begins_with(Id, :prefix)"),
+		ExpressionAttributeValues: map[string]dynamodb.AttributeValue{
+			":prefix": {S: aws.String(prefix)},
+		},
+	}, func(items []map[string]dynamodb.AttributeValue) error {
+		var records []struct {
+			Id      string
+			Value   string
+			TTL     int64
+			Counter int64
+		}
+
+		if err := dynamodbattribute.UnmarshalListOfMaps(items, &records); err != nil {
+			return err
+		}
+
+		for _, r := range records {
+			if !strings.HasSuffix(r.Id, _INFO_SUFFIX) {
+				continue
+			}
+
+			var fileInfo info
+			if err := (&fileInfo).UnmarshalString(r.Value); err != nil {
+				log.Println("Key:", r.Id, "Value:", r.Value)
+				return err
+			}
+
+			if fileInfo.Counter {
+				fileInfo.setCounter(r.Counter)
+			}
+
+			key := strings.TrimSuffix(r.Id, _INFO_SUFFIX)
+			files = append(files, fileInfo.fileInfo(key, time.Unix(r.TTL, 0)))
+		}
+
+		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
 
-	dbPaginate := dynamodb.NewScanPaginator(dbReq)
+	SortFiles(files, opts...)
+	return files, nil
+}
 
+// Scan database, for debugging purposes
+func (s *awsStorage) Scan(start string) error {
 	var records []struct {
 		Id    string
 		Value string
@@ -459,18 +1183,21 @@ func (s *awsStorage) Scan(start string) error {
 
 	fmt.Println("Records:")
 
-	for dbPaginate.Next(context.TODO()) {
-		if err := dynamodbattribute.UnmarshalListOfMaps(dbPaginate.CurrentPage().Items, &records); err != nil {
+	err := scanPages(s.db, &dynamodb.ScanInput{
+		TableName: aws.String(s.bucket),
+		Select:    dynamodb.SelectAllAttributes,
+	}, func(items []map[string]dynamodb.AttributeValue) error {
+		if err := dynamodbattribute.UnmarshalListOfMaps(items, &records); err != nil {
 			log.Println("cannot unmarshal items:", err)
-			break
+			return nil
 		}
 
 		for _, r := range records {
 			fmt.Printf(" %s: size=%v expires=%v\n", r.Id, len(r.Value), time.Unix(r.TTL, 0))
 		}
-	}
 
-	err := dbPaginate.Err()
+		return nil
+	})
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,358 @@
+package storage
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+type item = map[string]dynamodb.AttributeValue
+
+// A DynamoDB table in memory, recording the reads.
+// It evaluates the expressions used by the store: conditions of terms joined by AND or OR
+// (without parentheses), SET and ADD updates, projections and begins_with filters.
+type fakeDynamo struct {
+	mu    sync.Mutex
+	items map[string]item // by Id
+	gets  []*dynamodb.GetItemInput
+	scans []*dynamodb.ScanInput
+}
+
+// Return an AWS store with a fake DynamoDB table and no S3 client:
+// only files with no blocks (inline, empty or counters) can be written and read
+func openTestAWS(t *testing.T, opts ...Option) (*awsStorage, *fakeDynamo) {
+	t.Helper()
+
+	o := getOptions(opts)
+	if err := o.check(); err != nil {
+		t.Fatal(err)
+	}
+
+	db := &fakeDynamo{items: map[string]item{}}
+	return &awsStorage{options: o, db: db, bucket: "test", ttl: time.Hour}, db
+}
+
+var conditionFailed = awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil)
+
+// Return the attribute name for a name or #placeholder
+func attrName(name string, names map[string]string) string {
+	if strings.HasPrefix(name, "#") {
+		return names[name]
+	}
+
+	return name
+}
+
+// Return the value of a :placeholder or attribute
+func attrValue(it item, operand string, names map[string]string, values item) (dynamodb.AttributeValue, bool) {
+	if strings.HasPrefix(operand, ":") {
+		v, ok := values[operand]
+		return v, ok
+	}
+
+	v, ok := it[attrName(operand, names)]
+	return v, ok
+}
+
+var conditionTerm = regexp.MustCompile(`^(attribute_exists|attribute_not_exists)\((\S+)\)$|^(\S+) (=|<) (\S+)$`)
+
+func (f *fakeDynamo) check(it item, cond *string, names map[string]string, values item) bool {
+	if cond == nil {
+		return true
+	}
+
+	for _, any := range strings.Split(*cond, " OR ") {
+		all := true
+
+		for _, term := range strings.Split(any, " AND ") {
+			m := conditionTerm.FindStringSubmatch(term)
+			switch {
+			case m == nil:
+				panic("unsupported condition: " + term)
+			case m[1] != "":
+				_, exists := it[attrName(m[2], names)]
+				all = all && exists == (m[1] == "attribute_exists")
+			default:
+				a, aok := attrValue(it, m[3], names, values)
+				b, bok := attrValue(it, m[5], names, values)
+				if m[4] == "=" {
+					all = all && aok && bok && aws.StringValue(a.S) == aws.StringValue(b.S) && aws.StringValue(a.N) == aws.StringValue(b.N)
+				} else {
+					all = all && aok && bok && Nint(a.N) < Nint(b.N)
+				}
+			}
+		}
+
+		if all {
+			return true
+		}
+	}
+
+	return false
+}
+
+var (
+	updateClause = regexp.MustCompile(`(SET|ADD) ([^A-Z]+)`)
+	ifNotExists  = regexp.MustCompile(`^if_not_exists\((\S+), (\S+)\)$`)
+)
+
+// Apply the update expression, returning the updated attributes
+func (f *fakeDynamo) update(it item, expr string, names map[string]string, values item) item {
+	updated := item{}
+
+	for _, clause := range updateClause.FindAllStringSubmatch(expr, -1) {
+		if clause[1] == "ADD" {
+			parts := strings.Fields(clause[2])
+			name := attrName(parts[0], names)
+
+			n := Nint(values[parts[1]].N)
+			if cur, ok := it[name]; ok {
+				n += Nint(cur.N)
+			}
+
+			it[name] = dynamodb.AttributeValue{N: intN(n)}
+			updated[name] = it[name]
+			continue
+		}
+
+		for _, set := range strings.Split(strings.TrimSpace(clause[2]), ", #") {
+			parts := strings.SplitN(strings.TrimPrefix(set, "#"), " = ", 2)
+			name := names["#"+parts[0]]
+
+			if m := ifNotExists.FindStringSubmatch(parts[1]); m != nil {
+				if _, ok := it[name]; ok {
+					continue
+				}
+				parts[1] = m[2]
+			}
+
+			it[name], _ = attrValue(it, parts[1], names, values)
+			updated[name] = it[name]
+		}
+	}
+
+	return updated
+}
+
+// Return the attributes of it in the projection expression
+func project(it item, projection *string, names map[string]string) item {
+	if projection == nil {
+		return it
+	}
+
+	projected := item{}
+	for _, name := range strings.Split(*projection, ", ") {
+		if v, ok := it[attrName(name, names)]; ok {
+			projected[attrName(name, names)] = v
+		}
+	}
+
+	return projected
+}
+
+func copyItem(it item) item {
+	c := item{}
+	for k, v := range it {
+		c[k] = v
+	}
+
+	return c
+}
+
+func (f *fakeDynamo) GetItem(ctx context.Context, in *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.gets = append(f.gets, in)
+
+	it, ok := f.items[aws.StringValue(in.Key["Id"].S)]
+	if !ok {
+		return &dynamodb.GetItemOutput{}, nil
+	}
+
+	return &dynamodb.GetItemOutput{Item: project(copyItem(it), in.ProjectionExpression, in.ExpressionAttributeNames)}, nil
+}
+
+func (f *fakeDynamo) PutItem(ctx context.Context, in *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id := aws.StringValue(in.Item["Id"].S)
+	if !f.check(f.items[id], in.ConditionExpression, in.ExpressionAttributeNames, in.ExpressionAttributeValues) {
+		return nil, conditionFailed
+	}
+
+	f.items[id] = copyItem(in.Item)
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (f *fakeDynamo) UpdateItem(ctx context.Context, in *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id := aws.StringValue(in.Key["Id"].S)
+	it, ok := f.items[id]
+	if !f.check(it, in.ConditionExpression, in.ExpressionAttributeNames, in.ExpressionAttributeValues) {
+		return nil, conditionFailed
+	}
+	if !ok {
+		it = item{"Id": in.Key["Id"]}
+	}
+
+	it = copyItem(it)
+	updated := f.update(it, aws.StringValue(in.UpdateExpression), in.ExpressionAttributeNames, in.ExpressionAttributeValues)
+	f.items[id] = it
+
+	return &dynamodb.UpdateItemOutput{Attributes: updated}, nil
+}
+
+func (f *fakeDynamo) DeleteItem(ctx context.Context, in *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id := aws.StringValue(in.Key["Id"].S)
+	if !f.check(f.items[id], in.ConditionExpression, in.ExpressionAttributeNames, in.ExpressionAttributeValues) {
+		return nil, conditionFailed
+	}
+
+	delete(f.items, id)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+// Scan returns all the items in a single page, in key order
+func (f *fakeDynamo) Scan(ctx context.Context, in *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.scans = append(f.scans, in)
+
+	prefix := ""
+	if in.FilterExpression != nil {
+		if aws.StringValue(in.FilterExpression) != "begins_with(Id, :prefix)" {
+			panic("unsupported filter: " + aws.StringValue(in.FilterExpression))
+		}
+
+		prefix = aws.StringValue(in.ExpressionAttributeValues[":prefix"].S)
+	}
+
+	var ids []string
+	for id := range f.items {
+		if strings.HasPrefix(id, prefix) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	out := &dynamodb.ScanOutput{}
+	for _, id := range ids {
+		out.Items = append(out.Items, project(copyItem(f.items[id]), in.ProjectionExpression, in.ExpressionAttributeNames))
+	}
+
+	return out, nil
+}
+
+// Return the last GetItem request
+func (f *fakeDynamo) lastGet() *dynamodb.GetItemInput {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.gets[len(f.gets)-1]
+}
+
+// getInfo only fetches the attributes of the file info, naming the reserved words with placeholders
+func TestAWSInfoProjection(t *testing.T) {
+	s, db := openTestAWS(t)
+
+	if err := s.CreateFile("f", "f.txt", "text/plain", 10, nil); err != nil {
+		t.Fatal(err)
+	}
+	db.items[infoKey("f")]["Extra"] = dynamodb.AttributeValue{S: aws.String("not fetched")}
+
+	stat, err := s.Stat("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Name != "f.txt" || stat.Length != 10 || stat.ExpiresAt.Before(time.Now()) {
+		t.Errorf("stat %+v", stat)
+	}
+
+	get := db.lastGet()
+
+	var projected []string
+	for _, name := range strings.Split(aws.StringValue(get.ProjectionExpression), ", ") {
+		if !strings.HasPrefix(name, "#") || get.ExpressionAttributeNames[name] == "" {
+			t.Errorf("projected attribute %q is not a defined placeholder", name)
+		}
+
+		projected = append(projected, get.ExpressionAttributeNames[name])
+	}
+
+	sort.Strings(projected)
+	if strings.Join(projected, " ") != "Counter TTL Value" {
+		t.Errorf("projected attributes %v", projected)
+	}
+
+	res, _ := db.GetItem(context.TODO(), get)
+	if _, ok := res.Item["Extra"]; ok || len(res.Item) != 2 { // no Counter for a regular file
+		t.Errorf("fetched attributes %v", res.Item)
+	}
+}
+
+// Return the last Scan request
+func (f *fakeDynamo) lastScan() *dynamodb.ScanInput {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.scans[len(f.scans)-1]
+}
+
+// The metadata reads of Stat, ReadAt and ListFiles follow the read consistency options,
+// while the reads of the write path are always consistent
+func TestAWSReadConsistency(t *testing.T) {
+	for _, test := range []struct {
+		name                  string
+		opts                  []Option
+		stat, readAt, listing bool
+	}{
+		{"default", nil, true, true, true},
+		{"eventual reads", []Option{WithReadConsistency(ReadEventual)}, false, false, false},
+		{"eventual stat", []Option{WithEventualStat(true)}, false, true, true},
+	} {
+		s, db := openTestAWS(t, append(test.opts, WithInlineSize(100))...)
+		data := testData(10)
+
+		putTestFile(t, s, "f", data, len(data))
+		if consistent := aws.BoolValue(db.lastGet().ConsistentRead); !consistent {
+			t.Errorf("%v: eventual read when writing", test.name)
+		}
+
+		if _, err := s.Stat("f"); err != nil {
+			t.Fatal(err)
+		}
+		if consistent := aws.BoolValue(db.lastGet().ConsistentRead); consistent != test.stat {
+			t.Errorf("%v: Stat consistent read %v", test.name, consistent)
+		}
+
+		if _, err := s.ReadAt("f", make([]byte, len(data)), 0); err != nil {
+			t.Fatal(err)
+		}
+		if consistent := aws.BoolValue(db.lastGet().ConsistentRead); consistent != test.readAt {
+			t.Errorf("%v: ReadAt consistent read %v", test.name, consistent)
+		}
+
+		if files, err := s.ListFiles(""); err != nil || len(files) != 1 {
+			t.Fatalf("%v: list %v %v", test.name, files, err)
+		}
+		if consistent := aws.BoolValue(db.lastScan().ConsistentRead); consistent != test.listing {
+			t.Errorf("%v: ListFiles consistent read %v", test.name, consistent)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"crypto/md5"
+	"fmt"
+)
+
+// An estimate of the AWS operations and storage for a workload, for capacity and cost planning.
+// Request units follow the DynamoDB rules: a write unit per KB of item, a read unit per 4KB
+// (half for eventually consistent reads). Prices vary by region, so they are left to the caller.
+type CostEstimate struct {
+	Files  int64 // files stored
+	Blocks int64 // S3 objects (one per block, none for inline files)
+
+	MetadataWrites int64   // DynamoDB PutItem requests
+	MetadataReads  int64   // DynamoDB GetItem requests
+	WriteUnits     int64   // DynamoDB write request units (WCU)
+	ReadUnits      float64 // DynamoDB read request units (RCU)
+
+	ObjectPuts int64 // S3 PUT requests
+	ObjectGets int64 // S3 GET requests
+
+	ObjectBytes   int64 // bytes stored in S3
+	MetadataBytes int64 // bytes stored in DynamoDB (approximate)
+}
+
+func (c CostEstimate) String() string {
+	return fmt.Sprintf("files: %v blocks: %v metadata writes: %v (%v WCU) reads: %v (%v RCU) S3 puts: %v gets: %v stored: %v bytes (S3) %v bytes (DynamoDB)",
+		c.Files, c.Blocks, c.MetadataWrites, c.WriteUnits, c.MetadataReads, c.ReadUnits, c.ObjectPuts, c.ObjectGets, c.ObjectBytes, c.MetadataBytes)
+}
+
+// The size of a metadata item without the hash state and inline content:
+// attribute names, key, TTL and the JSON fields (an approximation)
+const infoItemOverhead = 320
+
+// Return the approximate size of the metadata item of a file of the specified size
+// with the specified number of blocks written
+func (s *awsStorage) infoItemSize(size, written int64) int64 {
+	n := int64(infoItemOverhead + 2*64) // item overhead, final hash and hash state (hex)
+
+	switch s.hashAlg() {
+	case HashMerkle: // the state is the list of block hashes
+		n += 2 * md5.Size * written
+	case HashSHA256: // the sha256 state is ~108 bytes
+		n += 2 * 108
+	}
+
+	if size <= s.inlineSize && written > 0 { // the content is written at once
+		n += (size + 2) / 3 * 4 // base64
+	}
+
+	return n
+}
+
+// Return the read units of a read of an item of the specified size
+func readUnits(size int64, consistent bool) float64 {
+	units := float64((size + 4*1024 - 1) / (4 * 1024))
+	if !consistent {
+		units /= 2
+	}
+
+	return units
+}
+
+// Return the write units of a write of an item of the specified size
+func writeUnits(size int64) int64 {
+	return (size + 1024 - 1) / 1024
+}
+
+// Estimate the requests and storage for fileCount files of avgSize bytes, each downloaded readsPerFile times,
+// with the configured block size.
+// Files are uploaded a block per WriteAt (as cashierd does): each write reads the metadata (consistent read),
+// puts the block to S3 and writes the metadata back. Each download is a Stat, then a ReadAt per block,
+// reading the metadata and getting the block. Small files stored inline don't use S3.
+func (s *awsStorage) EstimateCost(fileCount int, avgSize int64, readsPerFile int) CostEstimate {
+	var c CostEstimate
+
+	if fileCount <= 0 || avgSize < 0 {
+		return c
+	}
+
+	blockSize := s.fileBlockSize()
+	blocks := (avgSize + blockSize - 1) / blockSize
+	writes, reads := blocks, blocks // WriteAt and ReadAt calls per file
+
+	inline := avgSize <= s.inlineSize
+	if inline {
+		blocks, writes, reads = 0, 1, 1
+	}
+	if avgSize == 0 { // complete on creation, nothing to read
+		writes, reads = 0, 0
+	}
+
+	strong := s.strongReads()
+
+	// per file upload
+	var up CostEstimate
+
+	up.MetadataWrites = 1 + writes // CreateFile and a write per WriteAt
+	up.WriteUnits = writeUnits(s.infoItemSize(avgSize, 0))
+	up.MetadataReads = writes
+
+	for k := int64(1); k <= writes; k++ {
+		up.ReadUnits += readUnits(s.infoItemSize(avgSize, k-1), true)
+		up.WriteUnits += writeUnits(s.infoItemSize(avgSize, k))
+	}
+
+	up.ObjectPuts = blocks
+
+	// per file download
+	var down CostEstimate
+
+	final := s.infoItemSize(avgSize, writes)
+
+	down.MetadataReads = 1 + reads // Stat and a read per ReadAt
+	down.ReadUnits = readUnits(final, strong && !s.eventualStat) + float64(reads)*readUnits(final, strong)
+	down.ObjectGets = blocks
+
+	n, r := int64(fileCount), int64(readsPerFile)
+
+	c.Files = n
+	c.Blocks = n * blocks
+	c.MetadataWrites = n * up.MetadataWrites
+	c.MetadataReads = n * (up.MetadataReads + r*down.MetadataReads)
+	c.WriteUnits = n * up.WriteUnits
+	c.ReadUnits = float64(n) * (up.ReadUnits + float64(r)*down.ReadUnits)
+	c.ObjectPuts = n * up.ObjectPuts
+	c.ObjectGets = n * r * down.ObjectGets
+	c.MetadataBytes = n * final
+
+	if !inline {
+		c.ObjectBytes = n * avgSize
+	}
+
+	return c
+}
@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"testing"
+)
+
+// The estimate counts the requests made by cashierd uploads and downloads of each file
+func TestEstimateCost(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		opts     []Option
+		files    int
+		size     int64
+		reads    int
+		expected CostEstimate
+	}{
+		{
+			// 3 blocks per file; the metadata items are under 1KB
+			"blocks", nil, 10, 40000, 2,
+			CostEstimate{Files: 10, Blocks: 30, MetadataWrites: 40, MetadataReads: 110, WriteUnits: 40, ReadUnits: 110,
+				ObjectPuts: 30, ObjectGets: 60, ObjectBytes: 400000, MetadataBytes: 4480},
+		},
+		{
+			// downloads use half units, uploads still read consistently
+			"eventual reads", []Option{WithReadConsistency(ReadEventual)}, 10, 40000, 2,
+			CostEstimate{Files: 10, Blocks: 30, MetadataWrites: 40, MetadataReads: 110, WriteUnits: 40, ReadUnits: 70,
+				ObjectPuts: 30, ObjectGets: 60, ObjectBytes: 400000, MetadataBytes: 4480},
+		},
+		{
+			// a single write, the content in the metadata item (base64, 2 write units)
+			"inline", []Option{WithInlineSize(1000)}, 1, 500, 1,
+			CostEstimate{Files: 1, MetadataWrites: 2, MetadataReads: 3, WriteUnits: 3, ReadUnits: 3, MetadataBytes: 1116},
+		},
+		{
+			// complete on creation, only Stat on download
+			"empty", nil, 5, 0, 1,
+			CostEstimate{Files: 5, MetadataWrites: 5, MetadataReads: 5, WriteUnits: 5, ReadUnits: 5, MetadataBytes: 5 * 448},
+		},
+		{
+			"no files", nil, 0, 40000, 1, CostEstimate{},
+		},
+	} {
+		s := &awsStorage{options: getOptions(tc.opts)}
+
+		if c := s.EstimateCost(tc.files, tc.size, tc.reads); c != tc.expected {
+			t.Errorf("%v:\n%v\nexpected\n%v", tc.name, c, tc.expected)
+		}
+	}
+}
@@ -1,13 +1,18 @@
 /*
-This package stores files in BadgerDB, allowing for incremental writes of multiple of BlockSize.
+This package stores files in BadgerDB, allowing for incremental writes of multiple of the block size.
 For each file it stores a "metadata" record and a series of "block" records.
 Files and data expire after a predefined TTL.
 */
 package storage
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"log"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/dgraph-io/badger"
@@ -16,12 +21,20 @@ import (
 // An instance of the Storage service based on BadgerDB
 
 type badgerStorage struct {
+	options
+
 	db  *badger.DB
+	dir string
 	ttl time.Duration
 }
 
 // Open data folder and return instance of storage service
-func OpenBadger(dataFolder string, readonly bool, ttl time.Duration) (*badgerStorage, error) {
+func OpenBadger(dataFolder string, readonly bool, ttl time.Duration, options ...Option) (*badgerStorage, error) {
+	o := getOptions(options)
+	if err := o.check(); err != nil {
+		return nil, err
+	}
+
 	opts := badger.DefaultOptions
 	opts.Dir = dataFolder
 	opts.ValueDir = dataFolder
@@ -32,7 +45,45 @@ func OpenBadger(dataFolder string, readonly bool, ttl time.Duration) (*badgerSto
 		return nil, err
 	}
 
-	return &badgerStorage{db: db, ttl: ttl}, nil
+	s := &badgerStorage{options: o, db: db, dir: dataFolder, ttl: ttl}
+	if err := s.checkHash(readonly); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Record the default hash algorithm in a new store, or compare it with the recorded one
+func (s *badgerStorage) checkHash(readonly bool) error {
+	var stored string
+
+	err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(_HASH_KEY))
+		if err != nil {
+			return err
+		}
+
+		return item.Value(func(data []byte) error {
+			stored = string(data)
+			return nil
+		})
+	})
+	if err == badger.ErrKeyNotFound {
+		if readonly {
+			return nil
+		}
+
+		return s.db.Update(func(txn *badger.Txn) error {
+			return txn.Set([]byte(_HASH_KEY), []byte(s.hashAlg()))
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	s.checkStoreHash(stored)
+	return nil
 }
 
 // Close storage service
@@ -40,204 +91,1096 @@ func (s *badgerStorage) Close() error {
 	return s.db.Close()
 }
 
-// Run garbage collector
+// Run garbage collector, rewriting value log files until there is nothing left to reclaim
 func (s *badgerStorage) GC() error {
-	return s.db.RunValueLogGC(0.5)
+	for {
+		if err := s.db.RunValueLogGC(0.5); err != nil {
+			if err == badger.ErrNoRewrite {
+				return nil
+			}
+
+			return err
+		}
+	}
+}
+
+func (s *badgerStorage) Size() (index, data int64) {
+	return s.db.Size()
 }
 
 // Create new file, by adding the file info
-func (s *badgerStorage) CreateFile(key, filename, ctype string, size int64, hash []byte) error {
-	key = infoKey(key)
-	data, _ := (&info{Name: filename, ContentType: ctype, Length: size, Hash: toHex(hash[:])}).Marshal()
+func (s *badgerStorage) CreateFile(key, filename, ctype string, size int64, hash []byte, opts ...FileOption) error {
+	fileInfo := s.newFileInfo(filename, ctype, size, hash, opts)
+	return s.createFile(key, fileInfo, s.fileTTL(fileInfo, nil))
+}
+
+func (s *badgerStorage) newFileInfo(filename, ctype string, size int64, hash []byte, opts []FileOption) *info {
+	return newInfo(&info{Name: filename, ContentType: ctype, Length: size, Hash: toHex(hash[:]), HashAlg: s.hash,
+		BlockSize: s.blockSize, Inlined: s.inlined(size), Created: s.now(), Preserve: s.ttlFromCreation}, opts)
+}
+
+// Create new file, preserving the specified creation and expiration time
+func (s *badgerStorage) CreateFileWithTimes(key, filename, ctype string, size int64, hash []byte, created, expires time.Time, opts ...FileOption) error {
+	ttl := expires.Sub(s.now())
+	if ttl <= 0 {
+		return ErrExpired
+	}
+
+	return s.createFile(key, newInfo(&info{Name: filename, ContentType: ctype, Length: size, Hash: toHex(hash[:]), HashAlg: s.hash,
+		BlockSize: s.blockSize, Inlined: s.inlined(size), Created: created, Preserve: true}, opts), ttl)
+}
+
+func (s *badgerStorage) createFile(key string, fileInfo *info, ttl time.Duration) error {
+	if s.minFreeSpace > 0 {
+		if err := checkFreeSpace(s.dir, fileInfo.Length, s.minFreeSpace); err != nil {
+			return err
+		}
+	}
+
+	for {
+		err := s.db.Update(func(txn *badger.Txn) error {
+			return s.createFileTxn(txn, key, fileInfo, ttl)
+		})
+
+		if err == badger.ErrConflict { // concurrent create, try again (and get ErrExists)
+			continue
+		}
+
+		return err
+	}
+}
+
+func (s *badgerStorage) createFileTxn(txn *badger.Txn, key string, fileInfo *info, ttl time.Duration) error {
+	ikey := infoKey(key)
+
+	if err := fileInfo.completeEmpty(); err != nil {
+		return err
+	}
+
+	_, err := txn.Get([]byte(ikey))
+	if err == nil {
+		return ErrExists
+	}
+	if err != badger.ErrKeyNotFound {
+		return err
+	}
+
+	if err := s.setExpiry(txn, key, fileInfo, ttl); err != nil {
+		return err
+	}
+
+	data, _ := fileInfo.Marshal()
+	if err := s.checkInfoSize(data); err != nil {
+		return err
+	}
+
+	// write file Info
+	if err = txn.SetWithTTL([]byte(ikey), data, ttl); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// A badger transaction, for Batch
+type badgerTx struct {
+	s   *badgerStorage
+	txn *badger.Txn
+}
+
+func (tx *badgerTx) CreateFile(key, filename, ctype string, size int64, hash []byte, opts ...FileOption) error {
+	s := tx.s
+
+	if s.minFreeSpace > 0 {
+		if err := checkFreeSpace(s.dir, size, s.minFreeSpace); err != nil {
+			return err
+		}
+	}
+
+	fileInfo := s.newFileInfo(filename, ctype, size, hash, opts)
+	return s.createFileTxn(tx.txn, key, fileInfo, s.fileTTL(fileInfo, nil))
+}
+
+func (tx *badgerTx) WriteAt(key string, pos int64, data []byte) (int64, error) {
+	return tx.s.writeAtTxn(tx.txn, key, pos, data)
+}
+
+func (tx *badgerTx) DeleteFile(key string) error {
+	return tx.s.deleteFileTxn(tx.txn, key)
+}
+
+// Run fn in a single transaction: the changes are committed together if fn doesn't return an error.
+// All the data written in the batch is kept in memory until the commit, and badger limits the size
+// of a transaction (ErrTxnTooBig), so batches are meant for a few small files.
+func (s *badgerStorage) Batch(fn func(tx Tx) error) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return fn(&badgerTx{s: s, txn: txn})
+	})
+}
+
+// Return the TTL for updated file records (item is the current info record).
+// Files with preserved times keep their original expiration.
+func (s *badgerStorage) fileTTL(fileInfo *info, item *badger.Item) time.Duration {
+	if fileInfo.Preserve && item != nil && item.ExpiresAt() > 0 {
+		return time.Unix(int64(item.ExpiresAt()), 0).Sub(s.now())
+	}
+	if fileInfo.Reserve > 0 {
+		return fileInfo.Reserve
+	}
+	if fileInfo.TTL > 0 {
+		return fileInfo.TTL
+	}
+
+	return s.ttl
+}
+
+// Return the badger TTL of a block kept for ttl, with the expiration time by the storage clock.
+// Badger expires keys by the system clock: with WithClock, getBlock also checks the expiration
+// time by the storage clock, so that the clock drives the block TTL.
+func (s *badgerStorage) blockExpiry(ttl time.Duration) time.Duration {
+	if s.clock == nil {
+		return ttl
+	}
+
+	return s.now().Add(ttl).Sub(time.Now())
+}
+
+// Get a block of the file, missing if expired by the storage clock (see blockExpiry)
+func (s *badgerStorage) getBlock(txn *badger.Txn, key string, block int64) (*badger.Item, error) {
+	item, err := txn.Get([]byte(blockKey(key, block)))
+	if err == nil && s.clock != nil && item.ExpiresAt() > 0 && int64(item.ExpiresAt()) <= s.now().Unix() {
+		return nil, badger.ErrKeyNotFound
+	}
+
+	return item, err
+}
+
+// Return the offset of the first available byte of the file: for files with a block TTL,
+// the start of the first block that didn't expire. Blocks expire in write order,
+// so the first one is found with a binary search.
+func (s *badgerStorage) firstByte(txn *badger.Txn, key string, fileInfo *info) int64 {
+	if fileInfo.BlockTTL <= 0 || fileInfo.content() != nil || fileInfo.DeletedAt > 0 {
+		return fileInfo.Base
+	}
+
+	end := fileInfo.Length
+	if fileInfo.CurPos != FileComplete {
+		end = fileInfo.CurPos
+	}
+
+	blockSize := fileInfo.blockSize()
+	first := fileInfo.Base / blockSize
+	n := int((end+blockSize-1)/blockSize - first)
+
+	i := sort.Search(n, func(i int) bool {
+		_, err := s.getBlock(txn, key, first+int64(i))
+		return err != badger.ErrKeyNotFound
+	})
+	if i == 0 {
+		return fileInfo.Base
+	}
+	if i == n {
+		return end
+	}
+
+	return (first + int64(i)) * blockSize
+}
+
+// Move the file to its new position in the expiration index,
+// before writing the file record with the specified ttl
+func (s *badgerStorage) setExpiry(txn *badger.Txn, key string, fileInfo *info, ttl time.Duration) error {
+	if fileInfo.Expiry > 0 {
+		if err := txn.Delete([]byte(expiryKey(fileInfo.Expiry, key))); err != nil {
+			return err
+		}
+	}
+
+	fileInfo.Expiry = 0
+	if ttl <= 0 {
+		return nil
+	}
+
+	fileInfo.Expiry = s.now().Add(ttl).UnixNano()
+	return txn.Set([]byte(expiryKey(fileInfo.Expiry, key)), nil)
+}
+
+// Delete the records of expired files, using the expiration index.
+// Badger hides expired records, but this makes the space reclaimable
+// without scanning all files. Returns the number of files removed.
+func (s *badgerStorage) SweepExpired(now time.Time) (int, error) {
+	var expired []string
+
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		prefix := []byte(_EXPIRY_PREFIX)
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			ekey := string(it.Item().Key())
+
+			expiry, _, ok := parseExpiryKey(ekey)
+			if ok && expiry > now.UnixNano() {
+				break
+			}
+
+			expired = append(expired, ekey)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	swept := 0
+
+	for _, ekey := range expired {
+		err := s.db.Update(func(txn *badger.Txn) error {
+			expiry, key, ok := parseExpiryKey(ekey)
+			if ok {
+				ival, err := txn.Get([]byte(infoKey(key)))
+				if err == nil {
+					var fileInfo info
+					if err := ival.Value(func(data []byte) error {
+						return (&fileInfo).Unmarshal(data)
+					}); err != nil {
+						return err
+					}
+
+					if fileInfo.Expiry == expiry {
+						return nil // not expired yet (badger TTLs have a 1 second resolution)
+					}
+
+					return txn.Delete([]byte(ekey)) // stale index record
+				}
+				if err != badger.ErrKeyNotFound {
+					return err
+				}
+
+				opts := badger.DefaultIteratorOptions
+				opts.PrefetchValues = false
+				opts.AllVersions = true // expired records are only visible here
+
+				it := txn.NewIterator(opts)
+				prefix := []byte(prefixKey(key))
+				var keys [][]byte
+
+				for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+					k := it.Item().KeyCopy(nil)
+					if len(keys) > 0 && bytes.Equal(keys[len(keys)-1], k) {
+						continue // older version
+					}
+					if _, ok := blockNumber(key, string(k)); ok || string(k) == infoKey(key) {
+						keys = append(keys, k)
+					}
+				}
+
+				it.Close()
+
+				for _, k := range keys {
+					if err := txn.Delete(k); err != nil {
+						return err
+					}
+				}
+
+				swept++
+			}
+
+			return txn.Delete([]byte(ekey))
+		})
+		if err != nil {
+			return swept, err
+		}
+	}
+
+	return swept, nil
+}
+
+// Delete file
+func (s *badgerStorage) DeleteFile(key string) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return s.deleteFileTxn(txn, key)
+	})
+}
+
+func (s *badgerStorage) deleteFileTxn(txn *badger.Txn, key string) error {
+	ikey := infoKey(key)
+
+	ival, err := txn.Get([]byte(ikey))
+	if err == badger.ErrKeyNotFound {
+		return nil
+	}
+
+	var fileInfo info
+	err = ival.Value(func(data []byte) error {
+		return (&fileInfo).Unmarshal(data)
+	})
+	if err != nil {
+		return err
+	}
+
+	if fileInfo.locked(s.now()) { // expired records are not visible
+		return ErrImmutable
+	}
+
+	if err := txn.Delete([]byte(ikey)); err != nil {
+		return err
+	}
+
+	if fileInfo.Expiry > 0 {
+		if err := txn.Delete([]byte(expiryKey(fileInfo.Expiry, key))); err != nil {
+			return err
+		}
+	}
+
+	deleteBlocksTxn(txn, key, &fileInfo)
+	return nil
+}
+
+// Delete the blocks of a file (errors are only logged)
+func deleteBlocksTxn(txn *badger.Txn, key string, fileInfo *info) {
+	if fileInfo.Inline != nil || fileInfo.DeletedAt > 0 { // no block records
+		return
+	}
+
+	blocks := fileInfo.dataBlocks()
+
+	for i := fileInfo.Base / fileInfo.blockSize(); i < blocks; i++ {
+		bkey := blockKey(key, i)
+		if err := txn.Delete([]byte(bkey)); err != nil {
+			log.Println("delete block", i, err)
+		}
+	}
+}
+
+// Blocks refreshed per transaction by Touch
+const touchBatch = 64
+
+// Refresh the expiration of the file identified by key to a TTL from now (sliding expiration),
+// by the same rules as writes: files with preserved times keep their expiration, and reservations
+// get the reservation TTL. The metadata and then the blocks are written again, in transactions
+// of touchBatch blocks; blocks with their own TTL (WithBlockTTL) are left to expire.
+func (s *badgerStorage) Touch(key string) error {
+	ikey := infoKey(key)
+
+	var fileInfo info
+	var ttl time.Duration
+
+	err := s.db.Update(func(txn *badger.Txn) error {
+		ival, err := txn.Get([]byte(ikey))
+		if err == badger.ErrKeyNotFound {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		err = ival.Value(func(data []byte) error {
+			return (&fileInfo).Unmarshal(data)
+		})
+		if err != nil {
+			return err
+		}
+
+		ttl = s.fileTTL(&fileInfo, ival)
+		if err := s.setExpiry(txn, key, &fileInfo, ttl); err != nil {
+			return err
+		}
+
+		buf, _ := fileInfo.Marshal()
+		return txn.SetWithTTL([]byte(ikey), buf, ttl)
+	})
+	if err != nil || fileInfo.BlockTTL > 0 || fileInfo.Preserve {
+		return err
+	}
+
+	blocks := fileInfo.dataBlocks()
+
+	for first := fileInfo.Base / fileInfo.blockSize(); first < blocks; first += touchBatch {
+		err := s.db.Update(func(txn *badger.Txn) error {
+			for i := first; i < first+touchBatch && i < blocks; i++ {
+				bkey := []byte(blockKey(key, i))
+
+				item, err := txn.Get(bkey)
+				if err == badger.ErrKeyNotFound {
+					continue
+				}
+				if err != nil {
+					return err
+				}
+
+				data, err := item.ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+
+				if err := txn.SetWithTTL(bkey, data, ttl); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Copy the file src to the new file dst: the metadata and all the blocks are copied
+// in a single transaction, so a large file may fail with badger.ErrTxnTooBig.
+// Blocks that already expired (WithBlockTTL) are not copied.
+func (s *badgerStorage) Copy(src, dst string) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return s.copyFileTxn(txn, src, dst, false)
+	})
+}
+
+// Move the file src to the new key dst, with its metadata and blocks, in a single transaction.
+// The file keeps its info, including the state to resume an incomplete upload,
+// and the TTL applies from now (unless the file has preserved times).
+func (s *badgerStorage) Rename(src, dst string) error {
 	return s.db.Update(func(txn *badger.Txn) error {
-		_, err := txn.Get([]byte(key))
-		if err == nil {
+		return s.copyFileTxn(txn, src, dst, true)
+	})
+}
+
+// Copy the records of file src to dst, deleting the src records if rename is set
+func (s *badgerStorage) copyFileTxn(txn *badger.Txn, src, dst string, rename bool) error {
+	ival, err := txn.Get([]byte(infoKey(src)))
+	if err == badger.ErrKeyNotFound {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	var srcInfo info
+
+	err = ival.Value(func(data []byte) error {
+		return (&srcInfo).Unmarshal(data)
+	})
+	if err != nil {
+		return err
+	}
+	if srcInfo.DeletedAt > 0 {
+		return ErrDeleted
+	}
+
+	fileInfo, item := &srcInfo, ival
+
+	if rename {
+		if src == dst {
 			return ErrExists
 		}
-		if err != badger.ErrKeyNotFound {
+		if fileInfo.locked(s.now()) {
+			return ErrImmutable
+		}
+
+		if fileInfo.Expiry > 0 { // the new key gets its own expiration index entry
+			if err := txn.Delete([]byte(expiryKey(fileInfo.Expiry, src))); err != nil {
+				return err
+			}
+
+			fileInfo.Expiry = 0
+		}
+
+		if err := txn.Delete([]byte(infoKey(src))); err != nil {
+			return err
+		}
+	} else {
+		if s.minFreeSpace > 0 {
+			if err := checkFreeSpace(s.dir, srcInfo.Length, s.minFreeSpace); err != nil {
+				return err
+			}
+		}
+
+		fileInfo, item = srcInfo.copyInfo(s.now()), nil
+		fileInfo.Preserve = s.ttlFromCreation
+	}
+
+	ttl := s.fileTTL(fileInfo, item)
+	if err := s.createFileTxn(txn, dst, fileInfo, ttl); err != nil {
+		return err
+	}
+
+	blockTTL := ttl
+	if fileInfo.BlockTTL > 0 && fileInfo.BlockTTL < ttl {
+		blockTTL = s.blockExpiry(fileInfo.BlockTTL)
+	}
+
+	blocks := fileInfo.dataBlocks()
+
+	for i := fileInfo.Base / fileInfo.blockSize(); i < blocks; i++ {
+		if !fileInfo.hasBlock(i) { // not written yet (see WithRanges)
+			continue
+		}
+
+		bkey := []byte(blockKey(src, i))
+
+		item, err := txn.Get(bkey)
+		if err == badger.ErrKeyNotFound && fileInfo.BlockTTL > 0 {
+			continue
+		}
+		if err == badger.ErrKeyNotFound {
+			return ErrMissingBlock{Block: i}
+		}
+		if err != nil {
+			return err
+		}
+
+		data, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+
+		if err := txn.SetWithTTL([]byte(blockKey(dst, i)), data, blockTTL); err != nil {
+			return err
+		}
+
+		if rename {
+			if err := txn.Delete(bkey); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Delete the blocks of a file, keeping the metadata (marked as deleted) until it expires
+func (s *badgerStorage) SoftDelete(key string) error {
+	ikey := infoKey(key)
+
+	return s.db.Update(func(txn *badger.Txn) error {
+		ival, err := txn.Get([]byte(ikey))
+		if err == badger.ErrKeyNotFound {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		var fileInfo info
+		err = ival.Value(func(data []byte) error {
+			return (&fileInfo).Unmarshal(data)
+		})
+		if err != nil {
+			return err
+		}
+
+		if fileInfo.DeletedAt > 0 {
+			return nil
+		}
+		if fileInfo.locked(s.now()) {
+			return ErrImmutable
+		}
+
+		deleteBlocksTxn(txn, key, &fileInfo)
+
+		fileInfo.Inline = nil
+		fileInfo.DeletedAt = s.now().UnixNano()
+
+		ttl := s.fileTTL(&fileInfo, ival)
+		if err := s.setExpiry(txn, key, &fileInfo, ttl); err != nil {
 			return err
 		}
 
-		// write file Info
-		if err = txn.SetWithTTL([]byte(key), data, s.ttl); err != nil {
-			return err
+		buf, _ := fileInfo.Marshal()
+		return txn.SetWithTTL([]byte(ikey), buf, ttl)
+	})
+}
+
+// Add data to file
+func (s *badgerStorage) WriteAt(key string, pos int64, data []byte) (int64, error) {
+	for {
+		retpos := InvalidPos
+
+		err := s.db.Update(func(txn *badger.Txn) (err error) {
+			retpos, err = s.writeAtTxn(txn, key, pos, data)
+			return
+		})
+
+		if err == badger.ErrConflict { // concurrent write (of another range, see WithRanges), try again
+			continue
+		}
+
+		return retpos, err
+	}
+}
+
+func (s *badgerStorage) writeAtTxn(txn *badger.Txn, key string, pos int64, data []byte) (int64, error) {
+	if pos < 0 {
+		return InvalidPos, ErrInvalidPos
+	}
+
+	ikey := infoKey(key)
+	retpos := InvalidPos
+
+	ival, err := txn.Get([]byte(ikey))
+	if err == badger.ErrKeyNotFound {
+		return InvalidPos, ErrNotFound
+	}
+
+	var fileInfo info
+	err = ival.Value(func(data []byte) error {
+		return (&fileInfo).Unmarshal(data)
+	})
+	if err != nil {
+		return InvalidPos, err
+	}
+
+	blockSize := fileInfo.blockSize()
+	data = s.writeLimit(data, blockSize)
+
+	nblocks, rest := int64(len(data))/blockSize, int64(len(data))%blockSize
+	startBlock, rr := pos/blockSize, pos%blockSize
+	if rr != 0 {
+		log.Println(key, "pos", pos, "block", startBlock, "rest", rr)
+		return InvalidPos, ErrInvalidPos
+	}
+
+	//log.Println(fileInfo, "start", startBlock, "blocks", nblocks, "rest", rest, "pos", pos)
+
+	if fileInfo.DeletedAt > 0 {
+		return InvalidPos, ErrDeleted
+	}
+
+	if fileInfo.CurPos < 0 { // file complete
+		return InvalidPos, ErrExists
+	}
+
+	if err := fileInfo.checkWrite(pos, int64(len(data))); err != nil { // wrong start
+		log.Println(fileInfo.Name, "block", startBlock, "pos", pos, "cur", fileInfo.CurPos, "ranges", fileInfo.Ranges)
+		return InvalidPos, err
+	}
+
+	if pos+int64(len(data)) > fileInfo.Length { // out of boundary
+		log.Println(fileInfo.Name, "block", startBlock, "pos", pos, "data", len(data), "file", fileInfo.Length)
+		return InvalidPos, ErrInvalidSize
+	}
+
+	fblocks := fileInfo.Length / blockSize
+
+	if startBlock+nblocks < fblocks && rest != 0 {
+		log.Println(fileInfo.Name, "block", startBlock, "pos", pos, "n", nblocks, "file", fblocks, "rest", rest)
+		return InvalidPos, ErrInvalidSize
+	}
+
+	if pos+int64(len(data)) == fileInfo.Length && rest > 0 {
+		nblocks += 1
+	}
+
+	block := startBlock
+	offs := int64(0)
+	ldata := len(data)
+	item := ival
+	if fileInfo.Reserve > 0 { // the upload started: the file TTL applies from now
+		fileInfo.Reserve, fileInfo.Preserve, item = 0, s.ttlFromCreation, nil
+	}
+	ttl := s.fileTTL(&fileInfo, item)
+
+	blockTTL := ttl
+	if fileInfo.BlockTTL > 0 && fileInfo.BlockTTL < ttl {
+		blockTTL = s.blockExpiry(fileInfo.BlockTTL)
+	}
+
+	curHash := getHasher(fileInfo.HashAlg)
+	if err := unmarshalHash(curHash, fileInfo.CurHash); err != nil {
+		return InvalidPos, err
+	}
+
+	if fileInfo.Inlined || fileInfo.Inline != nil { // small file, stored in the metadata record
+		fileInfo.Inline = append(fileInfo.Inline, data...)
+		curHash.Write(data)
+		offs, ldata = int64(len(data)), 0
+	}
+
+	for ldata > 0 {
+		bkey := blockKey(key, block)
+		buf := data[offs:]
+		if int64(len(buf)) > blockSize {
+			buf = buf[:blockSize]
+		}
+
+		err = txn.SetWithTTL([]byte(bkey), buf, blockTTL)
+		if err != nil {
+			return InvalidPos, err
+		}
+
+		hashBlock(curHash, block, buf)
+
+		block += 1
+		offs += int64(len(buf))
+		ldata -= len(buf)
+	}
+
+	hh := curHash.Sum(nil)
+	if fileInfo.addRange(pos, offs) == fileInfo.Length { // we are done
+		if fileInfo.Hash == "" {
+			fileInfo.Hash = toHex(hh)
+		} else if fileInfo.Hash != toHex(hh) {
+			// delete file ?
+			hashMismatch(key, &fileInfo, toHex(hh))
+			return InvalidPos, ErrInvalidHash
+		}
+
+		retpos = FileComplete
+		fileInfo.CurPos = FileComplete
+		fileInfo.CurHash = completeHashState(fileInfo.HashAlg, curHash)
+	} else {
+		fileInfo.CurHash, err = marshalHash(curHash)
+		if err != nil {
+			return InvalidPos, err
 		}
 
-		return nil
-	})
+		retpos = pos + offs
+	}
+
+	if !fileInfo.Preserve {
+		fileInfo.Created = s.now()
+	}
+	fileInfo.completeMigrated()
+
+	if err := s.setExpiry(txn, key, &fileInfo, ttl); err != nil {
+		return InvalidPos, err
+	}
+
+	buf, _ := fileInfo.Marshal()
+	if err := s.checkInfoSize(buf); err != nil {
+		return InvalidPos, err
+	}
+
+	if err := txn.SetWithTTL([]byte(ikey), buf, ttl); err != nil {
+		return InvalidPos, err
+	}
+
+	return retpos, nil
 }
 
-// Delete file
-func (s *badgerStorage) DeleteFile(key string) error {
+func (s *badgerStorage) ReadAt(key string, buf []byte, pos int64) (int64, error) {
 	ikey := infoKey(key)
+	if pos < 0 {
+		return 0, ErrInvalidPos
+	}
 
-	return s.db.Update(func(txn *badger.Txn) error {
-		ival, err := txn.Get([]byte(ikey))
+	nread := int64(0)
+	incomplete := false
+
+	err := s.db.View(func(txn *badger.Txn) error {
+		val, err := txn.Get([]byte(ikey))
 		if err == badger.ErrKeyNotFound {
-			return nil
+			return ErrNotFound
 		}
 
 		var fileInfo info
-		err = ival.Value(func(data []byte) error {
+		err = val.Value(func(data []byte) error {
 			return (&fileInfo).Unmarshal(data)
 		})
 		if err != nil {
 			return err
 		}
 
-		if err := txn.Delete([]byte(ikey)); err != nil {
-			return err
+		if fileInfo.DeletedAt > 0 {
+			return ErrDeleted
+		}
+
+		if pos >= fileInfo.Length {
+			return io.EOF
+		}
+
+		end := fileInfo.Length
+		if incomplete = fileInfo.CurPos != FileComplete; incomplete {
+			end = fileInfo.CurPos
+		}
+
+		if pos >= end {
+			return ErrIncomplete
 		}
 
-		length := fileInfo.Length
-		if fileInfo.CurPos >= 0 { // file not completely written
-			length = fileInfo.CurPos
+		if pos < fileInfo.Base {
+			return ErrTrimmed
 		}
 
-		blocks, rest := length/BlockSize, length%BlockSize
-		if rest > 0 {
-			blocks += 1
+		if data := fileInfo.content(); data != nil { // the content is in the metadata
+			nread = int64(copy(buf, data[pos:]))
+			return nil
+		}
+
+		block, offs := pos/fileInfo.blockSize(), pos%fileInfo.blockSize()
+
+		lbuf := int64(len(buf))
+		if rest := end - pos; rest < lbuf {
+			lbuf = rest
 		}
 
-		for i := 0; i < int(blocks); i++ {
-			bkey := blockKey(key, i)
-			if err := txn.Delete([]byte(bkey)); err != nil {
-				log.Println("delete block", i, err)
+		for p := int64(0); lbuf > 0; block += 1 {
+			val, err := s.getBlock(txn, key, block)
+			if err == badger.ErrKeyNotFound && fileInfo.BlockTTL > 0 && p == 0 {
+				return ErrTrimmed // the block expired, as the ones before
+			}
+			if err == badger.ErrKeyNotFound {
+				return ErrMissingBlock{Block: block}
+			}
+			if err != nil {
+				return err
 			}
+
+			val.Value(func(data []byte) error {
+				data, offs = data[offs:], 0
+				l := int64(len(data))
+
+				if lbuf > l {
+					copy(buf[p:], data)
+					nread += l
+					lbuf -= l
+					p += l
+				} else {
+					copy(buf[p:], data[:lbuf])
+					nread += lbuf
+					p += lbuf
+					lbuf = 0
+				}
+
+				return nil
+			})
 		}
 
 		return nil
 	})
-}
 
-// Add data to file
-func (s *badgerStorage) WriteAt(key string, pos int64, data []byte) (int64, error) {
-	if pos < 0 {
-		return InvalidPos, ErrInvalidPos
+	if err == nil && nread < int64(len(buf)) {
+		if incomplete {
+			err = ErrIncomplete // a short read is at the end of the data written so far
+		} else {
+			err = io.EOF // like io.ReaderAt, a short read is at the end of the file
+		}
 	}
 
-	ikey := infoKey(key)
-	nblocks, rest := len(data)/BlockSize, len(data)%BlockSize
-	startBlock, rr := int(pos/BlockSize), int(pos%BlockSize)
-	if rr != 0 {
-		log.Println(key, "pos", pos, "block", startBlock, "rest", rr)
-		return InvalidPos, ErrInvalidPos
+	return nread, err
+}
+
+// Return a sequential reader of the file, reading all blocks in the same read transaction
+// (a consistent snapshot of the file), that is discarded when the reader is closed.
+func (s *badgerStorage) OpenReader(key string) (io.ReadCloser, *FileInfo, error) {
+	txn := s.db.NewTransaction(false)
+
+	val, err := txn.Get([]byte(infoKey(key)))
+	if err == badger.ErrKeyNotFound {
+		err = ErrNotFound
+	}
+	if err != nil {
+		txn.Discard()
+		return nil, nil, err
 	}
 
-	retpos := InvalidPos
+	var fileInfo info
+	err = val.Value(func(data []byte) error {
+		return (&fileInfo).Unmarshal(data)
+	})
+	if err == nil && fileInfo.DeletedAt > 0 {
+		err = ErrDeleted
+	}
+	if err != nil {
+		txn.Discard()
+		return nil, nil, err
+	}
 
-	err := s.db.Update(func(txn *badger.Txn) error {
-		ival, err := txn.Get([]byte(ikey))
+	get := func(block int64) ([]byte, error) {
+		val, err := s.getBlock(txn, key, block)
+		if err == badger.ErrKeyNotFound && fileInfo.BlockTTL > 0 {
+			return nil, ErrTrimmed // the block expired
+		}
 		if err == badger.ErrKeyNotFound {
-			return ErrNotFound
+			return nil, ErrMissingBlock{Block: block}
 		}
-
-		var fileInfo info
-		err = ival.Value(func(data []byte) error {
-			return (&fileInfo).Unmarshal(data)
-		})
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		//log.Println(fileInfo, "start", startBlock, "blocks", nblocks, "rest", rest, "pos", pos)
+		return val.ValueCopy(nil)
+	}
 
-		if fileInfo.CurPos < 0 { // file complete
-			return ErrExists
-		}
+	discard := func() error {
+		txn.Discard()
+		return nil
+	}
 
-		if pos != fileInfo.CurPos { // wrong start
-			log.Println(fileInfo.Name, "block", startBlock, "pos", pos, "cur", fileInfo.CurPos)
-			return ErrInvalidPos
-		}
+	fileInfo.Base = s.firstByte(txn, key, &fileInfo) // the reader starts after expired blocks
+	stat := fileInfo.fileInfo(key, time.Unix(int64(val.ExpiresAt()), 0))
+	return newBlockReader(&fileInfo, get, discard), stat, nil
+}
 
-		if pos+int64(len(data)) > fileInfo.Length { // out of boundary
-			log.Println(fileInfo.Name, "block", startBlock, "pos", pos, "data", len(data), "file", fileInfo.Length)
-			return ErrInvalidSize
-		}
+// Atomically add delta to the counter file identified by key (a big-endian int64),
+// creating it if missing. Returns the new value.
+func (s *badgerStorage) IncrFile(key string, delta int64) (int64, error) {
+	ikey, bkey := infoKey(key), blockKey(key, 0)
 
-		fblocks := int(fileInfo.Length / BlockSize)
+	for {
+		var value int64
 
-		if startBlock+nblocks < fblocks && rest != 0 {
-			log.Println(fileInfo.Name, "block", startBlock, "pos", pos, "n", nblocks, "file", fblocks, "rest", rest)
-			return ErrInvalidSize
-		}
+		err := s.db.Update(func(txn *badger.Txn) error {
+			var fileInfo info
 
-		if pos+int64(len(data)) == fileInfo.Length && rest > 0 {
-			nblocks += 1
-		}
+			ival, err := txn.Get([]byte(ikey))
+			if err == badger.ErrKeyNotFound {
+				ival = nil
+				fileInfo = info{Name: key, HashAlg: s.hash}
+			} else if err != nil {
+				return err
+			} else {
+				err = ival.Value(func(data []byte) error {
+					return (&fileInfo).Unmarshal(data)
+				})
+				if err != nil {
+					return err
+				}
+
+				if fileInfo.DeletedAt > 0 {
+					return ErrDeleted
+				}
+				if fileInfo.CurPos != FileComplete || fileInfo.Length != counterSize || fileInfo.Base != 0 {
+					return ErrInvalidSize // not a counter
+				}
+				if fileInfo.locked(s.now()) {
+					return ErrImmutable
+				}
 
-		block := startBlock
-		offs := int64(0)
-		ldata := len(data)
+				if fileInfo.Inline != nil {
+					value = int64(binary.BigEndian.Uint64(fileInfo.Inline))
+				} else {
+					bval, err := txn.Get([]byte(bkey))
+					if err == badger.ErrKeyNotFound {
+						return ErrMissingBlock{Block: 0}
+					}
+					if err != nil {
+						return err
+					}
+
+					err = bval.Value(func(data []byte) error {
+						if len(data) != counterSize {
+							return ErrInvalidSize
+						}
+
+						value = int64(binary.BigEndian.Uint64(data))
+						return nil
+					})
+					if err != nil {
+						return err
+					}
+				}
+			}
 
-		curHash := getHasher()
-		if err := unmarshalHash(curHash, fileInfo.CurHash); err != nil {
-			return err
-		}
+			// new counters are inlined if small files are
+			inline := fileInfo.Inline != nil || (ival == nil && counterSize <= s.inlineSize)
+			fileInfo.Inlined = inline
 
-		for ldata > 0 {
-			bkey := blockKey(key, block)
-			buf := data[offs:]
-			if len(buf) > BlockSize {
-				buf = buf[:BlockSize]
+			value += delta
+			data := fileInfo.setCounter(value)
+
+			if !fileInfo.Preserve {
+				fileInfo.Created = s.now()
 			}
 
-			err = txn.SetWithTTL([]byte(bkey), buf, s.ttl)
-			if err != nil {
+			ttl := s.fileTTL(&fileInfo, ival)
+			if err := s.setExpiry(txn, key, &fileInfo, ttl); err != nil {
+				return err
+			}
+
+			if inline {
+				fileInfo.Inline = data
+			} else if err := txn.SetWithTTL([]byte(bkey), data, ttl); err != nil {
 				return err
 			}
 
-			curHash.Write(buf)
+			buf, _ := fileInfo.Marshal()
+			return txn.SetWithTTL([]byte(ikey), buf, ttl)
+		})
 
-			block += 1
-			offs += int64(len(buf))
-			ldata -= len(buf)
+		if err == badger.ErrConflict { // concurrent update, try again
+			continue
 		}
 
-		hh := curHash.Sum(nil)
-		if fileInfo.CurPos+offs == fileInfo.Length { // we are done
-			if fileInfo.Hash == "" {
-				fileInfo.Hash = toHex(hh)
-			} else if fileInfo.Hash != toHex(hh) {
-				// delete file ?
-				return ErrInvalidHash
-			}
+		return value, err
+	}
+}
 
-			retpos = FileComplete
-			fileInfo.CurPos = FileComplete
-			fileInfo.CurHash = ""
-		} else {
-			fileInfo.CurHash, err = marshalHash(curHash)
-			if err != nil {
+// Remove the leading blocks of a file, up to offset bytes.
+// The offsets of the remaining data don't change.
+func (s *badgerStorage) TrimFront(key string, bytes int64) error {
+	ikey := infoKey(key)
+
+	return s.db.Update(func(txn *badger.Txn) error {
+		ival, err := txn.Get([]byte(ikey))
+		if err == badger.ErrKeyNotFound {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		var fileInfo info
+		err = ival.Value(func(data []byte) error {
+			return (&fileInfo).Unmarshal(data)
+		})
+		if err != nil {
+			return err
+		}
+
+		if fileInfo.DeletedAt > 0 {
+			return ErrDeleted
+		}
+		if fileInfo.locked(s.now()) {
+			return ErrImmutable
+		}
+
+		base := trimBase(&fileInfo, bytes)
+		if base <= fileInfo.Base {
+			return nil
+		}
+
+		for i := fileInfo.Base / fileInfo.blockSize(); i < base/fileInfo.blockSize(); i++ {
+			if err := txn.Delete([]byte(blockKey(key, i))); err != nil {
 				return err
 			}
-
-			fileInfo.CurPos += offs
-			retpos = fileInfo.CurPos
 		}
 
-		fileInfo.Created = time.Now()
+		fileInfo.Base = base
 
-		buf, _ := fileInfo.Marshal()
-		if err := txn.SetWithTTL([]byte(ikey), buf, s.ttl); err != nil {
+		ttl := s.fileTTL(&fileInfo, ival)
+		if err := s.setExpiry(txn, key, &fileInfo, ttl); err != nil {
 			return err
 		}
 
-		return nil
+		buf, _ := fileInfo.Marshal()
+		return txn.SetWithTTL([]byte(ikey), buf, ttl)
 	})
+}
+
+// Return true if the file exists (complete or not), without reading its metadata
+func (s *badgerStorage) Exists(key string) (bool, error) {
+	err := s.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte(infoKey(key)))
+		return err
+	})
+	if err == badger.ErrKeyNotFound {
+		return false, nil
+	}
 
-	return retpos, err
+	return err == nil, err
 }
 
-func (s *badgerStorage) ReadAt(key string, buf []byte, pos int64) (int64, error) {
+// Return file info
+func (s *badgerStorage) Stat(key string) (*FileInfo, error) {
 	ikey := infoKey(key)
-	if pos < 0 {
-		return 0, ErrInvalidPos
-	}
 
-	block, offs := pos/BlockSize, pos%BlockSize
-	nread := int64(0)
+	var stats *FileInfo
 
 	err := s.db.View(func(txn *badger.Txn) error {
 		val, err := txn.Get([]byte(ikey))
@@ -253,64 +1196,58 @@ func (s *badgerStorage) ReadAt(key string, buf []byte, pos int64) (int64, error)
 			return err
 		}
 
-		if fileInfo.CurPos != FileComplete {
-			return ErrIncomplete
-		}
-
-		if pos > fileInfo.Length {
-			return ErrInvalidPos
-		}
-
-		lbuf := len(buf)
-		if int(fileInfo.Length-pos) < lbuf {
-			lbuf = int(fileInfo.Length - pos)
-		}
+		stats = fileInfo.fileInfo(key, time.Unix(int64(val.ExpiresAt()), 0))
+		stats.Base = s.firstByte(txn, key, &fileInfo)
+		return nil
+	})
 
-		for p := 0; lbuf > 0; block += 1 {
-			bkey := blockKey(key, int(block))
+	return stats, err
+}
 
-			val, err := txn.Get([]byte(bkey))
-			if err == badger.ErrKeyNotFound {
-				return ErrNotFound
-			}
+// Return the raw file metadata, for diagnostics
+func (s *badgerStorage) DebugInfo(key string) (map[string]interface{}, error) {
+	ikey := infoKey(key)
 
-			val.Value(func(data []byte) error {
-				data, offs = data[offs:], 0
-				l := len(data)
+	var debug map[string]interface{}
 
-				if lbuf > l {
-					copy(buf[p:], data)
-					nread += int64(l)
-					lbuf -= l
-					p += l
-				} else {
-					copy(buf[p:], data[:lbuf])
-					nread += int64(lbuf)
-					p += lbuf
-					lbuf = 0
-				}
+	err := s.db.View(func(txn *badger.Txn) error {
+		val, err := txn.Get([]byte(ikey))
+		if err == badger.ErrKeyNotFound {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
 
-				return nil
-			})
+		var fileInfo info
+		err = val.Value(func(data []byte) error {
+			return (&fileInfo).Unmarshal(data)
+		})
+		if err != nil {
+			return err
 		}
 
+		debug = fileInfo.debugInfo(key, time.Unix(int64(val.ExpiresAt()), 0))
 		return nil
 	})
 
-	return nread, err
+	return debug, err
 }
 
-// Return file info
-func (s *badgerStorage) Stat(key string) (*FileInfo, error) {
-	key = infoKey(key)
+// Return storage details for the file
+func (s *badgerStorage) StatPhysical(key string) (*PhysicalInfo, error) {
+	ikey := infoKey(key)
 
-	var stats *FileInfo
+	var stats *PhysicalInfo
 
-	return stats, s.db.View(func(txn *badger.Txn) error {
-		val, err := txn.Get([]byte(key))
+	err := s.db.View(func(txn *badger.Txn) error {
+		val, err := txn.Get([]byte(ikey))
 		if err == badger.ErrKeyNotFound {
 			return ErrNotFound
 		}
+		if err != nil {
+			return err
+		}
 
 		var fileInfo info
 		err = val.Value(func(data []byte) error {
@@ -320,18 +1257,73 @@ func (s *badgerStorage) Stat(key string) (*FileInfo, error) {
 			return err
 		}
 
-		stats = &FileInfo{
-			Name:        fileInfo.Name,
-			ContentType: fileInfo.ContentType,
-			Created:     fileInfo.Created,
-			Hash:        fileInfo.Hash,
-			Length:      fileInfo.Length,
-			Next:        fileInfo.CurPos,
-			ExpiresAt:   time.Unix(int64(val.ExpiresAt()), 0),
+		stats = &PhysicalInfo{
+			Key:       key,
+			Medium:    "badger",
+			InfoBytes: val.EstimatedSize(),
+			CurPos:    fileInfo.CurPos,
+			CurHash:   fileInfo.CurHash,
+		}
+
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		prefix := []byte(prefixKey(key))
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+
+			if _, ok := blockNumber(key, string(item.Key())); ok {
+				stats.Blocks++
+				stats.Bytes += item.EstimatedSize()
+			}
+		}
+
+		return nil
+	})
+
+	return stats, err
+}
+
+// Return file info for all files with a key starting with prefix
+func (s *badgerStorage) ListFiles(prefix string, opts ...ListOption) ([]*FileInfo, error) {
+	var files []*FileInfo
+
+	err := s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek([]byte(prefix)); it.ValidForPrefix([]byte(prefix)); it.Next() {
+			item := it.Item()
+
+			ikey := string(item.Key())
+			if !strings.HasSuffix(ikey, _INFO_SUFFIX) || strings.HasPrefix(ikey, _EXPIRY_PREFIX) {
+				continue // block or index record
+			}
+
+			var fileInfo info
+			err := item.Value(func(data []byte) error {
+				return (&fileInfo).Unmarshal(data)
+			})
+			if err != nil {
+				return err
+			}
+
+			key := strings.TrimSuffix(ikey, _INFO_SUFFIX)
+			files = append(files, fileInfo.fileInfo(key, time.Unix(int64(item.ExpiresAt()), 0)))
 		}
 
 		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	SortFiles(files, opts...)
+	return files, nil
 }
 
 // Scan database, for debugging purposes
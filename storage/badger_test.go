@@ -0,0 +1,214 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger"
+)
+
+// Open a badger store in a temporary folder, removed at the end of the test
+func openTestBadger(t testing.TB, opts ...Option) *badgerStorage {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "cashier-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := OpenBadger(dir, false, time.Hour, opts...)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		s.Close()
+		os.RemoveAll(dir)
+	})
+
+	return s
+}
+
+// Return size bytes of test content
+func testData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i*7 + i/251)
+	}
+
+	return data
+}
+
+// Create the file key with data, hashed with the store algorithm, and write it in chunks of chunk bytes
+func putTestFile(t *testing.T, sdb StorageDB, key string, data []byte, chunk int, opts ...FileOption) {
+	t.Helper()
+
+	stat := FileInfo{HashAlg: HashCumulative}
+	if s, ok := sdb.(*badgerStorage); ok && s.hash != "" {
+		stat.HashAlg = s.hash
+	}
+
+	hash, _, err := GetHashAlg(bytes.NewReader(data), stat.HashAlg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sdb.CreateFile(key, key, "application/octet-stream", int64(len(data)), hash, opts...); err != nil {
+		t.Fatal(err)
+	}
+
+	for pos := 0; pos < len(data); pos += chunk {
+		end := pos + chunk
+		if end > len(data) {
+			end = len(data)
+		}
+
+		if _, err := WriteAll(sdb, key, int64(pos), data[pos:end]); err != nil {
+			t.Fatalf("write %v at %v: %v", key, pos, err)
+		}
+	}
+}
+
+// Read the whole file key
+func readTestFile(t *testing.T, sdb StorageDB, key string) []byte {
+	t.Helper()
+
+	stat, err := sdb.Stat(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, stat.Length)
+	for pos := int64(0); pos < stat.Length; {
+		n, err := sdb.ReadAt(key, buf[pos:], pos)
+		if n == 0 {
+			t.Fatalf("read %v at %v: %v", key, pos, err)
+		}
+
+		pos += n
+	}
+
+	return buf
+}
+
+// Return the stored metadata of file key
+func getTestInfo(t *testing.T, s *badgerStorage, key string) *info {
+	t.Helper()
+
+	var fileInfo info
+
+	err := s.db.View(func(txn *badger.Txn) error {
+		val, err := txn.Get([]byte(infoKey(key)))
+		if err != nil {
+			return err
+		}
+
+		return val.Value(func(data []byte) error {
+			return (&fileInfo).Unmarshal(data)
+		})
+	})
+	if err != nil {
+		t.Fatalf("info %v: %v", key, err)
+	}
+
+	return &fileInfo
+}
+
+// Change the stored metadata of file key, keeping its TTL
+func setTestInfo(t *testing.T, s *badgerStorage, key string, update func(i *info)) {
+	t.Helper()
+
+	err := s.db.Update(func(txn *badger.Txn) error {
+		val, err := txn.Get([]byte(infoKey(key)))
+		if err != nil {
+			return err
+		}
+
+		var fileInfo info
+		if err := val.Value(func(data []byte) error {
+			return (&fileInfo).Unmarshal(data)
+		}); err != nil {
+			return err
+		}
+
+		update(&fileInfo)
+
+		buf, _ := fileInfo.Marshal()
+		return txn.SetWithTTL([]byte(infoKey(key)), buf, time.Unix(int64(val.ExpiresAt()), 0).Sub(time.Now()))
+	})
+	if err != nil {
+		t.Fatalf("info %v: %v", key, err)
+	}
+}
+
+// Compare reading all the blocks of a large file with point gets (as ReadAt does)
+// and with an iterator over the block prefix. The block numbers are not zero padded,
+// so the iterator returns the blocks in key order (0, 1, 10, 100, ...): each block
+// is copied to its position in the file, which only works for whole file reads.
+func BenchmarkBlockReads(b *testing.B) {
+	s := openTestBadger(b)
+
+	const blocks = 1024
+	data := testData(blocks * BlockSize)
+	if err := s.CreateFile("f", "f", "", int64(len(data)), nil); err != nil {
+		b.Fatal(err)
+	}
+	if _, err := WriteAll(s, "f", 0, data); err != nil {
+		b.Fatal(err)
+	}
+
+	buf := make([]byte, len(data))
+
+	b.Run("point-get", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+
+		for i := 0; i < b.N; i++ {
+			if n, err := s.ReadAt("f", buf, 0); err != nil || n != int64(len(data)) {
+				b.Fatal(n, err)
+			}
+		}
+	})
+
+	b.Run("iterator", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+
+		for i := 0; i < b.N; i++ {
+			var n int64
+
+			err := s.db.View(func(txn *badger.Txn) error {
+				it := txn.NewIterator(badger.DefaultIteratorOptions)
+				defer it.Close()
+
+				prefix := []byte(prefixKey("f"))
+
+				for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+					block, ok := blockNumber("f", string(it.Item().Key()))
+					if !ok {
+						continue
+					}
+
+					err := it.Item().Value(func(data []byte) error {
+						n += int64(copy(buf[block*BlockSize:], data))
+						return nil
+					})
+					if err != nil {
+						return err
+					}
+				}
+
+				return nil
+			})
+			if err != nil || n != int64(len(data)) {
+				b.Fatal(n, err)
+			}
+		}
+	})
+
+	if !bytes.Equal(buf, data) {
+		b.Errorf("content differs")
+	}
+}
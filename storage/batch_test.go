@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// A batch that fails midway leaves none of its files, a successful one commits them all
+func TestBatch(t *testing.T) {
+	s := openTestBadger(t)
+	putTestFile(t, s, "old", testData(100), 100)
+
+	manifest, part := []byte("part\n"), testData(1000)
+
+	batch := func(fail error) error {
+		return s.Batch(func(tx Tx) error {
+			if err := tx.CreateFile("part", "part", "", int64(len(part)), nil); err != nil {
+				return err
+			}
+			if _, err := tx.WriteAt("part", 0, part); err != nil {
+				return err
+			}
+			if err := tx.DeleteFile("old"); err != nil {
+				return err
+			}
+			if fail != nil {
+				return fail
+			}
+			if err := tx.CreateFile("manifest", "manifest", "text/plain", int64(len(manifest)), nil); err != nil {
+				return err
+			}
+			_, err := tx.WriteAt("manifest", 0, manifest)
+			return err
+		})
+	}
+
+	errFail := errors.New("fail")
+	if err := batch(errFail); err != errFail {
+		t.Fatalf("failed batch: %v, expected %v", err, errFail)
+	}
+
+	for _, key := range []string{"part", "manifest"} {
+		if _, err := s.Stat(key); err != ErrNotFound {
+			t.Errorf("%v after failed batch: %v, expected ErrNotFound", key, err)
+		}
+	}
+	if !bytes.Equal(readTestFile(t, s, "old"), testData(100)) {
+		t.Error("old file changed by the failed batch")
+	}
+
+	if err := batch(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readTestFile(t, s, "part"); !bytes.Equal(got, part) {
+		t.Errorf("part: %v bytes, expected %v", len(got), len(part))
+	}
+	if got := readTestFile(t, s, "manifest"); !bytes.Equal(got, manifest) {
+		t.Errorf("manifest: %q, expected %q", got, manifest)
+	}
+	if _, err := s.Stat("old"); err != ErrNotFound {
+		t.Errorf("old after batch: %v, expected ErrNotFound", err)
+	}
+}
@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Settings for BenchmarkStorage
+type BenchConfig struct {
+	FileSize    int64 // bytes per file
+	Concurrency int   // goroutines per CPU (default 1)
+	BlockSize   int64 // block size of the storage service (default BlockSize)
+}
+
+// Latencies of each operation in a benchmark
+type benchLatencies struct {
+	sync.Mutex
+	ops map[string][]time.Duration
+}
+
+func (l *benchLatencies) add(op string, d time.Duration) {
+	l.Lock()
+	l.ops[op] = append(l.ops[op], d)
+	l.Unlock()
+}
+
+// Report the 50th and 99th percentile latencies of each operation
+func (l *benchLatencies) report(b *testing.B) {
+	for op, ds := range l.ops {
+		sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+
+		b.ReportMetric(float64(ds[len(ds)*50/100].Nanoseconds()), op+"-p50-ns")
+		b.ReportMetric(float64(ds[len(ds)*99/100].Nanoseconds()), op+"-p99-ns")
+	}
+}
+
+// Benchmark a storage service with the workload of the server: each iteration creates a file,
+// writes it in 4-block requests, reads it back and deletes it.
+// Reports the throughput (MB/s of file data) and the latency percentiles of each operation.
+// Call it from a benchmark with the backend under test, e.g.
+//
+//	func BenchmarkBadger(b *testing.B) { storage.BenchmarkSizes(b, openTestBadger(b)) }
+func BenchmarkStorage(b *testing.B, sdb StorageDB, cfg BenchConfig) {
+	data := make([]byte, cfg.FileSize)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	blockSize := cfg.BlockSize
+	if blockSize == 0 {
+		blockSize = BlockSize
+	}
+
+	if cfg.Concurrency > 1 {
+		b.SetParallelism(cfg.Concurrency)
+	}
+
+	var seq int64
+	prefix := fmt.Sprintf("bench-%v-", time.Now().UnixNano())
+	lat := &benchLatencies{ops: map[string][]time.Duration{}}
+
+	timed := func(op string, fn func() error) {
+		start := time.Now()
+		if err := fn(); err != nil {
+			b.Fatalf("%v: %v", op, err)
+		}
+		lat.add(op, time.Since(start))
+	}
+
+	b.SetBytes(cfg.FileSize)
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		buf := make([]byte, 4*blockSize)
+
+		for pb.Next() {
+			key := prefix + fmt.Sprint(atomic.AddInt64(&seq, 1))
+
+			timed("create", func() error {
+				return sdb.CreateFile(key, key, "application/octet-stream", cfg.FileSize, nil)
+			})
+
+			for pos := int64(0); pos < cfg.FileSize; pos += int64(len(buf)) {
+				end := pos + int64(len(buf))
+				if end > cfg.FileSize {
+					end = cfg.FileSize
+				}
+
+				timed("write", func() error {
+					_, err := WriteAll(sdb, key, pos, data[pos:end])
+					return err
+				})
+			}
+
+			for pos := int64(0); pos < cfg.FileSize; pos += int64(len(buf)) {
+				timed("read", func() error {
+					_, err := sdb.ReadAt(key, buf, pos)
+					if err == io.EOF {
+						err = nil
+					}
+					return err
+				})
+			}
+
+			timed("delete", func() error {
+				return sdb.DeleteFile(key)
+			})
+		}
+	})
+
+	b.StopTimer()
+	lat.report(b)
+}
+
+// Run BenchmarkStorage as sub-benchmarks with small (1 KB) and large (1 MB) files,
+// sequentially and with 8 goroutines per CPU
+func BenchmarkSizes(b *testing.B, sdb StorageDB) {
+	for _, size := range []int64{1 << 10, 1 << 20} {
+		for _, concurrency := range []int{1, 8} {
+			name := fmt.Sprintf("size=%v/concurrency=%v", size, concurrency)
+
+			b.Run(name, func(b *testing.B) {
+				BenchmarkStorage(b, sdb, BenchConfig{FileSize: size, Concurrency: concurrency})
+			})
+		}
+	}
+}
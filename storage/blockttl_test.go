@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// With a block TTL, the leading blocks expire by the storage clock and the file starts after them
+func TestBlockTTLExpiry(t *testing.T) {
+	now := time.Now()
+	s := openTestBadger(t, WithClock(func() time.Time { return now }))
+
+	data := testData(4*BlockSize + 10)
+	hash, _, _ := GetHash(bytes.NewReader(data))
+	if err := s.CreateFile("f", "f", "", int64(len(data)), hash, WithBlockTTL(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.WriteAt("f", 0, data[:BlockSize]); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(30 * time.Second)
+	if _, err := WriteAll(s, "f", BlockSize, data[BlockSize:]); err != nil {
+		t.Fatal(err)
+	}
+
+	stat, _ := s.Stat("f")
+	if stat.Base != 0 {
+		t.Fatalf("base %v before expiry", stat.Base)
+	}
+
+	now = now.Add(45 * time.Second) // the first block expired
+	stat, _ = s.Stat("f")
+	if stat.Base != BlockSize {
+		t.Fatalf("base %v, expected %v", stat.Base, BlockSize)
+	}
+
+	buf := make([]byte, 10)
+	if _, err := s.ReadAt("f", buf, 0); err != ErrTrimmed {
+		t.Errorf("read before base: %v, expected ErrTrimmed", err)
+	}
+	if n, err := s.ReadAt("f", buf, stat.Base); err != nil || !bytes.Equal(buf[:n], data[BlockSize:BlockSize+10]) {
+		t.Errorf("read at base: %v %v", n, err)
+	}
+
+	r, rstat, err := s.OpenReader("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadAll(r); err != nil || rstat.Base != BlockSize || !bytes.Equal(got, data[BlockSize:]) {
+		t.Errorf("sequential read from %v: %v bytes, %v", rstat.Base, len(got), err)
+	}
+	r.Close()
+
+	now = now.Add(time.Minute) // all the blocks expired
+	stat, _ = s.Stat("f")
+	if stat.Base != stat.Length {
+		t.Fatalf("base %v, expected the file length %v", stat.Base, stat.Length)
+	}
+}
@@ -0,0 +1,250 @@
+package storage
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	BreakerClosed   = "closed"    // requests go to the backend
+	BreakerOpen     = "open"      // requests fail with ErrUnavailable
+	BreakerHalfOpen = "half-open" // one request is testing the backend
+)
+
+// A storage service that stops calling a failing backend.
+// After a number of consecutive backend failures the breaker opens and all calls
+// fail with ErrUnavailable; after the cooldown one call is let through to test
+// the backend, closing the breaker if it succeeds.
+type CircuitBreaker struct {
+	StorageDB
+
+	failures int           // consecutive failures to open the breaker
+	cooldown time.Duration // time before testing the backend again
+
+	mu        sync.Mutex
+	state     string
+	count     int       // current consecutive failures
+	openUntil time.Time // when the cooldown ends
+	trips     int64     // number of times the breaker opened
+}
+
+// Return a storage service that fails fast after failures consecutive backend errors
+func NewCircuitBreaker(sdb StorageDB, failures int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{StorageDB: sdb, failures: failures, cooldown: cooldown, state: BreakerClosed}
+}
+
+// Return the breaker state and the number of times it opened
+func (b *CircuitBreaker) State() (string, int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state, b.trips
+}
+
+// Return ErrUnavailable if the call should not go to the backend
+func (b *CircuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if time.Now().Before(b.openUntil) {
+			return ErrUnavailable
+		}
+
+		b.state = BreakerHalfOpen
+		return nil
+
+	case BreakerHalfOpen:
+		return ErrUnavailable // wait for the test call
+	}
+
+	return nil
+}
+
+// Record the result of a backend call
+func (b *CircuitBreaker) done(err error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !isBackendError(err) {
+		b.state = BreakerClosed
+		b.count = 0
+		return err
+	}
+
+	b.count++
+	if b.state == BreakerHalfOpen || b.count >= b.failures {
+		if b.state != BreakerOpen {
+			b.trips++
+		}
+
+		b.state = BreakerOpen
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+
+	return err
+}
+
+// Return true if err is a backend failure, rather than an error about the file
+func isBackendError(err error) bool {
+	switch err {
+	case nil, io.EOF, ErrExists, ErrNotFound, ErrInvalidSize, ErrInvalidPos, ErrInvalidHash,
+		ErrIncomplete, ErrTrimmed, ErrExpired, ErrInfoTooBig, ErrUnavailable, ErrImmutable, ErrDeleted,
+		ErrQuotaExceeded, ErrNoSpace:
+		return false
+	}
+
+	if _, ok := err.(ErrMissingBlock); ok {
+		return false
+	}
+
+	return true
+}
+
+func (b *CircuitBreaker) CreateFile(key, filename, ctype string, size int64, hash []byte, opts ...FileOption) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+
+	return b.done(b.StorageDB.CreateFile(key, filename, ctype, size, hash, opts...))
+}
+
+func (b *CircuitBreaker) CreateFileWithTimes(key, filename, ctype string, size int64, hash []byte, created, expires time.Time, opts ...FileOption) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+
+	return b.done(b.StorageDB.CreateFileWithTimes(key, filename, ctype, size, hash, created, expires, opts...))
+}
+
+func (b *CircuitBreaker) DeleteFile(key string) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+
+	return b.done(b.StorageDB.DeleteFile(key))
+}
+
+func (b *CircuitBreaker) SoftDelete(key string) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+
+	return b.done(b.StorageDB.SoftDelete(key))
+}
+
+func (b *CircuitBreaker) Touch(key string) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+
+	return b.done(b.StorageDB.Touch(key))
+}
+
+func (b *CircuitBreaker) Copy(src, dst string) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+
+	return b.done(b.StorageDB.Copy(src, dst))
+}
+
+func (b *CircuitBreaker) Rename(src, dst string) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+
+	return b.done(b.StorageDB.Rename(src, dst))
+}
+
+func (b *CircuitBreaker) WriteAt(key string, pos int64, data []byte) (int64, error) {
+	if err := b.allow(); err != nil {
+		return InvalidPos, err
+	}
+
+	npos, err := b.StorageDB.WriteAt(key, pos, data)
+	return npos, b.done(err)
+}
+
+func (b *CircuitBreaker) ReadAt(key string, buf []byte, pos int64) (int64, error) {
+	if err := b.allow(); err != nil {
+		return 0, err
+	}
+
+	n, err := b.StorageDB.ReadAt(key, buf, pos)
+	return n, b.done(err)
+}
+
+// Only opening the reader counts for the breaker
+func (b *CircuitBreaker) OpenReader(key string) (io.ReadCloser, *FileInfo, error) {
+	if err := b.allow(); err != nil {
+		return nil, nil, err
+	}
+
+	r, stat, err := b.StorageDB.OpenReader(key)
+	return r, stat, b.done(err)
+}
+
+func (b *CircuitBreaker) Stat(key string) (*FileInfo, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+
+	stat, err := b.StorageDB.Stat(key)
+	return stat, b.done(err)
+}
+
+func (b *CircuitBreaker) Exists(key string) (bool, error) {
+	if err := b.allow(); err != nil {
+		return false, err
+	}
+
+	exists, err := b.StorageDB.Exists(key)
+	return exists, b.done(err)
+}
+
+func (b *CircuitBreaker) ListFiles(prefix string, opts ...ListOption) ([]*FileInfo, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+
+	files, err := b.StorageDB.ListFiles(prefix, opts...)
+	return files, b.done(err)
+}
+
+func (b *CircuitBreaker) TrimFront(key string, bytes int64) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+
+	return b.done(b.StorageDB.TrimFront(key, bytes))
+}
+
+func (b *CircuitBreaker) StatPhysical(key string) (*PhysicalInfo, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+
+	stat, err := b.StorageDB.StatPhysical(key)
+	return stat, b.done(err)
+}
+
+func (b *CircuitBreaker) DebugInfo(key string) (map[string]interface{}, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+
+	debug, err := b.StorageDB.DebugInfo(key)
+	return debug, b.done(err)
+}
+
+func (b *CircuitBreaker) IncrFile(key string, delta int64) (int64, error) {
+	if err := b.allow(); err != nil {
+		return 0, err
+	}
+
+	value, err := b.StorageDB.IncrFile(key, delta)
+	return value, b.done(err)
+}
@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+var errThrottled = errors.New("throttled")
+
+// A storage service failing Stat calls while down, and counting them
+type flakyStore struct {
+	StorageDB
+	down  bool
+	calls int
+}
+
+func (s *flakyStore) Stat(key string) (*FileInfo, error) {
+	s.calls++
+	if s.down {
+		return nil, errThrottled
+	}
+
+	return s.StorageDB.Stat(key)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	backend := &flakyStore{StorageDB: openTestBadger(t)}
+	b := NewCircuitBreaker(backend, 3, 20*time.Millisecond)
+
+	// missing files are not failures
+	for i := 0; i < 5; i++ {
+		if _, err := b.Stat("f"); err != ErrNotFound {
+			t.Fatalf("stat: %v", err)
+		}
+	}
+	if state, _ := b.State(); state != BreakerClosed {
+		t.Fatalf("breaker %v after NotFound", state)
+	}
+
+	backend.down, backend.calls = true, 0
+	for i := 0; i < 3; i++ {
+		if _, err := b.Stat("f"); err != errThrottled {
+			t.Fatalf("failure %v: %v", i, err)
+		}
+	}
+	if _, err := b.Stat("f"); err != ErrUnavailable || backend.calls != 3 {
+		t.Errorf("open breaker: %v, %v backend calls", err, backend.calls)
+	}
+	if state, trips := b.State(); state != BreakerOpen || trips != 1 {
+		t.Errorf("breaker %v, %v trips", state, trips)
+	}
+
+	// a failed test call opens it again
+	time.Sleep(30 * time.Millisecond)
+	if _, err := b.Stat("f"); err != errThrottled {
+		t.Errorf("half-open: %v", err)
+	}
+	if _, err := b.Stat("f"); err != ErrUnavailable {
+		t.Errorf("reopened: %v", err)
+	}
+
+	// a successful one closes it
+	backend.down = false
+	time.Sleep(30 * time.Millisecond)
+	if _, err := b.Stat("f"); err != ErrNotFound {
+		t.Errorf("recovered: %v", err)
+	}
+	if state, trips := b.State(); state != BreakerClosed || trips != 2 {
+		t.Errorf("breaker %v, %v trips", state, trips)
+	}
+}
@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+// Creation and expiration times follow the configured clock
+func TestClock(t *testing.T) {
+	now := time.Now().Add(-time.Hour).Truncate(time.Second)
+	clock := WithClock(func() time.Time { return now })
+
+	s := openTestBadger(t, clock)
+	putTestFile(t, s, "f", testData(10), 10, WithTTL(time.Minute))
+
+	stat, err := s.Stat("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stat.Created.Equal(now) {
+		t.Errorf("created %v, expected %v", stat.Created, now)
+	}
+	if expiry := getTestInfo(t, s, "f").Expiry; expiry != now.Add(time.Minute).UnixNano() {
+		t.Errorf("expiration index at %v, expected %v", time.Unix(0, expiry), now.Add(time.Minute))
+	}
+
+	strict := StrictTTL(s, clock)
+	if _, err := strict.Stat("f"); err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+
+	now = now.Add(2 * time.Hour)
+	if _, err := strict.Stat("f"); err != ErrNotFound {
+		t.Errorf("stat after the TTL: %v, expected ErrNotFound", err)
+	}
+
+	// a new file starts from the new time
+	putTestFile(t, s, "g", testData(10), 10)
+	if stat, _ := s.Stat("g"); stat == nil || !stat.Created.Equal(now) {
+		t.Errorf("new file: %+v", stat)
+	}
+}
@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// Copy duplicates a file under a new key, restarting its TTL, and copies an incomplete file up to CurPos
+func TestCopy(t *testing.T) {
+	now := time.Now().Add(-time.Hour).Truncate(time.Second)
+	s := openTestBadger(t, WithClock(func() time.Time { return now }))
+
+	data := testData(3*BlockSize + 10)
+	putTestFile(t, s, "src", data, BlockSize, WithTTL(time.Minute))
+
+	now = now.Add(30 * time.Second)
+	if err := s.Copy("src", "dst"); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readTestFile(t, s, "dst"), data) {
+		t.Errorf("copy content differs")
+	}
+	if stat, _ := s.Stat("dst"); stat == nil || !stat.Created.Equal(now) {
+		t.Errorf("copy %+v, expected created at %v", stat, now)
+	}
+	if expiry := getTestInfo(t, s, "dst").Expiry; expiry != now.Add(time.Minute).UnixNano() {
+		t.Errorf("copy expires at %v, expected %v", time.Unix(0, expiry), now.Add(time.Minute))
+	}
+	if !bytes.Equal(readTestFile(t, s, "src"), data) {
+		t.Errorf("source content changed")
+	}
+
+	if err := s.Copy("src", "dst"); err != ErrExists {
+		t.Errorf("copy to existing: %v, expected ErrExists", err)
+	}
+	if err := s.Copy("missing", "other"); err != ErrNotFound {
+		t.Errorf("copy of missing: %v, expected ErrNotFound", err)
+	}
+
+	// the copy of an incomplete file can be completed on its own
+	hash, _, err := GetHash(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateFile("partial", "partial", "", int64(len(data)), hash); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := WriteAll(s, "partial", 0, data[:BlockSize]); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Copy("partial", "partial-copy"); err != nil {
+		t.Fatal(err)
+	}
+	if pos := getTestInfo(t, s, "partial-copy").CurPos; pos != BlockSize {
+		t.Fatalf("incomplete copy at %v, expected %v", pos, BlockSize)
+	}
+	if _, err := WriteAll(s, "partial-copy", BlockSize, data[BlockSize:]); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readTestFile(t, s, "partial-copy"), data) {
+		t.Errorf("completed copy content differs")
+	}
+	if pos := getTestInfo(t, s, "partial").CurPos; pos != BlockSize {
+		t.Errorf("incomplete source at %v, expected %v", pos, BlockSize)
+	}
+}
+
+// The blocks of a copy with a block TTL expire by the storage clock, as the blocks written
+func TestCopyBlockTTL(t *testing.T) {
+	now := time.Now().Add(time.Hour)
+	s := openTestBadger(t, WithClock(func() time.Time { return now }))
+
+	data := testData(2*BlockSize + 10)
+	putTestFile(t, s, "src", data, BlockSize, WithBlockTTL(time.Minute))
+
+	if err := s.Copy("src", "dst"); err != nil {
+		t.Fatal(err)
+	}
+	if stat, _ := s.Stat("dst"); stat == nil || stat.Base != 0 {
+		t.Fatalf("copy %+v, expected all the blocks", stat)
+	}
+	if !bytes.Equal(readTestFile(t, s, "dst"), data) {
+		t.Errorf("copy content differs")
+	}
+
+	now = now.Add(2 * time.Minute)
+	if stat, _ := s.Stat("dst"); stat == nil || stat.Base != stat.Length {
+		t.Errorf("copy %+v, expected the blocks to expire", stat)
+	}
+}
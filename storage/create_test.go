@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"sync"
+	"testing"
+)
+
+// Concurrent creates of the same key: exactly one wins
+func TestCreateFileConcurrent(t *testing.T) {
+	s := openTestBadger(t)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- s.CreateFile("f", "f", "", 10, nil)
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	created := 0
+	for err := range errs {
+		if err == nil {
+			created++
+		} else if err != ErrExists {
+			t.Errorf("create: %v", err)
+		}
+	}
+
+	if created != 1 {
+		t.Errorf("%v files created, expected 1", created)
+	}
+}
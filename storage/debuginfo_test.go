@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"bytes"
+	"testing"
+)
+
+// The CurHash in DebugInfo is the marshaled state of the hash of the blocks written so far,
+// and resuming from it completes the file with the expected hash
+func TestDebugInfoCurHash(t *testing.T) {
+	data := testData(3*BlockSize + 10)
+
+	for _, alg := range []string{HashCumulative, HashMerkle, HashSHA256} {
+		s := openTestBadger(t, WithHash(alg))
+
+		hash, _, err := GetHashAlg(bytes.NewReader(data), alg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.CreateFile("f", "f", "", int64(len(data)), hash); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := WriteAll(s, "f", 0, data[:2*BlockSize]); err != nil {
+			t.Fatal(err)
+		}
+
+		debug, err := s.DebugInfo("f")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if debug["CurPos"] != int64(2*BlockSize) {
+			t.Errorf("%v: CurPos %v, expected %v", alg, debug["CurPos"], 2*BlockSize)
+		}
+
+		expected := getHasher(alg)
+		expected.Write(data[:BlockSize])
+		expected.Write(data[BlockSize : 2*BlockSize])
+		state, err := marshalHash(expected)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if debug["CurHash"] != state {
+			t.Errorf("%v: CurHash %v, expected %v", alg, debug["CurHash"], state)
+		}
+
+		resumed := getHasher(alg)
+		if err := unmarshalHash(resumed, debug["CurHash"].(string)); err != nil {
+			t.Fatalf("%v: unmarshal CurHash: %v", alg, err)
+		}
+		if state, _ := marshalHash(resumed); state != debug["CurHash"] {
+			t.Errorf("%v: CurHash doesn't round-trip: %v", alg, state)
+		}
+
+		npos, err := WriteAll(s, "f", 2*BlockSize, data[2*BlockSize:])
+		if err != nil || npos != FileComplete {
+			t.Fatalf("%v: resume write: %v %v", alg, npos, err)
+		}
+
+		// only merkle hashes keep their state (the list of block hashes) once complete
+		if debug, _ = s.DebugInfo("f"); (debug["CurHash"] != "") != (alg == HashMerkle) || debug["CurPos"] != FileComplete {
+			t.Errorf("%v: complete file: CurHash %q, CurPos %v", alg, debug["CurHash"], debug["CurPos"])
+		}
+	}
+
+	if _, err := openTestBadger(t).DebugInfo("missing"); err != ErrNotFound {
+		t.Errorf("missing file: %v, expected ErrNotFound", err)
+	}
+}
@@ -0,0 +1,46 @@
+package storage
+
+// The savings of storing duplicate content once, as computed by DedupReport
+type DedupStats struct {
+	Files       int   // complete files
+	TotalBytes  int64 // bytes stored now
+	UniqueBytes int64 // bytes stored with duplicate content stored once
+	Duplicates  int   // files with the same content as another file
+}
+
+// Return the potential savings of deduplicating content, grouping complete files by hash.
+// This is a read-only scan of the file metadata: the content is not read.
+// Files with different hash algorithms are never duplicates, and trimmed files count their full length.
+func DedupReport(sdb StorageDB) (DedupStats, error) {
+	var stats DedupStats
+
+	files, err := sdb.ListFiles("")
+	if err != nil {
+		return stats, err
+	}
+
+	seen := map[string]bool{}
+
+	for _, f := range files {
+		if f.Next != FileComplete {
+			continue
+		}
+
+		stats.Files++
+		stats.TotalBytes += f.Length
+
+		alg := f.HashAlg
+		if alg == "" {
+			alg = HashCumulative
+		}
+
+		if hkey := alg + ":" + f.Hash; seen[hkey] {
+			stats.Duplicates++
+		} else {
+			seen[hkey] = true
+			stats.UniqueBytes += f.Length
+		}
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,36 @@
+package storage
+
+import (
+	"testing"
+)
+
+// Files with the same content count once in the unique bytes, incomplete files are ignored
+func TestDedupReport(t *testing.T) {
+	s := openTestBadger(t)
+
+	a, b := testData(40000), testData(1000)
+	putTestFile(t, s, "a1", a, BlockSize)
+	putTestFile(t, s, "a2", a, 2*BlockSize)
+	putTestFile(t, s, "a3", a, BlockSize)
+	putTestFile(t, s, "b", b, BlockSize)
+
+	if err := s.CreateFile("partial", "partial", "", int64(len(a)), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.WriteAt("partial", 0, a[:BlockSize]); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := DedupReport(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := DedupStats{Files: 4, TotalBytes: int64(3*len(a) + len(b)), UniqueBytes: int64(len(a) + len(b)), Duplicates: 2}
+	if stats != expected {
+		t.Errorf("%+v, expected %+v", stats, expected)
+	}
+	if saved := stats.TotalBytes - stats.UniqueBytes; saved != int64(2*len(a)) {
+		t.Errorf("%v bytes saved, expected %v", saved, 2*len(a))
+	}
+}
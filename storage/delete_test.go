@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// DeleteFile removes the metadata and the blocks of the file, and only of that file
+func TestDeleteFile(t *testing.T) {
+	s := openTestBadger(t)
+
+	data := testData(3*BlockSize + 10)
+	putTestFile(t, s, "f", data, BlockSize)
+	putTestFile(t, s, "f:1", data, BlockSize) // its blocks share the prefix of the blocks of f
+
+	if err := s.DeleteFile("f"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Stat("f"); err != ErrNotFound {
+		t.Errorf("Stat after delete: %v, expected ErrNotFound", err)
+	}
+	for _, k := range testKeys(t, s, prefixKey("f")) {
+		if _, ok := blockNumber("f", k); ok || k == infoKey("f") {
+			t.Errorf("record %v left after delete", k)
+		}
+	}
+
+	if !bytes.Equal(readTestFile(t, s, "f:1"), data) {
+		t.Errorf("f:1 changed by the delete of f")
+	}
+
+	if err := s.DeleteFile("f"); err != nil && err != ErrNotFound {
+		t.Errorf("second delete: %v", err)
+	}
+}
+
+// The block keys are listed by the file prefix, and parsed back by blockNumber
+func TestBlockKeys(t *testing.T) {
+	for _, key := range []string{"f", "f:1", "dir/file.txt"} {
+		for _, block := range []int64{0, 1, 12345} {
+			k := blockKey(key, block)
+			if !strings.HasPrefix(k, prefixKey(key)) {
+				t.Errorf("block key %v doesn't start with the prefix %v", k, prefixKey(key))
+			}
+			if n, ok := blockNumber(key, k); !ok || n != block {
+				t.Errorf("blockNumber(%v, %v): %v %v", key, k, n, ok)
+			}
+		}
+
+		if _, ok := blockNumber(key, infoKey(key)); ok {
+			t.Errorf("info key %v parsed as a block", infoKey(key))
+		}
+	}
+
+	if _, ok := blockNumber("f", blockKey("f:1", 0)); ok {
+		t.Errorf("block of f:1 parsed as a block of f")
+	}
+}
@@ -0,0 +1,28 @@
+package storage
+
+import "syscall"
+
+// Return the bytes available to unprivileged users on the filesystem containing dir
+// (a variable, so that it can be replaced in tests)
+var freeSpace = func(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+// Return ErrNoSpace if a file of size bytes doesn't fit in dir, keeping margin bytes free
+func checkFreeSpace(dir string, size, margin int64) error {
+	avail, err := freeSpace(dir)
+	if err != nil {
+		return err
+	}
+
+	if size+margin > avail {
+		return ErrNoSpace
+	}
+
+	return nil
+}
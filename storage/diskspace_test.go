@@ -0,0 +1,30 @@
+package storage
+
+import (
+	"testing"
+)
+
+// Files that don't fit in the free space, minus the margin, are rejected
+func TestMinFreeSpace(t *testing.T) {
+	saved := freeSpace
+	defer func() { freeSpace = saved }()
+
+	freeSpace = func(dir string) (int64, error) { return 10000, nil }
+
+	s := openTestBadger(t, WithMinFreeSpace(1000))
+
+	if err := s.CreateFile("fits", "f", "", 9000, nil); err != nil {
+		t.Errorf("create within the margin: %v", err)
+	}
+	if err := s.CreateFile("big", "b", "", 9001, nil); err != ErrNoSpace {
+		t.Errorf("create past the margin: %v, expected ErrNoSpace", err)
+	}
+	if _, err := s.Stat("big"); err != ErrNotFound {
+		t.Errorf("rejected file: %v", err)
+	}
+
+	// no check without a margin
+	if err := openTestBadger(t).CreateFile("big", "b", "", 1<<40, nil); err != nil {
+		t.Errorf("create without a margin: %v", err)
+	}
+}
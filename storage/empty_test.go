@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"testing"
+)
+
+// Empty files are complete on creation, with the hash of empty content
+func TestEmptyFile(t *testing.T) {
+	md5Empty, sha256Empty := md5.Sum(nil), sha256.Sum256(nil)
+
+	for alg, sum := range map[string][]byte{
+		HashCumulative: md5Empty[:],
+		HashMerkle:     md5Empty[:],
+		HashSHA256:     sha256Empty[:],
+	} {
+		s := openTestBadger(t, WithHash(alg))
+		expected := FormatHash(alg, sum)
+
+		if err := s.CreateFile("f", "f", "", 0, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		stat, err := s.Stat("f")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stat.Next != FileComplete || stat.Length != 0 || stat.Hash != expected {
+			t.Errorf("%v: empty file %+v, expected complete with hash %v", alg, stat, expected)
+		}
+		if data := readTestFile(t, s, "f"); len(data) != 0 {
+			t.Errorf("%v: read %v bytes", alg, len(data))
+		}
+
+		if _, err := s.WriteAt("f", 0, []byte("x")); err == nil {
+			t.Errorf("%v: write to a complete empty file succeeded", alg)
+		}
+
+		if err := s.CreateFile("g", "g", "", 0, sum); err != nil {
+			t.Errorf("%v: create with the empty hash: %v", alg, err)
+		}
+		if err := s.CreateFile("h", "h", "", 0, []byte("not the hash")); err != ErrInvalidHash {
+			t.Errorf("%v: create with a wrong hash: %v, expected ErrInvalidHash", alg, err)
+		}
+	}
+}
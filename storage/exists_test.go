@@ -0,0 +1,25 @@
+package storage
+
+import (
+	"testing"
+)
+
+// Exists reports files complete or not, and not the missing or deleted ones
+func TestExists(t *testing.T) {
+	s := openTestBadger(t)
+
+	putTestFile(t, s, "complete", testData(100), 100)
+	putTestFile(t, s, "deleted", testData(100), 100)
+	if err := s.CreateFile("partial", "partial", "", 100, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteFile("deleted"); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, expected := range map[string]bool{"complete": true, "partial": true, "deleted": false, "missing": false} {
+		if exists, err := s.Exists(key); exists != expected || err != nil {
+			t.Errorf("Exists(%v): %v %v, expected %v", key, exists, err, expected)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package storage
+
+import "io"
+
+// A storage service reading from a list of backends in order (e.g. hot and cold storage).
+// Stat, ReadAt and OpenReader try the next backend if a file is missing; all other calls,
+// including writes, go to the first backend.
+type failoverReader struct {
+	StorageDB
+
+	backends []StorageDB
+}
+
+// Return a storage service that reads a file from the first backend that has it
+func FailoverReader(backends ...StorageDB) StorageDB {
+	return &failoverReader{StorageDB: backends[0], backends: backends}
+}
+
+// Return true if err means the file (or part of it) is not in this backend
+func isMissing(err error) bool {
+	if err == ErrNotFound || err == ErrExpired {
+		return true
+	}
+
+	_, ok := err.(ErrMissingBlock)
+	return ok
+}
+
+func (f *failoverReader) Stat(key string) (stat *FileInfo, err error) {
+	for _, sdb := range f.backends {
+		if stat, err = sdb.Stat(key); !isMissing(err) {
+			break
+		}
+	}
+
+	return
+}
+
+func (f *failoverReader) Exists(key string) (exists bool, err error) {
+	for _, sdb := range f.backends {
+		if exists, err = sdb.Exists(key); exists || err != nil {
+			break
+		}
+	}
+
+	return
+}
+
+func (f *failoverReader) ReadAt(key string, buf []byte, pos int64) (n int64, err error) {
+	for _, sdb := range f.backends {
+		if n, err = sdb.ReadAt(key, buf, pos); !isMissing(err) {
+			break
+		}
+	}
+
+	return
+}
+
+// A block missing once the reader is open is an error: the reader doesn't switch backends
+func (f *failoverReader) OpenReader(key string) (r io.ReadCloser, stat *FileInfo, err error) {
+	for _, sdb := range f.backends {
+		if r, stat, err = sdb.OpenReader(key); !isMissing(err) {
+			break
+		}
+	}
+
+	return
+}
+
+func (f *failoverReader) Close() error {
+	var ret error
+
+	for _, sdb := range f.backends {
+		if err := sdb.Close(); err != nil && ret == nil {
+			ret = err
+		}
+	}
+
+	return ret
+}
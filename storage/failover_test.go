@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/dgraph-io/badger"
+)
+
+func TestFailoverReader(t *testing.T) {
+	hot, cold := openTestBadger(t), openTestBadger(t)
+	sdb := FailoverReader(hot, cold)
+
+	data := testData(2*BlockSize + 10)
+	putTestFile(t, cold, "cold", data, BlockSize)
+	putTestFile(t, hot, "hot", data[:100], 100)
+
+	if stat, err := sdb.Stat("cold"); err != nil || stat.Length != int64(len(data)) {
+		t.Errorf("stat: %+v %v", stat, err)
+	}
+	if ok, err := sdb.Exists("cold"); !ok || err != nil {
+		t.Errorf("exists: %v %v", ok, err)
+	}
+	if !bytes.Equal(readTestFile(t, sdb, "cold"), data) {
+		t.Errorf("read: content differs")
+	}
+
+	r, _, err := sdb.OpenReader("cold")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("sequential read: %v bytes, %v", len(got), err)
+	}
+	r.Close()
+
+	if !bytes.Equal(readTestFile(t, sdb, "hot"), data[:100]) {
+		t.Errorf("read from the first backend: content differs")
+	}
+	if _, err := sdb.Stat("missing"); err != ErrNotFound {
+		t.Errorf("stat missing: %v", err)
+	}
+
+	// writes go to the first backend
+	putTestFile(t, sdb, "new", data, BlockSize)
+	if _, err := cold.Stat("new"); err != ErrNotFound {
+		t.Errorf("write in the second backend: %v", err)
+	}
+}
+
+// A block evicted from the first backend is read from the next one
+func TestFailoverMissingBlock(t *testing.T) {
+	hot, cold := openTestBadger(t), openTestBadger(t)
+
+	data := testData(2*BlockSize + 10)
+	putTestFile(t, hot, "f", data, BlockSize)
+	putTestFile(t, cold, "f", data, BlockSize)
+
+	if err := hot.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(blockKey("f", 1)))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(readTestFile(t, FailoverReader(hot, cold), "f"), data) {
+		t.Errorf("read: content differs")
+	}
+}
@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"io"
+	"sync"
+)
+
+// A storage service that lets readers in the same process follow files while they are uploaded:
+// each change made through it wakes up the readers waiting for more data.
+type Follower struct {
+	StorageDB
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	gen  uint64 // incremented on each change
+}
+
+// Return a storage service that supports OpenFollowReader for the writes made through it
+func WithFollow(sdb StorageDB) *Follower {
+	f := &Follower{StorageDB: sdb}
+	f.cond = sync.NewCond(&f.mu)
+	return f
+}
+
+// Wake up the follow readers
+func (f *Follower) changed() {
+	f.mu.Lock()
+	f.gen++
+	f.mu.Unlock()
+
+	f.cond.Broadcast()
+}
+
+func (f *Follower) WriteAt(key string, pos int64, data []byte) (int64, error) {
+	defer f.changed()
+	return f.StorageDB.WriteAt(key, pos, data)
+}
+
+func (f *Follower) DeleteFile(key string) error {
+	defer f.changed()
+	return f.StorageDB.DeleteFile(key)
+}
+
+func (f *Follower) SoftDelete(key string) error {
+	defer f.changed()
+	return f.StorageDB.SoftDelete(key)
+}
+
+func (f *Follower) TrimFront(key string, bytes int64) error {
+	defer f.changed()
+	return f.StorageDB.TrimFront(key, bytes)
+}
+
+func (f *Follower) Rename(src, dst string) error {
+	defer f.changed()
+	return f.StorageDB.Rename(src, dst)
+}
+
+// Return a reader for the file identified by key, starting at pos.
+// At the end of the data written so far, Read blocks until more is written through f;
+// it returns io.EOF at the end of the complete file, or the storage error (e.g. ErrNotFound if deleted).
+// Close unblocks a pending Read (e.g. for an abandoned upload, that expires without notice).
+func (f *Follower) OpenFollowReader(key string, pos int64) *FollowReader {
+	return &FollowReader{f: f, key: key, pos: pos}
+}
+
+// A reader following a file being uploaded
+type FollowReader struct {
+	f      *Follower
+	key    string
+	pos    int64
+	closed bool // protected by f.mu
+}
+
+func (r *FollowReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	for {
+		r.f.mu.Lock()
+		gen, closed := r.f.gen, r.closed
+		r.f.mu.Unlock()
+
+		if closed {
+			return 0, io.ErrClosedPipe
+		}
+
+		n, err := r.f.ReadAt(r.key, p, r.pos)
+		r.pos += n
+
+		if err == ErrIncomplete && n > 0 {
+			err = nil
+		}
+		if err != ErrIncomplete {
+			return int(n), err
+		}
+
+		// wait for the next change, unless there was one since the read
+		r.f.mu.Lock()
+		for r.f.gen == gen && !r.closed {
+			r.f.cond.Wait()
+		}
+		r.f.mu.Unlock()
+	}
+}
+
+func (r *FollowReader) Close() error {
+	r.f.mu.Lock()
+	r.closed = true
+	r.f.mu.Unlock()
+
+	r.f.cond.Broadcast()
+	return nil
+}
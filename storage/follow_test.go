@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// A follow reader gets the whole file while it's written by another goroutine
+func TestFollowReader(t *testing.T) {
+	f := WithFollow(openTestBadger(t))
+
+	data := testData(5*BlockSize + 10)
+	if err := f.CreateFile("f", "f", "", int64(len(data)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	r := f.OpenFollowReader("f", 0)
+	defer r.Close()
+
+	written := make(chan error, 1)
+	go func() {
+		for pos := 0; pos < len(data); pos += BlockSize {
+			end := pos + BlockSize
+			if end > len(data) {
+				end = len(data)
+			}
+
+			time.Sleep(time.Millisecond)
+			if _, err := f.WriteAt("f", int64(pos), data[pos:end]); err != nil {
+				written <- err
+				return
+			}
+		}
+
+		written <- nil
+	}()
+
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("followed %v bytes, content differs", len(got))
+	}
+}
+
+// A follow reader waiting for data fails if the file is deleted, or once closed
+func TestFollowReaderStop(t *testing.T) {
+	f := WithFollow(openTestBadger(t))
+
+	for _, key := range []string{"deleted", "closed"} {
+		if err := f.CreateFile(key, key, "", 2*BlockSize, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for key, expected := range map[string]error{"deleted": ErrNotFound, "closed": io.ErrClosedPipe} {
+		r := f.OpenFollowReader(key, 0)
+
+		done := make(chan error, 1)
+		go func() {
+			_, err := r.Read(make([]byte, 100))
+			done <- err
+		}()
+
+		time.Sleep(10 * time.Millisecond)
+		select {
+		case err := <-done:
+			t.Fatalf("%v: read returned before any data: %v", key, err)
+		default:
+		}
+
+		if key == "deleted" {
+			f.DeleteFile(key)
+		} else {
+			r.Close()
+		}
+
+		select {
+		case err := <-done:
+			if err != expected {
+				t.Errorf("%v: %v, expected %v", key, err, expected)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%v: read still blocked", key)
+		}
+	}
+}
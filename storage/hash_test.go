@@ -0,0 +1,261 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/raff/cashier/merkle"
+)
+
+// GetHashAlg must compute the hash WriteAt stores, also when the reader writes
+// in chunks other than the block size (os.File uses WriteTo with 32 KB writes)
+func TestGetHashAlgMatchesWriteAt(t *testing.T) {
+	data := testData(5*BlockSize + 1000)
+
+	f, err := ioutil.TempFile("", "cashier-hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, alg := range []string{HashCumulative, HashMerkle, HashSHA256} {
+		if _, err := f.Seek(0, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		hash, size, err := GetHashAlg(f, alg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != int64(len(data)) {
+			t.Fatalf("%v: size %v, expected %v", alg, size, len(data))
+		}
+
+		s := openTestBadger(t, WithHash(alg))
+		if err := s.CreateFile("f", "f", "", size, hash); err != nil {
+			t.Fatal(err)
+		}
+
+		npos, err := WriteAll(s, "f", 0, data)
+		if err != nil || npos != FileComplete {
+			t.Fatalf("%v: write: %v %v", alg, npos, err)
+		}
+
+		stat, err := s.Stat("f")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stat.Hash != FormatHash(alg, hash) {
+			t.Fatalf("%v: stored hash %v, expected %v", alg, stat.Hash, FormatHash(alg, hash))
+		}
+	}
+}
+
+// The info of a merkle file keeps the hash of each block, also once complete,
+// and the hashes of the blocks computed out of order give the hash of the sequential upload
+func TestMerkleBlockHashes(t *testing.T) {
+	s := openTestBadger(t, WithHash(HashMerkle))
+	data := testData(2*BlockSize + 100)
+	blocks := [][]byte{data[:BlockSize], data[BlockSize : 2*BlockSize], data[2*BlockSize:]}
+
+	hash, _, _ := GetHashAlg(bytes.NewReader(data), HashMerkle)
+	if err := s.CreateFile("f", "f", "", int64(len(data)), hash); err != nil {
+		t.Fatal(err)
+	}
+
+	var expected []byte
+	for i, b := range blocks {
+		if _, err := s.WriteAt("f", int64(i*BlockSize), b); err != nil {
+			t.Fatal(err)
+		}
+
+		sum := md5.Sum(b)
+		expected = append(expected, sum[:]...)
+		if fi := getTestInfo(t, s, "f"); fi.CurHash != toHex(expected) {
+			t.Fatalf("block hashes after %v blocks: %v, expected %x", i+1, fi.CurHash, expected)
+		}
+	}
+
+	stat, err := s.Stat("f")
+	if err != nil || stat.Next != FileComplete {
+		t.Fatalf("stat: %+v %v", stat, err)
+	}
+
+	h := merkle.New()
+	for _, i := range []int{2, 0, 1} {
+		h.WriteBlock(i, blocks[i])
+	}
+	if sum := FormatHash(HashMerkle, h.Sum(nil)); sum != stat.Hash {
+		t.Errorf("out of order hash %v, expected %v", sum, stat.Hash)
+	}
+}
+
+// Opening a store with another default hash algorithm logs a warning,
+// and the existing files keep their own algorithm
+func TestStoreHashMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cashier-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	open := func(alg string) *badgerStorage {
+		logged.Reset()
+
+		s, err := OpenBadger(dir, false, time.Hour, WithHash(alg))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return s
+	}
+
+	data := testData(2*BlockSize + 10)
+
+	s := open(HashCumulative)
+	putTestFile(t, s, "f", data, BlockSize)
+	if err := s.CreateFile("g", "g", "", int64(len(data)), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := WriteAll(s, "g", 0, data[:BlockSize]); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s = open(HashMerkle)
+
+	if warning := logged.String(); !strings.Contains(warning, `hash algorithm "cumulative", new files will use "merkle"`) {
+		t.Errorf("no warning for the mismatched algorithm: %q", warning)
+	}
+
+	// the partial file is completed with its own algorithm
+	if _, err := WriteAll(s, "g", BlockSize, data[BlockSize:]); err != nil {
+		t.Fatalf("resume with another store algorithm: %v", err)
+	}
+
+	for _, key := range []string{"f", "g"} {
+		if stat, _ := s.Stat(key); stat == nil || stat.HashAlg != HashCumulative || stat.Hash != getTestInfo(t, s, "f").Hash {
+			t.Errorf("%v: %+v, expected the cumulative hash", key, stat)
+		}
+	}
+
+	s.Close()
+	s = open(HashCumulative)
+	s.Close()
+	if logged.Len() != 0 {
+		t.Errorf("warning for the recorded algorithm: %q", logged.String())
+	}
+}
+
+// SHA-256 files show a prefixed hash and are checked with SHA-256, while records
+// written before the hash algorithm was stored are still checked with the cumulative MD5
+func TestSHA256Hash(t *testing.T) {
+	s := openTestBadger(t, WithHash(HashSHA256))
+	data := testData(3*BlockSize + 10)
+
+	sum := sha256.Sum256(data)
+	if err := s.CreateFile("f", "f", "", int64(len(data)), sum[:]); err != nil {
+		t.Fatal(err)
+	}
+	if npos, err := WriteAll(s, "f", 0, data); err != nil || npos != FileComplete {
+		t.Fatalf("write: %v %v", npos, err)
+	}
+
+	stat, err := s.Stat("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.HashAlg != HashSHA256 || stat.Hash != "sha256:"+hex.EncodeToString(sum[:]) {
+		t.Errorf("stat %v %v, expected sha256:%x", stat.HashAlg, stat.Hash, sum)
+	}
+
+	// a file with the wrong hash fails on the last write
+	md5sum := md5.Sum(data)
+	if err := s.CreateFile("wrong", "wrong", "", int64(len(data)), md5sum[:]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := WriteAll(s, "wrong", 0, data); err != ErrInvalidHash {
+		t.Errorf("write with an MD5 hash: %v, expected ErrInvalidHash", err)
+	}
+
+	// a partial upload from before the algorithm was recorded completes with the cumulative hash
+	hash, _, _ := GetHashAlg(bytes.NewReader(data), HashCumulative)
+	if err := s.CreateFile("old", "old", "", int64(len(data)), hash); err != nil {
+		t.Fatal(err)
+	}
+	setTestInfo(t, s, "old", func(i *info) { i.HashAlg = "" })
+	if _, err := WriteAll(s, "old", 0, data[:BlockSize]); err != nil {
+		t.Fatal(err)
+	}
+
+	if npos, err := WriteAll(s, "old", BlockSize, data[BlockSize:]); err != nil || npos != FileComplete {
+		t.Fatalf("resume the old upload: %v %v", npos, err)
+	}
+	if stat, _ := s.Stat("old"); stat == nil || stat.Hash != toHex(hash) {
+		t.Errorf("old file %+v, expected hash %x", stat, hash)
+	}
+}
+
+// A file not matching the expected hash on completion is counted and logged with both hashes
+func TestHashMismatchReport(t *testing.T) {
+	s := openTestBadger(t)
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	data := testData(2*BlockSize + 10)
+	expected, _, err := GetHash(bytes.NewReader(data[1:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, _, err := GetHash(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.CreateFile("f", "f", "", int64(len(data)), expected); err != nil {
+		t.Fatal(err)
+	}
+
+	count := hashMismatches.Value()
+	if _, err := WriteAll(s, "f", 0, data); err != ErrInvalidHash {
+		t.Fatalf("write: %v, expected ErrInvalidHash", err)
+	}
+
+	if n := hashMismatches.Value() - count; n != 1 {
+		t.Errorf("%v hash mismatches counted, expected 1", n)
+	}
+
+	line := fmt.Sprintf(`hash mismatch: key="f" alg=cumulative length=%v expected=%v actual=%v`,
+		len(data), hex.EncodeToString(expected), hex.EncodeToString(actual))
+	if !strings.Contains(logged.String(), line) {
+		t.Errorf("log %q, expected %q", logged.String(), line)
+	}
+
+	// a matching upload is not reported
+	logged.Reset()
+	putTestFile(t, s, "g", data, BlockSize)
+	if n := hashMismatches.Value() - count; n != 1 || strings.Contains(logged.String(), "hash mismatch") {
+		t.Errorf("matching upload reported: %v %q", n, logged.String())
+	}
+}
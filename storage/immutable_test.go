@@ -0,0 +1,36 @@
+package storage
+
+import (
+	"bytes"
+	"testing"
+)
+
+// A complete immutable file can't be changed or removed
+func TestImmutable(t *testing.T) {
+	s := openTestBadger(t)
+
+	data := testData(2*BlockSize + 10)
+	putTestFile(t, s, "f", data, BlockSize, WithImmutable())
+
+	for op, call := range map[string]func() error{
+		"delete":      func() error { return s.DeleteFile("f") },
+		"soft delete": func() error { return s.SoftDelete("f") },
+		"rename":      func() error { return s.Rename("f", "g") },
+		"trim":        func() error { return s.TrimFront("f", BlockSize) },
+	} {
+		if err := call(); err != ErrImmutable {
+			t.Errorf("%v: %v, expected ErrImmutable", op, err)
+		}
+	}
+	if !bytes.Equal(readTestFile(t, s, "f"), data) {
+		t.Errorf("immutable file changed")
+	}
+
+	// an incomplete upload can be removed
+	if err := s.CreateFile("partial", "p", "", 10, nil, WithImmutable()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteFile("partial"); err != nil {
+		t.Errorf("delete incomplete: %v", err)
+	}
+}
@@ -0,0 +1,43 @@
+package storage
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// An imported file keeps its creation and expiration time, also once complete
+func TestCreateFileWithTimes(t *testing.T) {
+	s := openTestBadger(t)
+
+	data := testData(2*BlockSize + 10)
+	created := time.Now().Add(-48 * time.Hour).Truncate(time.Second)
+	expires := time.Now().Add(5 * time.Hour).Truncate(time.Second)
+	hash, _, _ := GetHashAlg(bytes.NewReader(data), HashCumulative)
+
+	if err := s.CreateFileWithTimes("f", "f", "", int64(len(data)), hash, created, expires); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(when string) {
+		stat, err := s.Stat("f")
+		if err != nil {
+			t.Fatalf("%v: %v", when, err)
+		}
+		if !stat.Created.Equal(created) || stat.ExpiresAt.Unix() != expires.Unix() || !stat.Preserve {
+			t.Errorf("%v: created %v expires %v, expected %v %v", when, stat.Created, stat.ExpiresAt, created, expires)
+		}
+	}
+
+	check("created")
+
+	if _, err := WriteAll(s, "f", 0, data); err != nil {
+		t.Fatal(err)
+	}
+
+	check("complete")
+
+	if err := s.CreateFileWithTimes("old", "old", "", 0, hash, created, time.Now().Add(-time.Minute)); err != ErrExpired {
+		t.Errorf("expired import: %v, expected ErrExpired", err)
+	}
+}
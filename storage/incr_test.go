@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"encoding/binary"
+	"sync"
+	"testing"
+)
+
+// Return the stores the backend tests run on: badger, and AWS on a fake table (see openTestAWS)
+func openTestStores(t *testing.T, opts ...Option) map[string]StorageDB {
+	t.Helper()
+
+	aws, _ := openTestAWS(t, opts...)
+	return map[string]StorageDB{"badger": openTestBadger(t, opts...), "aws": aws}
+}
+
+func TestIncrFileConcurrent(t *testing.T) {
+	for name, s := range openTestStores(t) {
+		var wg sync.WaitGroup
+		for i := 0; i < 100; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				if _, err := s.IncrFile("counter", 1); err != nil {
+					t.Error(name, err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		value, err := s.IncrFile("counter", 0)
+		if err != nil || value != 100 {
+			t.Fatalf("%v: counter %v, %v: expected 100", name, value, err)
+		}
+
+		if data := readTestFile(t, s, "counter"); int64(binary.BigEndian.Uint64(data)) != 100 {
+			t.Errorf("%v: content %x", name, data)
+		}
+	}
+}
+
+func TestIncrFileInvalid(t *testing.T) {
+	for name, s := range openTestStores(t, WithInlineSize(64)) {
+		counter := make([]byte, counterSize)
+		putTestFile(t, s, "immutable", counter, counterSize, WithImmutable())
+		if _, err := s.IncrFile("immutable", 1); err != ErrImmutable {
+			t.Errorf("%v: immutable counter: %v, expected ErrImmutable", name, err)
+		}
+
+		putTestFile(t, s, "file", []byte("not a counter"), BlockSize)
+		if _, err := s.IncrFile("file", 1); err != ErrInvalidSize {
+			t.Errorf("%v: not a counter: %v, expected ErrInvalidSize", name, err)
+		}
+
+		if err := s.DeleteFile("file"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.IncrFile("file", 1); err != nil {
+			t.Errorf("%v: deleted file: %v, expected a new counter", name, err)
+		}
+	}
+}
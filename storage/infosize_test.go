@@ -0,0 +1,29 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Metadata records over the limit are rejected before writing anything
+func TestMaxInfoSize(t *testing.T) {
+	s := openTestBadger(t, WithMaxInfoSize(300))
+
+	// grow the name one byte at a time, until the record is just over the limit
+	var err error
+	n := 1
+	for ; n < 300 && err == nil; n++ {
+		err = s.CreateFile(fmt.Sprint("f", n), strings.Repeat("n", n), "text/plain", 10, nil)
+	}
+
+	if err != ErrInfoTooBig {
+		t.Fatalf("name of %v bytes: %v, expected ErrInfoTooBig", n-1, err)
+	}
+	if n < 100 {
+		t.Errorf("rejected a name of %v bytes", n-1)
+	}
+	if _, err := s.Stat(fmt.Sprint("f", n-1)); err != ErrNotFound {
+		t.Errorf("rejected file: %v, expected ErrNotFound", err)
+	}
+}
@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// Files stay inlined or in blocks as created, when the store is reopened with another inline size
+func TestInlineReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cashier-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	small, large := testData(100), testData(3000)
+
+	s, err := OpenBadger(dir, false, time.Hour, WithInlineSize(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	putTestFile(t, s, "small", small, len(small))
+	putTestFile(t, s, "large", large, BlockSize)
+	s.Close()
+
+	for _, size := range []int64{0, BlockSize} {
+		s, err := OpenBadger(dir, false, time.Hour, WithInlineSize(size))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !getTestInfo(t, s, "small").Inlined || getTestInfo(t, s, "large").Inlined {
+			t.Errorf("inline size %v: inline decision changed", size)
+		}
+		if got := readTestFile(t, s, "small"); !bytes.Equal(got, small) {
+			t.Errorf("inline size %v: small file differs", size)
+		}
+		if got := readTestFile(t, s, "large"); !bytes.Equal(got, large) {
+			t.Errorf("inline size %v: large file differs", size)
+		}
+		s.Close()
+	}
+}
+
+// Files created before the inline size changes are written as decided at creation
+func TestInlineReopenCreated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cashier-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := testData(100)
+	hash, _, _ := GetHash(bytes.NewReader(data))
+
+	s, err := OpenBadger(dir, false, time.Hour, WithInlineSize(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateFile("inline", "f", "", int64(len(data)), hash); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s, err = OpenBadger(dir, false, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateFile("blocks", "f", "", int64(len(data)), hash); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s, err = OpenBadger(dir, false, time.Hour, WithInlineSize(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for key, inline := range map[string]bool{"inline": true, "blocks": false} {
+		if pos, err := s.WriteAt(key, 0, data); err != nil || pos != FileComplete {
+			t.Fatalf("write %v: %v %v", key, pos, err)
+		}
+		if got := readTestFile(t, s, key); !bytes.Equal(got, data) {
+			t.Errorf("%v: content differs", key)
+		}
+		if info := getTestInfo(t, s, key); (info.Inline != nil) != inline {
+			t.Errorf("%v: inline content %v bytes", key, len(info.Inline))
+		}
+	}
+}
+
+// Only files with a known length up to the inline size are stored in the metadata record
+func TestInlineSize(t *testing.T) {
+	a, db := openTestAWS(t, WithInlineSize(100))
+	stores := map[string]StorageDB{"badger": openTestBadger(t, WithInlineSize(100)), "aws": a}
+
+	for name, sdb := range stores {
+		for size, inlined := range map[int64]bool{-1: false, 0: true, 100: true, 101: false} {
+			key := fmt.Sprint("f", size)
+			if err := sdb.CreateFile(key, key, "", size, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			fileInfo := &info{}
+			if s, ok := sdb.(*badgerStorage); ok {
+				fileInfo = getTestInfo(t, s, key)
+			} else if err := fileInfo.UnmarshalString(aws.StringValue(db.items[infoKey(key)]["Value"].S)); err != nil {
+				t.Fatal(err)
+			}
+
+			if fileInfo.Inlined != inlined {
+				t.Errorf("%v: size %v inlined %v, expected %v", name, size, fileInfo.Inlined, inlined)
+			}
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"sort"
+)
+
+// Sort orders for ListFiles
+const (
+	SortName    = "name"    // by key
+	SortCreated = "created" // by creation time
+	SortSize    = "size"    // by file length
+)
+
+// An option for ListFiles
+type ListOption func(o *listOptions)
+
+type listOptions struct {
+	sortBy string
+	desc   bool
+}
+
+// Sort the files by SortName, SortCreated or SortSize, in descending order if desc.
+// Without it the files are returned in storage order (key order for badger, none for AWS).
+func WithSort(by string, desc bool) ListOption {
+	return func(o *listOptions) {
+		o.sortBy, o.desc = by, desc
+	}
+}
+
+// Return true if by is a valid sort order for WithSort
+func ValidSort(by string) bool {
+	switch by {
+	case SortName, SortCreated, SortSize:
+		return true
+	}
+
+	return false
+}
+
+func getListOptions(opts []ListOption) listOptions {
+	var o listOptions
+
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return o
+}
+
+// Sort the files as requested by the ListFiles options, breaking ties by key.
+// The backends scan all the records for ListFiles anyway, so they sort the result
+// in memory rather than keeping an index for each order.
+func SortFiles(files []*FileInfo, opts ...ListOption) {
+	o := getListOptions(opts)
+	if o.sortBy == "" {
+		return
+	}
+
+	less := func(a, b *FileInfo) bool {
+		switch o.sortBy {
+		case SortCreated:
+			if !a.Created.Equal(b.Created) {
+				return a.Created.Before(b.Created)
+			}
+		case SortSize:
+			if a.Length != b.Length {
+				return a.Length < b.Length
+			}
+		}
+
+		return a.Key < b.Key
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		if o.desc {
+			return less(files[j], files[i])
+		}
+
+		return less(files[i], files[j])
+	})
+}
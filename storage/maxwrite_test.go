@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// A store recording the size of each WriteAt call
+type writeRecorder struct {
+	StorageDB
+	writes []int
+}
+
+func (s *writeRecorder) WriteAt(key string, pos int64, data []byte) (int64, error) {
+	n, err := s.StorageDB.WriteAt(key, pos, data)
+	if err == nil {
+		if n == FileComplete {
+			s.writes = append(s.writes, len(data))
+		} else {
+			s.writes = append(s.writes, int(n-pos))
+		}
+	}
+
+	return n, err
+}
+
+// With a max write size, WriteAt writes at most that many bytes and returns the next position
+func TestMaxWriteSize(t *testing.T) {
+	s := openTestBadger(t, WithMaxWriteSize(2*BlockSize))
+
+	data := testData(7*BlockSize + 10)
+	if err := s.CreateFile("f", "f", "", int64(len(data)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	npos, err := s.WriteAt("f", 0, data)
+	if err != nil || npos != 2*BlockSize {
+		t.Fatalf("oversized write: %v %v, expected next position %v", npos, err, 2*BlockSize)
+	}
+	if stat, _ := s.StatPhysical("f"); stat == nil || stat.Blocks != 2 {
+		t.Errorf("after the first write: %+v, expected 2 blocks", stat)
+	}
+
+	rec := &writeRecorder{StorageDB: s}
+	npos, err = WriteAll(rec, "f", npos, data[npos:])
+	if err != nil || npos != FileComplete {
+		t.Fatalf("write the rest: %v %v", npos, err)
+	}
+
+	expected := []int{2 * BlockSize, 2 * BlockSize, BlockSize + 10}
+	if len(rec.writes) != len(expected) {
+		t.Fatalf("writes %v, expected %v", rec.writes, expected)
+	}
+	for i := range expected {
+		if rec.writes[i] != expected[i] {
+			t.Errorf("writes %v, expected %v", rec.writes, expected)
+			break
+		}
+	}
+
+	if !bytes.Equal(readTestFile(t, s, "f"), data) {
+		t.Errorf("content differs")
+	}
+}
+
+func TestMaxWriteSizeInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cashier-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, size := range []int64{-BlockSize, BlockSize + 1, 1000} {
+		if s, err := OpenBadger(dir, false, time.Hour, WithMaxWriteSize(size)); err == nil {
+			s.Close()
+			t.Errorf("max write size %v accepted", size)
+		}
+	}
+}
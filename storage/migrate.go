@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// Copy the file identified by key from one storage service to another,
+// preserving name, content type, hash and hash algorithm, creation and expiration time,
+// TTL, block TTL and immutability. Only complete files migrate (so no reservations).
+// Merkle hashes depend on the block size, so those files only migrate to a store with the same block size.
+func Migrate(from, to StorageDB, key string) error {
+	stat, err := from.Stat(key)
+	if err != nil {
+		return err
+	}
+
+	if stat.Next != FileComplete {
+		return ErrIncomplete
+	}
+
+	hash, err := ParseHash(stat.Hash)
+	if err != nil {
+		return err
+	}
+
+	opts := []FileOption{WithHashAlg(stat.HashAlg)}
+	if stat.Immutable {
+		opts = append(opts, WithImmutable())
+	}
+	if stat.TTL > 0 {
+		opts = append(opts, WithTTL(stat.TTL))
+	}
+	if stat.BlockTTL > 0 {
+		opts = append(opts, WithBlockTTL(stat.BlockTTL))
+	}
+
+	if stat.ExpiresAt.Unix() > 0 {
+		if !stat.Preserve {
+			opts = append(opts, withMigrated())
+		}
+
+		err = to.CreateFileWithTimes(key, stat.Name, stat.ContentType, stat.Length, hash,
+			stat.Created, stat.ExpiresAt, opts...)
+	} else {
+		err = to.CreateFile(key, stat.Name, stat.ContentType, stat.Length, hash, opts...)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := migrateContent(from, to, key, stat.Length); err != nil {
+		to.DeleteFile(key) // don't leave a partial file, so that the migration can be run again
+		return err
+	}
+
+	return nil
+}
+
+// Copy length bytes of the file key to the new file in to
+func migrateContent(from, to StorageDB, key string, length int64) error {
+	dst, err := to.Stat(key) // the new file may have a different block size
+	if err != nil {
+		return err
+	}
+
+	var buf = make([]byte, 4*dst.BlockSize)
+	var rpos, wpos int64
+
+	for rpos < length && wpos != FileComplete {
+		n, err := from.ReadAt(key, buf, rpos)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if n == 0 {
+			return io.ErrUnexpectedEOF
+		}
+
+		if wpos, err = WriteAll(to, key, wpos, buf[:n]); err != nil {
+			return err
+		}
+
+		rpos += n
+	}
+
+	return nil
+}
+
+// Migrate the files identified by keys from one storage service to another (see Migrate),
+// with up to concurrency files in parallel. done, if not nil, is called after each file.
+// Returns the number of files that failed.
+func MigrateAll(from, to StorageDB, keys []string, concurrency int, done func(key string, err error)) int {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var failed int32
+	var wg sync.WaitGroup
+
+	work := make(chan string)
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for key := range work {
+				err := Migrate(from, to, key)
+				if err != nil {
+					atomic.AddInt32(&failed, 1)
+				}
+				if done != nil {
+					done(key, err)
+				}
+			}
+		}()
+	}
+
+	for _, key := range keys {
+		work <- key
+	}
+
+	close(work)
+	wg.Wait()
+
+	return int(failed)
+}
+
+// Return the keys of the complete files with a key starting with prefix, to migrate
+func CompleteKeys(sdb StorageDB, prefix string) ([]string, error) {
+	files, err := sdb.ListFiles(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, f := range files {
+		if f.Next == FileComplete {
+			keys = append(keys, f.Key)
+		}
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,216 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Files migrate to a store with another hash algorithm, keeping their own
+func TestMigrateCrossAlgorithm(t *testing.T) {
+	from := openTestBadger(t, WithHash(HashMerkle))
+	to := openTestBadger(t) // cumulative
+
+	files := map[string][]byte{
+		"merkle": testData(3*BlockSize + 10),
+		"sha256": testData(BlockSize + 1),
+		"small":  []byte("hello"),
+	}
+
+	for key, data := range files {
+		alg := HashMerkle
+		if key == "sha256" {
+			alg = HashSHA256
+		}
+
+		hash, _, err := GetHashAlg(bytes.NewReader(data), alg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = from.CreateFile(key, key+".bin", "application/x-test", int64(len(data)), hash,
+			WithHashAlg(alg), WithTTL(2*time.Hour), WithBlockTTL(90*time.Minute), WithImmutable())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := WriteAll(from, key, 0, data); err != nil {
+			t.Fatalf("write %v: %v", key, err)
+		}
+	}
+
+	for key, data := range files {
+		if err := Migrate(from, to, key); err != nil {
+			t.Fatalf("migrate %v: %v", key, err)
+		}
+
+		src, _ := from.Stat(key)
+		dst, err := to.Stat(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if dst.Next != FileComplete {
+			t.Fatalf("%v: incomplete at %v", key, dst.Next)
+		}
+		if dst.Hash != src.Hash || dst.HashAlg != src.HashAlg {
+			t.Errorf("%v: hash %v %v, expected %v %v", key, dst.HashAlg, dst.Hash, src.HashAlg, src.Hash)
+		}
+		if dst.Name != src.Name || dst.ContentType != src.ContentType || !dst.Created.Equal(src.Created) {
+			t.Errorf("%v: migrated as %+v, from %+v", key, dst, src)
+		}
+		if dst.ExpiresAt.Unix() != src.ExpiresAt.Unix() {
+			t.Errorf("%v: expires %v, expected %v", key, dst.ExpiresAt, src.ExpiresAt)
+		}
+		if dst.TTL != src.TTL || dst.BlockTTL != src.BlockTTL || dst.Immutable != src.Immutable || dst.Preserve != src.Preserve {
+			t.Errorf("%v: options %+v, expected %+v", key, dst, src)
+		}
+
+		if got := readTestFile(t, to, key); !bytes.Equal(got, data) {
+			t.Errorf("%v: content differs", key)
+		}
+
+		if err := Verify(to, key); err != nil {
+			t.Errorf("%v: verify: %v", key, err)
+		}
+	}
+}
+
+// Incomplete files are not migrated
+func TestMigrateIncomplete(t *testing.T) {
+	from := openTestBadger(t)
+	to := openTestBadger(t)
+
+	data := testData(2 * BlockSize)
+	hash, _, _ := GetHashAlg(bytes.NewReader(data), HashCumulative)
+
+	if err := from.CreateFile("f", "f", "", int64(len(data)), hash); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := from.WriteAt("f", 0, data[:BlockSize]); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Migrate(from, to, "f"); err != ErrIncomplete {
+		t.Fatalf("migrate: %v, expected ErrIncomplete", err)
+	}
+	if keys, _ := CompleteKeys(from, ""); len(keys) != 0 {
+		t.Fatalf("complete keys: %v", keys)
+	}
+}
+
+// Imported files stay imported, other files follow their TTL once migrated
+func TestMigrateTimes(t *testing.T) {
+	from := openTestBadger(t)
+	to := openTestBadger(t)
+
+	created := time.Now().Add(-time.Hour).Truncate(time.Second)
+	expires := time.Now().Add(3 * time.Hour).Truncate(time.Second)
+	hash, _, _ := GetHashAlg(bytes.NewReader(nil), HashCumulative)
+
+	if err := from.CreateFileWithTimes("imported", "i", "", 0, hash, created, expires); err != nil {
+		t.Fatal(err)
+	}
+	if err := from.CreateFile("empty", "e", "", 0, hash); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"imported", "empty"} {
+		if err := Migrate(from, to, key); err != nil {
+			t.Fatalf("migrate %v: %v", key, err)
+		}
+
+		src, _ := from.Stat(key)
+		dst, _ := to.Stat(key)
+
+		if dst.Preserve != src.Preserve || !dst.Created.Equal(src.Created) || dst.ExpiresAt.Unix() != src.ExpiresAt.Unix() {
+			t.Errorf("%v: migrated as %+v, from %+v", key, dst, src)
+		}
+		if info := getTestInfo(t, to, key); info.Migrated {
+			t.Errorf("%v: still migrating", key)
+		}
+	}
+}
+
+// A store failing the writes after the first ones
+type failingWrites struct {
+	StorageDB
+	writes int // writes to allow
+}
+
+func (s *failingWrites) WriteAt(key string, pos int64, data []byte) (int64, error) {
+	if s.writes == 0 {
+		return InvalidPos, ErrUnavailable
+	}
+
+	s.writes--
+	return s.StorageDB.WriteAt(key, pos, data)
+}
+
+// A migration failing halfway deletes the partial file, and can be run again
+func TestMigrateWriteFailure(t *testing.T) {
+	from := openTestBadger(t)
+	to := &failingWrites{StorageDB: openTestBadger(t, WithMaxWriteSize(BlockSize)), writes: 2}
+
+	data := testData(5*BlockSize + 10)
+	putTestFile(t, from, "f", data, BlockSize, WithImmutable())
+
+	if err := Migrate(from, to, "f"); err != ErrUnavailable {
+		t.Fatalf("migrate: %v, expected ErrUnavailable", err)
+	}
+	if _, err := to.Stat("f"); err != ErrNotFound {
+		t.Fatalf("partial file left: %v", err)
+	}
+
+	to.writes = 100
+	if err := Migrate(from, to, "f"); err != nil {
+		t.Fatalf("migrate again: %v", err)
+	}
+	if !bytes.Equal(readTestFile(t, to, "f"), data) {
+		t.Errorf("content differs")
+	}
+}
+
+func TestMigrateAllConcurrent(t *testing.T) {
+	from := openTestBadger(t)
+	to := openTestBadger(t)
+
+	files := map[string][]byte{}
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("f%02d", i)
+		files[key] = testData(100 + i*37)
+		putTestFile(t, from, key, files[key], BlockSize)
+	}
+
+	keys, err := CompleteKeys(from, "")
+	if err != nil || len(keys) != len(files) {
+		t.Fatalf("complete keys: %v %v", len(keys), err)
+	}
+
+	var mu sync.Mutex
+	migrated := map[string]bool{}
+
+	failed := MigrateAll(from, to, append(keys, "missing"), 4, func(key string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if err == nil {
+			migrated[key] = true
+		} else if key != "missing" {
+			t.Errorf("migrate %v: %v", key, err)
+		}
+	})
+	if failed != 1 {
+		t.Errorf("%v failed, expected 1 (the missing key)", failed)
+	}
+
+	for key, data := range files {
+		if !migrated[key] {
+			t.Errorf("%v not migrated", key)
+		} else if got := readTestFile(t, to, key); !bytes.Equal(got, data) {
+			t.Errorf("%v: content differs", key)
+		}
+	}
+}
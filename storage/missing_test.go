@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/dgraph-io/badger"
+)
+
+// Reading a complete file with a block removed reports which block is missing
+func TestMissingBlock(t *testing.T) {
+	s := openTestBadger(t)
+
+	data := testData(3*BlockSize + 10)
+	putTestFile(t, s, "f", data, len(data))
+
+	if err := s.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(blockKey("f", 1)))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, len(data))
+	if n, err := s.ReadAt("f", buf[:BlockSize], 0); n != BlockSize || err != nil {
+		t.Errorf("read block 0: %v %v", n, err)
+	}
+	if _, err := s.ReadAt("f", buf, 0); err != (ErrMissingBlock{Block: 1}) {
+		t.Errorf("read across block 1: %v, expected missing block 1", err)
+	}
+	if _, err := s.ReadAt("f", buf, BlockSize+5); err != (ErrMissingBlock{Block: 1}) {
+		t.Errorf("read in block 1: %v, expected missing block 1", err)
+	}
+	if err := (ErrMissingBlock{Block: 1}); err.Error() != "Missing block 1" {
+		t.Errorf("message %q", err.Error())
+	}
+
+	r, _, err := s.OpenReader("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if _, err := ioutil.ReadAll(r); err != (ErrMissingBlock{Block: 1}) {
+		t.Errorf("sequential read: %v, expected missing block 1", err)
+	}
+}
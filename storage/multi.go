@@ -0,0 +1,172 @@
+package storage
+
+import (
+	"log"
+	"time"
+)
+
+// A storage service that applies all writes to a primary backend and a list of replicas.
+// Reads only go to the primary. Writes fail if the primary fails; replica failures
+// are either logged or returned, after the primary was updated.
+type multiWriter struct {
+	StorageDB
+
+	replicas []StorageDB
+	strict   bool // replica failures are returned
+}
+
+// Return a storage service writing to primary and replicas, logging replica failures
+// (e.g. to dual-write during a migration)
+func MultiWriter(primary StorageDB, replicas ...StorageDB) StorageDB {
+	return &multiWriter{StorageDB: primary, replicas: replicas}
+}
+
+// Return a storage service writing to primary and replicas, failing if any replica fails
+func StrictMultiWriter(primary StorageDB, replicas ...StorageDB) StorageDB {
+	return &multiWriter{StorageDB: primary, replicas: replicas, strict: true}
+}
+
+// Apply op to all replicas, returning the first failure if strict
+func (m *multiWriter) replicate(name, key string, op func(sdb StorageDB) error) error {
+	var ret error
+
+	for i, r := range m.replicas {
+		if err := op(r); err != nil {
+			log.Printf("replica %v: %v %v: %v", i, name, key, err)
+
+			if m.strict && ret == nil {
+				ret = err
+			}
+		}
+	}
+
+	return ret
+}
+
+func (m *multiWriter) CreateFile(key, filename, ctype string, size int64, hash []byte, opts ...FileOption) error {
+	if err := m.StorageDB.CreateFile(key, filename, ctype, size, hash, opts...); err != nil {
+		return err
+	}
+
+	return m.replicate("create", key, func(sdb StorageDB) error {
+		return sdb.CreateFile(key, filename, ctype, size, hash, opts...)
+	})
+}
+
+func (m *multiWriter) CreateFileWithTimes(key, filename, ctype string, size int64, hash []byte, created, expires time.Time, opts ...FileOption) error {
+	if err := m.StorageDB.CreateFileWithTimes(key, filename, ctype, size, hash, created, expires, opts...); err != nil {
+		return err
+	}
+
+	return m.replicate("create", key, func(sdb StorageDB) error {
+		return sdb.CreateFileWithTimes(key, filename, ctype, size, hash, created, expires, opts...)
+	})
+}
+
+func (m *multiWriter) DeleteFile(key string) error {
+	if err := m.StorageDB.DeleteFile(key); err != nil {
+		return err
+	}
+
+	return m.replicate("delete", key, func(sdb StorageDB) error {
+		err := sdb.DeleteFile(key)
+		if err == ErrNotFound {
+			err = nil
+		}
+		return err
+	})
+}
+
+func (m *multiWriter) SoftDelete(key string) error {
+	if err := m.StorageDB.SoftDelete(key); err != nil {
+		return err
+	}
+
+	return m.replicate("soft delete", key, func(sdb StorageDB) error {
+		return sdb.SoftDelete(key)
+	})
+}
+
+func (m *multiWriter) Touch(key string) error {
+	if err := m.StorageDB.Touch(key); err != nil {
+		return err
+	}
+
+	return m.replicate("touch", key, func(sdb StorageDB) error {
+		return sdb.Touch(key)
+	})
+}
+
+func (m *multiWriter) Copy(src, dst string) error {
+	if err := m.StorageDB.Copy(src, dst); err != nil {
+		return err
+	}
+
+	return m.replicate("copy", dst, func(sdb StorageDB) error {
+		return sdb.Copy(src, dst)
+	})
+}
+
+func (m *multiWriter) Rename(src, dst string) error {
+	if err := m.StorageDB.Rename(src, dst); err != nil {
+		return err
+	}
+
+	return m.replicate("rename", src, func(sdb StorageDB) error {
+		return sdb.Rename(src, dst)
+	})
+}
+
+func (m *multiWriter) WriteAt(key string, pos int64, data []byte) (int64, error) {
+	npos, err := m.StorageDB.WriteAt(key, pos, data)
+	if err != nil {
+		return npos, err
+	}
+
+	if npos != FileComplete { // the primary may have written only part of data
+		data = data[:npos-pos]
+	}
+
+	return npos, m.replicate("write", key, func(sdb StorageDB) error {
+		_, err := WriteAll(sdb, key, pos, data)
+		return err
+	})
+}
+
+func (m *multiWriter) TrimFront(key string, bytes int64) error {
+	if err := m.StorageDB.TrimFront(key, bytes); err != nil {
+		return err
+	}
+
+	return m.replicate("trim", key, func(sdb StorageDB) error {
+		return sdb.TrimFront(key, bytes)
+	})
+}
+
+func (m *multiWriter) IncrFile(key string, delta int64) (int64, error) {
+	value, err := m.StorageDB.IncrFile(key, delta)
+	if err != nil {
+		return value, err
+	}
+
+	return value, m.replicate("incr", key, func(sdb StorageDB) error {
+		_, err := sdb.IncrFile(key, delta)
+		return err
+	})
+}
+
+func (m *multiWriter) GC() error {
+	err := m.StorageDB.GC()
+	m.replicate("gc", "", func(sdb StorageDB) error {
+		return sdb.GC()
+	})
+	return err
+}
+
+func (m *multiWriter) Close() error {
+	err := m.StorageDB.Close()
+	m.replicate("close", "", func(sdb StorageDB) error {
+		return sdb.Close()
+	})
+	return err
+}
@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMultiWriter(t *testing.T) {
+	primary, replica := openTestBadger(t), openTestBadger(t)
+	sdb := MultiWriter(primary, replica)
+
+	data := testData(3*BlockSize + 10)
+	putTestFile(t, sdb, "f", data, BlockSize)
+
+	for name, s := range map[string]StorageDB{"primary": primary, "replica": replica} {
+		if !bytes.Equal(readTestFile(t, s, "f"), data) {
+			t.Errorf("%v: content differs", name)
+		}
+	}
+
+	pstat, _ := primary.Stat("f")
+	rstat, _ := replica.Stat("f")
+	if pstat.Hash != rstat.Hash || pstat.Length != rstat.Length {
+		t.Errorf("replica %+v, primary %+v", rstat, pstat)
+	}
+
+	if err := sdb.DeleteFile("f"); err != nil {
+		t.Fatal(err)
+	}
+	for name, s := range map[string]StorageDB{"primary": primary, "replica": replica} {
+		if _, err := s.Stat("f"); err != ErrNotFound {
+			t.Errorf("%v after delete: %v", name, err)
+		}
+	}
+}
+
+// Replica failures are only returned by a strict writer, after updating the primary
+func TestMultiWriterReplicaFailure(t *testing.T) {
+	primary, replica := openTestBadger(t), openTestBadger(t)
+	putTestFile(t, replica, "f", testData(10), 10)
+
+	if err := MultiWriter(primary, replica).CreateFile("f", "f", "", 10, nil); err != nil {
+		t.Errorf("create: %v", err)
+	}
+	if err := StrictMultiWriter(primary, replica).CreateFile("g", "g", "", 10, nil); err != nil {
+		t.Errorf("strict create: %v", err)
+	}
+
+	primary.DeleteFile("f")
+	if err := StrictMultiWriter(primary, replica).CreateFile("f", "f", "", 10, nil); err != ErrExists {
+		t.Errorf("strict create: %v, expected ErrExists", err)
+	}
+	if _, err := primary.Stat("f"); err != nil {
+		t.Errorf("primary: %v", err)
+	}
+}
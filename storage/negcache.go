@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"sync"
+	"time"
+)
+
+// A storage service that remembers recent ErrNotFound results from Stat,
+// so that clients polling for a missing file don't hit the backend every time
+type negativeCache struct {
+	StorageDB
+
+	ttl time.Duration
+
+	mu      sync.Mutex
+	missing map[string]time.Time // key -> time the NotFound result expires
+}
+
+// Return a storage service that caches NotFound lookups for ttl.
+// Creating a file invalidates its entry immediately.
+func NegativeCache(sdb StorageDB, ttl time.Duration) StorageDB {
+	return &negativeCache{StorageDB: sdb, ttl: ttl, missing: map[string]time.Time{}}
+}
+
+// Return true if key is known to be missing
+func (s *negativeCache) isMissing(key string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	exp, ok := s.missing[key]
+	if ok && now.After(exp) {
+		delete(s.missing, key)
+		return false
+	}
+
+	return ok
+}
+
+// Remember key as missing, dropping stale entries if the cache grew
+func (s *negativeCache) setMissing(key string, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.missing) >= 1024 {
+		for k, exp := range s.missing {
+			if now.After(exp) {
+				delete(s.missing, k)
+			}
+		}
+	}
+
+	s.missing[key] = now.Add(s.ttl)
+}
+
+func (s *negativeCache) invalidate(key string) {
+	s.mu.Lock()
+	delete(s.missing, key)
+	s.mu.Unlock()
+}
+
+// Return file info, or a cached ErrNotFound
+func (s *negativeCache) Stat(key string) (*FileInfo, error) {
+	now := time.Now()
+
+	if s.isMissing(key, now) {
+		return nil, ErrNotFound
+	}
+
+	stat, err := s.StorageDB.Stat(key)
+	if err == ErrNotFound {
+		s.setMissing(key, now)
+	}
+
+	return stat, err
+}
+
+// Return true if the file exists, or false for a cached ErrNotFound
+func (s *negativeCache) Exists(key string) (bool, error) {
+	now := time.Now()
+
+	if s.isMissing(key, now) {
+		return false, nil
+	}
+
+	exists, err := s.StorageDB.Exists(key)
+	if err == nil && !exists {
+		s.setMissing(key, now)
+	}
+
+	return exists, err
+}
+
+func (s *negativeCache) CreateFile(key, filename, ctype string, size int64, hash []byte, opts ...FileOption) error {
+	s.invalidate(key)
+	err := s.StorageDB.CreateFile(key, filename, ctype, size, hash, opts...)
+	s.invalidate(key)
+	return err
+}
+
+func (s *negativeCache) CreateFileWithTimes(key, filename, ctype string, size int64, hash []byte, created, expires time.Time, opts ...FileOption) error {
+	s.invalidate(key)
+	err := s.StorageDB.CreateFileWithTimes(key, filename, ctype, size, hash, created, expires, opts...)
+	s.invalidate(key)
+	return err
+}
+
+func (s *negativeCache) Copy(src, dst string) error {
+	s.invalidate(dst)
+	err := s.StorageDB.Copy(src, dst)
+	s.invalidate(dst)
+	return err
+}
+
+func (s *negativeCache) Rename(src, dst string) error {
+	s.invalidate(dst)
+	err := s.StorageDB.Rename(src, dst)
+	s.invalidate(dst)
+	return err
+}
+
+func (s *negativeCache) IncrFile(key string, delta int64) (int64, error) {
+	s.invalidate(key)
+	value, err := s.StorageDB.IncrFile(key, delta)
+	s.invalidate(key)
+	return value, err
+}
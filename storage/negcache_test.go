@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+// A storage service counting the Stat calls
+type statCounter struct {
+	StorageDB
+	stats int
+}
+
+func (s *statCounter) Stat(key string) (*FileInfo, error) {
+	s.stats++
+	return s.StorageDB.Stat(key)
+}
+
+func TestNegativeCache(t *testing.T) {
+	backend := &statCounter{StorageDB: openTestBadger(t)}
+	sdb := NegativeCache(backend, time.Hour)
+
+	for i := 0; i < 3; i++ {
+		if _, err := sdb.Stat("f"); err != ErrNotFound {
+			t.Fatalf("lookup %v: %v, expected ErrNotFound", i, err)
+		}
+	}
+	if backend.stats != 1 {
+		t.Errorf("%v backend lookups, expected 1", backend.stats)
+	}
+
+	if err := sdb.CreateFile("f", "f", "", 10, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sdb.Stat("f"); err != nil {
+		t.Errorf("lookup after create: %v", err)
+	}
+	if backend.stats != 2 {
+		t.Errorf("%v backend lookups, expected 2", backend.stats)
+	}
+}
+
+func TestNegativeCacheExpiry(t *testing.T) {
+	backend := &statCounter{StorageDB: openTestBadger(t)}
+	sdb := NegativeCache(backend, 10*time.Millisecond)
+
+	sdb.Stat("f")
+	time.Sleep(20 * time.Millisecond)
+	sdb.Stat("f")
+
+	if backend.stats != 2 {
+		t.Errorf("%v backend lookups, expected 2", backend.stats)
+	}
+}
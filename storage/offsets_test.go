@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// Offsets past 4GB work without allocating the file: the upload position is moved there in the metadata
+func TestLargeOffsets(t *testing.T) {
+	s := openTestBadger(t)
+
+	const length = 5<<30 + 10
+
+	if err := s.CreateFile("big", "big", "", length, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// two blocks across 4GB
+	pos := int64(4<<30 - BlockSize)
+	data := testData(2 * BlockSize)
+	setTestInfo(t, s, "big", func(i *info) { i.CurPos = pos })
+
+	if next, err := s.WriteAt("big", pos, data); err != nil || next != pos+2*BlockSize {
+		t.Fatalf("write at %v: %v %v", pos, next, err)
+	}
+
+	buf := make([]byte, 100)
+	if n, err := s.ReadAt("big", buf, 4<<30-50); err != nil || !bytes.Equal(buf[:n], data[BlockSize-50:BlockSize+50]) {
+		t.Errorf("read across 4GB: %v %v", n, err)
+	}
+	if _, err := s.ReadAt("big", buf, pos+2*BlockSize); err != ErrIncomplete {
+		t.Errorf("read past the data written: %v, expected ErrIncomplete", err)
+	}
+
+	// the last (partial) block
+	pos = length - 10 - BlockSize
+	data = testData(BlockSize + 10)
+	setTestInfo(t, s, "big", func(i *info) { i.CurPos = pos })
+
+	if next, err := s.WriteAt("big", pos, data); err != nil || next != FileComplete {
+		t.Fatalf("write at %v: %v %v", pos, next, err)
+	}
+
+	if n, err := s.ReadAt("big", buf, length-5); n != 5 || err != io.EOF || !bytes.Equal(buf[:n], data[len(data)-5:]) {
+		t.Errorf("read at the end: %v %v", n, err)
+	}
+
+	if stat, _ := s.StatPhysical("big"); stat.Blocks != 4 {
+		t.Errorf("%v block records, expected 4", stat.Blocks)
+	}
+}
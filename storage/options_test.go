@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// The block size is validated at Open: a zero block size would divide by zero in WriteAt
+func TestOpenBlockSize(t *testing.T) {
+	for _, tc := range []struct {
+		size int64
+		ok   bool
+	}{
+		{0, false},
+		{MinBlockSize, true},
+		{BlockSize, true},
+		{MaxBlockSize, true},
+		{-1, false},
+		{3000, false},
+		{MinBlockSize / 2, false},
+		{MaxBlockSize * 2, false},
+	} {
+		dir, err := ioutil.TempDir("", "cashier-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := OpenBadger(dir, false, time.Hour, WithBlockSize(tc.size))
+		if err == nil {
+			s.Close()
+		}
+		os.RemoveAll(dir)
+
+		if (err == nil) != tc.ok {
+			t.Errorf("block size %v: %v", tc.size, err)
+		}
+	}
+}
+
+// Files keep the block size they were created with
+func TestSmallBlockSize(t *testing.T) {
+	s := openTestBadger(t, WithBlockSize(MinBlockSize))
+
+	data := testData(5*MinBlockSize + 3)
+	putTestFile(t, s, "f", data, MinBlockSize)
+
+	stat, _ := s.Stat("f")
+	if stat.BlockSize != MinBlockSize || stat.Next != FileComplete {
+		t.Fatalf("stat %+v", stat)
+	}
+	if got := readTestFile(t, s, "f"); string(got) != string(data) {
+		t.Error("content differs")
+	}
+}
@@ -0,0 +1,225 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"sync"
+)
+
+// A storage service that imports missing files from an origin server on first access (read-through).
+// Concurrent misses for the same key share a single fetch.
+type origin struct {
+	StorageDB
+
+	url    func(key string) string
+	client *http.Client
+
+	mu    sync.Mutex
+	fills map[string]*originFill // fetches in progress
+}
+
+type originFill struct {
+	done chan struct{}
+	err  error
+}
+
+// Return a storage service that fetches files missing from sdb from originURL(key),
+// storing them for the next requests. A 404 from the origin is ErrNotFound.
+func WithOrigin(sdb StorageDB, originURL func(key string) string) StorageDB {
+	return &origin{StorageDB: sdb, url: originURL, client: http.DefaultClient, fills: map[string]*originFill{}}
+}
+
+// Wait for the fetch of key in progress, if any
+func (o *origin) wait(key string) {
+	o.mu.Lock()
+	f := o.fills[key]
+	o.mu.Unlock()
+
+	if f != nil {
+		<-f.done
+	}
+}
+
+// Import key from the origin, or wait for the import in progress
+func (o *origin) fill(key string) error {
+	o.mu.Lock()
+	if f, ok := o.fills[key]; ok {
+		o.mu.Unlock()
+
+		<-f.done
+		return f.err
+	}
+
+	f := &originFill{done: make(chan struct{})}
+	o.fills[key] = f
+	o.mu.Unlock()
+
+	f.err = o.fetch(key)
+
+	o.mu.Lock()
+	delete(o.fills, key)
+	o.mu.Unlock()
+
+	close(f.done)
+	return f.err
+}
+
+func (o *origin) fetch(key string) error {
+	res, err := o.client.Get(o.url(key))
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("origin %v: %v", key, res.Status)
+	}
+
+	var body io.Reader = res.Body
+
+	length := res.ContentLength
+	if length < 0 { // chunked response
+		data, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return err
+		}
+
+		body, length = bytes.NewReader(data), int64(len(data))
+	}
+
+	err = o.StorageDB.CreateFile(key, path.Base(res.Request.URL.Path), res.Header.Get("Content-Type"), length, nil)
+	if err == ErrExists { // imported by another instance
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("origin %v: importing %v bytes", key, length)
+
+	stat, err := o.StorageDB.Stat(key)
+	if err != nil {
+		o.StorageDB.DeleteFile(key)
+		return err
+	}
+
+	buf := make([]byte, 4*stat.BlockSize)
+
+	for pos := int64(0); length > 0 && pos != FileComplete; { // empty files are complete on creation
+		n, err := io.ReadFull(body, buf)
+		if err == io.ErrUnexpectedEOF { // short last block
+			err = nil
+		}
+		if err == nil {
+			pos, err = WriteAll(o.StorageDB, key, pos, buf[:n])
+		}
+		if err != nil {
+			o.StorageDB.DeleteFile(key) // don't leave a partial file
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (o *origin) Stat(key string) (*FileInfo, error) {
+	o.wait(key)
+
+	stat, err := o.StorageDB.Stat(key)
+	if err == ErrNotFound {
+		if err = o.fill(key); err != nil {
+			return nil, err
+		}
+
+		return o.StorageDB.Stat(key)
+	}
+
+	return stat, err
+}
+
+// Missing files are imported, as for Stat
+func (o *origin) Exists(key string) (bool, error) {
+	o.wait(key)
+
+	exists, err := o.StorageDB.Exists(key)
+	if err == nil && !exists {
+		if err = o.fill(key); err == ErrNotFound {
+			return false, nil
+		}
+
+		return err == nil, err
+	}
+
+	return exists, err
+}
+
+func (o *origin) ReadAt(key string, buf []byte, pos int64) (int64, error) {
+	o.wait(key)
+
+	n, err := o.StorageDB.ReadAt(key, buf, pos)
+	if err == ErrNotFound {
+		if err = o.fill(key); err != nil {
+			return 0, err
+		}
+
+		return o.StorageDB.ReadAt(key, buf, pos)
+	}
+
+	return n, err
+}
+
+// A missing source is imported, as for Stat
+func (o *origin) Copy(src, dst string) error {
+	o.wait(src)
+
+	err := o.StorageDB.Copy(src, dst)
+	if err == ErrNotFound {
+		if err = o.fill(src); err != nil {
+			return err
+		}
+
+		return o.StorageDB.Copy(src, dst)
+	}
+
+	return err
+}
+
+// A missing source is imported, as for Stat
+func (o *origin) Rename(src, dst string) error {
+	o.wait(src)
+
+	err := o.StorageDB.Rename(src, dst)
+	if err == ErrNotFound {
+		if err = o.fill(src); err != nil {
+			return err
+		}
+
+		return o.StorageDB.Rename(src, dst)
+	}
+
+	return err
+}
+
+func (o *origin) OpenReader(key string) (io.ReadCloser, *FileInfo, error) {
+	o.wait(key)
+
+	r, stat, err := o.StorageDB.OpenReader(key)
+	if err == ErrNotFound {
+		if err = o.fill(key); err != nil {
+			return nil, nil, err
+		}
+
+		return o.StorageDB.OpenReader(key)
+	}
+
+	return r, stat, err
+}
@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// The first access to a missing file imports it from the origin, the next ones are served locally.
+// Concurrent misses share a single fetch.
+func TestOrigin(t *testing.T) {
+	files := map[string][]byte{
+		"a":       testData(3*BlockSize + 10),
+		"chunked": testData(BlockSize + 1),
+		"b":       testData(100),
+	}
+
+	var fetches int32
+	release := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+
+		key := strings.TrimPrefix(r.URL.Path, "/files/")
+		data, ok := files[key]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if key == "b" {
+			<-release
+		}
+
+		w.Header().Set("Content-Type", "application/x-test")
+		if key == "chunked" {
+			w.(http.Flusher).Flush() // no Content-Length
+		}
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	s := openTestBadger(t)
+	sdb := WithOrigin(s, func(key string) string { return server.URL + "/files/" + key })
+
+	for _, key := range []string{"a", "chunked"} {
+		atomic.StoreInt32(&fetches, 0)
+
+		stat, err := sdb.Stat(key)
+		if err != nil {
+			t.Fatalf("%v: %v", key, err)
+		}
+		if stat.Next != FileComplete || stat.Length != int64(len(files[key])) || stat.ContentType != "application/x-test" {
+			t.Errorf("%v: imported file %+v", key, stat)
+		}
+		if !bytes.Equal(readTestFile(t, sdb, key), files[key]) {
+			t.Errorf("%v: imported content differs", key)
+		}
+		if !bytes.Equal(readTestFile(t, s, key), files[key]) {
+			t.Errorf("%v: stored content differs", key)
+		}
+		if n := atomic.LoadInt32(&fetches); n != 1 {
+			t.Errorf("%v: %v fetches from the origin, expected 1", key, n)
+		}
+	}
+
+	if _, err := sdb.Stat("missing"); err != ErrNotFound {
+		t.Errorf("missing from the origin: %v, expected ErrNotFound", err)
+	}
+	if exists, err := sdb.Exists("missing"); exists || err != nil {
+		t.Errorf("Exists(missing): %v %v", exists, err)
+	}
+
+	atomic.StoreInt32(&fetches, 0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			buf := make([]byte, 100)
+			if n, err := sdb.ReadAt("b", buf, 0); n != 100 || (err != nil && err != io.EOF) {
+				t.Errorf("concurrent read: %v %v", n, err)
+			}
+		}()
+	}
+
+	for atomic.LoadInt32(&fetches) == 0 {
+		runtime.Gosched()
+	}
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("%v fetches for concurrent misses, expected 1", n)
+	}
+}
@@ -0,0 +1,41 @@
+package storage
+
+import (
+	"testing"
+)
+
+// StatPhysical reports a block record for each block written
+func TestStatPhysical(t *testing.T) {
+	s := openTestBadger(t, WithBlockSize(MinBlockSize))
+
+	data := testData(3*MinBlockSize + 500)
+	if err := s.CreateFile("f", "f", "", int64(len(data)), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := WriteAll(s, "f", 0, data[:2*MinBlockSize]); err != nil {
+		t.Fatal(err)
+	}
+
+	stat, err := s.StatPhysical("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Medium != "badger" || stat.Blocks != 2 || stat.CurPos != 2*MinBlockSize {
+		t.Errorf("partial file: %+v", stat)
+	}
+
+	if _, err := WriteAll(s, "f", 2*MinBlockSize, data[2*MinBlockSize:]); err != nil {
+		t.Fatal(err)
+	}
+
+	if stat, _ = s.StatPhysical("f"); stat.Blocks != 4 || stat.CurPos != FileComplete {
+		t.Errorf("%v block records (pos %v), expected 4", stat.Blocks, stat.CurPos)
+	}
+	if stat.Bytes < int64(len(data)) || stat.InfoBytes == 0 {
+		t.Errorf("%v bytes in blocks, %v in info, expected at least %v", stat.Bytes, stat.InfoBytes, len(data))
+	}
+
+	if _, err := s.StatPhysical("missing"); err != ErrNotFound {
+		t.Errorf("missing file: %v, expected ErrNotFound", err)
+	}
+}
@@ -0,0 +1,197 @@
+package storage
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Return the namespace of key: the part before the first "/" (or URL-escaped "%2F"), or "" if none
+func Namespace(key string) string {
+	i := -1
+	for _, sep := range []string{"/", "%2F", "%2f"} {
+		if j := strings.Index(key, sep); j >= 0 && (i < 0 || j < i) {
+			i = j
+		}
+	}
+
+	if i < 0 {
+		return ""
+	}
+
+	return key[:i]
+}
+
+type quotaFile struct {
+	size    int64
+	expires time.Time
+}
+
+// A storage service limiting the total size of the files in each namespace.
+// Usage is computed from the stored files on start, and updated on CreateFile
+// and DeleteFile (expired files are released when the quota is checked).
+type quota struct {
+	StorageDB
+
+	limits map[string]int64 // namespace -> max bytes
+	def    int64            // max bytes for other namespaces (0 for no limit)
+
+	mu    sync.Mutex
+	files map[string]map[string]quotaFile // namespace -> key -> file
+}
+
+// Return a storage service enforcing the namespace limits (in bytes), and def for all other namespaces.
+// CreateFile returns ErrQuotaExceeded if the new file doesn't fit.
+func Quota(sdb StorageDB, limits map[string]int64, def int64) (StorageDB, error) {
+	q := &quota{StorageDB: sdb, limits: limits, def: def, files: map[string]map[string]quotaFile{}}
+
+	files, err := sdb.ListFiles("")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		q.add(f.Key, f.Length, f.ExpiresAt)
+	}
+
+	return q, nil
+}
+
+func (q *quota) limit(ns string) int64 {
+	if limit, ok := q.limits[ns]; ok {
+		return limit
+	}
+
+	return q.def
+}
+
+func (q *quota) add(key string, size int64, expires time.Time) {
+	ns := Namespace(key)
+	if q.files[ns] == nil {
+		q.files[ns] = map[string]quotaFile{}
+	}
+
+	q.files[ns][key] = quotaFile{size: size, expires: expires}
+}
+
+// Return the bytes used by the files in namespace ns, releasing expired files
+func (q *quota) usage(ns string, now time.Time) (used int64) {
+	for key, f := range q.files[ns] {
+		if !f.expires.IsZero() && now.After(f.expires) {
+			delete(q.files[ns], key)
+			continue
+		}
+
+		used += f.size
+	}
+
+	return
+}
+
+// Reserve size bytes for key, if within the namespace limit
+func (q *quota) reserve(key string, size int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	ns := Namespace(key)
+	used := q.usage(ns, time.Now())
+
+	if _, exists := q.files[ns][key]; exists {
+		return nil // CreateFile will fail with ErrExists
+	}
+
+	if limit := q.limit(ns); limit > 0 && used+size > limit {
+		return ErrQuotaExceeded
+	}
+
+	q.add(key, size, time.Time{})
+	return nil
+}
+
+// Update the reservation for key after CreateFile: release it if the file
+// wasn't created, or set the expiration time
+func (q *quota) created(key string, err error) error {
+	if err == ErrExists {
+		return err
+	}
+
+	var stat *FileInfo
+	if err == nil {
+		stat, _ = q.StorageDB.Stat(key)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err != nil {
+		delete(q.files[Namespace(key)], key)
+	} else if stat != nil {
+		q.add(key, stat.Length, stat.ExpiresAt)
+	}
+
+	return err
+}
+
+func (q *quota) release(key string) {
+	q.mu.Lock()
+	delete(q.files[Namespace(key)], key)
+	q.mu.Unlock()
+}
+
+func (q *quota) CreateFile(key, filename, ctype string, size int64, hash []byte, opts ...FileOption) error {
+	if err := q.reserve(key, size); err != nil {
+		return err
+	}
+
+	return q.created(key, q.StorageDB.CreateFile(key, filename, ctype, size, hash, opts...))
+}
+
+func (q *quota) CreateFileWithTimes(key, filename, ctype string, size int64, hash []byte, created, expires time.Time, opts ...FileOption) error {
+	if err := q.reserve(key, size); err != nil {
+		return err
+	}
+
+	return q.created(key, q.StorageDB.CreateFileWithTimes(key, filename, ctype, size, hash, created, expires, opts...))
+}
+
+// The copy counts as a new file of the source size
+func (q *quota) Copy(src, dst string) error {
+	stat, err := q.StorageDB.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	if err := q.reserve(dst, stat.Length); err != nil {
+		return err
+	}
+
+	return q.created(dst, q.StorageDB.Copy(src, dst))
+}
+
+// The file moves to the namespace of dst, if within its limit
+func (q *quota) Rename(src, dst string) error {
+	stat, err := q.StorageDB.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	if err := q.reserve(dst, stat.Length); err != nil {
+		return err
+	}
+
+	err = q.created(dst, q.StorageDB.Rename(src, dst))
+	if err == nil {
+		q.release(src)
+	}
+
+	return err
+}
+
+func (q *quota) DeleteFile(key string) error {
+	err := q.StorageDB.DeleteFile(key)
+	if err == nil || err == ErrNotFound {
+		q.release(key)
+	}
+
+	return err
+}
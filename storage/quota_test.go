@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"testing"
+)
+
+func TestQuota(t *testing.T) {
+	s := openTestBadger(t)
+	putTestFile(t, s, "a/old", testData(300), 300)
+
+	sdb, err := Quota(s, map[string]int64{"a": 1000}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		key  string
+		size int64
+		err  error
+	}{
+		{"a/1", 400, nil},
+		{"a/2", 300, nil}, // up to the limit, with the existing file
+		{"a/3", 1, ErrQuotaExceeded},
+		{"a%2F3", 1, ErrQuotaExceeded},
+		{"b/1", 5000, nil}, // no limit
+		{"c", 5000, nil},
+	} {
+		if err := sdb.CreateFile(tc.key, tc.key, "", tc.size, nil); err != tc.err {
+			t.Errorf("create %v (%v bytes): %v, expected %v", tc.key, tc.size, err, tc.err)
+		}
+	}
+	if _, err := s.Stat("a/3"); err != ErrNotFound {
+		t.Errorf("rejected file: %v", err)
+	}
+
+	if err := sdb.DeleteFile("a/1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sdb.CreateFile("a/3", "a/3", "", 400, nil); err != nil {
+		t.Errorf("create after delete: %v", err)
+	}
+
+	// the usage is recomputed from the stored files
+	sdb, err = Quota(s, map[string]int64{"a": 1000}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sdb.CreateFile("a/4", "a/4", "", 1, nil); err != ErrQuotaExceeded {
+		t.Errorf("create after restart: %v, expected ErrQuotaExceeded", err)
+	}
+}
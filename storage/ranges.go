@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"hash"
+	"sort"
+
+	"github.com/raff/cashier/merkle"
+)
+
+// A file created WithRanges accepts writes at any block position, not only at the current position:
+// the hash is the merkle hash, that hashes the blocks in any order, and the file info records
+// the ranges written past the current position. CurPos is the end of the data written from
+// the start (the first gap), and the file is complete when there are no gaps left.
+
+// A range of bytes written to a file, from Start to End (excluded)
+type Range struct {
+	Start int64 `json:"s"`
+	End   int64 `json:"e"`
+}
+
+// Accept writes of whole blocks at any position (the last block of the file may be partial),
+// until the whole file is written. The file is hashed with HashMerkle, and is never inlined.
+// Badger retries concurrent writes to different ranges, while on AWS the metadata update
+// is not conditional, so the ranges of a file should be written one at a time.
+func WithRanges() FileOption {
+	return func(i *info) {
+		i.Ranged, i.HashAlg, i.Inlined = true, HashMerkle, false
+	}
+}
+
+// Check that n bytes can be written at pos: at the current position, or at any position
+// of a file written WithRanges, without overlapping the data written so far
+func (i *info) checkWrite(pos, n int64) error {
+	if pos != i.CurPos && (!i.Ranged || pos < i.CurPos) {
+		return ErrInvalidPos
+	}
+
+	for _, r := range i.Ranges {
+		if pos < r.End && r.Start < pos+n {
+			return ErrInvalidPos
+		}
+	}
+
+	return nil
+}
+
+// Record that n bytes were written at pos, and return the new current position
+func (i *info) addRange(pos, n int64) int64 {
+	ranges := append(i.Ranges, Range{Start: pos, End: pos + n})
+	sort.Slice(ranges, func(a, b int) bool { return ranges[a].Start < ranges[b].Start })
+
+	i.Ranges = nil
+	for _, r := range ranges {
+		switch last := len(i.Ranges) - 1; {
+		case r.Start == i.CurPos: // no gap left before r
+			i.CurPos = r.End
+		case last >= 0 && r.Start == i.Ranges[last].End:
+			i.Ranges[last].End = r.End
+		default:
+			i.Ranges = append(i.Ranges, r)
+		}
+	}
+
+	return i.CurPos
+}
+
+// Return true if block n was written (for an incomplete file written WithRanges, it may be in a gap)
+func (i *info) hasBlock(n int64) bool {
+	if i.CurPos == FileComplete || len(i.Ranges) == 0 {
+		return true
+	}
+
+	start := n * i.blockSize()
+	if start < i.CurPos {
+		return true
+	}
+
+	for _, r := range i.Ranges {
+		if r.Start <= start && start < r.End {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Hash block n of the file: merkle hashes are updated in place, so the blocks can be written in any order
+func hashBlock(h hash.Hash, n int64, p []byte) {
+	if bh, ok := h.(merkle.BlockHash); ok {
+		bh.WriteBlock(int(n), p)
+		return
+	}
+
+	h.Write(p)
+}
+
+// Return the ranges of the file written so far: from Base to Next, then the Ranges past Next
+func (f *FileInfo) Written() []Range {
+	if f.Next == FileComplete {
+		return []Range{{Start: f.Base, End: f.Length}}
+	}
+
+	ranges := []Range{}
+	if f.Next > f.Base {
+		ranges = append(ranges, Range{Start: f.Base, End: f.Next})
+	}
+
+	return append(ranges, f.Ranges...)
+}
@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// A file created WithRanges is written in any order, and completes when there are no gaps left
+func TestWriteRanges(t *testing.T) {
+	s := openTestBadger(t, WithInlineSize(BlockSize))
+
+	data := testData(4*BlockSize + 10)
+	hash, _, _ := GetHashAlg(bytes.NewReader(data), HashMerkle)
+	half := int64(2 * BlockSize)
+
+	if err := s.CreateFile("f", "f", "", int64(len(data)), hash, WithRanges()); err != nil {
+		t.Fatal(err)
+	}
+
+	if pos, err := s.WriteAt("f", half, data[half:]); err != nil || pos != int64(len(data)) {
+		t.Fatalf("write second half: %v %v", pos, err)
+	}
+
+	stat, err := s.Stat("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []Range{{Start: half, End: int64(len(data))}}; stat.Next != 0 || !reflect.DeepEqual(stat.Written(), expected) {
+		t.Errorf("next %v written %v, expected %v", stat.Next, stat.Written(), expected)
+	}
+
+	for _, pos := range []int64{half, BlockSize + half, 10} {
+		if _, err := s.WriteAt("f", pos, data[pos:pos+BlockSize]); err != ErrInvalidPos {
+			t.Errorf("write at %v: %v, expected ErrInvalidPos", pos, err)
+		}
+	}
+
+	if pos, err := s.WriteAt("f", BlockSize, data[BlockSize:half]); err != nil || pos != half {
+		t.Fatalf("write second block: %v %v", pos, err)
+	}
+	if _, err := s.ReadAt("f", make([]byte, BlockSize), 0); err != ErrIncomplete {
+		t.Errorf("read before the gap: %v, expected ErrIncomplete", err)
+	}
+
+	if pos, err := s.WriteAt("f", 0, data[:BlockSize]); err != nil || pos != FileComplete {
+		t.Fatalf("write first block: %v %v", pos, err)
+	}
+	if !bytes.Equal(readTestFile(t, s, "f"), data) {
+		t.Errorf("content differs")
+	}
+	if err := Verify(s, "f"); err != nil {
+		t.Error(err)
+	}
+	if info := getTestInfo(t, s, "f"); info.Ranges != nil || info.Inline != nil {
+		t.Errorf("complete file info %+v", info)
+	}
+
+	// files written in order only accept writes at the current position
+	if err := s.CreateFile("ordered", "ordered", "", int64(len(data)), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.WriteAt("ordered", half, data[half:]); err != ErrInvalidPos {
+		t.Errorf("write out of order: %v, expected ErrInvalidPos", err)
+	}
+}
+
+// The blocks written past a gap are copied and deleted with the file
+func TestRangesCopy(t *testing.T) {
+	s := openTestBadger(t)
+
+	data := testData(4 * BlockSize)
+	if err := s.CreateFile("f", "f", "", int64(len(data)), nil, WithRanges()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.WriteAt("f", 2*BlockSize, data[2*BlockSize:3*BlockSize]); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Copy("f", "copy"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteFile("f"); err != nil {
+		t.Fatal(err)
+	}
+	if keys := testKeys(t, s, prefixKey("f")); len(keys) > 0 {
+		t.Errorf("records %v left after delete", keys)
+	}
+
+	for _, pos := range []int64{0, BlockSize, 3 * BlockSize} {
+		if _, err := s.WriteAt("copy", pos, data[pos:pos+BlockSize]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(readTestFile(t, s, "copy"), data) {
+		t.Errorf("copy content differs")
+	}
+}
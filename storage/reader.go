@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"io"
+)
+
+// A sequential reader of a file, from the first available byte to the end of the data written
+// when it was opened. The info is decoded once, and get fetches one block at a time.
+type blockReader struct {
+	fileInfo *info
+	pos      int64  // offset of the next byte
+	end      int64  // end of the data
+	short    error  // error at end: io.EOF, or ErrIncomplete if the file was incomplete
+	buf      []byte // rest of the current block
+
+	get   func(block int64) ([]byte, error)
+	close func() error
+}
+
+func newBlockReader(fileInfo *info, get func(block int64) ([]byte, error), close func() error) *blockReader {
+	r := &blockReader{fileInfo: fileInfo, pos: fileInfo.Base, end: fileInfo.Length, short: io.EOF, get: get, close: close}
+	if fileInfo.CurPos != FileComplete {
+		r.end, r.short = fileInfo.CurPos, ErrIncomplete
+	}
+
+	return r
+}
+
+func (r *blockReader) Read(p []byte) (int, error) {
+	if len(r.buf) == 0 {
+		if r.pos >= r.end {
+			return 0, r.short
+		}
+
+		if data := r.fileInfo.content(); data != nil { // the content is in the metadata
+			r.buf = data[r.pos:r.end]
+		} else {
+			blockSize := r.fileInfo.blockSize()
+
+			data, err := r.get(r.pos / blockSize)
+			if err != nil {
+				return 0, err
+			}
+
+			offs := r.pos % blockSize
+			if offs >= int64(len(data)) {
+				return 0, io.ErrUnexpectedEOF // short block
+			}
+
+			r.buf = data[offs:]
+			if rest := r.end - r.pos; int64(len(r.buf)) > rest {
+				r.buf = r.buf[:rest]
+			}
+		}
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *blockReader) Close() error {
+	if r.close == nil {
+		return nil
+	}
+
+	close := r.close
+	r.close = nil
+	return close()
+}
@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// ReadAt follows io.ReaderAt: io.EOF at and past the end, and with a read reaching it
+func TestReadAtEOF(t *testing.T) {
+	s := openTestBadger(t, WithInlineSize(100))
+
+	for key, size := range map[string]int{"blocks": 2*BlockSize + 10, "inline": 50, "empty": 0} {
+		putTestFile(t, s, key, testData(size), BlockSize)
+
+		buf := make([]byte, 20)
+		for _, tc := range []struct {
+			pos int64
+			n   int64
+		}{
+			{int64(size), 0},
+			{int64(size) + 1, 0},
+			{int64(size) - 5, 5},
+		} {
+			if tc.pos < 0 {
+				continue
+			}
+
+			if n, err := s.ReadAt(key, buf, tc.pos); n != tc.n || err != io.EOF {
+				t.Errorf("%v: read at %v: %v %v, expected %v io.EOF", key, tc.pos, n, err, tc.n)
+			}
+		}
+
+		if size >= len(buf) {
+			if n, err := s.ReadAt(key, buf, 0); n != int64(len(buf)) || err != nil {
+				t.Errorf("%v: full read: %v %v", key, n, err)
+			}
+		}
+	}
+}
+
+// OpenReader streams the whole file, from the metadata or block by block
+func TestOpenReader(t *testing.T) {
+	s := openTestBadger(t, WithInlineSize(100))
+
+	for key, size := range map[string]int{"blocks": 3*BlockSize + 10, "inline": 50, "empty": 0} {
+		data := testData(size)
+		putTestFile(t, s, key, data, BlockSize)
+
+		r, stat, err := s.OpenReader(key)
+		if err != nil {
+			t.Fatalf("%v: %v", key, err)
+		}
+
+		got, err := ioutil.ReadAll(r)
+		r.Close()
+
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%v: read %v bytes %v, expected %v", key, len(got), err, size)
+		}
+		if stat.Length != int64(size) || stat.Next != FileComplete {
+			t.Errorf("%v: stat %+v", key, stat)
+		}
+	}
+
+	// an incomplete file ends with ErrIncomplete after the data written
+	data := testData(3 * BlockSize)
+	if err := s.CreateFile("partial", "partial", "", int64(len(data)), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := WriteAll(s, "partial", 0, data[:2*BlockSize]); err != nil {
+		t.Fatal(err)
+	}
+
+	r, _, err := s.OpenReader("partial")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != ErrIncomplete || !bytes.Equal(got, data[:2*BlockSize]) {
+		t.Errorf("partial: read %v bytes %v, expected %v ErrIncomplete", len(got), err, 2*BlockSize)
+	}
+
+	if err := s.SoftDelete("blocks"); err != nil {
+		t.Fatal(err)
+	}
+	for key, expected := range map[string]error{"missing": ErrNotFound, "blocks": ErrDeleted} {
+		if _, _, err := s.OpenReader(key); err != expected {
+			t.Errorf("%v: %v, expected %v", key, err, expected)
+		}
+	}
+}
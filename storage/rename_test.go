@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Rename moves all the records of a file to the new key, keeping the resume state of an incomplete upload
+func TestRename(t *testing.T) {
+	s := openTestBadger(t)
+
+	data := testData(3*BlockSize + 10)
+	putTestFile(t, s, "old", data, BlockSize, WithTTL(time.Minute))
+
+	if err := s.Rename("old", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readTestFile(t, s, "new"), data) {
+		t.Errorf("renamed content differs")
+	}
+	if _, err := s.Stat("old"); err != ErrNotFound {
+		t.Errorf("stat old key: %v, expected ErrNotFound", err)
+	}
+	if keys := testKeys(t, s, prefixKey("old")); len(keys) != 0 {
+		t.Errorf("records left under the old key: %v", keys)
+	}
+	if keys := testKeys(t, s, _EXPIRY_PREFIX); len(keys) != 1 || !strings.HasSuffix(keys[0], ":new") {
+		t.Errorf("expiration index %v", keys)
+	}
+
+	for _, test := range []struct {
+		src, dst string
+		err      error
+	}{
+		{"new", "new", ErrExists},
+		{"missing", "other", ErrNotFound},
+	} {
+		if err := s.Rename(test.src, test.dst); err != test.err {
+			t.Errorf("rename %v to %v: %v, expected %v", test.src, test.dst, err, test.err)
+		}
+	}
+
+	putTestFile(t, s, "taken", testData(10), 10)
+	if err := s.Rename("new", "taken"); err != ErrExists {
+		t.Errorf("rename to existing: %v, expected ErrExists", err)
+	}
+	if !bytes.Equal(readTestFile(t, s, "new"), data) {
+		t.Errorf("content changed after a failed rename")
+	}
+
+	// an incomplete upload continues under the new key
+	hash, _, err := GetHash(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateFile("partial", "partial", "", int64(len(data)), hash); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := WriteAll(s, "partial", 0, data[:2*BlockSize]); err != nil {
+		t.Fatal(err)
+	}
+	before := getTestInfo(t, s, "partial")
+
+	if err := s.Rename("partial", "moved"); err != nil {
+		t.Fatal(err)
+	}
+	if after := getTestInfo(t, s, "moved"); after.CurPos != before.CurPos || after.CurHash != before.CurHash {
+		t.Fatalf("resume state %v %q, expected %v %q", after.CurPos, after.CurHash, before.CurPos, before.CurHash)
+	}
+	if _, err := WriteAll(s, "moved", 2*BlockSize, data[2*BlockSize:]); err != nil {
+		t.Fatalf("resume under the new key: %v", err)
+	}
+	if !bytes.Equal(readTestFile(t, s, "moved"), data) {
+		t.Errorf("resumed content differs")
+	}
+}
@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+// A soft deleted file loses its blocks, but Stat still returns it as deleted until it expires
+func TestSoftDelete(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := openTestBadger(t, WithClock(func() time.Time { return now }), WithInlineSize(100))
+
+	data := testData(3*BlockSize + 10)
+	putTestFile(t, s, "f", data, BlockSize)
+	putTestFile(t, s, "small", testData(50), 50)
+
+	for _, key := range []string{"f", "small"} {
+		if err := s.SoftDelete(key); err != nil {
+			t.Fatalf("%v: %v", key, err)
+		}
+
+		stat, err := s.Stat(key)
+		if err != nil {
+			t.Fatalf("%v: Stat after soft delete: %v", key, err)
+		}
+		if !stat.Deleted() || !stat.DeletedAt.Equal(now) || stat.Next != FileComplete {
+			t.Errorf("%v: tombstone %+v", key, stat)
+		}
+
+		phys, err := s.StatPhysical(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if phys.Blocks != 0 || phys.Bytes != 0 {
+			t.Errorf("%v: %v blocks, %v bytes left", key, phys.Blocks, phys.Bytes)
+		}
+	}
+
+	if stat := getTestInfo(t, s, "f"); stat.Length != int64(len(data)) || stat.Hash == "" {
+		t.Errorf("metadata not kept: %+v", stat)
+	}
+
+	// deleting again keeps the original time
+	now = now.Add(time.Minute)
+	if err := s.SoftDelete("f"); err != nil {
+		t.Fatal(err)
+	}
+	if stat, _ := s.Stat("f"); stat == nil || !stat.DeletedAt.Equal(now.Add(-time.Minute)) {
+		t.Errorf("second soft delete: %+v", stat)
+	}
+
+	if err := s.DeleteFile("f"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Stat("f"); err != ErrNotFound {
+		t.Errorf("Stat after delete: %v, expected ErrNotFound", err)
+	}
+	if err := s.SoftDelete("missing"); err != ErrNotFound {
+		t.Errorf("soft delete of a missing file: %v, expected ErrNotFound", err)
+	}
+}
@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"sync"
+	"time"
+)
+
+type cachedStat struct {
+	stat    FileInfo
+	expires time.Time
+}
+
+// A storage service that caches Stat results of complete files for a short time.
+// Any change to a file through this service invalidates its entry; changes made by other
+// instances sharing the backend are seen when the entry expires.
+type statCache struct {
+	StorageDB
+
+	ttl time.Duration
+
+	mu    sync.Mutex
+	stats map[string]cachedStat
+	gen   uint64 // incremented on each invalidation, so that a Stat racing with a write is not cached
+}
+
+// Return a storage service that caches the Stat results of complete files for ttl.
+// Incomplete files are never cached, so an upload in progress always reports its current position.
+func StatCache(sdb StorageDB, ttl time.Duration) StorageDB {
+	return &statCache{StorageDB: sdb, ttl: ttl, stats: map[string]cachedStat{}}
+}
+
+// Return the cached file info for key and the current generation
+func (s *statCache) get(key string, now time.Time) (*FileInfo, uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.stats[key]
+	if !ok {
+		return nil, s.gen
+	}
+	if now.After(c.expires) {
+		delete(s.stats, key)
+		return nil, s.gen
+	}
+
+	stat := c.stat
+	return &stat, s.gen
+}
+
+// Cache stat, if nothing was invalidated since generation gen, dropping stale entries if the cache grew
+func (s *statCache) set(key string, stat *FileInfo, gen uint64, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if gen != s.gen {
+		return
+	}
+
+	if len(s.stats) >= 1024 {
+		for k, c := range s.stats {
+			if now.After(c.expires) {
+				delete(s.stats, k)
+			}
+		}
+	}
+
+	s.stats[key] = cachedStat{stat: *stat, expires: now.Add(s.ttl)}
+}
+
+func (s *statCache) invalidate(key string) {
+	s.mu.Lock()
+	delete(s.stats, key)
+	s.gen++
+	s.mu.Unlock()
+}
+
+// Return file info, from the cache if recent
+func (s *statCache) Stat(key string) (*FileInfo, error) {
+	now := time.Now()
+
+	stat, gen := s.get(key, now)
+	if stat != nil {
+		return stat, nil
+	}
+
+	stat, err := s.StorageDB.Stat(key)
+	if err == nil && stat.Next == FileComplete {
+		s.set(key, stat, gen, now)
+	}
+
+	return stat, err
+}
+
+// Return true if the file exists, from the cache if recent
+func (s *statCache) Exists(key string) (bool, error) {
+	if stat, _ := s.get(key, time.Now()); stat != nil {
+		return true, nil
+	}
+
+	return s.StorageDB.Exists(key)
+}
+
+func (s *statCache) CreateFile(key, filename, ctype string, size int64, hash []byte, opts ...FileOption) error {
+	defer s.invalidate(key)
+	return s.StorageDB.CreateFile(key, filename, ctype, size, hash, opts...)
+}
+
+func (s *statCache) CreateFileWithTimes(key, filename, ctype string, size int64, hash []byte, created, expires time.Time, opts ...FileOption) error {
+	defer s.invalidate(key)
+	return s.StorageDB.CreateFileWithTimes(key, filename, ctype, size, hash, created, expires, opts...)
+}
+
+func (s *statCache) DeleteFile(key string) error {
+	defer s.invalidate(key)
+	return s.StorageDB.DeleteFile(key)
+}
+
+func (s *statCache) SoftDelete(key string) error {
+	defer s.invalidate(key)
+	return s.StorageDB.SoftDelete(key)
+}
+
+func (s *statCache) Touch(key string) error {
+	defer s.invalidate(key)
+	return s.StorageDB.Touch(key)
+}
+
+func (s *statCache) Copy(src, dst string) error {
+	defer s.invalidate(dst)
+	return s.StorageDB.Copy(src, dst)
+}
+
+func (s *statCache) Rename(src, dst string) error {
+	defer s.invalidate(src)
+	defer s.invalidate(dst)
+	return s.StorageDB.Rename(src, dst)
+}
+
+func (s *statCache) WriteAt(key string, pos int64, data []byte) (int64, error) {
+	defer s.invalidate(key)
+	return s.StorageDB.WriteAt(key, pos, data)
+}
+
+func (s *statCache) TrimFront(key string, bytes int64) error {
+	defer s.invalidate(key)
+	return s.StorageDB.TrimFront(key, bytes)
+}
+
+func (s *statCache) IncrFile(key string, delta int64) (int64, error) {
+	defer s.invalidate(key)
+	return s.StorageDB.IncrFile(key, delta)
+}
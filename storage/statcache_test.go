@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+// Stat of a complete file is served from the cache until a change to the file,
+// incomplete files always go to the backend
+func TestStatCache(t *testing.T) {
+	backend := &statCounter{StorageDB: openTestBadger(t)}
+	sdb := StatCache(backend, time.Hour)
+
+	data := testData(2*BlockSize + 10)
+	putTestFile(t, sdb, "f", data, BlockSize)
+
+	stat := func(key string) *FileInfo {
+		t.Helper()
+
+		stat, err := sdb.Stat(key)
+		if err != nil {
+			t.Fatalf("Stat(%v): %v", key, err)
+		}
+
+		return stat
+	}
+
+	backend.stats = 0
+	for i := 0; i < 3; i++ {
+		if st := stat("f"); st.Next != FileComplete || st.Length != int64(len(data)) {
+			t.Fatalf("lookup %v: %+v", i, st)
+		}
+	}
+	if backend.stats != 1 {
+		t.Errorf("%v backend lookups, expected 1", backend.stats)
+	}
+
+	// the cached info is a copy
+	stat("f").Name = "changed"
+	if st := stat("f"); st.Name != "f" {
+		t.Errorf("cached info changed by the caller: %v", st.Name)
+	}
+
+	// a change invalidates the entry
+	if err := sdb.Touch("f"); err != nil {
+		t.Fatal(err)
+	}
+	stat("f")
+	if backend.stats != 2 {
+		t.Errorf("%v backend lookups after touch, expected 2", backend.stats)
+	}
+
+	if err := sdb.CreateFile("g", "g", "", int64(len(data)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	backend.stats = 0
+	for pos := 0; pos < len(data); pos += BlockSize {
+		end := pos + BlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		if st := stat("g"); st.Next != int64(pos) {
+			t.Fatalf("upload position %v, expected %v", st.Next, pos)
+		}
+		if _, err := sdb.WriteAt("g", int64(pos), data[pos:end]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if backend.stats != 3 {
+		t.Errorf("%v backend lookups for the incomplete file, expected 3", backend.stats)
+	}
+	if st := stat("g"); st.Next != FileComplete {
+		t.Errorf("after the last write: %+v", st)
+	}
+
+	if err := sdb.DeleteFile("f"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sdb.Stat("f"); err != ErrNotFound {
+		t.Errorf("Stat after delete: %v, expected ErrNotFound", err)
+	}
+	if exists, _ := sdb.Exists("f"); exists {
+		t.Errorf("deleted file exists")
+	}
+
+	// entries expire after the TTL
+	sdb = StatCache(backend, 10*time.Millisecond)
+	backend.stats = 0
+	stat("g")
+	stat("g")
+	time.Sleep(20 * time.Millisecond)
+	stat("g")
+	if backend.stats != 2 {
+		t.Errorf("%v backend lookups with an expired entry, expected 2", backend.stats)
+	}
+}
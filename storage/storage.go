@@ -1,30 +1,53 @@
 /*
-This package stores files in BadgerDB, allowing for incremental writes of multiple of BlockSize.
+This package stores files in BadgerDB, allowing for incremental writes of multiple of the block size.
 For each file it stores a "metadata" record and a series of "block" records.
 Files and data expire after a predefined TTL.
 */
 package storage
 
 import (
+	"crypto/sha256"
 	"encoding"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"expvar"
 	"fmt"
 	"hash"
 	"io"
 	"log"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/raff/cashier/cumulative"
+	"github.com/raff/cashier/merkle"
 )
 
 const (
-	BlockSize          = 16 * 1024
+	BlockSize          = 16 * 1024 // default block size, see WithBlockSize
+	MinBlockSize       = 1024      // smallest block size for WithBlockSize
+	MaxBlockSize       = 64 << 20  // largest block size for WithBlockSize (well within a single S3 PUT)
 	FileComplete int64 = -1
 	InvalidPos   int64 = -2
 
+	HashCumulative = "cumulative" // cumulative MD5 (default)
+	HashMerkle     = "merkle"     // MD5 of the ordered list of block MD5s
+	HashSHA256     = "sha256"     // SHA-256 of the content, shown as "sha256:<hex>"
+
+	ReadStrong   = "strong"   // reads see all previous writes (default)
+	ReadEventual = "eventual" // reads may miss recent writes, at half the cost (AWS)
+
 	_PREFIX = "%v:"
 	_INFO   = "%v:i"
 	_BLOCK  = "%v:%d"
+
+	_INFO_SUFFIX = ":i"
+
+	_EXPIRY_PREFIX = "\x00exp:"
+	_EXPIRY        = "\x00exp:%020d:%v" // expiration (unix nano), key
+
+	_HASH_KEY = "\x00cfg:hash" // default hash algorithm of the store, recorded on first Open
 )
 
 var (
@@ -34,16 +57,282 @@ var (
 	ErrInvalidPos  = fmt.Errorf("Invalid Position")
 	ErrInvalidHash = fmt.Errorf("Invalid Hash")
 	ErrIncomplete  = fmt.Errorf("File incomplete")
+	ErrTrimmed     = fmt.Errorf("File trimmed")
+	ErrExpired     = fmt.Errorf("File expired")
+	ErrInfoTooBig  = fmt.Errorf("Metadata too large")
+	ErrUnavailable = fmt.Errorf("Storage unavailable")
+	ErrImmutable   = fmt.Errorf("File is immutable")
+	ErrDeleted     = fmt.Errorf("File deleted")
+
+	ErrQuotaExceeded = fmt.Errorf("Quota exceeded")
+	ErrNoSpace       = fmt.Errorf("Not enough free space")
 )
 
+// Storage service options
+type options struct {
+	maxInfoSize int    // max size of the serialized metadata record (0 for no limit)
+	hash        string // hash algorithm for new files
+
+	eventualStat bool   // Stat can use cheaper, eventually consistent reads (AWS)
+	consistency  string // consistency of metadata reads for ReadAt, Stat and ListFiles (AWS)
+
+	ttlFromCreation bool  // the TTL is not refreshed by writes
+	minFreeSpace    int64 // free space to keep on the data volume (badger)
+	inlineSize      int64 // max length of files stored in the metadata record
+	maxWriteSize    int64 // max bytes written by a WriteAt call
+	blockSize       int64 // block size of new files (0 for BlockSize)
+	blockSizeSet    bool  // the block size was set with WithBlockSize (so 0 is invalid)
+
+	clock func() time.Time // time source (default time.Now)
+}
+
+// An option for the Open functions
+type Option func(o *options)
+
+// Limit the size of the serialized metadata record
+func WithMaxInfoSize(size int) Option {
+	return func(o *options) {
+		o.maxInfoSize = size
+	}
+}
+
+// Select the hash algorithm for new files (HashCumulative, HashMerkle or HashSHA256)
+func WithHash(name string) Option {
+	return func(o *options) {
+		o.hash = name
+	}
+}
+
+// Allow Stat to use eventually consistent metadata reads, where the backend supports them.
+// Writes still read the metadata consistently, so a stale Stat can only cause a resume to be rejected.
+func WithEventualStat(eventual bool) Option {
+	return func(o *options) {
+		o.eventualStat = eventual
+	}
+}
+
+// Anchor the expiration time of new files to their creation, instead of refreshing it on each write,
+// so that incomplete uploads expire on a fixed schedule (the creation time is not updated either)
+func WithTTLFromCreation(fromCreation bool) Option {
+	return func(o *options) {
+		o.ttlFromCreation = fromCreation
+	}
+}
+
+// Reject new files that would leave less than margin bytes free on the data volume, where the backend
+// uses local storage. The file length is checked when the file is created.
+func WithMinFreeSpace(margin int64) Option {
+	return func(o *options) {
+		o.minFreeSpace = margin
+	}
+}
+
+// Store the content of files up to size bytes (at most the block size) in the metadata record,
+// instead of separate block records. Reading or deleting a small file then takes a single operation.
+// The metadata record with the content must fit WithMaxInfoSize.
+// Files are stored as decided when created, so changing the size doesn't affect existing files.
+func WithInlineSize(size int64) Option {
+	return func(o *options) {
+		o.inlineSize = size
+	}
+}
+
+// Return true if a new file of the specified size is stored in the metadata record
+// (a negative size is not a known length)
+func (o *options) inlined(size int64) bool {
+	return 0 <= size && size <= o.inlineSize
+}
+
+// Limit the data written by a single WriteAt call to size bytes (a multiple of the block size),
+// bounding the size of a transaction (badger) or the number of requests (aws).
+// WriteAt returns the next write position, and the caller sends the rest of the data (see WriteAll).
+func WithMaxWriteSize(size int64) Option {
+	return func(o *options) {
+		o.maxWriteSize = size
+	}
+}
+
+// Split new files in blocks of size bytes (a power of two, from MinBlockSize to MaxBlockSize) instead of BlockSize.
+// Larger blocks mean fewer records (or objects) per file; each file keeps the block size it was created with.
+// Writes must be a multiple of the block size of the file (see FileInfo.BlockSize), except the last one.
+// With the cumulative hash, blocks smaller than BlockSize keep the partial hash chunk in the metadata
+// of incomplete files (up to 32K, as hex), so they need a metadata limit (see WithMaxInfoSize) above that.
+func WithBlockSize(size int64) Option {
+	return func(o *options) {
+		o.blockSize, o.blockSizeSet = size, true
+	}
+}
+
+// Return the block size of new files
+func (o *options) fileBlockSize() int64 {
+	if o.blockSize == 0 {
+		return BlockSize
+	}
+
+	return o.blockSize
+}
+
+// Use clock instead of time.Now for creation and expiration times
+// (Badger still expires records using its own clock, except the blocks of files with a block TTL)
+func WithClock(clock func() time.Time) Option {
+	return func(o *options) {
+		o.clock = clock
+	}
+}
+
+// Return the current time, according to the configured clock
+func (o *options) now() time.Time {
+	if o.clock != nil {
+		return o.clock()
+	}
+
+	return time.Now()
+}
+
+// Select the consistency of metadata reads (ReadStrong or ReadEventual) for ReadAt, Stat and ListFiles.
+// Eventual reads cost half as much, but may return the state before a recent write:
+// a file just completed may still look incomplete, or a new file missing.
+// Writes and deletes always read the metadata consistently.
+func WithReadConsistency(consistency string) Option {
+	return func(o *options) {
+		o.consistency = consistency
+	}
+}
+
+// Return true if reads should be consistent
+func (o *options) strongReads() bool {
+	return o.consistency != ReadEventual
+}
+
+func getOptions(opts []Option) options {
+	var o options
+
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return o
+}
+
+// Return the hash algorithm for new files
+func (o *options) hashAlg() string {
+	if o.hash == "" {
+		return HashCumulative
+	}
+
+	return o.hash
+}
+
+// Warn if the store was created with a different default hash algorithm (stored) than the configured one.
+// Each file keeps its own algorithm, so uploads are still resumed and verified correctly,
+// but new files get a different kind of hash than the existing ones.
+func (o *options) checkStoreHash(stored string) {
+	if stored != o.hashAlg() {
+		log.Printf("storage: the store was created with hash algorithm %q, new files will use %q", stored, o.hashAlg())
+	}
+}
+
+// Validate the options
+func (o *options) check() error {
+	switch o.hash {
+	case "", HashCumulative, HashMerkle, HashSHA256:
+	default:
+		return fmt.Errorf("Invalid hash algorithm %q", o.hash)
+	}
+
+	switch o.consistency {
+	case "", ReadStrong, ReadEventual:
+	default:
+		return fmt.Errorf("Invalid read consistency %q", o.consistency)
+	}
+
+	if o.blockSizeSet {
+		if o.blockSize <= 0 || o.blockSize&(o.blockSize-1) != 0 {
+			return fmt.Errorf("Invalid block size %v (must be a power of two)", o.blockSize)
+		}
+		if o.blockSize < MinBlockSize || o.blockSize > MaxBlockSize {
+			return fmt.Errorf("Invalid block size %v (must be between %v and %v)", o.blockSize, MinBlockSize, MaxBlockSize)
+		}
+	}
+
+	blockSize := o.fileBlockSize()
+
+	if o.inlineSize > blockSize {
+		return fmt.Errorf("Invalid inline size %v (max %v)", o.inlineSize, blockSize)
+	}
+
+	if o.maxWriteSize < 0 || o.maxWriteSize%blockSize != 0 {
+		return fmt.Errorf("Invalid max write size %v (must be a multiple of %v)", o.maxWriteSize, blockSize)
+	}
+
+	return nil
+}
+
+// Return the part of data that a WriteAt call can write to a file with the specified block size:
+// the limit is rounded down to a multiple of the block size, and is at least one block
+func (o *options) writeLimit(data []byte, blockSize int64) []byte {
+	if o.maxWriteSize == 0 {
+		return data
+	}
+
+	limit := o.maxWriteSize / blockSize * blockSize
+	if limit == 0 {
+		limit = blockSize
+	}
+
+	if int64(len(data)) > limit {
+		return data[:limit]
+	}
+
+	return data
+}
+
+// Check the serialized metadata record against the configured limit
+func (o *options) checkInfoSize(data []byte) error {
+	if o.maxInfoSize > 0 && len(data) > o.maxInfoSize {
+		return ErrInfoTooBig
+	}
+
+	return nil
+}
+
+// Error returned when reading a block that should be there, but is missing
+// (expired before the file metadata, or corrupted)
+type ErrMissingBlock struct {
+	Block int64
+}
+
+func (e ErrMissingBlock) Error() string {
+	return fmt.Sprintf("Missing block %v", e.Block)
+}
+
 // The interface to storage services
 type StorageDB interface {
-	CreateFile(key, filename, ctype string, size int64, hash []byte) error
+	CreateFile(key, filename, ctype string, size int64, hash []byte, opts ...FileOption) error
+	CreateFileWithTimes(key, filename, ctype string, size int64, hash []byte, created, expires time.Time, opts ...FileOption) error
 	DeleteFile(key string) error
+	SoftDelete(key string) error
+	Touch(key string) error
+	// Copy the file src to the new file dst, with a TTL from now: ErrExists if dst exists.
+	// An incomplete file is copied up to the data written so far, and can be resumed as dst
+	Copy(src, dst string) error
+	// Move the file src to the new key dst (ErrExists if dst exists), keeping its info:
+	// an incomplete upload can be resumed as dst
+	Rename(src, dst string) error
 	Close() error
 	WriteAt(key string, pos int64, data []byte) (int64, error)
+	// Reads of an incomplete file return the data written so far, and ErrIncomplete past it
 	ReadAt(key string, buf []byte, pos int64) (int64, error)
+	// Return a sequential reader of the file from its first available byte, and the file info.
+	// The reader must be closed
+	OpenReader(key string) (io.ReadCloser, *FileInfo, error)
 	Stat(key string) (*FileInfo, error)
+	Exists(key string) (bool, error)
+	ListFiles(prefix string, opts ...ListOption) ([]*FileInfo, error)
+	TrimFront(key string, bytes int64) error
+	StatPhysical(key string) (*PhysicalInfo, error)
+	DebugInfo(key string) (map[string]interface{}, error)
+	IncrFile(key string, delta int64) (int64, error)
 
 	GC() error
 	Scan(start string) error
@@ -51,14 +340,177 @@ type StorageDB interface {
 
 // file metadata
 type info struct {
-	Name        string    `json:"n"`  // original file name
-	ContentType string    `json:"c"`  //
-	Hash        string    `json:"h"`  // original file hash
-	Length      int64     `json:"l"`  // original file size
-	Created     time.Time `json:"t"`  // creation time (time of completion)
-	CurPos      int64     `json:"p"`  // current offset in file
-	CurHash     string    `json:"x"`  // current hash
-	ExpiresAt   time.Time `json:omit` // this is stored separately
+	Name        string        `json:"n"`           // original file name
+	ContentType string        `json:"c"`           //
+	Hash        string        `json:"h"`           // original file hash
+	Length      int64         `json:"l"`           // original file size
+	Created     time.Time     `json:"t"`           // creation time (time of last write, until complete)
+	CurPos      int64         `json:"p"`           // current offset in file
+	CurHash     string        `json:"x"`           // current hash state (merkle: the block hashes, kept once complete)
+	Base        int64         `json:"b,omitempty"` // offset of first available byte (after TrimFront)
+	Preserve    bool          `json:"k,omitempty"` // keep creation and expiration time (imported files)
+	HashAlg     string        `json:"a,omitempty"` // hash algorithm (default cumulative)
+	Expiry      int64         `json:"e,omitempty"` // expiration index timestamp (badger)
+	Immutable   bool          `json:"w,omitempty"` // write once: can't be deleted or trimmed until expired
+	TTL         time.Duration `json:"d,omitempty"` // time to live, if different from the storage default
+	Reserve     time.Duration `json:"v,omitempty"` // time to live until the first write (reservation)
+	BlockTTL    time.Duration `json:"y,omitempty"` // time to live of the blocks, if shorter than the file (badger)
+	Counter     bool          `json:"z,omitempty"` // counter file, with the value stored in the metadata (aws)
+	BlockSize   int64         `json:"s,omitempty"` // block size, if not BlockSize
+	Inline      []byte        `json:"i,omitempty"` // content of a small file, stored in the metadata
+	Inlined     bool          `json:"q,omitempty"` // the content is stored in Inline (decided at creation)
+	DeletedAt   int64         `json:"r,omitempty"` // soft delete time (unix nano): the blocks are gone
+	Migrated    bool          `json:"o,omitempty"` // preserve the times only until complete (see Migrate)
+	Ranged      bool          `json:"u,omitempty"` // blocks can be written in any order (see WithRanges)
+	Ranges      []Range       `json:"g,omitempty"` // ranges written past CurPos (see WithRanges)
+	ExpiresAt   time.Time     `json:"-"`           // this is stored separately
+
+	data []byte // content of a counter file (aws)
+}
+
+// An option for CreateFile
+type FileOption func(i *info)
+
+// Once complete, the file can't be deleted or trimmed until it expires
+func WithImmutable() FileOption {
+	return func(i *info) {
+		i.Immutable = true
+	}
+}
+
+// Keep the file for ttl after the last write, instead of the storage default
+func WithTTL(ttl time.Duration) FileOption {
+	return func(i *info) {
+		i.TTL = ttl
+	}
+}
+
+// Create a reservation: the file expires after ttl unless the upload starts before,
+// then the file TTL applies from the first write
+func WithReservation(ttl time.Duration) FileOption {
+	return func(i *info) {
+		i.Reserve = ttl
+	}
+}
+
+// Keep each block for ttl after it's written, while the metadata follows the file TTL:
+// old blocks expire first, like a TrimFront, and reads before the oldest block return ErrTrimmed (badger)
+func WithBlockTTL(ttl time.Duration) FileOption {
+	return func(i *info) {
+		i.BlockTTL = ttl
+	}
+}
+
+// Hash the file with algorithm alg instead of the storage default (e.g. to import a file with its hash)
+func WithHashAlg(alg string) FileOption {
+	return func(i *info) {
+		i.HashAlg = alg
+	}
+}
+
+// For CreateFileWithTimes: keep the creation and expiration time only until the file is complete,
+// then the file TTL applies to updates as for CreateFile
+func withMigrated() FileOption {
+	return func(i *info) {
+		i.Migrated = true
+	}
+}
+
+// A migrated file keeps its times while it's copied, then only if they were preserved in the source
+func (i *info) completeMigrated() {
+	if i.Migrated && i.CurPos == FileComplete {
+		i.Preserve, i.Migrated = false, false
+	}
+}
+
+// Apply the file options to a new file info
+func newInfo(i *info, opts []FileOption) *info {
+	for _, opt := range opts {
+		opt(i)
+	}
+
+	return i
+}
+
+// Size of a counter file (a big-endian int64), see IncrFile
+const counterSize = 8
+
+// Update the info of a counter file for the new value, and return the file content
+func (i *info) setCounter(value int64) []byte {
+	data := make([]byte, counterSize)
+	binary.BigEndian.PutUint64(data, uint64(value))
+
+	h := getHasher(i.HashAlg)
+	h.Write(data)
+
+	i.Hash = toHex(h.Sum(nil))
+	i.Length = counterSize
+	i.CurPos = FileComplete
+	i.CurHash = completeHashState(i.HashAlg, h)
+	return data
+}
+
+// Return the value of a counter file (aws)
+func (i *info) counter() int64 {
+	return int64(binary.BigEndian.Uint64(i.data))
+}
+
+// Return the block size the file is written with
+func (i *info) blockSize() int64 {
+	if i.BlockSize == 0 {
+		return BlockSize
+	}
+
+	return i.BlockSize
+}
+
+// Return the content stored in the metadata record (inline and aws counter files), or nil
+func (i *info) content() []byte {
+	if i.Inline != nil {
+		return i.Inline
+	}
+
+	return i.data
+}
+
+// Return true if the file can't be modified or deleted at the specified time
+func (i *info) locked(now time.Time) bool {
+	return i.Immutable && i.CurPos == FileComplete &&
+		!(i.ExpiresAt.Unix() > 0 && now.After(i.ExpiresAt))
+}
+
+// Return the info for a copy of the file, created at the specified time:
+// the copy doesn't keep the original creation and expiration time,
+// and a counter is copied as a regular file with its current value
+func (i *info) copyInfo(created time.Time) *info {
+	c := *i
+	c.Created, c.Preserve, c.Expiry, c.ExpiresAt = created, false, 0, time.Time{}
+
+	if c.Counter {
+		c.Inline, c.Counter, c.data = i.data, false, nil
+	}
+
+	return &c
+}
+
+// Mark an empty file as complete, since there is nothing to write.
+// Returns ErrInvalidHash if the expected hash is not the hash of empty content.
+func (i *info) completeEmpty() error {
+	if i.Length != 0 || i.Counter {
+		return nil
+	}
+
+	h := getHasher(i.HashAlg)
+	if hash := toHex(h.Sum(nil)); i.Hash == "" {
+		i.Hash = hash
+	} else if i.Hash != hash {
+		return ErrInvalidHash
+	}
+
+	i.CurPos = FileComplete
+	i.CurHash = completeHashState(i.HashAlg, h)
+	i.completeMigrated()
+	return nil
 }
 
 func (i *info) Marshal() ([]byte, error) {
@@ -80,13 +532,128 @@ func (i *info) UnmarshalString(data string) error {
 
 // User file info, returned by Stat
 type FileInfo struct {
+	Key         string
 	Name        string
 	ContentType string
 	Hash        string
+	HashAlg     string
 	Length      int64
 	Next        int64
+	Base        int64
+	BlockSize   int64 // writes must be a multiple of the block size, except the last one
 	Created     time.Time
 	ExpiresAt   time.Time
+	Immutable   bool
+	Reserved    bool          // reserved, the upload didn't start yet
+	DeletedAt   time.Time     // soft delete time (zero if not deleted)
+	Preserve    bool          // the creation and expiration time are kept (imported files)
+	TTL         time.Duration // time to live, if different from the storage default
+	BlockTTL    time.Duration // time to live of the blocks (see WithBlockTTL)
+	Ranged      bool          // blocks can be written in any order (see WithRanges)
+	Ranges      []Range       // ranges written past Next, for files written in any order
+}
+
+// Storage details, returned by StatPhysical
+type PhysicalInfo struct {
+	Key       string
+	Medium    string // storage medium
+	InfoBytes int64  // size of the metadata record
+	Blocks    int    // number of block records
+	Bytes     int64  // physical size of the block records
+	CurPos    int64
+	CurHash   string
+}
+
+// Return user file info for the file identified by key
+func (i *info) fileInfo(key string, expires time.Time) *FileInfo {
+	return &FileInfo{
+		Key:         key,
+		Name:        i.Name,
+		ContentType: i.ContentType,
+		Created:     i.Created,
+		Hash:        hashString(i.HashAlg, i.Hash),
+		HashAlg:     i.HashAlg,
+		Length:      i.Length,
+		Next:        i.CurPos,
+		Base:        i.Base,
+		BlockSize:   i.blockSize(),
+		ExpiresAt:   expires,
+		Immutable:   i.Immutable,
+		Reserved:    i.Reserve > 0,
+		DeletedAt:   i.deletedAt(),
+		Preserve:    i.Preserve,
+		TTL:         i.TTL,
+		BlockTTL:    i.BlockTTL,
+		Ranged:      i.Ranged,
+		Ranges:      i.Ranges,
+	}
+}
+
+// Return the number of blocks with data: the written blocks of an incomplete file,
+// and none for files stored in the metadata or soft deleted
+func (i *info) dataBlocks() int64 {
+	if i.content() != nil || i.DeletedAt > 0 {
+		return 0
+	}
+
+	written := i.Length
+	if i.CurPos != FileComplete {
+		written = i.CurPos
+	}
+	if n := len(i.Ranges); n > 0 { // the blocks written past CurPos (see WithRanges)
+		written = i.Ranges[n-1].End
+	}
+
+	blockSize := i.blockSize()
+	return (written + blockSize - 1) / blockSize
+}
+
+// Return the soft delete time, or the zero time if the file was not deleted
+func (i *info) deletedAt() time.Time {
+	if i.DeletedAt == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, i.DeletedAt)
+}
+
+// Return all the metadata fields, including the hash state, for diagnostics
+func (i *info) debugInfo(key string, expires time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"Key":         key,
+		"Name":        i.Name,
+		"ContentType": i.ContentType,
+		"Hash":        i.Hash,
+		"HashAlg":     i.HashAlg,
+		"Length":      i.Length,
+		"CurPos":      i.CurPos,
+		"CurHash":     i.CurHash,
+		"Base":        i.Base,
+		"Created":     i.Created,
+		"ExpiresAt":   expires,
+		"Preserve":    i.Preserve,
+		"Immutable":   i.Immutable,
+		"TTL":         i.TTL,
+		"Reserve":     i.Reserve,
+		"BlockTTL":    i.BlockTTL,
+		"Ranges":      i.Ranges,
+		"Counter":     i.Counter,
+		"BlockSize":   i.blockSize(),
+		"Inline":      len(i.Inline),
+		"DeletedAt":   i.deletedAt(),
+		"Expiry":      i.Expiry,
+	}
+}
+
+// Return true if the file was soft deleted: only the metadata is left
+func (f *FileInfo) Deleted() bool {
+	return !f.DeletedAt.IsZero()
+}
+
+// Return true if the file expired at the specified time
+// (a file without expiration never expires)
+func (f *FileInfo) Expired(now time.Time) bool {
+	return f.ExpiresAt.Unix() > 0 && now.After(f.ExpiresAt)
 }
 
 func (f *FileInfo) String() string {
@@ -94,6 +661,47 @@ func (f *FileInfo) String() string {
 	return string(res)
 }
 
+// Split a storage dsn in scheme ("badger", "aws") and path.
+// A dsn without a scheme is a Badger data folder.
+func ParseDSN(dsn string) (scheme, path string) {
+	scheme, path = "badger", dsn
+	if parts := strings.SplitN(dsn, ":", 2); len(parts) == 2 {
+		scheme, path = parts[0], parts[1]
+	}
+
+	if scheme == "s3" {
+		scheme = "aws"
+	}
+
+	return
+}
+
+// Open the storage service described by dsn.
+//
+// The dsn is in the form "badger:<data folder>" or "aws:<bucket>[/<prefix>]"
+// (or "s3:<bucket>[/<prefix>]"). A dsn without a scheme is a Badger data folder.
+func Open(dsn string, readonly bool, ttl time.Duration, opts ...Option) (StorageDB, error) {
+	scheme, path := ParseDSN(dsn)
+
+	switch scheme {
+	case "badger":
+		sdb, err := OpenBadger(path, readonly, ttl, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return sdb, nil
+
+	case "aws":
+		sdb, err := OpenAWS(path, ttl, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return sdb, nil
+	}
+
+	return nil, fmt.Errorf("Invalid storage %q", dsn)
+}
+
 func prefixKey(key string) string {
 	return fmt.Sprintf(_PREFIX, key)
 }
@@ -102,10 +710,77 @@ func infoKey(key string) string {
 	return fmt.Sprintf(_INFO, key)
 }
 
-func blockKey(key string, block int) string {
+func blockKey(key string, block int64) string {
 	return fmt.Sprintf(_BLOCK, key, block)
 }
 
+func expiryKey(expiry int64, key string) string {
+	return fmt.Sprintf(_EXPIRY, expiry, key)
+}
+
+// Return expiration time and file key from an expiration index key
+func parseExpiryKey(ekey string) (int64, string, bool) {
+	parts := strings.SplitN(strings.TrimPrefix(ekey, _EXPIRY_PREFIX), ":", 2)
+	if len(parts) != 2 {
+		return 0, "", false
+	}
+
+	expiry, err := strconv.ParseInt(parts[0], 10, 64)
+	return expiry, parts[1], err == nil
+}
+
+// A storage service that can remove expired files without scanning all files
+type Sweeper interface {
+	SweepExpired(now time.Time) (int, error)
+}
+
+// The file operations available in a batch
+type Tx interface {
+	CreateFile(key, filename, ctype string, size int64, hash []byte, opts ...FileOption) error
+	WriteAt(key string, pos int64, data []byte) (int64, error)
+	DeleteFile(key string) error
+}
+
+// A storage service that can apply changes to multiple files atomically:
+// if fn returns an error none of the changes are applied, otherwise they all become visible together.
+// Only badger supports batches (the AWS backend can't commit a DynamoDB record and S3 objects together).
+type Batcher interface {
+	Batch(fn func(tx Tx) error) error
+}
+
+// A storage service that can report its size on disk:
+// the size of the index (LSM tree) and of the data (value log), in bytes
+type Sizer interface {
+	Size() (index, data int64)
+}
+
+// Return the logical offset of the first block kept when trimming
+// a file with the specified info up to offset bytes
+func trimBase(fileInfo *info, bytes int64) int64 {
+	written := fileInfo.Length
+	if fileInfo.CurPos >= 0 { // file not completely written
+		written = fileInfo.CurPos
+	}
+
+	if bytes > written {
+		bytes = written
+	}
+
+	blockSize := fileInfo.blockSize()
+	return bytes / blockSize * blockSize
+}
+
+// Return the block number if skey is the key of a block record for file key
+func blockNumber(key, skey string) (int64, bool) {
+	prefix := prefixKey(key)
+	if !strings.HasPrefix(skey, prefix) {
+		return 0, false
+	}
+
+	n, err := strconv.ParseInt(skey[len(prefix):], 10, 64)
+	return n, err == nil
+}
+
 func toHex(b []byte) string {
 	return fmt.Sprintf("%x", b)
 }
@@ -116,15 +791,130 @@ func fromHex(s string) []byte {
 	return b
 }
 
-func getHasher() hash.Hash {
+// Number of files that didn't match the expected hash on completion
+var hashMismatches = expvar.NewInt("hash_mismatches")
+
+// Record a hash mismatch on completion of file key. With the cumulative hash,
+// this is the only sign of a corrupted (or colliding) upload.
+func hashMismatch(key string, fileInfo *info, actual string) {
+	alg := fileInfo.HashAlg
+	if alg == "" {
+		alg = HashCumulative
+	}
+
+	hashMismatches.Add(1)
+	log.Printf("hash mismatch: key=%q alg=%v length=%v expected=%v actual=%v",
+		key, alg, fileInfo.Length, fileInfo.Hash, actual)
+}
+
+func getHasher(alg string) hash.Hash {
+	switch alg {
+	case HashMerkle:
+		return merkle.New()
+	case HashSHA256:
+		return sha256.New()
+	}
+
 	return cumulative.New() // md5.New()
 }
 
+// Return the hash sum of a file with algorithm alg, as shown in FileInfo:
+// SHA-256 hashes have a "sha256:" prefix, the MD5-based hashes are plain hex
+func FormatHash(alg string, sum []byte) string {
+	return hashString(alg, toHex(sum))
+}
+
+func hashString(alg, hash string) string {
+	if alg == HashSHA256 && hash != "" {
+		return alg + ":" + hash
+	}
+
+	return hash
+}
+
+// Return the bytes of a hex hash, with or without an algorithm prefix (e.g. "sha256:")
+func ParseHash(s string) ([]byte, error) {
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		s = s[i+1:]
+	}
+
+	return hex.DecodeString(s)
+}
+
+// A hash fed to the file hash block by block, as WriteAt does
+type blockHasher struct {
+	hash.Hash
+
+	alg       string
+	blockSize int
+	buf       []byte // partial block
+}
+
+// Return a hash computing the stored hash of a file (with algorithm alg and the default block size)
+// from its content, written in chunks of any size
+func NewHasher(alg string) hash.Hash {
+	return NewFileHasher(alg, BlockSize)
+}
+
+// Return a hash computing the stored hash of a file with algorithm alg and the specified block size
+// (see FileInfo.BlockSize) from its content, written in chunks of any size
+func NewFileHasher(alg string, blockSize int64) hash.Hash {
+	return &blockHasher{Hash: getHasher(alg), alg: alg, blockSize: int(blockSize)}
+}
+
+func (h *blockHasher) Write(p []byte) (int, error) {
+	h.buf = append(h.buf, p...)
+
+	for len(h.buf) >= h.blockSize {
+		h.Hash.Write(h.buf[:h.blockSize])
+		h.buf = append(h.buf[:0], h.buf[h.blockSize:]...)
+	}
+
+	return len(p), nil
+}
+
+// Return the hash, with the partial block as the last block
+func (h *blockHasher) Sum(b []byte) []byte {
+	if len(h.buf) == 0 {
+		return h.Hash.Sum(b)
+	}
+
+	last := getHasher(h.alg) // a copy, to keep the state
+	if state, err := marshalHash(h.Hash); err == nil {
+		unmarshalHash(last, state)
+	}
+
+	last.Write(h.buf)
+	return last.Sum(b)
+}
+
+func (h *blockHasher) Reset() {
+	h.Hash.Reset()
+	h.buf = h.buf[:0]
+}
+
+// Return the hash state to keep once the file is complete:
+// merkle hashes keep the list of block hashes
+func completeHashState(alg string, h hash.Hash) string {
+	if alg != HashMerkle {
+		return ""
+	}
+
+	state, _ := marshalHash(h)
+	return state
+}
+
+// Return the (default) hash of the content of r, and its size
 func GetHash(r io.Reader) ([]byte, int64, error) {
-	var b [BlockSize]byte
-	hasher := getHasher()
+	return GetHashAlg(r, HashCumulative)
+}
 
-	sz, err := io.CopyBuffer(hasher, r, b[:])
+// Return the hash of the content of r, using the specified algorithm, and its size.
+// The content is hashed block by block as WriteAt does, with the default block size.
+func GetHashAlg(r io.Reader, alg string) ([]byte, int64, error) {
+	hasher := NewHasher(alg)
+
+	sz, err := io.Copy(hasher, r)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -132,6 +922,58 @@ func GetHash(r io.Reader) ([]byte, int64, error) {
 	return hasher.Sum(nil), sz, nil
 }
 
+// Write all data to the file identified by key, starting at pos, with as many WriteAt calls
+// as the storage needs (see WithMaxWriteSize). Returns the next write position.
+func WriteAll(sdb StorageDB, key string, pos int64, data []byte) (int64, error) {
+	for {
+		npos, err := sdb.WriteAt(key, pos, data)
+		if err != nil || npos == FileComplete || npos-pos >= int64(len(data)) {
+			return npos, err
+		}
+
+		data, pos = data[npos-pos:], npos
+	}
+}
+
+// Read the file identified by key and verify that its content matches the stored hash
+func Verify(sdb StorageDB, key string) error {
+	stat, err := sdb.Stat(key)
+	if err != nil {
+		return err
+	}
+
+	if stat.Next != FileComplete {
+		return ErrIncomplete
+	}
+
+	if stat.Base > 0 { // the hash covers the trimmed blocks
+		return ErrTrimmed
+	}
+
+	hasher := NewFileHasher(stat.HashAlg, stat.BlockSize) // hash block by block, as WriteAt does
+
+	var buf = make([]byte, 4*stat.BlockSize)
+
+	for pos := int64(0); pos < stat.Length; {
+		n, err := sdb.ReadAt(key, buf, pos)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if n == 0 {
+			return io.ErrUnexpectedEOF
+		}
+
+		hasher.Write(buf[:n])
+		pos += n
+	}
+
+	if FormatHash(stat.HashAlg, hasher.Sum(nil)) != stat.Hash {
+		return ErrInvalidHash
+	}
+
+	return nil
+}
+
 func marshalHash(h hash.Hash) (string, error) {
 	marshaler, ok := h.(encoding.BinaryMarshaler)
 	if !ok {
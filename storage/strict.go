@@ -0,0 +1,57 @@
+package storage
+
+// A storage service that hides files past their expiration time,
+// even if the backend didn't remove them yet
+type strictStorage struct {
+	StorageDB
+	options
+}
+
+// Return a storage service that reports expired files as not found.
+// Only WithClock applies.
+func StrictTTL(sdb StorageDB, opts ...Option) StorageDB {
+	return &strictStorage{StorageDB: sdb, options: getOptions(opts)}
+}
+
+// Return file info, or ErrNotFound if the file is expired
+func (s *strictStorage) Stat(key string) (*FileInfo, error) {
+	stat, err := s.StorageDB.Stat(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if stat.Expired(s.now()) {
+		return nil, ErrNotFound
+	}
+
+	return stat, nil
+}
+
+// Return true if the file exists and is not expired (this needs the file info)
+func (s *strictStorage) Exists(key string) (bool, error) {
+	_, err := s.Stat(key)
+	if err == ErrNotFound {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// Return file info for all files with a key starting with prefix, skipping expired files
+func (s *strictStorage) ListFiles(prefix string, opts ...ListOption) ([]*FileInfo, error) {
+	files, err := s.StorageDB.ListFiles(prefix, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.now()
+	live := files[:0]
+
+	for _, f := range files {
+		if !f.Expired(now) {
+			live = append(live, f)
+		}
+	}
+
+	return live, nil
+}
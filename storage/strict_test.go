@@ -0,0 +1,34 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStrictTTL(t *testing.T) {
+	s := openTestBadger(t)
+	putTestFile(t, s, "short", testData(10), 10, WithTTL(time.Minute))
+	putTestFile(t, s, "long", testData(10), 10)
+
+	now := time.Now()
+	strict := StrictTTL(s, WithClock(func() time.Time { return now }))
+
+	if _, err := strict.Stat("short"); err != nil {
+		t.Fatalf("stat before expiry: %v", err)
+	}
+
+	now = now.Add(2 * time.Minute) // past the expiration, still stored
+
+	if _, err := s.Stat("short"); err != nil {
+		t.Fatalf("backend stat: %v", err)
+	}
+	if _, err := strict.Stat("short"); err != ErrNotFound {
+		t.Errorf("stat: %v, expected ErrNotFound", err)
+	}
+	if ok, err := strict.Exists("short"); ok || err != nil {
+		t.Errorf("exists: %v %v", ok, err)
+	}
+	if files, _ := strict.ListFiles(""); len(files) != 1 || files[0].Key != "long" {
+		t.Errorf("list: %v", files)
+	}
+}
@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger"
+)
+
+// Return the stored keys starting with prefix
+func testKeys(t *testing.T, s *badgerStorage, prefix string) []string {
+	t.Helper()
+
+	var keys []string
+
+	err := s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek([]byte(prefix)); it.ValidForPrefix([]byte(prefix)); it.Next() {
+			keys = append(keys, string(it.Item().Key()))
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return keys
+}
+
+// The sweeper removes the files expired according to the index, and stops at the first one not expired
+func TestSweepExpired(t *testing.T) {
+	s := openTestBadger(t)
+
+	ttls := map[string]time.Duration{"a": time.Minute, "b": 2 * time.Minute, "c": time.Hour}
+	for key, ttl := range ttls {
+		putTestFile(t, s, key, testData(2*BlockSize), BlockSize, WithTTL(ttl))
+	}
+	if keys := testKeys(t, s, _EXPIRY_PREFIX); len(keys) != 3 {
+		t.Fatalf("expiration index: %q", keys)
+	}
+
+	// badger hides expired records: remove all the file records, leaving the blocks and the index
+	if err := s.db.Update(func(txn *badger.Txn) error {
+		for key := range ttls {
+			if err := txn.Delete([]byte(infoKey(key))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := s.SweepExpired(time.Now().Add(5 * time.Minute))
+	if err != nil || n != 2 {
+		t.Fatalf("swept %v files: %v, expected 2", n, err)
+	}
+
+	for key := range ttls {
+		blocks := len(testKeys(t, s, prefixKey(key)))
+		if key == "c" && blocks != 2 || key != "c" && blocks != 0 {
+			t.Errorf("%v: %v records left", key, blocks)
+		}
+	}
+	if keys := testKeys(t, s, _EXPIRY_PREFIX); len(keys) != 1 || !strings.HasSuffix(keys[0], ":c") {
+		t.Errorf("expiration index: %q", keys)
+	}
+}
+
+// The index follows the file TTL and key, and is removed with the file
+func TestExpiryIndex(t *testing.T) {
+	s := openTestBadger(t)
+	putTestFile(t, s, "f", testData(10), 10)
+
+	expiry := getTestInfo(t, s, "f").Expiry
+	if keys := testKeys(t, s, _EXPIRY_PREFIX); len(keys) != 1 || keys[0] != expiryKey(expiry, "f") {
+		t.Fatalf("expiration index: %q, expected %v", keys, expiry)
+	}
+
+	time.Sleep(time.Millisecond)
+	if err := s.Touch("f"); err != nil {
+		t.Fatal(err)
+	}
+
+	expiry = getTestInfo(t, s, "f").Expiry
+	if keys := testKeys(t, s, _EXPIRY_PREFIX); len(keys) != 1 || keys[0] != expiryKey(expiry, "f") {
+		t.Errorf("expiration index after Touch: %q, expected %v", keys, expiry)
+	}
+
+	if err := s.Rename("f", "g"); err != nil {
+		t.Fatal(err)
+	}
+
+	expiry = getTestInfo(t, s, "g").Expiry
+	if keys := testKeys(t, s, _EXPIRY_PREFIX); len(keys) != 1 || keys[0] != expiryKey(expiry, "g") {
+		t.Errorf("expiration index after Rename: %q, expected %v", keys, expiry)
+	}
+
+	if err := s.DeleteFile("g"); err != nil {
+		t.Fatal(err)
+	}
+	if keys := testKeys(t, s, _EXPIRY_PREFIX); len(keys) != 0 {
+		t.Errorf("expiration index after delete: %q", keys)
+	}
+}
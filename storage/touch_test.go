@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+// Touch refreshes the expiration by the same rules as writes
+func TestTouchExpiration(t *testing.T) {
+	s := openTestBadger(t)
+	created := openTestBadger(t, WithTTLFromCreation(true))
+
+	hash := make([]byte, 16)
+	data := testData(2*BlockSize + 1)
+
+	putTestFile(t, s, "default", data, BlockSize)
+	putTestFile(t, s, "ttl", data, BlockSize, WithTTL(2*time.Hour))
+	putTestFile(t, created, "created", data, BlockSize)
+
+	if err := s.CreateFile("reserved", "r", "", 10, hash, WithReservation(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateFileWithTimes("imported", "i", "", 10, hash, time.Now(), time.Now().Add(10*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		sdb     *badgerStorage
+		key     string
+		expires time.Duration
+	}{
+		{s, "default", time.Hour},
+		{s, "ttl", 2 * time.Hour},
+		{s, "reserved", time.Minute},
+		{s, "imported", 10 * time.Minute},
+		{created, "created", time.Hour},
+	} {
+		if err := tc.sdb.Touch(tc.key); err != nil {
+			t.Fatalf("touch %v: %v", tc.key, err)
+		}
+
+		stat, _ := tc.sdb.Stat(tc.key)
+		if d := time.Until(stat.ExpiresAt) - tc.expires; d < -2*time.Second || d > 2*time.Second {
+			t.Errorf("%v: expires %v, expected in %v", tc.key, stat.ExpiresAt, tc.expires)
+		}
+	}
+}
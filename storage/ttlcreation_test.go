@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+// Writes refresh the expiration, unless the TTL is from the creation time
+func TestTTLFromCreation(t *testing.T) {
+	data := testData(2*BlockSize + 10)
+
+	stores := map[bool]*badgerStorage{
+		false: openTestBadger(t),
+		true:  openTestBadger(t, WithTTLFromCreation(true)),
+	}
+	expires := map[bool][]time.Time{}
+
+	for _, s := range stores {
+		if err := s.CreateFile("f", "f", "", int64(len(data)), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if i > 0 {
+			time.Sleep(1100 * time.Millisecond) // badger expiration times are in seconds
+		}
+
+		for fromCreation, s := range stores {
+			if _, err := s.WriteAt("f", int64(i*BlockSize), data[i*BlockSize:(i+1)*BlockSize]); err != nil {
+				t.Fatal(err)
+			}
+
+			stat, _ := s.Stat("f")
+			expires[fromCreation] = append(expires[fromCreation], stat.ExpiresAt)
+		}
+	}
+
+	for fromCreation, e := range expires {
+		if refreshed := e[1].After(e[0]); refreshed == fromCreation {
+			t.Errorf("from creation %v: expires at %v, then %v", fromCreation, e[0], e[1])
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Previous versions of a file are kept as files with the key <key>@<n>,
+// numbered from 1 in the order the file was replaced
+
+// A previous version of a file
+type Version struct {
+	*FileInfo
+	Version int
+}
+
+// Return the key of version n of the file key
+func VersionKey(key string, n int) string {
+	return fmt.Sprintf("%v@%v", key, n)
+}
+
+// Return the version number of vkey, if it's the key of a version of key (0 if not)
+func versionNumber(key, vkey string) int {
+	if !strings.HasPrefix(vkey, key+"@") {
+		return 0
+	}
+
+	n, err := strconv.Atoi(vkey[len(key)+1:])
+	if err != nil || n <= 0 || VersionKey(key, n) != vkey {
+		return 0
+	}
+
+	return n
+}
+
+// Return the versions of the file key, oldest first
+func ListVersions(sdb StorageDB, key string) ([]Version, error) {
+	files, err := sdb.ListFiles(key + "@")
+	if err != nil {
+		return nil, err
+	}
+
+	versions := []Version{}
+	for _, f := range files {
+		if n := versionNumber(key, f.Key); n > 0 {
+			versions = append(versions, Version{FileInfo: f, Version: n})
+		}
+	}
+
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+	return versions, nil
+}
+
+// Move the file key to its next version, deleting the oldest versions to keep at most max.
+// Nothing is done if the file doesn't exist, and a soft deleted file is deleted.
+func KeepVersion(sdb StorageDB, key string, max int) error {
+	for {
+		versions, err := ListVersions(sdb, key)
+		if err != nil {
+			return err
+		}
+
+		next := 1
+		if len(versions) > 0 {
+			next = versions[len(versions)-1].Version + 1
+		}
+
+		for ; len(versions) >= max && len(versions) > 0; versions = versions[1:] {
+			if err := sdb.DeleteFile(versions[0].Key); err != nil {
+				return err
+			}
+		}
+
+		switch err := sdb.Rename(key, VersionKey(key, next)); err {
+		case ErrExists: // another version was kept since
+			continue
+		case ErrNotFound:
+			return nil
+		case ErrDeleted:
+			return sdb.DeleteFile(key)
+		default:
+			return err
+		}
+	}
+}
+
+// A storage service where deleting a file also deletes its versions
+type versioned struct {
+	StorageDB
+}
+
+// Return a storage service that deletes the versions of a file (see KeepVersion) with the file
+func Versioned(sdb StorageDB) StorageDB {
+	return &versioned{StorageDB: sdb}
+}
+
+func (s *versioned) DeleteFile(key string) error {
+	if err := s.StorageDB.DeleteFile(key); err != nil {
+		return err
+	}
+
+	versions, err := ListVersions(s.StorageDB, key)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range versions {
+		if err := s.StorageDB.DeleteFile(v.Key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
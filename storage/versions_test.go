@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"bytes"
+	"testing"
+)
+
+// KeepVersion moves the file to the next version, pruning the oldest past the max count,
+// and deleting a versioned file deletes its versions
+func TestVersions(t *testing.T) {
+	s := Versioned(openTestBadger(t))
+
+	contents := [][]byte{testData(10), testData(20), testData(30), testData(40)}
+	for _, data := range contents {
+		if err := KeepVersion(s, "f", 2); err != nil {
+			t.Fatal(err)
+		}
+		putTestFile(t, s, "f", data, len(data))
+	}
+	putTestFile(t, s, "f@x", testData(5), 5) // not a version
+
+	versions, err := ListVersions(s, "f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].Version != 2 || versions[1].Version != 3 {
+		t.Fatalf("versions %+v, expected 2 and 3", versions)
+	}
+	for _, v := range versions {
+		if !bytes.Equal(readTestFile(t, s, VersionKey("f", v.Version)), contents[v.Version-1]) {
+			t.Errorf("version %v content differs", v.Version)
+		}
+	}
+	if !bytes.Equal(readTestFile(t, s, "f"), contents[3]) {
+		t.Errorf("current content differs")
+	}
+
+	if err := s.DeleteFile("f"); err != nil {
+		t.Fatal(err)
+	}
+	if versions, _ := ListVersions(s, "f"); len(versions) != 0 {
+		t.Errorf("versions left after delete: %+v", versions)
+	}
+	if _, err := s.Stat("f@x"); err != nil {
+		t.Errorf("other file deleted: %v", err)
+	}
+}